@@ -2,17 +2,21 @@ package aperture
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightningnetwork/lnd/build"
@@ -111,11 +115,20 @@ func run() error {
 
 	// Create our challenger that uses our backing lnd node to create
 	// invoices and check their settlement status.
-	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
-		return &lnrpc.Invoice{
+	genInvoiceReq := func(price int64,
+		params *mint.ChallengeParams) (*lnrpc.Invoice, error) {
+
+		invoice := &lnrpc.Invoice{
 			Memo:  "LSAT",
 			Value: price,
-		}, nil
+		}
+		if params != nil && params.Memo != "" {
+			invoice.Memo = params.Memo
+		}
+		if params != nil && params.Expiry > 0 {
+			invoice.Expiry = int64(params.Expiry.Seconds())
+		}
+		return invoice, nil
 	}
 	errChan := make(chan error)
 	challenger, err := NewLndChallenger(
@@ -130,11 +143,147 @@ func run() error {
 	}
 	defer challenger.Stop()
 
-	// Create the proxy and connect it to lnd.
-	servicesProxy, err := createProxy(cfg, challenger, etcdClient)
+	// Services can use additional lnd nodes for their payments, each of
+	// them needs its own challenger.
+	challengers := make(map[string]*LndChallenger, len(cfg.Authenticators))
+	for name, authCfg := range cfg.Authenticators {
+		challenger, err := NewLndChallenger(
+			authCfg, genInvoiceReq, errChan,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to create authenticator "+
+				"%s: %v", name, err)
+		}
+		err = challenger.Start()
+		if err != nil {
+			return fmt.Errorf("unable to start authenticator "+
+				"%s: %v", name, err)
+		}
+		defer challenger.Stop()
+
+		challengers[name] = challenger
+	}
+
+	// If configured, requests are logged to a separate access log file.
+	var proxyOpts []proxy.Option
+	if cfg.AccessLog != nil && cfg.AccessLog.File != "" {
+		maxFiles := cfg.AccessLog.MaxFiles
+		if maxFiles == 0 {
+			maxFiles = defaultMaxLogFiles
+		}
+		accessLog, err := proxy.NewRotatingFile(
+			cfg.AccessLog.File,
+			cfg.AccessLog.MaxSize*bytesPerMegabyte,
+			cfg.AccessLog.MaxAge, maxFiles,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to open access log: %v", err)
+		}
+		defer func() {
+			if err := accessLog.Close(); err != nil {
+				log.Errorf("Could not close access log: %v",
+					err)
+			}
+		}()
+		proxyOpts = append(proxyOpts, proxy.WithAccessLog(accessLog))
+	}
+
+	// Events are delivered to the webhook in the background so they never
+	// hold up a request.
+	if cfg.Webhook != nil && cfg.Webhook.URL != "" {
+		webhook, err := proxy.NewWebhook(cfg.Webhook)
+		if err != nil {
+			return err
+		}
+		webhook.Start()
+		defer webhook.Stop()
+
+		proxyOpts = append(proxyOpts, proxy.WithWebhook(webhook))
+	}
+
+	// Services with the disk freebie strategy keep their freebie counts in
+	// a database that survives restarts.
+	if cfg.FreebieDB != nil && cfg.FreebieDB.Path != "" {
+		freebieDB, err := freebie.OpenBoltDB(
+			cfg.FreebieDB.Path, cfg.FreebieDB.PruneInterval,
+		)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := freebieDB.Close(); err != nil {
+				log.Errorf("Could not close freebie DB: %v",
+					err)
+			}
+		}()
+		proxyOpts = append(proxyOpts, proxy.WithFreebieDiskDB(freebieDB))
+	}
+
+	// Services that require client certificates can only be reached if
+	// we're able to verify them.
+	for _, service := range cfg.Services {
+		if !service.RequireClientCert {
+			continue
+		}
+		if cfg.Insecure || cfg.ClientCAPath == "" {
+			return fmt.Errorf("service %s requires client "+
+				"certificates but TLS with a client CA is not "+
+				"configured", service.Name)
+		}
+	}
+
+	// Passthrough services are routed by the server name of the TLS
+	// handshake, so they can't be reached without TLS.
+	var tlsPassthrough, preserveHeaderOrder bool
+	for _, service := range cfg.Services {
+		if service.PreserveHeaderOrder {
+			preserveHeaderOrder = true
+		}
+		if !service.TLSPassthrough {
+			continue
+		}
+		if cfg.Insecure {
+			return fmt.Errorf("service %s uses TLS passthrough "+
+				"which is not available in insecure mode",
+				service.Name)
+		}
+		tlsPassthrough = true
+	}
+
+	// Create the proxy and connect it to lnd. The usage quotas of the
+	// services are kept apart so they follow reloads of the services.
+	quotas := newServiceQuotas(cfg.Services)
+	servicesProxy, err := createProxy(
+		cfg, challenger, challengers, quotas, etcdClient,
+		proxyOpts...,
+	)
 	if err != nil {
 		return err
 	}
+
+	// Keep the backend addresses of all services that use service
+	// discovery up to date.
+	discoveryManager := proxy.NewDiscoveryManager(
+		servicesProxy, cfg.DiscoveryInterval,
+	)
+	discoveryManager.Start()
+	defer discoveryManager.Stop()
+
+	// Keep traffic away from backends that fail their health checks.
+	healthChecker := proxy.NewHealthChecker(servicesProxy)
+	healthChecker.Start()
+	defer healthChecker.Stop()
+
+	// Give some visibility into the performance of the services without
+	// a metrics stack.
+	if cfg.LatencyReportInterval > 0 {
+		latencyReporter := proxy.NewLatencyReporter(
+			servicesProxy, cfg.LatencyReportInterval,
+		)
+		latencyReporter.Start()
+		defer latencyReporter.Stop()
+	}
+
 	handler := http.HandlerFunc(servicesProxy.ServeHTTP)
 	httpsServer := &http.Server{
 		Addr:    cfg.ListenAddr,
@@ -152,6 +301,24 @@ func run() error {
 		// though so we need to add a special h2c handler here.
 		serveFn = httpsServer.ListenAndServe
 		httpsServer.Handler = h2c.NewHandler(handler, &http2.Server{})
+
+		// The original form of request headers is only available if
+		// we capture it on the connection before the HTTP server
+		// normalizes it.
+		if preserveHeaderOrder {
+			httpsServer.ConnContext = proxy.HeaderCaptureConnContext
+			serveFn = func() error {
+				listener, err := net.Listen(
+					"tcp", cfg.ListenAddr,
+				)
+				if err != nil {
+					return err
+				}
+				return httpsServer.Serve(
+					proxy.NewHeaderCaptureListener(listener),
+				)
+			}
+		}
 	} else {
 		httpsServer.TLSConfig, err = getTLSConfig(
 			cfg.ServerName, cfg.AutoCert,
@@ -159,11 +326,39 @@ func run() error {
 		if err != nil {
 			return err
 		}
+		err = applyTLSSettings(httpsServer.TLSConfig, cfg.TLS)
+		if err != nil {
+			return err
+		}
+		err = configureClientAuth(
+			httpsServer.TLSConfig, cfg.ClientCAPath,
+		)
+		if err != nil {
+			return err
+		}
+		if preserveHeaderOrder {
+			log.Warnf("The order of request headers can only be " +
+				"preserved in insecure mode without TLS")
+		}
 		serveFn = func() error {
+			listener, err := net.Listen("tcp", cfg.ListenAddr)
+			if err != nil {
+				return err
+			}
+
+			// Connections to passthrough services are split off
+			// before the TLS handshake so they are never
+			// terminated here.
+			if tlsPassthrough {
+				listener = proxy.NewPassthroughListener(
+					listener, servicesProxy,
+				)
+			}
+
 			// The httpsServer.TLSConfig contains certificates at
 			// this point so we don't need to pass in certificate
 			// and key file names.
-			return httpsServer.ListenAndServeTLS("", "")
+			return httpsServer.ServeTLS(listener, "", "")
 		}
 	}
 
@@ -184,6 +379,52 @@ func run() error {
 		}
 	}()
 
+	// Keep an eye on the expiry of the backend TLS certificates so an
+	// operator is warned before a backend becomes unreachable. Reloaded
+	// services are handed over on the channel.
+	certServices := make(chan []*proxy.Service, 1)
+	if cfg.CertExpiryWarnDays >= 0 {
+		warnDays := cfg.CertExpiryWarnDays
+		if warnDays == 0 {
+			warnDays = defaultCertExpiryWarnDays
+		}
+		margin := time.Duration(warnDays) * 24 * time.Hour
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			monitorCertExpiry(
+				cfg.Services, certServices, margin, quit,
+			)
+		}()
+	}
+
+	// Rate limits, or all services, can be changed at runtime by editing
+	// the configuration file and sending SIGHUP.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		onServicesReload := func(cfg *config) {
+			discoveryManager.Refresh()
+			healthChecker.Refresh()
+			quotas.update(cfg.Services)
+
+			// Only the latest services are of interest to the
+			// certificate monitor.
+			select {
+			case <-certServices:
+			default:
+			}
+			certServices <- cfg.Services
+		}
+		reloadOnSignal(
+			configFile, cfg.ReloadMode, servicesProxy,
+			onServicesReload, quit,
+		)
+	}()
+
 	// If we need to listen over Tor as well, we'll set up the onion
 	// services now. We're not able to use TLS for onion services since they
 	// can't be verified, so we'll spin up an additional HTTP/2 server
@@ -226,6 +467,14 @@ func run() error {
 		returnErr = err
 	}
 
+	// Give the requests in flight the chance to complete before the
+	// connections are closed.
+	servers := []*http.Server{httpsServer}
+	if torHTTPServer != nil {
+		servers = append(servers, torHTTPServer)
+	}
+	drainServers(servers, cfg.ShutdownTimeout)
+
 	// Shut down our client and server connections now. This should cause
 	// the first goroutine to quit.
 	cleanup(etcdClient, httpsServer)
@@ -273,6 +522,15 @@ func getConfig(configFile string) (*config, error) {
 	if cfg.ListenAddr == "" {
 		return nil, fmt.Errorf("missing listen address for server")
 	}
+	switch cfg.ReloadMode {
+	case "", reloadRateLimits, reloadServices:
+
+	default:
+		return nil, fmt.Errorf("unknown reload mode %s", cfg.ReloadMode)
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout cannot be negative")
+	}
 	return cfg, nil
 }
 
@@ -293,6 +551,30 @@ func setupLogging(cfg *config) error {
 	return build.ParseAndSetDebugLevels(cfg.DebugLevel, logWriter)
 }
 
+// configureClientAuth makes the server ask clients for a TLS certificate and
+// verify it against the CA certificates in the given file. Presenting a
+// certificate stays optional on the TLS level since not every service requires
+// one.
+func configureClientAuth(tlsConfig *tls.Config, caPath string) error {
+	if caPath == "" {
+		return nil
+	}
+
+	caCerts, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return fmt.Errorf("unable to read client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCerts) {
+		return fmt.Errorf("no valid certificates found in client CA "+
+			"file %s", caPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
 // getTLSConfig returns a TLS configuration for either a self-signed certificate
 // or one obtained through Let's Encrypt.
 func getTLSConfig(serverName string, autoCert bool) (*tls.Config, error) {
@@ -329,7 +611,7 @@ func getTLSConfig(serverName string, autoCert bool) (*tls.Config, error) {
 		return &tls.Config{
 			GetCertificate: manager.GetCertificate,
 			CipherSuites:   http2TLSCipherSuites,
-			MinVersion:     tls.VersionTLS10,
+			MinVersion:     defaultTLSMinVersion,
 		}, nil
 	}
 
@@ -405,10 +687,39 @@ func getTLSConfig(serverName string, autoCert bool) (*tls.Config, error) {
 	return &tls.Config{
 		Certificates: []tls.Certificate{certData},
 		CipherSuites: http2TLSCipherSuites,
-		MinVersion:   tls.VersionTLS10,
+		MinVersion:   defaultTLSMinVersion,
 	}, nil
 }
 
+// monitorCertExpiry checks the TLS certificates of the backend services for
+// their expiry on startup and then periodically until the quit channel is
+// closed. Services received on the reload channel replace the checked ones and
+// are checked right away.
+func monitorCertExpiry(services []*proxy.Service,
+	reload <-chan []*proxy.Service, margin time.Duration,
+	quit <-chan struct{}) {
+
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := proxy.CheckBackendCertExpiry(
+			services, margin, time.Now(),
+		)
+		if err != nil {
+			log.Errorf("Unable to check backend certificate "+
+				"expiry: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case services = <-reload:
+		case <-quit:
+			return
+		}
+	}
+}
+
 // initTorListener initiates a Tor controller instance with the Tor server
 // specified in the config. Onion services will be created over which the proxy
 // can be reached at.
@@ -448,19 +759,169 @@ func initTorListener(cfg *config, etcd *clientv3.Client) (*tor.Controller, error
 	return torController, nil
 }
 
-// createProxy creates the proxy with all the services it needs.
+// createProxy creates the proxy with all the services it needs. The challenger
+// backs the default authenticator, the named challengers back the additional
+// authenticators services can select. All authenticators enforce the given
+// usage quotas. The given options are applied in addition to the ones derived
+// from the configuration.
 func createProxy(cfg *config, challenger *LndChallenger,
-	etcdClient *clientv3.Client) (*proxy.Proxy, error) {
+	challengers map[string]*LndChallenger, quotas auth.QuotaSource,
+	etcdClient *clientv3.Client,
+	opts ...proxy.Option) (*proxy.Proxy, error) {
+
+	authenticator, err := newAuthenticator(
+		cfg, cfg.Authenticator, challenger, quotas, etcdClient,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(challengers) > 0 {
+		authenticators := make(
+			map[string]auth.Authenticator, len(challengers),
+		)
+		for name, challenger := range challengers {
+			authenticators[name], err = newAuthenticator(
+				cfg, cfg.Authenticators[name], challenger,
+				quotas, etcdClient,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("unable to create "+
+					"authenticator %s: %v", name, err)
+			}
+		}
+		opts = append(opts, proxy.WithAuthenticators(authenticators))
+	}
+
+	if cfg.ExchangeRateURL != "" {
+		opts = append(opts, proxy.WithExchangeRates(
+			proxy.NewHTTPExchangeRates(
+				cfg.ExchangeRateURL, cfg.ExchangeRateRefresh,
+			),
+		))
+	}
+
+	if cfg.GeoIPDatabase != "" {
+		geoIP, err := proxy.LoadGeoIPDB(cfg.GeoIPDatabase)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithGeoIP(geoIP))
+	}
+
+	if cfg.Stats != nil && cfg.Stats.Token != "" {
+		opts = append(opts, proxy.WithStats(
+			cfg.Stats.Path, cfg.Stats.Token,
+		))
+	}
+
+	if cfg.ConfigExport != nil && cfg.ConfigExport.Token != "" {
+		opts = append(opts, proxy.WithConfigExport(
+			cfg.ConfigExport.Path, cfg.ConfigExport.Token,
+		))
+	}
+
+	if cfg.ServeWellKnown {
+		opts = append(opts, proxy.WithWellKnown(cfg.WellKnownPath))
+	}
+
+	if cfg.Debug != nil && len(cfg.Debug.TrustedCIDRs) > 0 {
+		opts = append(opts, proxy.WithDebugHeader(
+			cfg.Debug.Header, cfg.Debug.TrustedCIDRs,
+		))
+	}
+
+	if cfg.AccountTag != nil && cfg.AccountTag.Caveat != "" {
+		opts = append(opts, proxy.WithAccountTag(
+			cfg.AccountTag.Caveat, cfg.AccountTag.Header,
+		))
+	}
+
+	if len(cfg.Discounts) > 0 {
+		discounts, err := proxy.NewStaticDiscounts(cfg.Discounts)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, proxy.WithDiscounts(
+			cfg.DiscountHeader, discounts,
+		))
+	}
+
+	opts = append(
+		[]proxy.Option{
+			proxy.WithMatchMode(
+				proxy.MatchMode(cfg.ServiceMatching),
+			),
+			proxy.WithBackendAllowList(cfg.BackendAllowList),
+			proxy.WithStrictPathRegexp(cfg.StrictPathRegexp),
+			proxy.WithErrorFormat(
+				proxy.ErrorFormat(cfg.ErrorFormat),
+			),
+			proxy.WithBackendDialTimeout(cfg.BackendDialTimeout),
+			proxy.WithGrpcNoMatchCode(cfg.GrpcNoMatchCode),
+			proxy.WithGrpcHealth(cfg.GrpcHealth),
+			proxy.WithWarmUpPeriod(cfg.WarmUpPeriod),
+			proxy.WithCorsDisabled(cfg.DisableCors),
+		}, opts...,
+	)
+	return proxy.New(
+		authenticator, cfg.Services, cfg.ServeStatic, cfg.StaticRoot,
+		opts...,
+	)
+}
+
+// newAuthenticator creates an LSAT authenticator that mints tokens for the
+// configured services and creates their invoices with the given challenger.
+func newAuthenticator(cfg *config, authCfg *authConfig,
+	challenger *LndChallenger, quotas auth.QuotaSource,
+	etcdClient *clientv3.Client) (auth.Authenticator, error) {
 
 	minter := mint.New(&mint.Config{
 		Challenger:     challenger,
 		Secrets:        newSecretStore(etcdClient),
 		ServiceLimiter: newStaticServiceLimiter(cfg.Services),
 	})
-	authenticator := auth.NewLsatAuthenticator(minter, challenger)
-	return proxy.New(
-		authenticator, cfg.Services, cfg.ServeStatic, cfg.StaticRoot,
-	)
+
+	// The usage counters are stored in etcd so they are shared between all
+	// instances.
+	authOpts := []auth.Option{
+		auth.WithUsageQuotas(
+			newUsageStore(etcdClient, cfg.UsageTTL), quotas,
+		),
+	}
+	if cfg.VerifyPreimage {
+		authOpts = append(authOpts, auth.WithPreimageVerification())
+	}
+
+	// Knowing the network lets us decode our invoices to tell clients
+	// when they expire.
+	params, err := chainParams(authCfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	authOpts = append(authOpts, auth.WithInvoiceExpiryHeader(params))
+
+	return auth.NewLsatAuthenticator(minter, challenger, authOpts...), nil
+}
+
+// chainParams returns the chain parameters of the network with the given name.
+func chainParams(network string) (*chaincfg.Params, error) {
+	switch network {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+
+	default:
+		return nil, fmt.Errorf("unknown network %s", network)
+	}
 }
 
 // cleanup closes the given server and shuts down the log rotator.
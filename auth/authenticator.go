@@ -1,14 +1,17 @@
 package auth
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
 	"net/http"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"gopkg.in/macaroon.v2"
 )
 
 // LsatAuthenticator is an authenticator that uses the LSAT protocol to
@@ -16,21 +19,42 @@ import (
 type LsatAuthenticator struct {
 	minter  Minter
 	checker InvoiceChecker
+
+	// usage is the store that keeps track of the number of requests made
+	// with each token to enforce the quotas.
+	usage UsageStore
+
+	// quotas provides the maximum number of requests a token can be used
+	// for, by service name.
+	quotas QuotaSource
+
+	// verifyPreimage is set if the preimage of a token should be checked
+	// against its payment hash before any other validation.
+	verifyPreimage bool
+
+	// chainParams are the parameters of the network invoices are created
+	// on. If set, the invoice expiry is added to challenges.
+	chainParams *chaincfg.Params
 }
 
 // A compile time flag to ensure the LsatAuthenticator satisfies the
-// Authenticator interface.
-var _ Authenticator = (*LsatAuthenticator)(nil)
+// UsageCounter interface.
+var _ UsageCounter = (*LsatAuthenticator)(nil)
 
 // NewLsatAuthenticator creates a new authenticator that authenticates requests
 // based on LSAT tokens.
-func NewLsatAuthenticator(minter Minter,
-	checker InvoiceChecker) *LsatAuthenticator {
+func NewLsatAuthenticator(minter Minter, checker InvoiceChecker,
+	opts ...Option) *LsatAuthenticator {
 
-	return &LsatAuthenticator{
+	l := &LsatAuthenticator{
 		minter:  minter,
 		checker: checker,
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
 }
 
 // Accept returns whether or not the header successfully authenticates the user
@@ -42,11 +66,26 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 	// be in different header fields depending on the implementation and/or
 	// protocol.
 	mac, preimage, err := lsat.FromHeader(header)
-	if err != nil {
+	switch {
+	case err == lsat.ErrNoAuthHeader:
+		log.Debugf("Deny: No token present")
+		return false
+
+	case err != nil:
 		log.Debugf("Deny: %v", err)
 		return false
 	}
 
+	// If requested, make sure the token was actually paid for before we
+	// do anything else with it. A mismatch indicates a malformed or
+	// forged token rather than a client that simply needs to pay.
+	if l.verifyPreimage {
+		if err := lsat.VerifyPreimage(mac, preimage); err != nil {
+			log.Infof("Deny: Invalid token preimage: %v", err)
+			return false
+		}
+	}
+
 	verificationParams := &mint.VerificationParams{
 		Macaroon:      mac,
 		Preimage:      preimage,
@@ -68,15 +107,101 @@ func (l *LsatAuthenticator) Accept(header *http.Header, serviceName string) bool
 		return false
 	}
 
+	// Finally, make sure the token hasn't used up its quota for the
+	// service yet.
+	err = l.checkQuota(mac, serviceName)
+	if err != nil {
+		log.Debugf("Deny: %v", err)
+		return false
+	}
+
 	return true
 }
 
+// CountUsage counts one request made with the token in the header against its
+// usage quota for the given service. ErrQuotaExhausted is returned if the
+// quota is exhausted, any other error means the request couldn't be counted.
+// Tokens of services without a quota aren't counted.
+//
+// NOTE: This is part of the UsageCounter interface.
+func (l *LsatAuthenticator) CountUsage(header *http.Header,
+	serviceName string) error {
+
+	quota := l.usageQuota(serviceName)
+	if quota == 0 {
+		return nil
+	}
+
+	mac, _, err := lsat.FromHeader(header)
+	if err != nil {
+		return err
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return fmt.Errorf("unable to decode LSAT identifier: %v", err)
+	}
+	usage, err := l.usage.IncrementUsage(
+		context.Background(), id.TokenID, serviceName, quota,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to update usage of token %v: %v",
+			&id.TokenID, err)
+	}
+	if usage > quota {
+		return fmt.Errorf("%w: token %v used its %d requests for "+
+			"service %s", ErrQuotaExhausted, &id.TokenID, quota,
+			serviceName)
+	}
+
+	return nil
+}
+
+// usageQuota returns the usage quota of the given service or zero if requests
+// to it aren't limited.
+func (l *LsatAuthenticator) usageQuota(serviceName string) uint64 {
+	if l.usage == nil || l.quotas == nil {
+		return 0
+	}
+	return l.quotas.UsageQuota(serviceName)
+}
+
+// checkQuota returns an error if the token has already used up its usage
+// quota for the given service. The request isn't counted.
+func (l *LsatAuthenticator) checkQuota(mac *macaroon.Macaroon,
+	serviceName string) error {
+
+	quota := l.usageQuota(serviceName)
+	if quota == 0 {
+		return nil
+	}
+
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return fmt.Errorf("unable to decode LSAT identifier: %v", err)
+	}
+	usage, err := l.usage.Usage(
+		context.Background(), id.TokenID, serviceName,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to look up usage of token %v: %v",
+			&id.TokenID, err)
+	}
+	if usage >= quota {
+		return fmt.Errorf("token %v exhausted its quota of %d "+
+			"requests for service %s", &id.TokenID, quota,
+			serviceName)
+	}
+
+	return nil
+}
+
 // FreshChallengeHeader returns a header containing a challenge for the user to
 // complete.
 //
 // NOTE: This is part of the Authenticator interface.
 func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
-	serviceName string, servicePrice int64) (http.Header, error) {
+	serviceName string, servicePrice int64,
+	params *mint.ChallengeParams) (http.Header, error) {
 
 	service := lsat.Service{
 		Name:  serviceName,
@@ -84,7 +209,7 @@ func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 		Price: servicePrice,
 	}
 	mac, paymentRequest, err := l.minter.MintLSAT(
-		context.Background(), service,
+		context.Background(), params, service,
 	)
 	if err != nil {
 		log.Errorf("Error minting LSAT: %v", err)
@@ -99,6 +224,7 @@ func (l *LsatAuthenticator) FreshChallengeHeader(r *http.Request,
 		base64.StdEncoding.EncodeToString(macBytes), paymentRequest)
 	header := r.Header
 	header.Set("WWW-Authenticate", str)
+	l.addInvoiceExpiry(header, paymentRequest)
 
 	log.Debugf("Created new challenge header: [%s]", str)
 	return header, nil
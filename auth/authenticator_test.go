@@ -1,6 +1,7 @@
 package auth_test
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -150,3 +151,74 @@ func TestLsatAuthenticator(t *testing.T) {
 		}
 	}
 }
+
+// TestLsatAuthenticatorQuota tests that a token is no longer accepted once it
+// has used up its quota for a service.
+func TestLsatAuthenticatorQuota(t *testing.T) {
+	var buf bytes.Buffer
+	err := lsat.EncodeIdentifier(&buf, &lsat.Identifier{
+		Version: lsat.LatestVersion,
+	})
+	if err != nil {
+		t.Fatalf("unable to encode identifier: %v", err)
+	}
+	mac, err := macaroon.New(
+		[]byte("aabbccddeeff00112233445566778899"), buf.Bytes(),
+		"aperture", macaroon.LatestVersion,
+	)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+	preimageCaveat := lsat.Caveat{
+		Condition: lsat.PreimageKey,
+		Value: "49349dfea4abed3cd14f6d356afa83de" +
+			"9787b609f088c8df09bacc7b4bd21b39",
+	}
+	err = lsat.AddFirstPartyCaveats(mac, preimageCaveat)
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unable to serialize macaroon: %v", err)
+	}
+	header := &http.Header{
+		lsat.HeaderMacaroon: []string{hex.EncodeToString(macBytes)},
+	}
+
+	store := newMockUsageStore()
+	a := auth.NewLsatAuthenticator(
+		&mockMint{}, &mockChecker{}, auth.WithUsageQuotas(
+			store, auth.StaticQuotas{"limited": 2},
+		),
+	)
+
+	// Accepting a token doesn't count it, only admitted requests are.
+	for i := 0; i < 3; i++ {
+		if !a.Accept(header, "limited") {
+			t.Fatalf("expected request %d to be accepted", i)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := a.CountUsage(header, "limited"); err != nil {
+			t.Fatalf("unable to count request %d: %v", i, err)
+		}
+	}
+	if a.Accept(header, "limited") {
+		t.Fatalf("expected request to be denied after quota")
+	}
+	err = a.CountUsage(header, "limited")
+	if !errors.Is(err, ErrQuotaExhausted) {
+		t.Fatalf("expected request beyond quota to fail, got %v", err)
+	}
+
+	// Services without a quota are not affected.
+	for i := 0; i < 3; i++ {
+		if err := a.CountUsage(header, "unlimited"); err != nil {
+			t.Fatalf("unable to count request %d: %v", i, err)
+		}
+		if !a.Accept(header, "unlimited") {
+			t.Fatalf("expected request %d to be accepted", i)
+		}
+	}
+}
@@ -26,15 +26,33 @@ type Authenticator interface {
 	Accept(*http.Header, string) bool
 
 	// FreshChallengeHeader returns a header containing a challenge for the
-	// user to complete.
-	FreshChallengeHeader(*http.Request, string, int64) (http.Header, error)
+	// user to complete. The optional challenge parameters customize the
+	// payment request of the challenge.
+	FreshChallengeHeader(*http.Request, string, int64,
+		*mint.ChallengeParams) (http.Header, error)
+}
+
+// UsageCounter is an Authenticator that limits the number of requests a token
+// can be used for. Accept only checks that a token has requests left, the
+// proxy counts a request with CountUsage once it was admitted to the backend,
+// so requests that are re-authenticated or rejected for another reason don't
+// use up the quota.
+type UsageCounter interface {
+	Authenticator
+
+	// CountUsage counts one request made with the token in the header to
+	// the given service. ErrQuotaExhausted is returned if the token
+	// exhausted its quota for the service, any other error if the request
+	// couldn't be counted.
+	CountUsage(*http.Header, string) error
 }
 
 // Minter is an entity that is able to mint and verify LSATs for a set of
 // services.
 type Minter interface {
 	// MintLSAT mints a new LSAT for the target services.
-	MintLSAT(context.Context, ...lsat.Service) (*macaroon.Macaroon, string, error)
+	MintLSAT(context.Context, *mint.ChallengeParams,
+		...lsat.Service) (*macaroon.Macaroon, string, error)
 
 	// VerifyLSAT attempts to verify an LSAT with the given parameters.
 	VerifyLSAT(context.Context, *mint.VerificationParams) error
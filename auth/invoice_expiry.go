@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+const (
+	// HeaderInvoiceExpiry is the header of a challenge that contains the
+	// time the invoice of the challenge expires at, in the HTTP date
+	// format.
+	HeaderInvoiceExpiry = "X-Invoice-Expiry"
+)
+
+// WithInvoiceExpiryHeader adds the time the invoice of a challenge expires at
+// to the challenge header so clients know how long they have to pay it. The
+// chain parameters of the network the invoices are created on are needed to
+// decode them.
+func WithInvoiceExpiryHeader(params *chaincfg.Params) Option {
+	return func(l *LsatAuthenticator) {
+		l.chainParams = params
+	}
+}
+
+// invoiceExpiry returns the time the given payment request expires at.
+func invoiceExpiry(paymentRequest string,
+	params *chaincfg.Params) (time.Time, error) {
+
+	invoice, err := zpay32.Decode(paymentRequest, params)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return invoice.Timestamp.Add(invoice.Expiry()), nil
+}
+
+// addInvoiceExpiry sets the expiry of the given payment request in the
+// challenge header, if enabled.
+func (l *LsatAuthenticator) addInvoiceExpiry(header http.Header,
+	paymentRequest string) {
+
+	// The header is based on the request, so we make sure a value sent by
+	// the client is never passed on as ours.
+	header.Del(HeaderInvoiceExpiry)
+	if l.chainParams == nil {
+		return
+	}
+
+	expiry, err := invoiceExpiry(paymentRequest, l.chainParams)
+	if err != nil {
+		log.Errorf("Error decoding invoice of challenge: %v", err)
+		return
+	}
+	header.Set(HeaderInvoiceExpiry, expiry.UTC().Format(http.TimeFormat))
+}
@@ -2,6 +2,7 @@ package auth_test
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/lightninglabs/aperture/auth"
@@ -17,7 +18,7 @@ type mockMint struct {
 
 var _ auth.Minter = (*mockMint)(nil)
 
-func (m *mockMint) MintLSAT(_ context.Context,
+func (m *mockMint) MintLSAT(_ context.Context, _ *mint.ChallengeParams,
 	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
 
 	return nil, "", nil
@@ -38,3 +39,34 @@ func (m *mockChecker) VerifyInvoiceStatus(lntypes.Hash,
 
 	return m.err
 }
+
+type mockUsageStore struct {
+	usage map[string]uint64
+	mtx   sync.Mutex
+}
+
+var _ auth.UsageStore = (*mockUsageStore)(nil)
+
+func newMockUsageStore() *mockUsageStore {
+	return &mockUsageStore{usage: make(map[string]uint64)}
+}
+
+func (m *mockUsageStore) Usage(_ context.Context, id lsat.TokenID,
+	serviceName string) (uint64, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.usage[id.String()+"/"+serviceName], nil
+}
+
+func (m *mockUsageStore) IncrementUsage(_ context.Context, id lsat.TokenID,
+	serviceName string, _ uint64) (uint64, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := id.String() + "/" + serviceName
+	m.usage[key]++
+	return m.usage[key], nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+var (
+	// ErrQuotaExhausted is returned by CountUsage if a token has used up
+	// its usage quota for a service.
+	ErrQuotaExhausted = errors.New("token quota exhausted")
+)
+
+// UsageStore keeps track of how many requests were made with each LSAT. To
+// correctly enforce quotas when running multiple instances of the proxy, the
+// store should be shared between them.
+type UsageStore interface {
+	// Usage returns the number of requests made with the token to the
+	// given service so far.
+	Usage(ctx context.Context, id lsat.TokenID,
+		serviceName string) (uint64, error)
+
+	// IncrementUsage increments the number of requests made with the token
+	// to the given service and returns the new number of requests. The
+	// quota of the service is passed so the store never forgets the
+	// counters of tokens that used it up.
+	IncrementUsage(ctx context.Context, id lsat.TokenID,
+		serviceName string, quota uint64) (uint64, error)
+}
+
+// QuotaSource provides the usage quotas of the services. It is consulted for
+// every request, so the quotas can change while the authenticator is running.
+type QuotaSource interface {
+	// UsageQuota returns the maximum number of requests a single token
+	// can be used for with the given service. Zero means there is no
+	// limit.
+	UsageQuota(serviceName string) uint64
+}
+
+// StaticQuotas is a QuotaSource of fixed quotas by service name.
+type StaticQuotas map[string]uint64
+
+// UsageQuota returns the quota of the service.
+//
+// NOTE: This is part of the QuotaSource interface.
+func (q StaticQuotas) UsageQuota(serviceName string) uint64 {
+	return q[serviceName]
+}
+
+// Option is a functional option that modifies the default behavior of the
+// LsatAuthenticator.
+type Option func(*LsatAuthenticator)
+
+// WithUsageQuotas limits the number of requests a single LSAT can be used for
+// per service. The quotas provide the maximum number of requests by service
+// name. Services without a quota or a quota of zero are not limited. Once a
+// token has used up its quota, it is no longer accepted and a new one must be
+// paid for. Requests are only counted with CountUsage, Accept just checks that
+// the token has requests left.
+func WithUsageQuotas(store UsageStore, quotas QuotaSource) Option {
+	return func(l *LsatAuthenticator) {
+		l.usage = store
+		l.quotas = quotas
+	}
+}
+
+// WithPreimageVerification makes the authenticator explicitly check that the
+// preimage of a token hashes to the payment hash in its identifier before any
+// other validation. Tokens that fail the check are rejected without consulting
+// the secret store and are logged distinctly from requests without a token.
+func WithPreimageVerification() Option {
+	return func(l *LsatAuthenticator) {
+		l.verifyPreimage = true
+	}
+}
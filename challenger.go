@@ -18,8 +18,10 @@ import (
 )
 
 // InvoiceRequestGenerator is a function type that returns a new request for the
-// lnrpc.AddInvoice call.
-type InvoiceRequestGenerator func(price int64) (*lnrpc.Invoice, error)
+// lnrpc.AddInvoice call. The optional challenge parameters customize the
+// invoice.
+type InvoiceRequestGenerator func(price int64,
+	params *mint.ChallengeParams) (*lnrpc.Invoice, error)
 
 // InvoiceClient is an interface that only implements part of a full lnd client,
 // namely the part around the invoices we need for the challenger to work.
@@ -261,10 +263,12 @@ func (l *LndChallenger) Stop() {
 // request (invoice) and the corresponding payment hash.
 //
 // NOTE: This is part of the mint.Challenger interface.
-func (l *LndChallenger) NewChallenge(price int64) (string, lntypes.Hash, error) {
+func (l *LndChallenger) NewChallenge(price int64,
+	params *mint.ChallengeParams) (string, lntypes.Hash, error) {
+
 	// Obtain a new invoice from lnd first. We need to know the payment hash
 	// so we can add it as a caveat to the macaroon.
-	invoice, err := l.genInvoiceReq(price)
+	invoice, err := l.genInvoiceReq(price, params)
 	if err != nil {
 		log.Errorf("Error generating invoice request: %v", err)
 		return "", lntypes.ZeroHash, err
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightningnetwork/lnd/lnrpc"
 	"github.com/lightningnetwork/lnd/lntypes"
 	"github.com/stretchr/testify/require"
@@ -94,7 +95,9 @@ func newChallenger() (*LndChallenger, *mockInvoiceClient, chan error) {
 		errChan:    make(chan error, 1),
 		quit:       make(chan struct{}),
 	}
-	genInvoiceReq := func(price int64) (*lnrpc.Invoice, error) {
+	genInvoiceReq := func(price int64,
+		_ *mint.ChallengeParams) (*lnrpc.Invoice, error) {
+
 		return newInvoice(lntypes.ZeroHash, 99, lnrpc.Invoice_OPEN),
 			nil
 	}
@@ -138,7 +141,7 @@ func TestLndChallenger(t *testing.T) {
 	c, invoiceMock, mainErrChan := newChallenger()
 
 	// Creating a new challenge should add an invoice to the lnd backend.
-	req, hash, err := c.NewChallenge(1337)
+	req, hash, err := c.NewChallenge(1337, nil)
 	require.NoError(t, err)
 	require.Equal(t, "foo", req)
 	require.Equal(t, lntypes.ZeroHash, hash)
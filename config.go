@@ -1,6 +1,8 @@
 package aperture
 
 import (
+	"time"
+
 	"github.com/btcsuite/btcutil"
 	"github.com/lightninglabs/aperture/proxy"
 )
@@ -14,6 +16,18 @@ var (
 	defaultLogFilename     = "aperture.log"
 	defaultMaxLogFiles     = 3
 	defaultMaxLogFileSize  = 10
+
+	// bytesPerMegabyte is the number of bytes in a megabyte, the unit the
+	// maximum access log file size is configured in.
+	bytesPerMegabyte = 1024 * 1024
+
+	// defaultCertExpiryWarnDays is the default number of days before the
+	// expiry of a backend TLS certificate we start to warn about it.
+	defaultCertExpiryWarnDays = 30
+
+	// certExpiryCheckInterval is the interval in which the backend TLS
+	// certificates are checked for their expiry.
+	certExpiryCheckInterval = 24 * time.Hour
 )
 
 type etcdConfig struct {
@@ -41,6 +55,91 @@ type torConfig struct {
 	V3          bool   `long:"v3" description:"Whether we should listen for client requests through a v3 onion service."`
 }
 
+type tlsSettings struct {
+	// MinVersion is the minimum TLS version clients must use, one of
+	// "1.0", "1.1", "1.2" or "1.3". Defaults to "1.2".
+	MinVersion string `long:"minversion" description:"Minimum TLS version clients must use."`
+
+	// CipherSuites is the list of cipher suites that are accepted for TLS
+	// versions up to 1.2, by their standard name. The cipher suites of
+	// TLS 1.3 can't be configured. HTTP/2 requires one of the
+	// TLS_ECDHE_*_WITH_AES_128_GCM_SHA256 suites to be included.
+	CipherSuites []string `long:"ciphersuites" description:"Cipher suites accepted for TLS 1.2 and below."`
+
+	// CurvePreferences is the list of elliptic curves used for the key
+	// exchange in order of preference, for example X25519 or P256.
+	CurvePreferences []string `long:"curvepreferences" description:"Elliptic curves used for the key exchange in order of preference."`
+}
+
+type statsConfig struct {
+	// Path is the path the stats are served on. Defaults to
+	// /aperture/stats.
+	Path string `long:"path" description:"Path the stats are served on."`
+
+	// Token is the bearer token requests for the stats must present. The
+	// stats endpoint is disabled if it is empty.
+	Token string `long:"token" description:"Bearer token required to fetch the stats."`
+}
+
+type configExportConfig struct {
+	// Path is the path the configuration is served on. Defaults to
+	// /aperture/config.
+	Path string `long:"path" description:"Path the configuration is served on."`
+
+	// Token is the bearer token requests for the configuration must
+	// present. The endpoint is disabled if it is empty.
+	Token string `long:"token" description:"Bearer token required to fetch the configuration."`
+}
+
+type debugConfig struct {
+	// Header is the header the debug flags are sent in. Defaults to
+	// X-Aperture-Debug.
+	Header string `long:"header" description:"Header the debug flags are sent in."`
+
+	// TrustedCIDRs are the networks of the clients whose debug flags are
+	// honored. The debug header is ignored if none are set.
+	TrustedCIDRs []string `long:"trustedcidrs" description:"Networks of the clients that are allowed to send debug flags."`
+}
+
+type accountTagConfig struct {
+	// Caveat is the condition of the caveat of a token that names the
+	// billing account the token was issued to. Requests aren't tagged if
+	// it is empty.
+	Caveat string `long:"caveat" description:"Condition of the token caveat that names the billing account."`
+
+	// Header is the header the account is sent to the backends in.
+	// Defaults to X-Aperture-Account.
+	Header string `long:"header" description:"Header the account is sent to the backends in."`
+}
+
+type freebieDBConfig struct {
+	// Path is the path of the database file. It's created if it doesn't
+	// exist yet.
+	Path string `long:"path" description:"Path of the freebie database file."`
+
+	// PruneInterval is the interval in which expired keys are removed
+	// from the database. Defaults to one hour.
+	PruneInterval time.Duration `long:"pruneinterval" description:"Interval in which expired keys are removed from the freebie database."`
+}
+
+type accessLogConfig struct {
+	// File is the path of the access log file. If empty, requests are
+	// logged to the application log.
+	File string `long:"file" description:"Path of the access log file, requests are written to the application log if empty."`
+
+	// MaxSize is the maximum size in megabytes of the access log file
+	// before it is rotated.
+	MaxSize int64 `long:"maxsize" description:"Maximum size of the access log file in megabytes before it is rotated, 0 to not rotate by size."`
+
+	// MaxAge is the maximum age of the access log file before it is
+	// rotated.
+	MaxAge time.Duration `long:"maxage" description:"Maximum age of the access log file before it is rotated, 0 to not rotate by age."`
+
+	// MaxFiles is the number of rotated access log files to keep. If zero,
+	// the same number as for the application log is kept.
+	MaxFiles int `long:"maxfiles" description:"Number of rotated access log files to keep."`
+}
+
 type config struct {
 	// ListenAddr is the listening address that we should use to allow Aperture
 	// to listen for requests.
@@ -57,6 +156,16 @@ type config struct {
 	// Insecure can be set to disable TLS on incoming connections.
 	Insecure bool `long:"insecure" description:"Listen on an insecure connection, disabling TLS for incoming connections."`
 
+	// TLS restricts the TLS versions, cipher suites and curves clients can
+	// use.
+	TLS *tlsSettings `long:"tls" description:"Settings of the TLS connections of clients."`
+
+	// ClientCAPath is the optional path to a file with PEM encoded CA
+	// certificates that TLS client certificates are verified against.
+	// Client certificates are optional on the TLS level, services that set
+	// requireclientcert reject requests without a verified one.
+	ClientCAPath string `long:"clientcapath" description:"Path to the CA certificates to verify TLS client certificates against."`
+
 	// StaticRoot is the folder where the static content served by the proxy
 	// is located.
 	StaticRoot string `long:"staticroot" description:"The folder where the static content is located."`
@@ -65,16 +174,167 @@ type config struct {
 	// directory defined by StaticRoot.
 	ServeStatic bool `long:"servestatic" description:"Flag to enable or disable static content serving."`
 
+	// ServeWellKnown serves a discovery document that describes the
+	// services, their prices and the authentication scheme as JSON,
+	// without requiring payment.
+	ServeWellKnown bool `long:"servewellknown" description:"Serve a discovery document of the services and their prices."`
+
+	// WellKnownPath is the path the discovery document is served on.
+	// Defaults to /.well-known/lsat.
+	WellKnownPath string `long:"wellknownpath" description:"Path the discovery document is served on."`
+
 	Etcd *etcdConfig `long:"etcd" description:"Configuration for the etcd instance backing the proxy."`
 
 	Authenticator *authConfig `long:"authenticator" description:"Configuration for the authenticator."`
 
+	// Authenticators are additional authenticators by name, each backed by
+	// its own lnd node. Services can select one of them instead of the
+	// default authenticator.
+	Authenticators map[string]*authConfig `long:"authenticators" description:"Additional authenticators by name that services can select."`
+
 	Tor *torConfig `long:"tor" description:"Configuration for the Tor instance backing the proxy."`
 
+	// ServiceMatching is the mode used to match requests to services.
+	// With "first", the default, the first matching service in the list is
+	// used. With "specific", the matching service with the highest priority
+	// and most specific path expression is used, independent of its
+	// position in the list.
+	ServiceMatching string `long:"servicematching" description:"Mode to match requests to services, either 'first' or 'specific'."`
+
+	// GrpcNoMatchCode is the canonical name of the gRPC status code gRPC
+	// clients receive if their request doesn't match any service, for
+	// example "NOT_FOUND". Defaults to "UNIMPLEMENTED".
+	GrpcNoMatchCode string `long:"grpcnomatchcode" description:"gRPC status code for gRPC requests that don't match any service."`
+
+	// GrpcHealth enables answering requests of the standard gRPC health
+	// checking protocol on aperture itself, without authentication.
+	GrpcHealth bool `long:"grpchealth" description:"Answer gRPC health checks on aperture itself."`
+
+	// DisableCors turns off the CORS headers for all services and forwards
+	// OPTIONS requests to the backends instead of answering them.
+	DisableCors bool `long:"disablecors" description:"Don't add CORS headers and forward OPTIONS requests to the backends."`
+
+	// GeoIPDatabase is the path of an optional CSV file that maps networks
+	// to country codes. It's used to forward the country of clients to
+	// the backends of services that set a country header.
+	GeoIPDatabase string `long:"geoipdatabase" description:"Path of a CSV file mapping networks to country codes."`
+
+	// WarmUpPeriod is the optional period after startup during which
+	// requests that would need to be paid for are served for free. It is
+	// limited to 10 minutes.
+	WarmUpPeriod time.Duration `long:"warmupperiod" description:"Period after startup during which requests are served without payment, at most 10m."`
+
+	// Webhook is the optional configuration of a webhook that events like
+	// issued challenges and accepted payments are sent to.
+	Webhook *proxy.WebhookConfig `long:"webhook" description:"Configuration of the webhook events are sent to."`
+
+	// Stats is the optional configuration of the endpoint that serves the
+	// usage stats of all services.
+	Stats *statsConfig `long:"stats" description:"Configuration of the usage stats endpoint."`
+
+	// ConfigExport is the optional configuration of the endpoint that
+	// serves the effective configuration of all services.
+	ConfigExport *configExportConfig `long:"configexport" description:"Configuration of the endpoint that serves the effective service configuration."`
+
+	// Debug is the optional configuration of the header trusted clients
+	// can enable debug behaviors for single requests with.
+	Debug *debugConfig `long:"debug" description:"Configuration of the request debug flags."`
+
+	// AccountTag is the optional configuration of tagging requests with
+	// the billing account of their token.
+	AccountTag *accountTagConfig `long:"accounttag" description:"Configuration of tagging requests with the billing account of their token."`
+
+	// FreebieDB is the optional configuration of the on-disk database
+	// that keeps the freebie counts of services with the "disk" freebie
+	// strategy across restarts.
+	FreebieDB *freebieDBConfig `long:"freebiedb" description:"Configuration of the on-disk freebie database."`
+
+	// ErrorFormat is the format of the error responses the proxy sends to
+	// HTTP clients itself. With "text", the default, errors are sent as
+	// plain text. With "json", they are sent as a JSON object with the
+	// fields error and code unless the client's Accept header rules out
+	// JSON.
+	ErrorFormat string `long:"errorformat" description:"Format of error responses to HTTP clients, either 'text' or 'json'."`
+
+	// BackendAllowList is an optional list of regular expressions that the
+	// host of every service address must match. This protects against the
+	// proxy being pointed to internal endpoints if the service
+	// configuration is generated from less trusted input. An empty list
+	// disables the check.
+	BackendAllowList []string `long:"backendallowlist" description:"List of regular expressions of hosts backend services may point to."`
+
+	// StrictPathRegexp can be set to reject services without a path
+	// regular expression. By default an empty path regular expression
+	// matches every path of the host.
+	StrictPathRegexp bool `long:"strictpathregexp" description:"Require every service to have a path regular expression instead of treating an empty one as match-all."`
+
+	// BackendDialTimeout is the maximum duration of establishing a
+	// connection to a backend. Defaults to 5 seconds.
+	BackendDialTimeout time.Duration `long:"backenddialtimeout" description:"Maximum duration of establishing a connection to a backend."`
+
+	// ReloadMode is what is reloaded from the configuration file when the
+	// process receives SIGHUP. With "ratelimits", the default, only the
+	// rate limits of the running services are updated. With "services",
+	// all services are replaced by the ones in the file if they are valid.
+	ReloadMode string `long:"reloadmode" description:"What SIGHUP reloads from the config file, either 'ratelimits' or 'services'."`
+
+	// ShutdownTimeout is the maximum duration the requests in flight are
+	// given to complete after SIGINT or SIGTERM before all connections are
+	// closed. Defaults to 15 seconds.
+	ShutdownTimeout time.Duration `long:"shutdowntimeout" description:"Maximum duration to drain requests in flight on shutdown."`
+
+	// DiscoveryInterval is the interval in which the backend addresses of
+	// services that use service discovery are refreshed.
+	DiscoveryInterval time.Duration `long:"discoveryinterval" description:"Interval in which backend addresses of services are discovered."`
+
+	// LatencyReportInterval is the interval in which a summary of the
+	// requests to each service is logged, with their number, errors and
+	// latency percentiles. Zero disables the reports.
+	LatencyReportInterval time.Duration `long:"latencyreportinterval" description:"Interval in which request counts and latency percentiles of each service are logged, 0 to disable."`
+
+	// ExchangeRateURL is the optional URL of a JSON object that maps
+	// currency codes to the price of one bitcoin. It is used to show the
+	// approximate fiat price in the challenges of services that have a
+	// fiat currency configured.
+	ExchangeRateURL string `long:"exchangerateurl" description:"URL of the exchange rates used to show fiat prices in challenges."`
+
+	// ExchangeRateRefresh is the interval after which the exchange rates
+	// are fetched again.
+	ExchangeRateRefresh time.Duration `long:"exchangeraterefresh" description:"Interval after which the exchange rates are fetched again."`
+
+	// VerifyPreimage can be set to explicitly check that the preimage of
+	// each token hashes to the payment hash in its identifier before any
+	// other validation, logging mismatches distinctly.
+	VerifyPreimage bool `long:"verifypreimage" description:"Explicitly verify the preimage of each token against its payment hash."`
+
+	// UsageTTL is the duration after which the usage counters of a token
+	// that enforce the quotas of the services are removed from etcd,
+	// counted from the first request of the token. Counters of tokens that
+	// used up their quota are kept. Defaults to one year.
+	UsageTTL time.Duration `long:"usagettl" description:"Duration after the first request of a token after which its quota usage counters are removed."`
+
+	// DiscountHeader is the header clients can send a discount token in
+	// to get a challenge with a lower price. Defaults to
+	// "X-Discount-Token".
+	DiscountHeader string `long:"discountheader" description:"Header clients can send a discount token in."`
+
+	// Discounts is a map of discount tokens to the percentage they reduce
+	// the price of a challenge by. The discounted price is at least one
+	// satoshi.
+	Discounts map[string]uint8 `long:"discounts" description:"Map of discount tokens to the percentage they reduce the price by."`
+
 	// Services is a list of JSON objects in string format, which specify
 	// each backend service to Aperture.
 	Services []*proxy.Service `long:"service" description:"Configurations for each Aperture backend service."`
 
+	// CertExpiryWarnDays is the number of days before the expiry of a
+	// backend TLS certificate a warning is logged. The certificates are
+	// checked on startup and once a day. A negative value disables the
+	// check.
+	CertExpiryWarnDays int `long:"certexpirywarndays" description:"Number of days before expiry of a backend TLS certificate to start warning about it, negative to disable."`
+
+	AccessLog *accessLogConfig `long:"accesslog" description:"Configuration for the access log file."`
+
 	// DebugLevel is a string defining the log level for the service either
 	// for all subsystems the same or individual level by subsystem.
 	DebugLevel string `long:"debuglevel" description:"Debug level for the Aperture application and its subsystems."`
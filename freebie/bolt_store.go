@@ -0,0 +1,296 @@
+package freebie
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultPruneInterval is the default interval in which expired keys
+	// are removed from the on-disk freebie database.
+	DefaultPruneInterval = time.Hour
+
+	// boltOpenTimeout is the maximum duration we wait for the lock of the
+	// database file, which is held by any other process that has it open.
+	boltOpenTimeout = 5 * time.Second
+
+	// boltEntrySize is the size of an encoded entry, the freebie count
+	// followed by the expiry as unix nanoseconds.
+	boltEntrySize = 2 + 8
+)
+
+// BoltDB is an on-disk database that keeps the freebie counts of any number of
+// services, so they survive restarts. Each service uses its own bucket. Keys
+// that expired are pruned from all buckets in the background.
+type BoltDB struct {
+	db  *bbolt.DB
+	now func() time.Time
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenBoltDB opens or creates the freebie database at the given path and
+// starts pruning expired keys in the given interval. A zero interval uses the
+// DefaultPruneInterval. The database must be closed with Close.
+func OpenBoltDB(path string, pruneInterval time.Duration) (*BoltDB, error) {
+	if pruneInterval < 0 {
+		return nil, fmt.Errorf("prune interval cannot be negative")
+	}
+	if pruneInterval == 0 {
+		pruneInterval = DefaultPruneInterval
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: boltOpenTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open freebie DB %s: %v",
+			path, err)
+	}
+
+	b := &BoltDB{
+		db:   db,
+		now:  time.Now,
+		quit: make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.prune(); err != nil {
+					log.Errorf("Unable to prune freebie "+
+						"DB: %v", err)
+				}
+
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+
+	return b, nil
+}
+
+// Close stops pruning and closes the database.
+func (b *BoltDB) Close() error {
+	close(b.quit)
+	b.wg.Wait()
+
+	return b.db.Close()
+}
+
+// prune removes all expired keys from all buckets.
+func (b *BoltDB) prune() error {
+	now := b.now()
+
+	var pruned int
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, bucket *bbolt.Bucket) error {
+			// Keys can't be deleted while iterating over them, so
+			// we collect them first.
+			var expired [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				_, expiry := decodeBoltEntry(v)
+				if expiry.IsZero() || !now.After(expiry) {
+					return nil
+				}
+
+				key := make([]byte, len(k))
+				copy(key, k)
+				expired = append(expired, key)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			pruned += len(expired)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Pruned %d expired keys from freebie DB.", pruned)
+	return nil
+}
+
+// NewStore returns a freebie store that keeps its counts in the bucket with
+// the given name. A key that isn't used for longer than keyTTL expires, which
+// resets its freebie count. A keyTTL of zero means keys never expire.
+//
+// Writes of concurrent requests are batched into a single transaction, so the
+// store can handle many requests without syncing the file for each of them.
+func (b *BoltDB) NewStore(name string, numFreebies Count,
+	keyTTL time.Duration) (DB, error) {
+
+	bucket := []byte(name)
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create freebie bucket %s: %v",
+			name, err)
+	}
+
+	return &boltStore{
+		db:          b,
+		bucket:      bucket,
+		numFreebies: numFreebies,
+		keyTTL:      keyTTL,
+	}, nil
+}
+
+// boltStore is a freebie store that keeps the counts of a single service in a
+// bucket of the on-disk database.
+type boltStore struct {
+	db          *BoltDB
+	bucket      []byte
+	numFreebies Count
+	keyTTL      time.Duration
+}
+
+// A compile time check to make sure boltStore implements the RefundDB
+// interface.
+var _ RefundDB = (*boltStore)(nil)
+
+// encodeBoltEntry encodes a freebie count and the time it expires at. A zero
+// expiry means it never expires.
+func encodeBoltEntry(count Count, expiry time.Time) []byte {
+	var expiryNanos int64
+	if !expiry.IsZero() {
+		expiryNanos = expiry.UnixNano()
+	}
+
+	v := make([]byte, boltEntrySize)
+	binary.BigEndian.PutUint16(v[:2], uint16(count))
+	binary.BigEndian.PutUint64(v[2:], uint64(expiryNanos))
+	return v
+}
+
+// decodeBoltEntry decodes a freebie count and its expiry. Invalid entries are
+// treated as if they didn't exist.
+func decodeBoltEntry(v []byte) (Count, time.Time) {
+	if len(v) != boltEntrySize {
+		return 0, time.Time{}
+	}
+
+	count := Count(binary.BigEndian.Uint16(v[:2]))
+	expiryNanos := int64(binary.BigEndian.Uint64(v[2:]))
+	if expiryNanos == 0 {
+		return count, time.Time{}
+	}
+	return count, time.Unix(0, expiryNanos)
+}
+
+// currentCount returns the freebie count stored under the given key, or zero
+// if it doesn't exist or has expired.
+func (s *boltStore) currentCount(bucket *bbolt.Bucket, key []byte) Count {
+	count, expiry := decodeBoltEntry(bucket.Get(key))
+	if !expiry.IsZero() && s.db.now().After(expiry) {
+		return 0
+	}
+	return count
+}
+
+// update applies the given change to the count of the key of the IP address
+// in a batched transaction and returns the new count.
+func (s *boltStore) update(ip net.IP,
+	change func(Count) Count) (Count, error) {
+
+	key := []byte(ipKey(ip))
+
+	var count Count
+	err := s.db.db.Batch(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil {
+			return fmt.Errorf("freebie bucket %s not found",
+				s.bucket)
+		}
+
+		count = change(s.currentCount(bucket, key))
+
+		var expiry time.Time
+		if s.keyTTL > 0 {
+			expiry = s.db.now().Add(s.keyTTL)
+		}
+		return bucket.Put(key, encodeBoltEntry(count, expiry))
+	})
+	return count, err
+}
+
+// CanPass returns true if the client still has free requests left.
+//
+// NOTE: This is part of the DB interface.
+func (s *boltStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	key := []byte(ipKey(ip))
+
+	var count Count
+	err := s.db.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil {
+			return fmt.Errorf("freebie bucket %s not found",
+				s.bucket)
+		}
+
+		count = s.currentCount(bucket, key)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return count < s.numFreebies, nil
+}
+
+// TallyFreebie counts one free request of the client and returns the number
+// of free requests it has left.
+//
+// NOTE: This is part of the DB interface.
+func (s *boltStore) TallyFreebie(r *http.Request, ip net.IP) (Count, error) {
+	count, err := s.update(ip, func(count Count) Count {
+		if count == ^Count(0) {
+			return count
+		}
+		return count + 1
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining(s.numFreebies, count), nil
+}
+
+// RefundFreebie gives back one free request of the client.
+//
+// NOTE: This is part of the RefundDB interface.
+func (s *boltStore) RefundFreebie(r *http.Request, ip net.IP) error {
+	_, err := s.update(ip, func(count Count) Count {
+		if count == 0 {
+			return count
+		}
+		return count - 1
+	})
+	return err
+}
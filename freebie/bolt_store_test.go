@@ -0,0 +1,121 @@
+package freebie
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// TestBoltStorePersistence makes sure freebie counts survive reopening the
+// database and that refunds are stored as well.
+func TestBoltStorePersistence(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "freebie")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "freebies.db")
+
+	boltDB, err := OpenBoltDB(path, 0)
+	if err != nil {
+		t.Fatalf("unable to open DB: %v", err)
+	}
+	db, err := boltDB.NewStore("service", 2, 0)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	ip := net.ParseIP("1.1.1.1")
+	for i := 0; i < 2; i++ {
+		if _, err := db.TallyFreebie(nil, ip); err != nil {
+			t.Fatalf("unable to tally freebie: %v", err)
+		}
+	}
+	assertCanPass(t, db, ip, false)
+
+	err = db.(RefundDB).RefundFreebie(nil, ip)
+	if err != nil {
+		t.Fatalf("unable to refund freebie: %v", err)
+	}
+	if err := boltDB.Close(); err != nil {
+		t.Fatalf("unable to close DB: %v", err)
+	}
+
+	// After reopening, the client has the refunded freebie left.
+	boltDB, err = OpenBoltDB(path, 0)
+	if err != nil {
+		t.Fatalf("unable to reopen DB: %v", err)
+	}
+	defer boltDB.Close()
+	db, err = boltDB.NewStore("service", 2, 0)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+	assertCanPass(t, db, ip, true)
+
+	left, err := db.TallyFreebie(nil, ip)
+	if err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+	if left != 0 {
+		t.Fatalf("expected no freebies left, got %d", left)
+	}
+}
+
+// TestBoltStorePrune makes sure expired keys are treated as unused and removed
+// when the database is pruned.
+func TestBoltStorePrune(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "freebie")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	boltDB, err := OpenBoltDB(filepath.Join(dir, "freebies.db"), 0)
+	if err != nil {
+		t.Fatalf("unable to open DB: %v", err)
+	}
+	defer boltDB.Close()
+
+	now := time.Unix(1000, 0)
+	boltDB.now = func() time.Time {
+		return now
+	}
+	db, err := boltDB.NewStore("service", 1, time.Minute)
+	if err != nil {
+		t.Fatalf("unable to create store: %v", err)
+	}
+
+	ip := net.ParseIP("1.1.1.1")
+	if _, err := db.TallyFreebie(nil, ip); err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+	assertCanPass(t, db, ip, false)
+
+	now = now.Add(2 * time.Minute)
+	assertCanPass(t, db, ip, true)
+
+	if err := boltDB.prune(); err != nil {
+		t.Fatalf("unable to prune DB: %v", err)
+	}
+	err = boltDB.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte("service")).ForEach(
+			func(k, _ []byte) error {
+				t.Fatalf("expected key %s to be pruned", k)
+				return nil
+			},
+		)
+	})
+	if err != nil {
+		t.Fatalf("unable to read DB: %v", err)
+	}
+}
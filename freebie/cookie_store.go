@@ -0,0 +1,200 @@
+package freebie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cookieKeySize is the minimum size of the key used to sign cookies.
+	cookieKeySize = 32
+)
+
+var (
+	// ErrCookieRequiresResponse is returned if a cookie store should tally
+	// a freebie without having access to the response.
+	ErrCookieRequiresResponse = errors.New("freebie cookie store needs " +
+		"response to tally freebie")
+
+	// errInvalidCookie is returned if a cookie can't be decoded or its
+	// signature doesn't match.
+	errInvalidCookie = errors.New("invalid freebie cookie")
+)
+
+// CookieDB is a freebie DB that doesn't keep any state on the server but
+// stores the number of used freebies in a cookie on the client side instead.
+// Tallying a freebie therefore requires access to the response so the cookie
+// can be updated.
+type CookieDB interface {
+	DB
+
+	// TallyFreebieCookie counts one free request for the client of the
+	// given request, sets the updated cookie in the response and returns
+	// the number of free requests the client has left.
+	TallyFreebieCookie(http.ResponseWriter, *http.Request, net.IP) (Count,
+		error)
+}
+
+// cookieStore is a stateless freebie store that encodes the number of used
+// freebies in an HMAC signed cookie. Any modification of the cookie by the
+// client is detected by verifying the signature. Since a client can reset its
+// count by simply not sending the cookie, or replay an old one, all requests
+// are also limited by the IP based fallback store, which counts all free
+// requests of an address whether they came with a cookie or not.
+type cookieStore struct {
+	numFreebies Count
+	cookieName  string
+	key         []byte
+	fallback    DB
+}
+
+// A compile-time constraint to ensure cookieStore implements CookieDB.
+var _ CookieDB = (*cookieStore)(nil)
+
+// NewCookieStore creates a new freebie store that keeps track of the free
+// requests of a client in a cookie with the given name, signed with the given
+// key. This only works for clients that store cookies, like web browsers. All
+// clients are limited by the given IP based fallback store as well, since a
+// cookie can't prevent its own replay.
+func NewCookieStore(numFreebies Count, cookieName string, key []byte,
+	fallback DB) (CookieDB, error) {
+
+	if len(key) < cookieKeySize {
+		return nil, fmt.Errorf("freebie cookie key must be at least "+
+			"%d bytes", cookieKeySize)
+	}
+	if cookieName == "" {
+		return nil, fmt.Errorf("freebie cookie name cannot be empty")
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("freebie cookie fallback store " +
+			"cannot be nil")
+	}
+
+	return &cookieStore{
+		numFreebies: numFreebies,
+		cookieName:  cookieName,
+		key:         key,
+		fallback:    fallback,
+	}, nil
+}
+
+// signature returns the HMAC of the cookie name and the encoded count. The
+// name is included so a cookie of one service can't be used for another.
+func (c *cookieStore) signature(count string) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	_, _ = mac.Write([]byte(c.cookieName))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(count))
+	return mac.Sum(nil)
+}
+
+// encode returns the signed cookie value for the given count.
+func (c *cookieStore) encode(count Count) string {
+	countStr := strconv.FormatUint(uint64(count), 10)
+	sig := base64.RawURLEncoding.EncodeToString(c.signature(countStr))
+	return countStr + "." + sig
+}
+
+// decode verifies the signature of a cookie value and returns the count that
+// is encoded in it.
+func (c *cookieStore) decode(value string) (Count, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return 0, errInvalidCookie
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, errInvalidCookie
+	}
+	if !hmac.Equal(sig, c.signature(parts[0])) {
+		return 0, errInvalidCookie
+	}
+
+	count, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, errInvalidCookie
+	}
+	return Count(count), nil
+}
+
+// currentCount returns the number of freebies the client of the request has
+// already used according to its cookie and false if the request has no cookie.
+// If the cookie was tampered with, the client is treated as if all freebies
+// were used up.
+func (c *cookieStore) currentCount(r *http.Request) (Count, bool) {
+	cookie, err := r.Cookie(c.cookieName)
+	if err != nil {
+		return 0, false
+	}
+
+	count, err := c.decode(cookie.Value)
+	if err != nil {
+		return c.numFreebies, true
+	}
+	return count, true
+}
+
+// CanPass returns true if the client still has free requests left according
+// to the fallback store and, if it sent one, according to its cookie. The
+// signature of a cookie doesn't expire, so a client could replay an early one
+// forever if the cookie alone was checked.
+//
+// NOTE: This is part of the DB interface.
+func (c *cookieStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	count, ok := c.currentCount(r)
+	if ok && count >= c.numFreebies {
+		return false, nil
+	}
+	return c.fallback.CanPass(r, ip)
+}
+
+// TallyFreebie always fails since the cookie store needs access to the
+// response. TallyFreebieCookie must be used instead.
+//
+// NOTE: This is part of the DB interface.
+func (c *cookieStore) TallyFreebie(*http.Request, net.IP) (Count, error) {
+	return 0, ErrCookieRequiresResponse
+}
+
+// TallyFreebieCookie counts one free request for the client of the given
+// request, sets the updated cookie in the response and returns the number of
+// free requests the client has left. The request is counted by the fallback
+// store as well, so dropping the cookie doesn't give a client new freebies. A
+// client without a cookie starts with the count of its address.
+//
+// NOTE: This is part of the CookieDB interface.
+func (c *cookieStore) TallyFreebieCookie(w http.ResponseWriter,
+	r *http.Request, ip net.IP) (Count, error) {
+
+	left, err := c.fallback.TallyFreebie(r, ip)
+	if err != nil {
+		return 0, err
+	}
+
+	count, ok := c.currentCount(r)
+	switch {
+	case !ok:
+		count = c.numFreebies - left
+
+	case count < c.numFreebies:
+		count++
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookieName,
+		Value:    c.encode(count),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return remaining(c.numFreebies, count), nil
+}
@@ -0,0 +1,125 @@
+package freebie
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCookieStore makes sure the freebie count is carried in the cookie and
+// that tampered cookies are rejected.
+func TestCookieStore(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{0x01}, cookieKeySize)
+	db, err := NewCookieStore(2, "test", key, NewMemIPMaskStore(2))
+	if err != nil {
+		t.Fatalf("unable to create cookie store: %v", err)
+	}
+
+	// A client without a cookie can pass and gets a cookie with the first
+	// freebie counted.
+	req := httptest.NewRequest("GET", "/", nil)
+	assertCookieCanPass(t, db, req, true)
+	cookie := tallyCookie(t, db, req)
+
+	// With one freebie left, the client can still pass.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	assertCookieCanPass(t, db, req, true)
+	cookie = tallyCookie(t, db, req)
+
+	// All freebies are used up now.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	assertCookieCanPass(t, db, req, false)
+
+	// Resetting the count in the cookie must be detected.
+	cookie.Value = "0" + cookie.Value[1:]
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	assertCookieCanPass(t, db, req, false)
+
+	// A cookie signed for another service must be rejected too.
+	otherDb, err := NewCookieStore(
+		2, "other", key, NewMemIPMaskStore(2),
+	)
+	if err != nil {
+		t.Fatalf("unable to create cookie store: %v", err)
+	}
+	otherCookie := tallyCookie(
+		t, otherDb, httptest.NewRequest("GET", "/", nil),
+	)
+	otherCookie.Name = "test"
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(otherCookie)
+	assertCookieCanPass(t, db, req, false)
+}
+
+// TestCookieStoreWithoutCookie makes sure clients can't get new freebies by
+// dropping or replaying their cookie.
+func TestCookieStoreWithoutCookie(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{0x01}, cookieKeySize)
+	db, err := NewCookieStore(2, "test", key, NewMemIPMaskStore(2))
+	if err != nil {
+		t.Fatalf("unable to create cookie store: %v", err)
+	}
+
+	// The first freebie is counted in the cookie and for the address.
+	cookie := tallyCookie(t, db, httptest.NewRequest("GET", "/", nil))
+
+	// Without the cookie, the client is limited by its address, which
+	// has one freebie left. The new cookie continues from its count.
+	req := httptest.NewRequest("GET", "/", nil)
+	assertCookieCanPass(t, db, req, true)
+	cookie = tallyCookie(t, db, req)
+	if cookie.Value != db.(*cookieStore).encode(2) {
+		t.Fatalf("expected cookie with count 2, got %s", cookie.Value)
+	}
+	assertCookieCanPass(t, db, httptest.NewRequest("GET", "/", nil), false)
+
+	// Replaying an early cookie doesn't get around the limit of the
+	// address either.
+	fresh, err := NewCookieStore(2, "test", key, NewMemIPMaskStore(2))
+	if err != nil {
+		t.Fatalf("unable to create cookie store: %v", err)
+	}
+	cookie = tallyCookie(t, fresh, httptest.NewRequest("GET", "/", nil))
+	_ = tallyCookie(t, fresh, httptest.NewRequest("GET", "/", nil))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	assertCookieCanPass(t, fresh, req, false)
+}
+
+func tallyCookie(t *testing.T, db CookieDB, r *http.Request) *http.Cookie {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	if _, err := db.TallyFreebieCookie(rec, r, testIP); err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+// testIP is the address of the client in the cookie store tests.
+var testIP = net.ParseIP("192.0.2.1")
+
+func assertCookieCanPass(t *testing.T, db DB, r *http.Request, expected bool) {
+	t.Helper()
+
+	ok, err := db.CanPass(r, testIP)
+	if err != nil {
+		t.Fatalf("unable to query freebie db: %v", err)
+	}
+	if ok != expected {
+		t.Fatalf("expected CanPass to be %v, got %v", expected, ok)
+	}
+}
@@ -9,7 +9,20 @@ import (
 // keeps track of how many free requests a certain IP address can make to a
 // certain resource.
 type DB interface {
+	// CanPass returns true if the client still has free requests left.
 	CanPass(*http.Request, net.IP) (bool, error)
 
-	TallyFreebie(*http.Request, net.IP) (bool, error)
+	// TallyFreebie counts one free request of the client and returns the
+	// number of free requests the client has left.
+	TallyFreebie(*http.Request, net.IP) (Count, error)
+}
+
+// RefundDB is a freebie DB that can give back a free request that was already
+// counted, for example because the backend failed to serve it.
+type RefundDB interface {
+	DB
+
+	// RefundFreebie gives back one free request of the client that was
+	// counted with TallyFreebie before.
+	RefundFreebie(*http.Request, net.IP) error
 }
@@ -1,8 +1,11 @@
 package freebie
 
 import (
+	"container/list"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 var (
@@ -11,31 +14,160 @@ var (
 
 type Count uint16
 
+// memEntry is a single tracked key in the in-memory store together with its
+// current freebie count and the last time it was used.
+type memEntry struct {
+	key      string
+	count    Count
+	lastSeen time.Time
+}
+
 type memStore struct {
-	numFreebies    Count
-	freebieCounter map[string]Count
+	numFreebies Count
+
+	// maxKeys is the maximum number of keys we keep track of. If a new key
+	// would exceed that limit, the least recently used key is evicted. A
+	// value of zero means there is no limit.
+	maxKeys int
+
+	// keyTTL is the maximum time a key can be idle before it is expired.
+	// A value of zero means keys never expire.
+	keyTTL time.Duration
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	// freebieCounter maps each key to its element in the lru list. The
+	// front of the list is the most recently used key.
+	freebieCounter map[string]*list.Element
+	lru            *list.List
+	mtx            sync.Mutex
 }
 
 func (m *memStore) getKey(ip net.IP) string {
-	return ip.Mask(defaultIPMask).String()
+	return ipKey(ip)
+}
+
+// ipKey returns the key the free requests of the given IP address are counted
+// under. The last byte of IPv4 addresses is masked, IPv6 addresses are used as
+// they are since the IPv4 mask can't be applied to them.
+func ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(defaultIPMask).String()
+	}
+	return ip.String()
+}
+
+// lookup returns the entry for the given key if it exists and hasn't expired
+// yet. Expired entries are removed from the store.
+//
+// NOTE: The mutex must be held when calling this method.
+func (m *memStore) lookup(key string) (*memEntry, bool) {
+	elem, ok := m.freebieCounter[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*memEntry)
+	if m.keyTTL > 0 && m.now().Sub(entry.lastSeen) > m.keyTTL {
+		m.remove(elem)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// remove deletes the given element from both the map and the lru list.
+//
+// NOTE: The mutex must be held when calling this method.
+func (m *memStore) remove(elem *list.Element) {
+	entry := m.lru.Remove(elem).(*memEntry)
+	delete(m.freebieCounter, entry.key)
+}
+
+// evict removes all expired keys and then, if the store is still at its
+// capacity, the least recently used keys until there is room for one more.
+//
+// NOTE: The mutex must be held when calling this method.
+func (m *memStore) evict() {
+	// The oldest entries are at the back of the list, so we can stop at
+	// the first one that hasn't expired yet.
+	if m.keyTTL > 0 {
+		now := m.now()
+		for elem := m.lru.Back(); elem != nil; elem = m.lru.Back() {
+			entry := elem.Value.(*memEntry)
+			if now.Sub(entry.lastSeen) <= m.keyTTL {
+				break
+			}
+			m.remove(elem)
+		}
+	}
+
+	if m.maxKeys <= 0 {
+		return
+	}
+	for m.lru.Len() >= m.maxKeys {
+		m.remove(m.lru.Back())
+	}
 }
 
 func (m *memStore) currentCount(ip net.IP) Count {
-	counter, ok := m.freebieCounter[m.getKey(ip)]
+	entry, ok := m.lookup(m.getKey(ip))
 	if !ok {
 		return 0
 	}
-	return counter
+	return entry.count
 }
 
 func (m *memStore) CanPass(r *http.Request, ip net.IP) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	return m.currentCount(ip) < m.numFreebies, nil
 }
 
-func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
-	counter := m.currentCount(ip) + 1
-	m.freebieCounter[m.getKey(ip)] = counter
-	return true, nil
+func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (Count, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	key := m.getKey(ip)
+	entry, ok := m.lookup(key)
+	if !ok {
+		m.evict()
+		entry = &memEntry{key: key}
+		m.freebieCounter[key] = m.lru.PushFront(entry)
+	} else {
+		m.lru.MoveToFront(m.freebieCounter[key])
+	}
+
+	entry.count++
+	entry.lastSeen = m.now()
+	return remaining(m.numFreebies, entry.count), nil
+}
+
+// RefundFreebie gives back one free request of the client. Nothing happens if
+// the key of the client was evicted or expired in the meantime, since its count
+// was reset then.
+//
+// NOTE: This is part of the RefundDB interface.
+func (m *memStore) RefundFreebie(r *http.Request, ip net.IP) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	entry, ok := m.lookup(m.getKey(ip))
+	if ok && entry.count > 0 {
+		entry.count--
+	}
+	return nil
+}
+
+// remaining returns the number of free requests left given the number of free
+// requests that were already used.
+func remaining(numFreebies, count Count) Count {
+	if count >= numFreebies {
+		return 0
+	}
+	return numFreebies - count
 }
 
 // NewMemIPMaskStore creates a new in-memory freebie store that masks the last
@@ -43,8 +175,24 @@ func (m *memStore) TallyFreebie(r *http.Request, ip net.IP) (bool, error) {
 // address is discarded for the mapping to reduce risk of abuse by users that
 // have a whole range of IPs at their disposal.
 func NewMemIPMaskStore(numFreebies Count) DB {
+	return NewBoundedMemIPMaskStore(numFreebies, 0, 0)
+}
+
+// NewBoundedMemIPMaskStore creates a new in-memory freebie store like
+// NewMemIPMaskStore but bounds the memory it uses. At most maxKeys keys are
+// tracked, evicting the least recently used one if a new key is added. Keys
+// that haven't been used for longer than keyTTL are expired. Evicting or
+// expiring a key resets its freebie count. A value of zero for either of the
+// limits disables it.
+func NewBoundedMemIPMaskStore(numFreebies Count, maxKeys int,
+	keyTTL time.Duration) DB {
+
 	return &memStore{
 		numFreebies:    numFreebies,
-		freebieCounter: make(map[string]Count),
+		maxKeys:        maxKeys,
+		keyTTL:         keyTTL,
+		now:            time.Now,
+		freebieCounter: make(map[string]*list.Element),
+		lru:            list.New(),
 	}
 }
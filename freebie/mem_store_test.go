@@ -0,0 +1,111 @@
+package freebie
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMemStoreLRUEviction makes sure the least recently used key is evicted
+// once the maximum number of keys is reached.
+func TestMemStoreLRUEviction(t *testing.T) {
+	t.Parallel()
+
+	db := NewBoundedMemIPMaskStore(1, 2, 0)
+	ip1 := net.ParseIP("1.1.1.1")
+	ip2 := net.ParseIP("2.2.2.2")
+	ip3 := net.ParseIP("3.3.3.3")
+
+	for _, ip := range []net.IP{ip1, ip2} {
+		if _, err := db.TallyFreebie(nil, ip); err != nil {
+			t.Fatalf("unable to tally freebie: %v", err)
+		}
+	}
+
+	// Using up the third key should evict the first one, which resets its
+	// freebie count.
+	if _, err := db.TallyFreebie(nil, ip3); err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+	assertCanPass(t, db, ip1, true)
+	assertCanPass(t, db, ip2, false)
+	assertCanPass(t, db, ip3, false)
+}
+
+// TestMemStoreTTLExpiry makes sure keys that were idle for longer than the TTL
+// are expired.
+func TestMemStoreTTLExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	db := NewBoundedMemIPMaskStore(1, 0, time.Minute).(*memStore)
+	db.now = func() time.Time {
+		return now
+	}
+
+	ip := net.ParseIP("1.1.1.1")
+	if _, err := db.TallyFreebie(nil, ip); err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+	assertCanPass(t, db, ip, false)
+
+	now = now.Add(2 * time.Minute)
+	assertCanPass(t, db, ip, true)
+	if db.lru.Len() != 0 {
+		t.Fatalf("expected expired key to be removed")
+	}
+}
+
+// TestMemStoreKeys makes sure IPv4 addresses in the same /24 share their
+// freebies while IPv6 addresses are counted separately.
+func TestMemStoreKeys(t *testing.T) {
+	t.Parallel()
+
+	db := NewMemIPMaskStore(1)
+	tally := func(ip string) {
+		if _, err := db.TallyFreebie(nil, net.ParseIP(ip)); err != nil {
+			t.Fatalf("unable to tally freebie: %v", err)
+		}
+	}
+
+	tally("1.1.1.1")
+	assertCanPass(t, db, net.ParseIP("1.1.1.2"), false)
+	assertCanPass(t, db, net.ParseIP("1.1.2.1"), true)
+
+	tally("2001:db8::1")
+	assertCanPass(t, db, net.ParseIP("2001:db8::1"), false)
+	assertCanPass(t, db, net.ParseIP("2001:db8::2"), true)
+}
+
+func assertCanPass(t *testing.T, db DB, ip net.IP, expected bool) {
+	t.Helper()
+
+	ok, err := db.CanPass(nil, ip)
+	if err != nil {
+		t.Fatalf("unable to query freebie db: %v", err)
+	}
+	if ok != expected {
+		t.Fatalf("expected CanPass for %v to be %v, got %v", ip,
+			expected, ok)
+	}
+}
+
+// TestMemStoreRemaining makes sure tallying a freebie returns the number of
+// free requests the client has left.
+func TestMemStoreRemaining(t *testing.T) {
+	t.Parallel()
+
+	db := NewMemIPMaskStore(2)
+	ip := net.ParseIP("1.1.1.1")
+
+	for _, expected := range []Count{1, 0, 0} {
+		left, err := db.TallyFreebie(nil, ip)
+		if err != nil {
+			t.Fatalf("unable to tally freebie: %v", err)
+		}
+		if left != expected {
+			t.Fatalf("expected %d freebies left, got %d", expected,
+				left)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package aperture
 import (
 	"github.com/btcsuite/btclog"
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/proxy"
 	"github.com/lightninglabs/lndclient"
@@ -20,6 +21,7 @@ var (
 func init() {
 	setSubLogger(Subsystem, log, nil)
 	addSubLogger(auth.Subsystem, auth.UseLogger)
+	addSubLogger(freebie.Subsystem, freebie.UseLogger)
 	addSubLogger(lsat.Subsystem, lsat.UseLogger)
 	addSubLogger(proxy.Subsystem, proxy.UseLogger)
 	addSubLogger("LNDC", lndclient.UseLogger)
@@ -92,6 +92,20 @@ func HasCaveat(m *macaroon.Macaroon, cond string) (string, bool) {
 	return *value, true
 }
 
+// DecodeCaveats returns the first-party caveats of the given macaroon in their
+// order. Caveats that can't be decoded are skipped.
+func DecodeCaveats(m *macaroon.Macaroon) []Caveat {
+	var caveats []Caveat
+	for _, rawCaveat := range m.Caveats() {
+		caveat, err := DecodeCaveat(string(rawCaveat.Id))
+		if err != nil {
+			continue
+		}
+		caveats = append(caveats, caveat)
+	}
+	return caveats
+}
+
 // VerifyCaveats determines whether every relevant caveat of an LSAT holds true.
 // A caveat is considered relevant if a satisfier is provided for it, which is
 // what we'll use as their evaluation.
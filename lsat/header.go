@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/lightningnetwork/lnd/lntypes"
 	"gopkg.in/macaroon.v2"
@@ -29,6 +30,15 @@ const (
 var (
 	authRegex  = regexp.MustCompile("LSAT (.*?):([a-f0-9]{64})")
 	authFormat = "LSAT %s:%s"
+
+	// ErrNoAuthHeader is returned if a request doesn't contain any of the
+	// header fields an LSAT can be sent in.
+	ErrNoAuthHeader = errors.New("no auth header provided")
+
+	// ErrMalformedHeader is returned if a request contains an LSAT that
+	// can't be decoded. Unlike a missing LSAT, this usually indicates a
+	// bug in the client.
+	ErrMalformedHeader = errors.New("malformed auth header")
 )
 
 // FromHeader tries to extract authentication information from HTTP headers.
@@ -38,46 +48,54 @@ var (
 //    2.      Grpc-Metadata-Macaroon: <macHex>
 //    3.      Macaroon: <macHex>
 // If only the macaroon is sent in header 2 or three then it is expected to have
-// a caveat with the preimage attached to it.
+// a caveat with the preimage attached to it. An Authorization header with a
+// scheme other than LSAT is ignored. ErrNoAuthHeader is returned if no LSAT is
+// present at all, all errors of LSATs that can't be decoded wrap
+// ErrMalformedHeader.
 func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, error) {
 	var authHeader string
 
 	switch {
 	// Header field 1 contains the macaroon and the preimage as distinct
 	// values separated by a colon.
-	case header.Get(HeaderAuthorization) != "":
+	case strings.HasPrefix(header.Get(HeaderAuthorization), "LSAT "):
 		// Parse the content of the header field and check that it is in
 		// the correct format.
 		authHeader = header.Get(HeaderAuthorization)
 		log.Debugf("Trying to authorize with header value [%s].",
 			authHeader)
 		if !authRegex.MatchString(authHeader) {
-			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
-				"auth header format: %s", authHeader)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+				"invalid format: %s", ErrMalformedHeader,
+				authHeader)
 		}
 		matches := authRegex.FindStringSubmatch(authHeader)
 		if len(matches) != 3 {
-			return nil, lntypes.Preimage{}, fmt.Errorf("invalid "+
-				"auth header format: %s", authHeader)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+				"invalid format: %s", ErrMalformedHeader,
+				authHeader)
 		}
 
 		// Decode the content of the two parts of the header value.
 		macBase64, preimageHex := matches[1], matches[2]
 		macBytes, err := base64.StdEncoding.DecodeString(macBase64)
 		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("base64 "+
-				"decode of macaroon failed: %v", err)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+				"base64 decode of macaroon failed: %v",
+				ErrMalformedHeader, err)
 		}
 		mac := &macaroon.Macaroon{}
 		err = mac.UnmarshalBinary(macBytes)
 		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("unable to "+
-				"unmarshal macaroon: %v", err)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+				"unable to unmarshal macaroon: %v",
+				ErrMalformedHeader, err)
 		}
 		preimage, err := lntypes.MakePreimageFromStr(preimageHex)
 		if err != nil {
-			return nil, lntypes.Preimage{}, fmt.Errorf("hex "+
-				"decode of preimage failed: %v", err)
+			return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+				"hex decode of preimage failed: %v",
+				ErrMalformedHeader, err)
 		}
 
 		// All done, we don't need to extract anything from the
@@ -93,32 +111,34 @@ func FromHeader(header *http.Header) (*macaroon.Macaroon, lntypes.Preimage, erro
 		authHeader = header.Get(HeaderMacaroon)
 
 	default:
-		return nil, lntypes.Preimage{}, fmt.Errorf("no auth header " +
-			"provided")
+		return nil, lntypes.Preimage{}, ErrNoAuthHeader
 	}
 
 	// For case 2 and 3, we need to actually unmarshal the macaroon to
 	// extract the preimage.
 	macBytes, err := hex.DecodeString(authHeader)
 	if err != nil {
-		return nil, lntypes.Preimage{}, fmt.Errorf("hex decode of "+
-			"macaroon failed: %v", err)
+		return nil, lntypes.Preimage{}, fmt.Errorf("%w: hex "+
+			"decode of macaroon failed: %v", ErrMalformedHeader,
+			err)
 	}
 	mac := &macaroon.Macaroon{}
 	err = mac.UnmarshalBinary(macBytes)
 	if err != nil {
-		return nil, lntypes.Preimage{}, fmt.Errorf("unable to "+
-			"unmarshal macaroon: %v", err)
+		return nil, lntypes.Preimage{}, fmt.Errorf("%w: "+
+			"unable to unmarshal macaroon: %v", ErrMalformedHeader,
+			err)
 	}
 	preimageHex, ok := HasCaveat(mac, PreimageKey)
 	if !ok {
-		return nil, lntypes.Preimage{}, errors.New("preimage caveat " +
-			"not found")
+		return nil, lntypes.Preimage{}, fmt.Errorf("%w: preimage "+
+			"caveat not found", ErrMalformedHeader)
 	}
 	preimage, err := lntypes.MakePreimageFromStr(preimageHex)
 	if err != nil {
-		return nil, lntypes.Preimage{}, fmt.Errorf("hex decode of "+
-			"preimage failed: %v", err)
+		return nil, lntypes.Preimage{}, fmt.Errorf("%w: hex "+
+			"decode of preimage failed: %v", ErrMalformedHeader,
+			err)
 	}
 
 	return mac, preimage, nil
@@ -0,0 +1,73 @@
+package lsat
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+)
+
+// TestFromHeaderErrors makes sure a missing LSAT can be told apart from a
+// malformed one.
+func TestFromHeaderErrors(t *testing.T) {
+	t.Parallel()
+
+	validHeader := http.Header{}
+	err := SetHeader(&validHeader, testMacaroon, lntypes.Preimage{1})
+	if err != nil {
+		t.Fatalf("unable to set header: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		err    error
+	}{
+		{
+			name:   "valid LSAT",
+			header: validHeader,
+			err:    nil,
+		},
+		{
+			name:   "no header",
+			header: http.Header{},
+			err:    ErrNoAuthHeader,
+		},
+		{
+			name: "other authorization scheme",
+			header: http.Header{
+				HeaderAuthorization: []string{"Basic Zm9vOmJhcg=="},
+			},
+			err: ErrNoAuthHeader,
+		},
+		{
+			name: "invalid authorization format",
+			header: http.Header{
+				HeaderAuthorization: []string{"LSAT garbage"},
+			},
+			err: ErrMalformedHeader,
+		},
+		{
+			name: "invalid macaroon encoding",
+			header: http.Header{
+				HeaderMacaroon: []string{"not hex"},
+			},
+			err: ErrMalformedHeader,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		success := t.Run(test.name, func(t *testing.T) {
+			_, _, err := FromHeader(&test.header)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected err \"%v\", got \"%v\"",
+					test.err, err)
+			}
+		})
+		if !success {
+			return
+		}
+	}
+}
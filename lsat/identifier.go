@@ -1,6 +1,7 @@
 package lsat
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -8,6 +9,7 @@ import (
 	"io"
 
 	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
 )
 
 const (
@@ -31,6 +33,11 @@ var (
 	// ErrUnknownVersion is an error returned when attempting to decode an
 	// LSAT identifier with an unknown version.
 	ErrUnknownVersion = errors.New("unknown LSAT version")
+
+	// ErrInvalidPreimage is an error returned when the preimage presented
+	// with an LSAT doesn't hash to the payment hash committed to in its
+	// identifier.
+	ErrInvalidPreimage = errors.New("preimage doesn't match payment hash")
 )
 
 // TokenID is the type that stores the token identifier of an LSAT token.
@@ -126,3 +133,18 @@ func DecodeIdentifier(r io.Reader) (*Identifier, error) {
 		return nil, fmt.Errorf("%w: %v", ErrUnknownVersion, version)
 	}
 }
+
+// VerifyPreimage checks that the given preimage hashes to the payment hash
+// committed to in the identifier of the macaroon. This proves that the invoice
+// of the LSAT was paid, without checking anything else about the token.
+func VerifyPreimage(mac *macaroon.Macaroon, preimage lntypes.Preimage) error {
+	id, err := DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return fmt.Errorf("unable to decode identifier: %v", err)
+	}
+	if preimage.Hash() != id.PaymentHash {
+		return fmt.Errorf("%w: preimage %v, payment hash %v",
+			ErrInvalidPreimage, preimage, id.PaymentHash)
+	}
+	return nil
+}
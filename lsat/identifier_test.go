@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
 )
 
 var (
@@ -68,3 +69,35 @@ func TestIdentifierSerialization(t *testing.T) {
 		}
 	}
 }
+
+// TestVerifyPreimage ensures a preimage is only accepted if it hashes to the
+// payment hash in the identifier of the macaroon.
+func TestVerifyPreimage(t *testing.T) {
+	t.Parallel()
+
+	preimage := lntypes.Preimage{1, 2, 3}
+	id := &Identifier{
+		Version:     LatestVersion,
+		PaymentHash: preimage.Hash(),
+		TokenID:     testTokenID,
+	}
+	var buf bytes.Buffer
+	if err := EncodeIdentifier(&buf, id); err != nil {
+		t.Fatalf("unable to encode identifier: %v", err)
+	}
+	mac, err := macaroon.New(
+		nil, buf.Bytes(), "", macaroon.LatestVersion,
+	)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+
+	if err := VerifyPreimage(mac, preimage); err != nil {
+		t.Fatalf("expected valid preimage, got %v", err)
+	}
+
+	err = VerifyPreimage(mac, lntypes.Preimage{4, 5, 6})
+	if !errors.Is(err, ErrInvalidPreimage) {
+		t.Fatalf("expected invalid preimage error, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package lsat
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -115,3 +116,45 @@ func NewCapabilitiesSatisfier(service string, targetCapability string) Satisfier
 		},
 	}
 }
+
+// NewPriceSatisfier implements a satisfier to determine whether an LSAT covers
+// the given price in satoshis of a request to the service.
+func NewPriceSatisfier(service string, targetPrice int64) Satisfier {
+	return Satisfier{
+		Condition: service + CondPriceSuffix,
+		SatisfyPrevious: func(prev, cur Caveat) error {
+			prevPrice, err := strconv.ParseInt(prev.Value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid price %v: %v",
+					prev.Value, err)
+			}
+			curPrice, err := strconv.ParseInt(cur.Value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid price %v: %v",
+					cur.Value, err)
+			}
+
+			// The caveat should not allow more expensive requests
+			// than previously allowed.
+			if curPrice > prevPrice {
+				return fmt.Errorf("price %d not previously "+
+					"allowed", curPrice)
+			}
+
+			return nil
+		},
+		SatisfyFinal: func(c Caveat) error {
+			price, err := strconv.ParseInt(c.Value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid price %v: %v",
+					c.Value, err)
+			}
+			if targetPrice > price {
+				return fmt.Errorf("target price %d exceeds "+
+					"the price %d the LSAT was paid for",
+					targetPrice, price)
+			}
+			return nil
+		},
+	}
+}
@@ -15,6 +15,11 @@ const (
 	// capabilities caveat. For example, the condition of a capabilities
 	// caveat for a service named `loop` would be `loop_capabilities`.
 	CondCapabilitiesSuffix = "_capabilities"
+
+	// CondPriceSuffix is the condition suffix used for a service's price
+	// caveat. For example, the condition of a price caveat for a service
+	// named `loop` would be `loop_price`.
+	CondPriceSuffix = "_price"
 )
 
 var (
@@ -129,3 +134,13 @@ func NewCapabilitiesCaveat(serviceName string, capabilities string) Caveat {
 		Value:     capabilities,
 	}
 }
+
+// NewPriceCaveat creates a new price caveat for the given service. It limits
+// the LSAT to requests whose price is at most the given one in satoshis, so a
+// token paid for a cheap request can't be used for an expensive one.
+func NewPriceCaveat(serviceName string, price int64) Caveat {
+	return Caveat{
+		Condition: serviceName + CondPriceSuffix,
+		Value:     strconv.FormatInt(price, 10),
+	}
+}
@@ -81,3 +81,77 @@ func TestServicesCaveatSerialization(t *testing.T) {
 		}
 	}
 }
+
+// TestPriceSatisfier ensures that an LSAT with price caveats is only valid for
+// requests that don't cost more than it was paid for, and that the price can
+// only be lowered by further caveats.
+func TestPriceSatisfier(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		caveats []Caveat
+		price   int64
+		valid   bool
+	}{
+		{
+			name:    "cheaper request",
+			caveats: []Caveat{NewPriceCaveat("a", 10)},
+			price:   5,
+			valid:   true,
+		},
+		{
+			name:    "same price",
+			caveats: []Caveat{NewPriceCaveat("a", 10)},
+			price:   10,
+			valid:   true,
+		},
+		{
+			name:    "more expensive request",
+			caveats: []Caveat{NewPriceCaveat("a", 10)},
+			price:   11,
+			valid:   false,
+		},
+		{
+			name: "price raised by later caveat",
+			caveats: []Caveat{
+				NewPriceCaveat("a", 10),
+				NewPriceCaveat("a", 100),
+			},
+			price: 50,
+			valid: false,
+		},
+		{
+			name: "price lowered by later caveat",
+			caveats: []Caveat{
+				NewPriceCaveat("a", 10),
+				NewPriceCaveat("a", 5),
+			},
+			price: 8,
+			valid: false,
+		},
+		{
+			name:    "other service",
+			caveats: []Caveat{NewPriceCaveat("b", 1)},
+			price:   100,
+			valid:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		success := t.Run(test.name, func(t *testing.T) {
+			satisfier := NewPriceSatisfier("a", test.price)
+			err := VerifyCaveats(test.caveats, satisfier)
+			if test.valid && err != nil {
+				t.Fatalf("expected valid LSAT, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("expected invalid LSAT")
+			}
+		})
+		if !success {
+			return
+		}
+	}
+}
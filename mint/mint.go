@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightningnetwork/lnd/lntypes"
@@ -26,8 +27,26 @@ type Challenger interface {
 	// NewChallenge returns a new challenge in the form of a Lightning
 	// payment request. The payment hash is also returned as a convenience
 	// to avoid having to decode the payment request in order to retrieve
-	// its payment hash.
-	NewChallenge(price int64) (string, lntypes.Hash, error)
+	// its payment hash. The optional parameters customize the payment
+	// request.
+	NewChallenge(price int64, params *ChallengeParams) (string,
+		lntypes.Hash, error)
+}
+
+// ChallengeParams are optional parameters of the challenge that is created
+// for a new LSAT.
+type ChallengeParams struct {
+	// Memo is the description of the invoice of the challenge. If empty,
+	// the default of the challenger is used.
+	Memo string
+
+	// Expiry is the duration the invoice of the challenge can be paid
+	// in. If zero, the default of the challenger is used.
+	Expiry time.Duration
+
+	// Caveats are additional restrictions that are added to the LSAT of
+	// the challenge, after the ones of its services.
+	Caveats []lsat.Caveat
 }
 
 // SecretStore is the store responsible for storing LSAT secrets. These secrets
@@ -89,8 +108,9 @@ func New(cfg *Config) *Mint {
 	return &Mint{cfg: *cfg}
 }
 
-// MintLSAT mints a new LSAT for the target services.
-func (m *Mint) MintLSAT(ctx context.Context,
+// MintLSAT mints a new LSAT for the target services. The optional challenge
+// parameters customize the payment request of the LSAT.
+func (m *Mint) MintLSAT(ctx context.Context, params *ChallengeParams,
 	services ...lsat.Service) (*macaroon.Macaroon, string, error) {
 
 	// Let the LSAT value as the price of the most expensive of the
@@ -99,7 +119,9 @@ func (m *Mint) MintLSAT(ctx context.Context,
 
 	// We'll start by retrieving a new challenge in the form of a Lightning
 	// payment request to present the requester of the LSAT with.
-	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(price)
+	paymentRequest, paymentHash, err := m.cfg.Challenger.NewChallenge(
+		price, params,
+	)
 	if err != nil {
 		return nil, "", err
 	}
@@ -138,6 +160,9 @@ func (m *Mint) MintLSAT(ctx context.Context,
 			return nil, "", err
 		}
 	}
+	if params != nil {
+		caveats = append(caveats, params.Caveats...)
+	}
 	if err := lsat.AddFirstPartyCaveats(mac, caveats...); err != nil {
 		// Attempt to revoke the secret to save space.
 		_ = m.cfg.Secrets.RevokeSecret(ctx, idHash)
@@ -30,7 +30,7 @@ func TestBasicLSAT(t *testing.T) {
 	})
 
 	// Mint a basic LSAT which is only able to access the given service.
-	macaroon, _, err := mint.MintLSAT(ctx, testService)
+	macaroon, _, err := mint.MintLSAT(ctx, nil, testService)
 	if err != nil {
 		t.Fatalf("unable to mint LSAT: %v", err)
 	}
@@ -66,7 +66,7 @@ func TestAdminLSAT(t *testing.T) {
 	})
 
 	// Mint an admin LSAT by not including any services.
-	macaroon, _, err := mint.MintLSAT(ctx)
+	macaroon, _, err := mint.MintLSAT(ctx, nil)
 	if err != nil {
 		t.Fatalf("unable to mint LSAT: %v", err)
 	}
@@ -95,7 +95,7 @@ func TestRevokedLSAT(t *testing.T) {
 	})
 
 	// Mint an LSAT and verify it.
-	lsat, _, err := mint.MintLSAT(ctx)
+	lsat, _, err := mint.MintLSAT(ctx, nil)
 	if err != nil {
 		t.Fatalf("unable to mint LSAT: %v", err)
 	}
@@ -131,7 +131,7 @@ func TestTamperedLSAT(t *testing.T) {
 	})
 
 	// Mint a new LSAT and verify it is valid.
-	mac, _, err := mint.MintLSAT(ctx, testService)
+	mac, _, err := mint.MintLSAT(ctx, nil, testService)
 	if err != nil {
 		t.Fatalf("unable to mint LSAT: %v", err)
 	}
@@ -182,7 +182,7 @@ func TestDemotedServicesLSAT(t *testing.T) {
 
 	// Mint an LSAT that is able to access two services, one of which will
 	// be denied later on.
-	mac, _, err := mint.MintLSAT(ctx, testService, unauthorizedService)
+	mac, _, err := mint.MintLSAT(ctx, nil, testService, unauthorizedService)
 	if err != nil {
 		t.Fatalf("unable to mint LSAT: %v", err)
 	}
@@ -225,3 +225,32 @@ func TestDemotedServicesLSAT(t *testing.T) {
 		t.Fatal("expected macaroon to be invalid")
 	}
 }
+
+// TestChallengeCaveatsLSAT ensures that the caveats of the challenge
+// parameters are added to the minted LSAT.
+func TestChallengeCaveatsLSAT(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mint := New(&Config{
+		Secrets:        newMockSecretStore(),
+		Challenger:     newMockChallenger(),
+		ServiceLimiter: newMockServiceLimiter(),
+	})
+
+	params := &ChallengeParams{
+		Caveats: []lsat.Caveat{
+			lsat.NewPriceCaveat(testService.Name, 10),
+		},
+	}
+	mac, _, err := mint.MintLSAT(ctx, params, testService)
+	if err != nil {
+		t.Fatalf("unable to mint LSAT: %v", err)
+	}
+
+	cond := testService.Name + lsat.CondPriceSuffix
+	value, ok := lsat.HasCaveat(mac, cond)
+	if !ok || value != "10" {
+		t.Fatalf("expected price caveat, got %q", value)
+	}
+}
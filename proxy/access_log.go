@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// accessLogPattern is the pattern of an entry in the access log file.
+	// It follows the combined log format of the Apache web server.
+	// An example entry would look like this:
+	// 66.249.69.89 - - [09/Nov/2019:04:07:55 +0000]
+	// "GET /availability/v1/btc.json HTTP/1.1" 200 "" "Mozilla/5.0 ..."
+	accessLogPattern = "%s - - [%s] \"%s %s %s\" %d \"%s\" \"%s\""
+
+	// accessLogAccountPattern is the pattern of the account that is
+	// appended to an access log entry if requests are tagged with
+	// accounts.
+	accessLogAccountPattern = " \"%s\""
+
+	// accessLogTimeFormat is the format of the time in an access log entry.
+	accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// RotatingFile is a file writer that rotates the file once it reaches a
+// maximum size or age. The rotated files are renamed to <path>.1, <path>.2 and
+// so on, with <path>.1 being the most recent one. Only a limited number of
+// rotated files is kept. It is safe for concurrent use.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	file    *os.File
+	size    int64
+	created time.Time
+	mtx     sync.Mutex
+}
+
+// A compile-time constraint to ensure RotatingFile implements io.WriteCloser.
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+// NewRotatingFile opens the file at the given path for appending. The file is
+// rotated before a write would make it exceed maxSize bytes or once it is older
+// than maxAge. At most maxFiles rotated files are kept. A value of zero for
+// maxSize or maxAge disables the respective rotation.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration,
+	maxFiles int) (*RotatingFile, error) {
+
+	if maxSize < 0 || maxAge < 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("rotation limits cannot be negative")
+	}
+
+	r := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+		now:      time.Now,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file at the configured path for appending.
+//
+// NOTE: The mutex must be held when calling this method.
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(
+		r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600,
+	)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	// We can't reliably find out when an existing file was created, so
+	// its age is counted from the moment we opened it.
+	r.file = file
+	r.size = info.Size()
+	r.created = r.now()
+	return nil
+}
+
+// rotate closes the current file, shifts all rotated files by one, deleting
+// the oldest one if the maximum number is reached, and opens a new file.
+//
+// NOTE: The mutex must be held when calling this method.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	err := os.Remove(r.rotatedPath(r.maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxFiles - 1; i >= 0; i-- {
+		err := os.Rename(r.rotatedPath(i), r.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return r.open()
+}
+
+// rotatedPath returns the path of the rotated file with the given index. The
+// index zero is the current file.
+func (r *RotatingFile) rotatedPath(index int) string {
+	if index == 0 {
+		return r.path
+	}
+	return fmt.Sprintf("%s.%d", r.path, index)
+}
+
+// Write writes the given bytes to the file, rotating it first if needed.
+//
+// NOTE: This is part of the io.Writer interface.
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	tooBig := r.maxSize > 0 && r.size > 0 &&
+		r.size+int64(len(b)) > r.maxSize
+	tooOld := r.maxAge > 0 && r.now().Sub(r.created) >= r.maxAge
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("unable to rotate %s: %v", r.path,
+				err)
+		}
+	}
+
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+//
+// NOTE: This is part of the io.Closer interface.
+func (r *RotatingFile) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// writeAccessLog writes an entry for the given request to the access log. The
+// target is the service the request was matched to, if any, and determines
+// which headers are redacted.
+func (p *Proxy) writeAccessLog(r *http.Request, target *Service,
+	status int) {
+
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = host
+	}
+
+	entry := fmt.Sprintf(
+		accessLogPattern, remoteIP,
+		time.Now().Format(accessLogTimeFormat), r.Method,
+		p.loggedRequestURI(r, target), r.Proto, status,
+		loggedHeader(target, r, "Referer"),
+		loggedHeader(target, r, "User-Agent"),
+	)
+	if p.accountCaveat != "" {
+		account := requestAccount(r)
+		if account == "" {
+			account = anonymousAccount
+		}
+		entry += fmt.Sprintf(accessLogAccountPattern, account)
+	}
+
+	_, err := io.WriteString(p.accessLog, entry+"\n")
+	if err != nil {
+		log.Errorf("Unable to write access log: %v", err)
+	}
+}
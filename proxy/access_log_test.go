@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRotatingFile makes sure the file is rotated by size and age and that
+// only the configured number of rotated files is kept.
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "aperture-access-log")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	r, err := NewRotatingFile(path, 10, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("unable to create rotating file: %v", err)
+	}
+	defer r.Close()
+
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	r.created = now
+
+	// Each write that would exceed the maximum size rotates the file.
+	for _, entry := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := r.Write([]byte(entry)); err != nil {
+			t.Fatalf("unable to write: %v", err)
+		}
+	}
+	assertFileContent(t, path, "third\n")
+	assertFileContent(t, path+".1", "second\n")
+	assertFileContent(t, path+".2", "first\n")
+
+	// A small write still rotates the file once it's too old, which
+	// removes the oldest rotated file.
+	now = now.Add(time.Hour)
+	if _, err := r.Write([]byte("4\n")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	assertFileContent(t, path, "4\n")
+	assertFileContent(t, path+".1", "third\n")
+	assertFileContent(t, path+".2", "second\n")
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected oldest file to be removed, got %v", err)
+	}
+}
+
+func assertFileContent(t *testing.T, path, expected string) {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", path, err)
+	}
+	if string(content) != expected {
+		t.Fatalf("expected %s to contain %q, got %q", path, expected,
+			content)
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AccessWindow is a time window on certain days of the week during which a
+// service can be accessed. The times are wall clock times in the timezone of
+// the schedule, just like those of a PriceRule.
+type AccessWindow struct {
+	// Days is the list of days the window applies to, for example
+	// ["mon", "fri"]. If empty, the window applies to every day.
+	Days []string `long:"days" description:"Days of the week the window applies to, every day if empty"`
+
+	// Start is the time of day in the format HH:MM the window opens at.
+	Start string `long:"start" description:"Time of day in the format HH:MM the window opens at"`
+
+	// End is the time of day in the format HH:MM the window closes at. If
+	// it's before the start, the window extends past midnight into the
+	// next day. If it's equal to the start, the window spans all day.
+	End string `long:"end" description:"Time of day in the format HH:MM the window closes at"`
+
+	window *dailyWindow
+}
+
+// AccessScheduleConfig restricts the access to a service to certain times of
+// the day, for example to business hours or around maintenance windows.
+type AccessScheduleConfig struct {
+	// Timezone is the name of the timezone the times of the windows are
+	// in, for example "Europe/Zurich". Defaults to UTC.
+	Timezone string `long:"timezone" description:"Timezone of the access windows"`
+
+	// Windows are the time windows the service can be accessed in.
+	// Requests outside of all of them are rejected.
+	Windows []*AccessWindow `long:"windows" description:"Time windows the service can be accessed in"`
+
+	// Status is the HTTP status requests outside of the windows are
+	// rejected with. Defaults to 403.
+	Status int `long:"status" description:"Status of requests outside of the access windows, 403 if not set"`
+
+	location *time.Location
+}
+
+// compile parses the timezone and windows of the schedule.
+func (c *AccessScheduleConfig) compile() error {
+	if len(c.Windows) == 0 {
+		return fmt.Errorf("access schedule needs at least one window")
+	}
+
+	switch {
+	case c.Status == 0:
+		c.Status = http.StatusForbidden
+
+	case c.Status < 400 || c.Status > 599:
+		return fmt.Errorf("invalid status %d, must be an error status",
+			c.Status)
+	}
+
+	c.location = time.UTC
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %v", err)
+		}
+		c.location = loc
+	}
+
+	for _, w := range c.Windows {
+		window, err := parseDailyWindow(w.Days, w.Start, w.End)
+		if err != nil {
+			return fmt.Errorf("invalid access window: %v", err)
+		}
+		w.window = window
+	}
+
+	return nil
+}
+
+// open returns true if the given time lies in one of the windows.
+func (c *AccessScheduleConfig) open(now time.Time) bool {
+	local := now.In(c.location)
+	for _, w := range c.Windows {
+		if w.window.matches(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpening returns the earliest time after the given one a window opens
+// at. A window that opens in the hour that is skipped when the clocks are set
+// forward doesn't open on that day. The zero time is returned if no window
+// opens within the next week.
+func (c *AccessScheduleConfig) nextOpening(now time.Time) time.Time {
+	local := now.In(c.location)
+	year, month, day := local.Date()
+
+	var next time.Time
+	for offset := 0; offset <= 7; offset++ {
+		for _, w := range c.Windows {
+			// A window that spans all day opens at midnight.
+			start := w.window.start
+			if w.window.start == w.window.end {
+				start = 0
+			}
+
+			opening := time.Date(
+				year, month, day+offset, start/60, start%60, 0,
+				0, c.location,
+			)
+			if !opening.After(now) ||
+				!w.window.appliesOn(opening.Weekday()) ||
+				!w.window.matches(opening) {
+
+				continue
+			}
+			if next.IsZero() || opening.Before(next) {
+				next = opening
+			}
+		}
+
+		// Later days can't have an earlier opening.
+		if !next.IsZero() {
+			return next
+		}
+	}
+
+	return next
+}
+
+// checkAccessSchedule returns true if the service can be accessed at the given
+// time. Otherwise the request is answered with the status of the schedule, the
+// time access resumes at in the message and a Retry-After header.
+func (p *Proxy) checkAccessSchedule(w http.ResponseWriter, r *http.Request,
+	s *Service, now time.Time) bool {
+
+	schedule := s.AccessSchedule
+	if schedule == nil || schedule.open(now) {
+		return true
+	}
+
+	message := "service not available at this time"
+	if next := schedule.nextOpening(now); !next.IsZero() {
+		message = fmt.Sprintf("service not available until %s",
+			next.Format(time.RFC3339))
+
+		seconds := math.Ceil(next.Sub(now).Seconds())
+		w.Header().Set(
+			"Retry-After", strconv.FormatInt(int64(seconds), 10),
+		)
+	}
+
+	p.sendDirectResponse(w, r, schedule.Status, message)
+	return false
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestAccessSchedule makes sure services can only be accessed during their
+// access windows and clients learn when access resumes.
+func TestAccessSchedule(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+
+	schedule := &AccessScheduleConfig{
+		Timezone: "Europe/Zurich",
+		Windows: []*AccessWindow{{
+			Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+			Start: "09:00",
+			End:   "17:00",
+		}, {
+			Days:  []string{"sat"},
+			Start: "22:00",
+			End:   "02:00",
+		}},
+	}
+	if err := schedule.compile(); err != nil {
+		t.Fatalf("unable to compile schedule: %v", err)
+	}
+	if schedule.Status != http.StatusForbidden {
+		t.Fatalf("expected default status, got %d", schedule.Status)
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		open bool
+		next time.Time
+	}{{
+		name: "business hours",
+		now:  time.Date(2021, 3, 24, 10, 0, 0, 0, loc),
+		open: true,
+	}, {
+		name: "end is exclusive",
+		now:  time.Date(2021, 3, 24, 17, 0, 0, 0, loc),
+		next: time.Date(2021, 3, 25, 9, 0, 0, 0, loc),
+	}, {
+		name: "friday evening",
+		now:  time.Date(2021, 3, 26, 18, 0, 0, 0, loc),
+		next: time.Date(2021, 3, 27, 22, 0, 0, 0, loc),
+	}, {
+		name: "past midnight",
+		now:  time.Date(2021, 3, 28, 1, 30, 0, 0, loc),
+		open: true,
+	}, {
+		// The clocks are set forward at 02:00 on that sunday.
+		name: "across DST",
+		now:  time.Date(2021, 3, 28, 3, 0, 0, 0, loc),
+		next: time.Date(2021, 3, 29, 9, 0, 0, 0, loc),
+	}}
+	for _, tc := range tests {
+		if schedule.open(tc.now) != tc.open {
+			t.Fatalf("%s: expected open=%v", tc.name, tc.open)
+		}
+		if tc.open {
+			continue
+		}
+		next := schedule.nextOpening(tc.now)
+		if !next.Equal(tc.next) {
+			t.Fatalf("%s: expected next opening %v, got %v",
+				tc.name, tc.next, next)
+		}
+	}
+
+	// A window two days from now is never open during the test.
+	day := (time.Now().UTC().Weekday() + 2) % 7
+	services := []*Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:1",
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		AccessSchedule: &AccessScheduleConfig{
+			Status: http.StatusServiceUnavailable,
+			Windows: []*AccessWindow{{
+				Days: []string{
+					strings.ToLower(day.String()[:3]),
+				},
+				Start: "00:00",
+				End:   "00:00",
+			}},
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable ||
+		rec.Header().Get("Retry-After") == "" {
+
+		t.Fatalf("expected rejection with retry after, got %d %v",
+			rec.Code, rec.Header())
+	}
+
+	invalid := &AccessScheduleConfig{
+		Status:  http.StatusOK,
+		Windows: []*AccessWindow{{Start: "09:00", End: "17:00"}},
+	}
+	if err := invalid.compile(); err == nil {
+		t.Fatalf("expected error for non-error status")
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// DefaultAccountHeader is the default header the account of a request
+	// is sent to the backend in.
+	DefaultAccountHeader = "X-Aperture-Account"
+
+	// anonymousAccount is the account of requests without a verified
+	// token that carries an account caveat.
+	anonymousAccount = "anonymous"
+)
+
+// accountCtxKey is the key under which the account of a request is stored in
+// its context.
+type accountCtxKey struct{}
+
+// WithAccountTag makes the proxy tag each request with the billing account
+// the token of the request was issued to, which is the value of the caveat
+// with the given condition. Requests without a verified token or without the
+// caveat are tagged as "anonymous". The account is written to the access log,
+// added to usage reports and sent to the backend in the given header, which
+// clients can't set themselves. If the header is empty, the default header is
+// used.
+func WithAccountTag(caveat, header string) Option {
+	return func(p *Proxy) error {
+		if caveat == "" {
+			return fmt.Errorf("account tag needs a caveat")
+		}
+		if header == "" {
+			header = DefaultAccountHeader
+		}
+		p.accountCaveat = caveat
+		p.accountHeader = header
+		return nil
+	}
+}
+
+// withAccount adds the account of the request to its context. Only verified
+// tokens are trusted to name an account.
+func (p *Proxy) withAccount(ctx context.Context, r *http.Request,
+	authenticated bool) context.Context {
+
+	if p.accountCaveat == "" {
+		return ctx
+	}
+
+	account := anonymousAccount
+	if authenticated {
+		mac, _, err := lsat.FromHeader(&r.Header)
+		if err == nil && mac != nil {
+			value, ok := lsat.HasCaveat(mac, p.accountCaveat)
+			if ok && value != "" && validHeaderFieldValue(value) {
+				account = value
+			}
+		}
+	}
+
+	return context.WithValue(ctx, accountCtxKey{}, account)
+}
+
+// requestAccount returns the account of the request or an empty string if
+// requests aren't tagged with accounts or the request wasn't authenticated
+// yet.
+func requestAccount(r *http.Request) string {
+	account, _ := r.Context().Value(accountCtxKey{}).(string)
+	return account
+}
+
+// setAccountHeader sends the account of the request to the backend. The header
+// is always overwritten, so clients can't pretend to be another account.
+func (p *Proxy) setAccountHeader(req *http.Request) {
+	if p.accountCaveat == "" {
+		return
+	}
+
+	account := requestAccount(req)
+	if account == "" {
+		account = anonymousAccount
+	}
+	req.Header.Set(p.accountHeader, account)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestAccountTag makes sure requests are tagged with the account of their
+// verified token and clients can't spoof the account header.
+func TestAccountTag(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{}
+	if err := WithAccountTag("account", "")(p); err != nil {
+		t.Fatalf("unable to apply option: %v", err)
+	}
+
+	mac, err := macaroon.New(
+		[]byte("key"), []byte("id"), "loc", macaroon.LatestVersion,
+	)
+	if err != nil {
+		t.Fatalf("unable to create macaroon: %v", err)
+	}
+	err = lsat.AddFirstPartyCaveats(mac, lsat.NewCaveat("account", "acme"))
+	if err != nil {
+		t.Fatalf("unable to add caveat: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		token         bool
+		authenticated bool
+		account       string
+	}{{
+		name:          "verified token",
+		token:         true,
+		authenticated: true,
+		account:       "acme",
+	}, {
+		name:    "unverified token",
+		token:   true,
+		account: anonymousAccount,
+	}, {
+		name:          "no token",
+		authenticated: true,
+		account:       anonymousAccount,
+	}}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(DefaultAccountHeader, "spoofed")
+		if tc.token {
+			err := lsat.SetHeader(
+				&req.Header, mac, lntypes.Preimage{},
+			)
+			if err != nil {
+				t.Fatalf("unable to set header: %v", err)
+			}
+		}
+
+		req = req.WithContext(
+			p.withAccount(req.Context(), req, tc.authenticated),
+		)
+		if account := requestAccount(req); account != tc.account {
+			t.Fatalf("%s: expected account %s, got %s", tc.name,
+				tc.account, account)
+		}
+
+		p.setAccountHeader(req)
+		if req.Header.Get(DefaultAccountHeader) != tc.account {
+			t.Fatalf("%s: unexpected account header %s", tc.name,
+				req.Header.Get(DefaultAccountHeader))
+		}
+	}
+
+	// Without the option, requests aren't tagged at all.
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext((&Proxy{}).withAccount(req.Context(), req, true))
+	if requestAccount(req) != "" {
+		t.Fatalf("expected untagged request")
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// validateAuthSettings checks that the auth level of the service is valid and
+// consistent with its price and freebie settings. An auth level that isn't
+// "on", "off" or "freebie X" with a non-negative number X is rejected, since it
+// would either fail on the first request or leave the service open. The
+// following combinations are accepted but logged as a warning because some of
+// the settings have no effect:
+//   - "freebie 0", which behaves like "on".
+//   - freebie settings with an auth level other than "freebie X".
+//   - prices, price schedules, payment options, an authenticator or the
+//     observe-only mode with the auth level "off", since nothing is ever
+//     charged.
+func (s *Service) validateAuthSettings() error {
+	level := strings.ToLower(string(s.Auth))
+	switch {
+	case s.Auth.IsOn(), s.Auth.IsOff():
+
+	case s.Auth.IsFreebie():
+		parts := strings.Split(level, " ")
+		if len(parts) != 2 {
+			return fmt.Errorf("auth level %s must be 'freebie X' "+
+				"with the number of free requests X", s.Auth)
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil || count < 0 {
+			return fmt.Errorf("invalid number of free requests in "+
+				"auth level %s", s.Auth)
+		}
+		if count == 0 {
+			log.Warnf("Service %s has freebies enabled with zero "+
+				"free requests, it behaves like auth 'on'",
+				s.Name)
+		}
+
+	default:
+		return fmt.Errorf("unknown auth level %s, must be 'on', 'off' "+
+			"or 'freebie X'", s.Auth)
+	}
+
+	if !s.Auth.IsFreebie() && s.hasFreebieSettings() {
+		log.Warnf("Service %s has freebie settings but auth level "+
+			"%s, they are ignored", s.Name, s.Auth)
+	}
+
+	if s.Auth.IsOff() && s.hasPaymentSettings() {
+		log.Warnf("Service %s has price or payment settings but auth "+
+			"level off, its requests are never charged", s.Name)
+	}
+
+	return nil
+}
+
+// hasFreebieSettings returns true if any of the settings that only apply to
+// freebies is set.
+func (s *Service) hasFreebieSettings() bool {
+	return s.FreebieStrategy != "" || s.FreebieCookieKey != "" ||
+		s.FreebieFailPolicy != "" || s.FreebieHeaders ||
+		s.FreebieRefundServerErrors || s.FreebieMaxKeys != 0 ||
+		s.FreebieKeyTTL != 0 || s.FreebieIPv4Prefix != 0 ||
+		s.FreebieIPv6Prefix != 0
+}
+
+// hasPaymentSettings returns true if any of the settings that only apply to
+// paid requests is set.
+func (s *Service) hasPaymentSettings() bool {
+	return s.Price != 0 || len(s.MethodPrices) != 0 ||
+		len(s.PriceSchedule) != 0 || len(s.PaymentOptions) != 0 ||
+		s.Authenticator != "" || s.ObserveAuth
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestValidateAuthSettings makes sure invalid auth levels are rejected while
+// merely ineffective combinations are accepted.
+func TestValidateAuthSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		service *Service
+		valid   bool
+	}{{
+		name:    "default",
+		service: &Service{},
+		valid:   true,
+	}, {
+		name:    "freebie",
+		service: &Service{Auth: "freebie 3"},
+		valid:   true,
+	}, {
+		name:    "zero freebies",
+		service: &Service{Auth: "freebie 0"},
+		valid:   true,
+	}, {
+		name: "off with price",
+		service: &Service{
+			Auth:            auth.LevelOff,
+			Price:           10,
+			FreebieStrategy: freebieStrategyCookie,
+		},
+		valid: true,
+	}, {
+		name:    "freebie without count",
+		service: &Service{Auth: "freebie"},
+	}, {
+		name:    "negative freebies",
+		service: &Service{Auth: "freebie -1"},
+	}, {
+		name:    "invalid freebie count",
+		service: &Service{Auth: "freebie many"},
+	}, {
+		name:    "unknown level",
+		service: &Service{Auth: "maybe"},
+	}}
+	for _, tc := range tests {
+		err := tc.service.validateAuthSettings()
+		if tc.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+	}
+}
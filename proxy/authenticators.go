@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+const (
+	// hdrWWWAuthenticate is the header challenges are sent to the client
+	// in.
+	hdrWWWAuthenticate = "Www-Authenticate"
+)
+
+// WithAuthenticators registers additional authenticators by name. A service
+// can select one of them to validate its tokens and create its challenges,
+// for example to use a different lnd node for its payments. Services that
+// don't select an authenticator use the default one of the proxy.
+func WithAuthenticators(authenticators map[string]auth.Authenticator) Option {
+	return func(p *Proxy) error {
+		for name, authenticator := range authenticators {
+			if name == "" || authenticator == nil {
+				return fmt.Errorf("authenticators need a " +
+					"name and an implementation")
+			}
+		}
+		p.authenticators = authenticators
+		return nil
+	}
+}
+
+// checkAuthenticators makes sure every service only selects authenticators
+// that are registered, both for its own challenges and its payment options.
+func (p *Proxy) checkAuthenticators(services []*Service) error {
+	for _, service := range services {
+		if service.Authenticator != "" {
+			_, ok := p.authenticators[service.Authenticator]
+			if !ok {
+				return fmt.Errorf("unknown authenticator %s "+
+					"for service %s", service.Authenticator,
+					service.Name)
+			}
+		}
+
+		for _, name := range service.PaymentOptions {
+			if _, ok := p.authenticators[name]; !ok {
+				return fmt.Errorf("unknown payment option %s "+
+					"for service %s", name, service.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// serviceAuthenticator returns the authenticator that is responsible for the
+// given service.
+func (p *Proxy) serviceAuthenticator(s *Service) auth.Authenticator {
+	if authenticator, ok := p.authenticators[s.Authenticator]; ok {
+		return authenticator
+	}
+	return p.authenticator
+}
+
+// paymentAuthenticators returns the authenticator of the given service followed
+// by the authenticators of its additional payment options.
+func (p *Proxy) paymentAuthenticators(s *Service) []auth.Authenticator {
+	authenticators := []auth.Authenticator{p.serviceAuthenticator(s)}
+	for _, name := range s.PaymentOptions {
+		if authenticator, ok := p.authenticators[name]; ok {
+			authenticators = append(authenticators, authenticator)
+		}
+	}
+	return authenticators
+}
+
+// acceptToken returns true if the token in the given header is accepted by the
+// authenticator of the service or one of its payment options, and if it was
+// paid for requests of at least the given price.
+func (p *Proxy) acceptToken(header *http.Header, s *Service,
+	price int64) bool {
+
+	return p.tokenAuthenticator(header, s, price) != nil
+}
+
+// tokenAuthenticator returns the authenticator of the service or one of its
+// payment options that accepts the token in the given header, if it was paid
+// for requests of at least the given price. Nil is returned if the token isn't
+// accepted.
+func (p *Proxy) tokenAuthenticator(header *http.Header, s *Service,
+	price int64) auth.Authenticator {
+
+	for _, authenticator := range p.paymentAuthenticators(s) {
+		if !authenticator.Accept(header, s.Name) {
+			continue
+		}
+		if !s.tokenCoversPrice(header, price) {
+			return nil
+		}
+		return authenticator
+	}
+	return nil
+}
+
+// countUsage counts the admitted request against the usage quota of its token,
+// if the authenticator that accepted it keeps track of the usage. Requests are
+// counted only once, after all other checks passed, so neither checking the
+// token again nor rejecting the request for another reason uses up the quota.
+func countUsage(r *http.Request, s *Service,
+	authenticator auth.Authenticator) error {
+
+	counter, ok := authenticator.(auth.UsageCounter)
+	if !ok {
+		return nil
+	}
+	return counter.CountUsage(&r.Header, s.Name)
+}
+
+// freshChallengeHeader creates the challenge header of the given service for
+// the given price. The token of the challenge is valid for requests that cost
+// up to the given list price, which is the price before any discount. If the
+// service has additional payment options, a challenge of each of them is added
+// as a further WWW-Authenticate value after the one of the service's own
+// authenticator, so clients that don't know about multiple options keep using
+// the first one. Other headers of the additional challenges are dropped.
+func (p *Proxy) freshChallengeHeader(r *http.Request, s *Service, listPrice,
+	price int64) (http.Header, error) {
+
+	params := s.challengeParams(listPrice)
+	header, err := p.serviceAuthenticator(s).FreshChallengeHeader(
+		r, s.Name, price, params,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range s.PaymentOptions {
+		authenticator, ok := p.authenticators[name]
+		if !ok {
+			continue
+		}
+
+		// Authenticators write their challenge into the header of the
+		// request, so each option gets its own copy of the request.
+		option, err := authenticator.FreshChallengeHeader(
+			r.Clone(r.Context()), s.Name, price, params,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create challenge "+
+				"of payment option %s: %v", name, err)
+		}
+
+		for _, value := range option[hdrWWWAuthenticate] {
+			header.Add(hdrWWWAuthenticate, value)
+		}
+	}
+
+	return header, nil
+}
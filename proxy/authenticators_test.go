@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+// TestServiceAuthenticator makes sure services use the authenticator they
+// select and that unknown authenticators are rejected.
+func TestServiceAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	defaultAuth := auth.NewMockAuthenticator()
+	otherAuth := auth.NewMockAuthenticator()
+	p := &Proxy{authenticator: defaultAuth}
+	err := WithAuthenticators(map[string]auth.Authenticator{
+		"other": otherAuth,
+	})(p)
+	if err != nil {
+		t.Fatalf("unable to apply option: %v", err)
+	}
+
+	plain := &Service{Name: "plain"}
+	selected := &Service{Name: "selected", Authenticator: "other"}
+	unknown := &Service{Name: "unknown", Authenticator: "missing"}
+
+	if p.serviceAuthenticator(plain) != defaultAuth {
+		t.Fatalf("expected default authenticator")
+	}
+	if p.serviceAuthenticator(selected) != otherAuth {
+		t.Fatalf("expected selected authenticator")
+	}
+
+	err = p.checkAuthenticators([]*Service{plain, selected})
+	if err != nil {
+		t.Fatalf("unexpected error for known authenticators: %v", err)
+	}
+	err = p.checkAuthenticators([]*Service{plain, unknown})
+	if err == nil {
+		t.Fatalf("expected error for unknown authenticator")
+	}
+}
+
+// schemeAuthenticator is an authenticator that creates challenges of its own
+// scheme and accepts tokens of that scheme.
+type schemeAuthenticator struct {
+	scheme string
+}
+
+// Accept returns true if the authorization header uses the scheme.
+func (a *schemeAuthenticator) Accept(header *http.Header, _ string) bool {
+	return strings.HasPrefix(header.Get("Authorization"), a.scheme+" ")
+}
+
+// FreshChallengeHeader returns a challenge of the scheme.
+func (a *schemeAuthenticator) FreshChallengeHeader(r *http.Request, _ string,
+	_ int64, _ *mint.ChallengeParams) (http.Header, error) {
+
+	header := r.Header
+	header.Set("WWW-Authenticate", a.scheme+" challenge")
+	return header, nil
+}
+
+// TestPaymentOptions makes sure a challenge is offered for every payment
+// option of a service and tokens of each of them are accepted.
+func TestPaymentOptions(t *testing.T) {
+	t.Parallel()
+
+	newProxy := func(options []string) *Proxy {
+		services := []*Service{{
+			Name:           "service",
+			Address:        "127.0.0.1:1",
+			HostRegexp:     ".*",
+			Protocol:       "http",
+			Auth:           "on",
+			Price:          1,
+			PaymentOptions: options,
+		}}
+		p, err := New(
+			&schemeAuthenticator{scheme: "LSAT"}, services, false,
+			"", WithAuthenticators(map[string]auth.Authenticator{
+				"other": &schemeAuthenticator{scheme: "L402"},
+			}),
+		)
+		if err != nil {
+			t.Fatalf("unable to create proxy: %v", err)
+		}
+		return p
+	}
+
+	// Without payment options, only the default challenge is offered.
+	rec := httptest.NewRecorder()
+	newProxy(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	challenges := rec.Header()[hdrWWWAuthenticate]
+	if rec.Code != http.StatusPaymentRequired || len(challenges) != 1 {
+		t.Fatalf("expected single challenge, got %d %v", rec.Code,
+			challenges)
+	}
+
+	p := newProxy([]string{"other"})
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	challenges = rec.Header()[hdrWWWAuthenticate]
+	if len(challenges) != 2 || challenges[0] != "LSAT challenge" ||
+		challenges[1] != "L402 challenge" {
+
+		t.Fatalf("unexpected challenges: %v", challenges)
+	}
+
+	services := p.currentServices()
+	for _, token := range []string{"LSAT token", "L402 token"} {
+		header := http.Header{"Authorization": []string{token}}
+		if !p.acceptToken(&header, services[0], 1) {
+			t.Fatalf("expected %s to be accepted", token)
+		}
+	}
+
+	_, err := New(
+		auth.NewMockAuthenticator(), []*Service{{
+			Name:           "service",
+			HostRegexp:     ".*",
+			PaymentOptions: []string{"missing"},
+		}}, false, "",
+	)
+	if err == nil {
+		t.Fatalf("expected error for unknown payment option")
+	}
+}
+
+// usageAuthenticator is a schemeAuthenticator that counts the usage of its
+// tokens.
+type usageAuthenticator struct {
+	schemeAuthenticator
+
+	// counted is the number of requests counted. It must be accessed
+	// atomically.
+	counted uint64
+
+	// err is returned by CountUsage if set.
+	err error
+
+	// quota is the number of requests after which ErrQuotaExhausted is
+	// returned, if set.
+	quota uint64
+}
+
+// CountUsage counts one request.
+func (a *usageAuthenticator) CountUsage(*http.Header, string) error {
+	counted := atomic.AddUint64(&a.counted, 1)
+	if a.quota > 0 && counted > a.quota {
+		return auth.ErrQuotaExhausted
+	}
+	return a.err
+}
+
+// TestCountUsage makes sure requests are counted against the quota of their
+// token once they are admitted, but not if they are rejected.
+func TestCountUsage(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+
+	authenticator := &usageAuthenticator{
+		schemeAuthenticator: schemeAuthenticator{scheme: "LSAT"},
+	}
+	address := strings.TrimPrefix(backend.URL, "http://")
+	p, err := New(
+		authenticator, []*Service{{
+			Name:           "service",
+			Address:        address,
+			HostRegexp:     ".*",
+			Protocol:       "http",
+			Auth:           "on",
+			Price:          1,
+			RateLimit:      0.001,
+			RateLimitBurst: 1,
+		}}, false, "",
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// The first request is admitted and counted once, the second one is
+	// rejected by the rate limit and not counted.
+	statuses := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, status := range statuses {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "LSAT token")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("expected status %d, got %d", status,
+				rec.Code)
+		}
+	}
+	counted := atomic.LoadUint64(&authenticator.counted)
+	if counted != 1 {
+		t.Fatalf("expected one counted request, got %d", counted)
+	}
+}
+
+// TestCountUsageErrors makes sure only an exhausted quota leads to a new
+// challenge, while a failure to count the request doesn't ask the client to
+// pay again.
+func TestCountUsageErrors(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{auth.ErrQuotaExhausted, http.StatusPaymentRequired},
+		{errors.New("store down"), http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		authenticator := &usageAuthenticator{
+			schemeAuthenticator: schemeAuthenticator{
+				scheme: "LSAT",
+			},
+			err: tc.err,
+		}
+		p, err := New(
+			authenticator, []*Service{{
+				Name:       "service",
+				Address:    address,
+				HostRegexp: ".*",
+				Protocol:   "http",
+				Auth:       "on",
+				Price:      1,
+			}}, false, "",
+		)
+		if err != nil {
+			t.Fatalf("unable to create proxy: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "LSAT token")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("%v: expected status %d, got %d", tc.err,
+				tc.status, rec.Code)
+		}
+	}
+}
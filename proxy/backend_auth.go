@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// backendAuthForward is the backend auth mode that forwards the token
+	// of the client to the backend in the standard header.
+	backendAuthForward = "forward"
+
+	// backendAuthStrip is the backend auth mode that removes the token of
+	// the client before the request is forwarded to the backend.
+	backendAuthStrip = "strip"
+
+	// backendAuthTokenID is the backend auth mode that replaces the token
+	// of the client with the ID of the verified token.
+	backendAuthTokenID = "tokenid"
+
+	// DefaultBackendAuthHeader is the default header the ID of a verified
+	// token is sent to the backend in.
+	DefaultBackendAuthHeader = "X-Lsat-Token-Id"
+)
+
+// backendAuthHeader returns the name of the header the ID of a verified token
+// is sent to the backend in.
+func (s *Service) backendAuthHeader() string {
+	if s.BackendAuthHeader == "" {
+		return DefaultBackendAuthHeader
+	}
+	return s.BackendAuthHeader
+}
+
+// replaceBackendAuth removes the token of the client from the request to the
+// backend. In the "tokenid" mode, the ID of the token is sent instead, but only
+// if the token was verified. The header is always cleared first so clients
+// can't spoof it.
+func (s *Service) replaceBackendAuth(req *http.Request) {
+	tokenID := ""
+	if s.BackendAuth == backendAuthTokenID && authenticatedRequest(req) {
+		tokenID = tokenIDFromHeader(&req.Header)
+	}
+
+	req.Header.Del(lsat.HeaderAuthorization)
+	req.Header.Del(lsat.HeaderMacaroonMD)
+	req.Header.Del(lsat.HeaderMacaroon)
+
+	if s.BackendAuth != backendAuthTokenID {
+		return
+	}
+	req.Header.Del(s.backendAuthHeader())
+	if tokenID != "" {
+		req.Header.Set(s.backendAuthHeader(), tokenID)
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// TestReplaceBackendAuth makes sure the token is removed from requests to the
+// backend and that clients can't spoof the token ID header.
+func TestReplaceBackendAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{backendAuthStrip, backendAuthTokenID} {
+		service := &Service{BackendAuth: mode}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(lsat.HeaderAuthorization, "LSAT foo:bar")
+		req.Header.Set(lsat.HeaderMacaroon, "foo")
+		req.Header.Set(DefaultBackendAuthHeader, "spoofed")
+
+		service.replaceBackendAuth(req)
+		if req.Header.Get(lsat.HeaderAuthorization) != "" ||
+			req.Header.Get(lsat.HeaderMacaroon) != "" {
+
+			t.Fatalf("mode %s: expected token to be removed", mode)
+		}
+
+		// The unverified token ID header must only survive in the
+		// strip mode where it has no meaning to the proxy.
+		spoofed := req.Header.Get(DefaultBackendAuthHeader)
+		if mode == backendAuthTokenID && spoofed != "" {
+			t.Fatalf("expected spoofed token ID to be removed")
+		}
+	}
+}
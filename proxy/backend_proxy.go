@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// parseBackendProxy parses the URL of the proxy the connections to the
+// backends of the service are routed through, if it has one. Only SOCKS5 and
+// HTTP(S) proxies are supported. Services that dial their backends themselves
+// instead of using the backend transport can't use a proxy.
+func (s *Service) parseBackendProxy() error {
+	s.backendProxyURL = nil
+	if s.BackendProxy == "" {
+		return nil
+	}
+
+	proxyURL, err := url.Parse(s.BackendProxy)
+	if err != nil {
+		// The error contains the URL which may contain credentials.
+		return fmt.Errorf("invalid backend proxy URL")
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "http", "https":
+
+	default:
+		return fmt.Errorf("unsupported backend proxy scheme %s, must "+
+			"be socks5, http or https", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("backend proxy URL needs a host")
+	}
+
+	switch {
+	case s.TLSPassthrough:
+		return fmt.Errorf("TLS passthrough can't be used with a " +
+			"backend proxy")
+
+	case s.PreserveHeaderOrder:
+		return fmt.Errorf("preserving the header order can't be " +
+			"used with a backend proxy")
+	}
+
+	s.backendProxyURL = proxyURL
+	return nil
+}
+
+// backendProxy returns the URL of the proxy the request is sent through, which
+// is the backend proxy of the service the request is for. Requests without a
+// service or for services without a backend proxy are sent directly.
+//
+// NOTE: This is used as the Proxy function of the backend transport.
+func backendProxy(req *http.Request) (*url.URL, error) {
+	target, ok := serviceFromRequest(req)
+	if !ok {
+		return nil, nil
+	}
+	return target.backendProxyURL, nil
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestBackendProxy makes sure requests to a service with a backend proxy are
+// routed through it with its credentials.
+func TestBackendProxy(t *testing.T) {
+	t.Parallel()
+
+	const backendAddress = "backend.invalid:8080"
+	credentials := "Basic " + base64.StdEncoding.EncodeToString(
+		[]byte("user:pass"),
+	)
+
+	// The egress proxy answers for the backend that can't be reached
+	// otherwise.
+	egress := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Host != backendAddress ||
+				r.Header.Get("Proxy-Authorization") !=
+					credentials {
+
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, _ = w.Write([]byte("via proxy"))
+		},
+	))
+	defer egress.Close()
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    backendAddress,
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		BackendProxy: strings.Replace(
+			egress.URL, "http://", "http://user:pass@", 1,
+		),
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || string(body) != "via proxy" {
+		t.Fatalf("expected response via proxy, got %d %s", rec.Code,
+			body)
+	}
+
+	invalid := []*Service{{
+		Name:         "scheme",
+		BackendProxy: "ftp://127.0.0.1:21",
+	}, {
+		Name:         "host",
+		BackendProxy: "socks5://",
+	}, {
+		Name:           "passthrough",
+		BackendProxy:   "socks5://127.0.0.1:9050",
+		TLSPassthrough: true,
+	}}
+	for _, service := range invalid {
+		if err := service.parseBackendProxy(); err == nil {
+			t.Fatalf("%s: expected error", service.Name)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// CertExpiry describes a certificate of a backend service and its expiry.
+type CertExpiry struct {
+	// ServiceName is the name of the service the certificate belongs to.
+	ServiceName string
+
+	// Subject is the subject of the certificate.
+	Subject string
+
+	// NotAfter is the time the certificate expires at.
+	NotAfter time.Time
+}
+
+// BackendCertExpiries returns the expiry of all certificates contained in the
+// TLS certificate files of the given services.
+func BackendCertExpiries(services []*Service) ([]*CertExpiry, error) {
+	var expiries []*CertExpiry
+	for _, service := range services {
+		if service.TLSCertPath == "" {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(service.TLSCertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// A file can contain a whole certificate chain, we look at
+		// every certificate of it.
+		for block, rest := pem.Decode(b); block != nil; block, rest =
+			pem.Decode(rest) {
+
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse "+
+					"certificate of service %s: %v",
+					service.Name, err)
+			}
+
+			expiries = append(expiries, &CertExpiry{
+				ServiceName: service.Name,
+				Subject:     cert.Subject.String(),
+				NotAfter:    cert.NotAfter,
+			})
+		}
+	}
+
+	return expiries, nil
+}
+
+// CheckBackendCertExpiry logs a warning for every certificate of the given
+// services that expires within the given margin. The number of certificates
+// that expire soon or already have expired is returned. The expiry of the
+// certificate that expires first is recorded in the stats of each service.
+func CheckBackendCertExpiry(services []*Service, margin time.Duration,
+	now time.Time) (int, error) {
+
+	expiries, err := BackendCertExpiries(services)
+	if err != nil {
+		return 0, err
+	}
+
+	firstExpiry := make(map[string]time.Time, len(services))
+	var expiring int
+	for _, expiry := range expiries {
+		first, ok := firstExpiry[expiry.ServiceName]
+		if !ok || expiry.NotAfter.Before(first) {
+			firstExpiry[expiry.ServiceName] = expiry.NotAfter
+		}
+
+		remaining := expiry.NotAfter.Sub(now)
+		switch {
+		case remaining <= 0:
+			log.Errorf("TLS certificate [%s] of service %s expired "+
+				"at %v", expiry.Subject, expiry.ServiceName,
+				expiry.NotAfter)
+			expiring++
+
+		case remaining <= margin:
+			log.Warnf("TLS certificate [%s] of service %s expires "+
+				"in %v at %v", expiry.Subject,
+				expiry.ServiceName, remaining.Round(time.Hour),
+				expiry.NotAfter)
+			expiring++
+		}
+	}
+
+	for _, service := range services {
+		var unix int64
+		if first, ok := firstExpiry[service.Name]; ok {
+			unix = first.Unix()
+		}
+		atomic.StoreInt64(&service.stats.certExpiry, unix)
+	}
+
+	return expiring, nil
+}
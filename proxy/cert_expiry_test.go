@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCheckBackendCertExpiry makes sure certificates expiring within the
+// margin are detected.
+func TestCheckBackendCertExpiry(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "certexpiry")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	now := time.Now()
+	certPath := filepath.Join(tempDir, "tls.cert")
+	writeTestCert(t, certPath, now.Add(10*24*time.Hour))
+	services := []*Service{{Name: "test", TLSCertPath: certPath}}
+
+	expiring, err := CheckBackendCertExpiry(
+		services, 30*24*time.Hour, now,
+	)
+	if err != nil {
+		t.Fatalf("unable to check expiry: %v", err)
+	}
+	if expiring != 1 {
+		t.Fatalf("expected 1 expiring cert, got %d", expiring)
+	}
+	expiry := services[0].stats.certExpiry
+	if expiry != now.Add(10*24*time.Hour).Unix() {
+		t.Fatalf("expected cert expiry in stats, got %d", expiry)
+	}
+
+	expiring, err = CheckBackendCertExpiry(
+		services, 5*24*time.Hour, now,
+	)
+	if err != nil {
+		t.Fatalf("unable to check expiry: %v", err)
+	}
+	if expiring != 0 {
+		t.Fatalf("expected no expiring cert, got %d", expiring)
+	}
+}
+
+// writeTestCert writes a self-signed certificate that expires at the given
+// time to the given path.
+func writeTestCert(t *testing.T, path string, notAfter time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"test"}},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, template, &key.PublicKey, key,
+	)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	})
+	if err := ioutil.WriteFile(path, certPEM, 0600); err != nil {
+		t.Fatalf("unable to write certificate: %v", err)
+	}
+}
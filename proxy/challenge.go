@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightninglabs/aperture/mint"
+)
+
+const (
+	// maxChallengeDelay is the longest a challenge can be held back, so
+	// clients don't run into timeouts.
+	maxChallengeDelay = 5 * time.Second
+
+	// defaultMaxDelayedChallenges is the default maximum number of
+	// challenges of a service that are held back at the same time.
+	defaultMaxDelayedChallenges = 100
+)
+
+// ChallengeConfig customizes the challenges that are sent to clients of a
+// service that need to pay for access.
+type ChallengeConfig struct {
+	// InvoiceMemo is the description of the invoices of the challenges,
+	// for example "Access to service1". Defaults to "LSAT".
+	InvoiceMemo string `long:"invoicememo" description:"Description of the invoices of the challenges"`
+
+	// InvoiceExpiry is the duration the invoices of the challenges can be
+	// paid in. Defaults to the invoice expiry of lnd.
+	InvoiceExpiry time.Duration `long:"invoiceexpiry" description:"Duration the invoices of the challenges can be paid in"`
+
+	// ReuseWindow is the duration during which a client that requests the
+	// same resource again without a valid token gets the challenge it was
+	// last sent instead of a new one. This prevents clients that retry
+	// while their payment is still in progress from paying twice. Clients
+	// are identified by a cookie, so clients without cookies always get a
+	// new challenge. A value of 0 always creates a new challenge.
+	ReuseWindow time.Duration `long:"reusewindow" description:"Duration during which retrying clients get the same challenge again"`
+
+	// Delay is the duration a challenge is held back before it's sent,
+	// which makes probing the prices and paths of the service at high
+	// speed costly. Requests that don't need to pay are never delayed. A
+	// value of 0 disables the delay.
+	Delay time.Duration `long:"delay" description:"Duration challenges are held back before they are sent"`
+
+	// DelayJitter is the maximum random duration that is added to the
+	// delay of each challenge, so the delay can't be subtracted from the
+	// response times.
+	DelayJitter time.Duration `long:"delayjitter" description:"Maximum random duration added to the delay of challenges"`
+
+	// MaxDelayed is the maximum number of challenges that are held back
+	// at the same time. Further requests are rejected with status 503
+	// instead of a challenge, so a flood of requests can neither tie up
+	// the server nor get around the delay. Defaults to 100.
+	MaxDelayed int `long:"maxdelayed" description:"Maximum number of challenges held back at the same time, 100 if not set"`
+
+	// delayed is the number of challenges that are currently held back.
+	// It must be accessed atomically.
+	delayed int32
+}
+
+// validate makes sure the challenge configuration is valid.
+func (c *ChallengeConfig) validate() error {
+	if c.InvoiceExpiry < 0 {
+		return fmt.Errorf("invoice expiry cannot be negative")
+	}
+	if c.InvoiceExpiry > 0 && c.InvoiceExpiry < time.Second {
+		return fmt.Errorf("invoice expiry must be at least one second")
+	}
+	if c.ReuseWindow < 0 {
+		return fmt.Errorf("reuse window cannot be negative")
+	}
+	if c.Delay < 0 || c.DelayJitter < 0 || c.MaxDelayed < 0 {
+		return fmt.Errorf("delay settings cannot be negative")
+	}
+	if c.Delay+c.DelayJitter > maxChallengeDelay {
+		return fmt.Errorf("delay and jitter of challenges cannot "+
+			"exceed %v", maxChallengeDelay)
+	}
+	if c.MaxDelayed == 0 {
+		c.MaxDelayed = defaultMaxDelayedChallenges
+	}
+
+	// Reusing a challenge whose invoice already expired would leave the
+	// client without any way to pay.
+	if c.InvoiceExpiry > 0 && c.ReuseWindow >= c.InvoiceExpiry {
+		return fmt.Errorf("reuse window must be shorter than the " +
+			"invoice expiry")
+	}
+	return nil
+}
+
+// challengeParams returns the parameters for the challenges of the service for
+// requests with the given price. If the price of the service varies, the LSAT
+// of a challenge is limited to requests that don't cost more than that, so a
+// token paid for a cheap method or time window can't be used for an expensive
+// one.
+func (s *Service) challengeParams(price int64) *mint.ChallengeParams {
+	params := &mint.ChallengeParams{}
+	if s.hasVaryingPrice() {
+		params.Caveats = []lsat.Caveat{
+			lsat.NewPriceCaveat(s.Name, price),
+		}
+	}
+	if s.Challenge != nil {
+		params.Memo = s.Challenge.InvoiceMemo
+		params.Expiry = s.Challenge.InvoiceExpiry
+	}
+	return params
+}
+
+// delayChallenge holds back the challenge of the service for its delay plus a
+// random jitter. If the maximum number of challenges is already held back,
+// false is returned right away and the challenge must not be sent, since
+// holding it back costs the server resources while it's flooded and sending it
+// without the delay would defeat its purpose. It returns early if the client
+// disconnects.
+func (s *Service) delayChallenge(ctx context.Context) bool {
+	c := s.Challenge
+	if c == nil || c.Delay+c.DelayJitter == 0 {
+		return true
+	}
+
+	defer atomic.AddInt32(&c.delayed, -1)
+	if atomic.AddInt32(&c.delayed, 1) > int32(c.MaxDelayed) {
+		return false
+	}
+
+	delay := c.Delay
+	if c.DelayJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.DelayJitter) + 1))
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// retryAfter returns the number of seconds after which a client whose
+// challenge couldn't be held back should retry.
+func (c *ChallengeConfig) retryAfter() int {
+	return int(math.Ceil((c.Delay + c.DelayJitter).Seconds()))
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestDelayChallenge makes sure challenges are held back for their delay,
+// unless too many are held back already.
+func TestDelayChallenge(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{Challenge: &ChallengeConfig{
+		Delay:       50 * time.Millisecond,
+		DelayJitter: 10 * time.Millisecond,
+		MaxDelayed:  1,
+	}}
+	if err := s.Challenge.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if !s.delayChallenge(context.Background()) {
+		t.Fatalf("expected challenge to be delayed")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("challenge was only delayed by %v", elapsed)
+	}
+
+	// While one challenge is held back, the next one is rejected right
+	// away.
+	s.Challenge.delayed = 1
+	start = time.Now()
+	if s.delayChallenge(context.Background()) {
+		t.Fatalf("expected challenge over the limit to be rejected")
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Fatalf("challenge over the limit was delayed by %v", elapsed)
+	}
+	if retryAfter := s.Challenge.retryAfter(); retryAfter != 1 {
+		t.Fatalf("expected retry after 1s, got %d", retryAfter)
+	}
+
+	tooLong := &ChallengeConfig{
+		Delay:       4 * time.Second,
+		DelayJitter: 2 * time.Second,
+	}
+	if err := tooLong.validate(); err == nil {
+		t.Fatalf("expected too long delay to be rejected")
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+const (
+	// defaultInFlightMaxClients is the default maximum number of clients
+	// whose in-flight requests are tracked at the same time.
+	defaultInFlightMaxClients = 10000
+)
+
+var (
+	// errClientInFlightLimit is returned if a client already has the
+	// maximum number of requests to a service in flight.
+	errClientInFlightLimit = errors.New("too many concurrent requests " +
+		"of client")
+)
+
+// clientInFlightLimiter limits the number of requests each client can have in
+// flight at the same time, so a single client can't tie up the backend with
+// many slow requests. Clients are only tracked while they have requests in
+// flight, and at most maxClients of them at once.
+type clientInFlightLimiter struct {
+	limit      int
+	maxClients int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// newClientInFlightLimiter creates a new limiter that allows each client limit
+// requests in flight and tracks at most maxClients clients.
+func newClientInFlightLimiter(limit, maxClients int) *clientInFlightLimiter {
+	return &clientInFlightLimiter{
+		limit:      limit,
+		maxClients: maxClients,
+		inFlight:   make(map[string]int),
+	}
+}
+
+// acquire counts a request of the client as in flight. If that was possible,
+// the returned function must be called once the request completed. The
+// requests of new clients aren't counted if the maximum number of clients is
+// tracked already, since rejecting them would let a crowd of clients lock out
+// everybody else.
+func (l *clientInFlightLimiter) acquire(client string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count, ok := l.inFlight[client]
+	switch {
+	case count >= l.limit:
+		return nil, errClientInFlightLimit
+
+	case !ok && len(l.inFlight) >= l.maxClients:
+		log.Warnf("Not limiting in-flight requests of client %s, "+
+			"already tracking %d clients", client, l.maxClients)
+		return func() {}, nil
+	}
+
+	l.inFlight[client] = count + 1
+	return func() {
+		l.release(client)
+	}, nil
+}
+
+// release counts a request of the client as completed. Clients without any
+// requests in flight are forgotten, which keeps the memory bounded by the
+// number of requests in flight.
+func (l *clientInFlightLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[client] <= 1 {
+		delete(l.inFlight, client)
+		return
+	}
+	l.inFlight[client]--
+}
+
+// acquireClientInFlight counts the request as in flight for its client if the
+// service limits the in-flight requests per client. The client is identified
+// by its token if it was verified and by its IP address otherwise, so clients
+// can't escape the limit by making up tokens. The returned function must be
+// called once the request completed.
+func (s *Service) acquireClientInFlight(r *http.Request, clientIP string,
+	authenticated bool) (func(), error) {
+
+	if s.clientInFlight == nil {
+		return func() {}, nil
+	}
+
+	client := clientIP
+	if authenticated {
+		if id := tokenIDFromHeader(&r.Header); id != "" {
+			client = id
+		}
+	}
+	return s.clientInFlight.acquire(client)
+}
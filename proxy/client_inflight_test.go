@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestClientInFlightLimiter makes sure each client is limited on its own and
+// forgotten once all its requests completed.
+func TestClientInFlightLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newClientInFlightLimiter(2, 2)
+
+	releaseA1, err := l.acquire("a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	releaseA2, err := l.acquire("a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := l.acquire("a"); err != errClientInFlightLimit {
+		t.Fatalf("expected in-flight limit, got %v", err)
+	}
+
+	// Other clients aren't affected.
+	releaseB, err := l.acquire("b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Clients beyond the maximum aren't tracked and never limited.
+	for i := 0; i < 3; i++ {
+		if _, err := l.acquire("c"); err != nil {
+			t.Fatalf("untracked client was limited: %v", err)
+		}
+	}
+	if len(l.inFlight) != 2 {
+		t.Fatalf("expected 2 tracked clients, got %d", len(l.inFlight))
+	}
+
+	releaseA1()
+	if _, err := l.acquire("a"); err != nil {
+		t.Fatalf("expected request after release, got %v", err)
+	}
+
+	releaseA2()
+	releaseB()
+	if _, ok := l.inFlight["b"]; ok {
+		t.Fatalf("client without requests in flight wasn't forgotten")
+	}
+}
+
+// TestClientInFlightLimit makes sure a client that has too many requests in
+// flight gets a 429 until one of them completed.
+func TestClientInFlightLimit(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-unblock
+			}
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:              "service",
+		Address:           strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:        ".*",
+		Protocol:          "http",
+		Auth:              "off",
+		MaxClientInFlight: 1,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	send := func(path, remoteAddr string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- send("/slow", "10.0.0.1:1234")
+	}()
+	<-started
+
+	code := send("/", "10.0.0.1:1235")
+	if code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", code)
+	}
+	if code := send("/", "10.0.0.2:1234"); code != http.StatusOK {
+		t.Fatalf("other client was limited with status %d", code)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("unexpected status %d of slow request", code)
+	}
+	if code := send("/", "10.0.0.1:1235"); code != http.StatusOK {
+		t.Fatalf("expected status 200 after completion, got %d", code)
+	}
+}
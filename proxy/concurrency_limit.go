@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errConcurrencyLimit is returned if a request can't be sent to the
+	// backend because the maximum number of concurrent requests is
+	// reached and no slot became free within the maximum wait time.
+	errConcurrencyLimit = errors.New("backend concurrency limit reached")
+
+	// errQueueFull is returned if a request can't be queued because the
+	// queue of requests waiting for a free slot is full.
+	errQueueFull = errors.New("backend request queue full")
+)
+
+// concurrencyLimiter limits the number of requests that are sent to a backend
+// at the same time. Requests exceeding the limit can wait in a bounded queue
+// for a slot to become free.
+type concurrencyLimiter struct {
+	slots     chan struct{}
+	queueSize int32
+	maxWait   time.Duration
+
+	// queued is the number of requests that are currently waiting for a
+	// slot. It must be accessed atomically.
+	queued int32
+}
+
+// newConcurrencyLimiter creates a new limiter that allows maxConcurrent
+// requests at the same time. Up to queueSize further requests wait for at most
+// maxWait for a slot to become free. A maxWait of zero rejects them
+// immediately.
+func newConcurrencyLimiter(maxConcurrent, queueSize int,
+	maxWait time.Duration) *concurrencyLimiter {
+
+	return &concurrencyLimiter{
+		slots:     make(chan struct{}, maxConcurrent),
+		queueSize: int32(queueSize),
+		maxWait:   maxWait,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if none is free. If a slot was
+// taken, release must be called once the request completed. An error is
+// returned if no slot became available or the context was canceled while
+// waiting.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if l.maxWait <= 0 {
+		return errConcurrencyLimit
+	}
+
+	// Without a bound on the queue, a burst of requests could pile up an
+	// unlimited number of waiting goroutines.
+	defer atomic.AddInt32(&l.queued, -1)
+	if atomic.AddInt32(&l.queued, 1) > l.queueSize {
+		return errQueueFull
+	}
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+
+	case <-timer.C:
+		return errConcurrencyLimit
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot that was taken with acquire.
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrencyLimiter makes sure requests exceeding the concurrency limit
+// are queued for a bounded time and rejected if the queue is full.
+func TestConcurrencyLimiter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	// Without a wait time, requests over the limit are rejected at once.
+	limiter := newConcurrencyLimiter(1, 1, 0)
+	if err := limiter.acquire(ctx); err != nil {
+		t.Fatalf("unable to acquire slot: %v", err)
+	}
+	if err := limiter.acquire(ctx); err != errConcurrencyLimit {
+		t.Fatalf("expected concurrency limit error, got %v", err)
+	}
+	limiter.release()
+
+	// A queued request gets the slot once it's released.
+	limiter = newConcurrencyLimiter(1, 1, time.Second)
+	if err := limiter.acquire(ctx); err != nil {
+		t.Fatalf("unable to acquire slot: %v", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- limiter.acquire(ctx)
+	}()
+
+	// Wait until the request is queued, then a second one doesn't fit
+	// into the queue anymore.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&limiter.queued) == 0 &&
+		time.Now().Before(deadline) {
+
+		time.Sleep(time.Millisecond)
+	}
+	if err := limiter.acquire(ctx); err != errQueueFull {
+		t.Fatalf("expected queue full error, got %v", err)
+	}
+
+	limiter.release()
+	if err := <-errChan; err != nil {
+		t.Fatalf("queued request failed: %v", err)
+	}
+
+	// A queued request that doesn't get a slot in time is rejected.
+	limiter = newConcurrencyLimiter(1, 1, 10*time.Millisecond)
+	_ = limiter.acquire(ctx)
+	if err := limiter.acquire(ctx); err != errConcurrencyLimit {
+		t.Fatalf("expected concurrency limit error, got %v", err)
+	}
+
+	// A canceled request leaves the queue.
+	limiter = newConcurrencyLimiter(1, 1, time.Second)
+	_ = limiter.acquire(ctx)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limiter.acquire(cancelCtx); err != context.Canceled {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+const (
+	// DefaultConfigExportPath is the default path the proxy serves the
+	// effective configuration of its services on.
+	DefaultConfigExportPath = "/aperture/config"
+)
+
+var (
+	// redactedConfigOptions are the options whose values are never
+	// exported because they are secrets, may contain credentials or
+	// reveal where key material is stored or where requests are mirrored
+	// and reported to.
+	redactedConfigOptions = map[string]bool{
+		"secret":           true,
+		"freebiecookiekey": true,
+		"tlscertpath":      true,
+		"backendproxy":     true,
+		"usagereporturl":   true,
+		"shadowaddress":    true,
+	}
+
+	// redactedConfigMaps are the options whose keys are exported but whose
+	// values are not, because they may contain credentials like the
+	// content of macaroon files.
+	redactedConfigMaps = map[string]bool{
+		"headers": true,
+	}
+
+	// durationType is the type of the duration options, which are
+	// exported in their human readable form.
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// WithConfigExport makes the proxy serve the effective configuration of its
+// services as JSON on the given path, with secrets redacted. Requests must
+// present the given token as bearer token in the Authorization header. If the
+// path is empty, the default path is used.
+func WithConfigExport(path, token string) Option {
+	return func(p *Proxy) error {
+		if token == "" {
+			return fmt.Errorf("config export endpoint needs a " +
+				"token")
+		}
+		if path == "" {
+			path = DefaultConfigExportPath
+		}
+		p.configExportPath = path
+		p.configExportToken = token
+		return nil
+	}
+}
+
+// isConfigExportRequest returns true if the request is for the config export
+// endpoint.
+func (p *Proxy) isConfigExportRequest(r *http.Request) bool {
+	return p.configExportToken != "" && r.URL.Path == p.configExportPath
+}
+
+// serveConfigExport answers a request for the config export endpoint if it
+// presents the correct token. The services are the ones requests are currently
+// matched against, so the response reflects any updates at runtime. Rate
+// limits are taken from the limiters since they can be updated without
+// replacing the services.
+func (p *Proxy) serveConfigExport(w http.ResponseWriter, r *http.Request) {
+	if !p.checkBearerToken(w, r, p.configExportToken, "config export") {
+		return
+	}
+
+	services := p.currentServices()
+	export := make([]interface{}, 0, len(services))
+	for _, service := range services {
+		serviceExport := exportConfigValue(reflect.ValueOf(service), "")
+		values, ok := serviceExport.(map[string]interface{})
+		if ok && service.rateLimiter != nil {
+			rate, burst, maxWait := service.rateLimiter.settings()
+			values["ratelimit"] = rate
+			values["ratelimitburst"] = burst
+			values["ratelimitmaxwait"] = maxWait.String()
+		}
+		export = append(export, serviceExport)
+	}
+
+	w.Header().Set(hdrContentType, "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"services": export,
+	})
+	if err != nil {
+		log.Errorf("Unable to send config export: %v", err)
+	}
+}
+
+// exportConfigValue converts a configuration value into its exported form.
+// Structs are converted into maps keyed by the names of their options as they
+// are used in the configuration file, so only fields that are options are
+// exported. The name is the one of the option the value belongs to.
+func exportConfigValue(v reflect.Value, name string) interface{} {
+	if redactedConfigOptions[name] {
+		if v.IsZero() {
+			return v.Interface()
+		}
+		return redactedValue
+	}
+
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return exportConfigValue(v.Elem(), name)
+
+	case reflect.Struct:
+		export := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			option := v.Type().Field(i).Tag.Get("long")
+			if option == "" {
+				continue
+			}
+			export[option] = exportConfigValue(v.Field(i), option)
+		}
+		return export
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		export := make([]interface{}, v.Len())
+		for i := range export {
+			export[i] = exportConfigValue(v.Index(i), name)
+		}
+		return export
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		export := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			var value interface{} = redactedValue
+			if !redactedConfigMaps[name] {
+				value = exportConfigValue(v.MapIndex(key), "")
+			}
+			export[fmt.Sprint(key)] = value
+		}
+		return export
+
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// validateContentTypes makes sure all allowed content and accept types of the
+// service are media types like "application/json" or wildcards like "image/*"
+// and brings them into their canonical lower case form.
+func (s *Service) validateContentTypes() error {
+	if err := canonicalMediaTypes(s.AllowedContentTypes); err != nil {
+		return err
+	}
+	return canonicalMediaTypes(s.AllowedAcceptTypes)
+}
+
+// canonicalMediaTypes validates the given media types and replaces them with
+// their canonical lower case form.
+func canonicalMediaTypes(mediaTypes []string) error {
+	for i, contentType := range mediaTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return fmt.Errorf("invalid content type %s: %v",
+				contentType, err)
+		}
+
+		parts := strings.Split(mediaType, "/")
+		if len(parts) != 2 || parts[0] == "*" || parts[1] == "" {
+			return fmt.Errorf("invalid content type %s",
+				contentType)
+		}
+		mediaTypes[i] = mediaType
+	}
+
+	return nil
+}
+
+// contentTypeAllowed returns true if the content type of the request is in the
+// allow-list of the service or the service doesn't restrict content types.
+// Requests without a body don't need to declare a content type.
+func (s *Service) contentTypeAllowed(r *http.Request) bool {
+	if len(s.AllowedContentTypes) == 0 {
+		return true
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return r.ContentLength == 0
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowed := range s.AllowedContentTypes {
+		if mediaTypeMatches(allowed, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mediaTypeMatches returns true if the media type matches the allowed one. A
+// wildcard subtype matches all subtypes of its type, and a type with a suffix
+// like "application/grpc+proto" also matches its base type, so allowing
+// "application/grpc" covers all gRPC encodings.
+func mediaTypeMatches(allowed, mediaType string) bool {
+	if allowed == mediaType {
+		return true
+	}
+
+	if strings.HasSuffix(allowed, "/*") {
+		return strings.HasPrefix(mediaType, allowed[:len(allowed)-1])
+	}
+
+	return strings.HasPrefix(mediaType, allowed+"+")
+}
+
+// acceptAllowed returns true if the Accept header of the request asks for at
+// least one media type in the accept allow-list of the service, or the service
+// doesn't restrict the formats clients can ask for. Requests without an Accept
+// header accept any format. Media ranges with a quality of zero don't count,
+// since the client explicitly refuses them. The header is never changed.
+func (s *Service) acceptAllowed(r *http.Request) bool {
+	if len(s.AllowedAcceptTypes) == 0 {
+		return true
+	}
+
+	accept := strings.Join(r.Header["Accept"], ",")
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || refusedMediaRange(params) {
+			continue
+		}
+
+		for _, allowed := range s.AllowedAcceptTypes {
+			if mediaRangeMatches(mediaType, allowed) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// refusedMediaRange returns true if the parameters of a media range of an
+// Accept header contain a quality of zero.
+func refusedMediaRange(params map[string]string) bool {
+	quality, ok := params["q"]
+	if !ok {
+		return false
+	}
+	q, err := strconv.ParseFloat(quality, 64)
+	return err == nil && q == 0
+}
+
+// mediaRangeMatches returns true if the media range of an Accept header, which
+// may be "*/*" or a wildcard like "text/*", includes the allowed media type.
+func mediaRangeMatches(mediaRange, allowed string) bool {
+	switch {
+	case mediaRange == "*/*":
+		return true
+
+	case strings.HasSuffix(mediaRange, "/*"):
+		prefix := strings.TrimSuffix(mediaRange, "*")
+		return strings.HasPrefix(allowed, prefix)
+
+	default:
+		return mediaTypeMatches(allowed, mediaRange)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestContentTypeAllowed makes sure the content type of requests is checked
+// against the allow-list of a service.
+func TestContentTypeAllowed(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{
+		AllowedContentTypes: []string{
+			"Application/JSON", "image/*", "application/grpc",
+		},
+	}
+	if err := s.validateContentTypes(); err != nil {
+		t.Fatalf("unable to validate content types: %v", err)
+	}
+
+	testCases := []struct {
+		contentType string
+		body        string
+		allowed     bool
+	}{
+		{"application/json", "{}", true},
+		{"application/json; charset=utf-8", "{}", true},
+		{"image/png", "png", true},
+		{"application/grpc", "msg", true},
+		{"application/grpc+proto", "msg", true},
+		{"application/grpcx", "msg", false},
+		{"text/plain", "text", false},
+		{"not a type", "text", false},
+		{"", "", true},
+		{"", "text", false},
+	}
+	for _, tc := range testCases {
+		r, _ := http.NewRequest(
+			"POST", "http://x/", strings.NewReader(tc.body),
+		)
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		if s.contentTypeAllowed(r) != tc.allowed {
+			t.Fatalf("expected content type %q with body %q to "+
+				"be allowed=%v", tc.contentType, tc.body,
+				tc.allowed)
+		}
+	}
+
+	for _, invalid := range []string{"json", "*/*", "image/"} {
+		s := &Service{AllowedContentTypes: []string{invalid}}
+		if err := s.validateContentTypes(); err == nil {
+			t.Fatalf("expected content type %s to be invalid",
+				invalid)
+		}
+	}
+}
+
+// TestAcceptAllowed makes sure the Accept header of requests is checked against
+// the accept allow-list of a service.
+func TestAcceptAllowed(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{
+		AllowedAcceptTypes: []string{"Application/JSON", "text/*"},
+	}
+	if err := s.validateContentTypes(); err != nil {
+		t.Fatalf("unable to validate accept types: %v", err)
+	}
+
+	testCases := []struct {
+		accept  string
+		allowed bool
+	}{
+		{"", true},
+		{"application/json", true},
+		{"application/xml, application/json;q=0.5", true},
+		{"text/html", true},
+		{"text/*", true},
+		{"*/*", true},
+		{"application/*", true},
+		{"application/xml", false},
+		{"image/*", false},
+		{"application/json;q=0, application/xml", false},
+		{"application/json;q=0.000", false},
+		{"not a type", false},
+	}
+	for _, tc := range testCases {
+		r, _ := http.NewRequest("GET", "http://x/", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if s.acceptAllowed(r) != tc.allowed {
+			t.Fatalf("expected accept %q to be allowed=%v",
+				tc.accept, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import "net/http"
+
+// WithCorsDisabled disables the Cross Origin Resource Sharing headers for all
+// services. OPTIONS requests are then forwarded to the backends like any other
+// request instead of being answered by the proxy, which lets backends that
+// implement CORS themselves handle it without duplicate header fields.
+func WithCorsDisabled(disabled bool) Option {
+	return func(p *Proxy) error {
+		p.corsDisabled = disabled
+		return nil
+	}
+}
+
+// corsEnabled returns true if the CORS headers should be added to responses
+// for the given service. The service may be nil for requests that don't match
+// any service.
+func (p *Proxy) corsEnabled(target *Service) bool {
+	if p.corsDisabled {
+		return false
+	}
+
+	return target == nil || !target.DisableCors
+}
+
+// isCorsPreflight returns true if the request is an OPTIONS request the proxy
+// answers itself with the CORS headers.
+func (p *Proxy) isCorsPreflight(r *http.Request) bool {
+	if r.Method != "OPTIONS" || p.corsDisabled {
+		return false
+	}
+
+	target, ok := p.matchService(r)
+	if !ok {
+		target, _ = p.matchFallback(r)
+	}
+	return p.corsEnabled(target)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestCorsDisabled makes sure services that disable CORS get their OPTIONS
+// requests forwarded and their responses left without CORS headers.
+func TestCorsDisabled(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Method", r.Method)
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:        "own-cors",
+		Address:     address,
+		HostRegexp:  ".*",
+		PathRegexp:  "^/own/.*$",
+		Protocol:    "http",
+		Auth:        "off",
+		DisableCors: true,
+	}, {
+		Name:       "cors",
+		Address:    address,
+		HostRegexp: ".*",
+		PathRegexp: "^/cors/.*$",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	const allowOrigin = "Access-Control-Allow-Origin"
+	for _, method := range []string{"OPTIONS", "GET"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, "/own/x", nil))
+		if rec.Header().Get("X-Method") != method {
+			t.Fatalf("expected %s request to be forwarded", method)
+		}
+		if rec.Header().Get(allowOrigin) != "" {
+			t.Fatalf("unexpected CORS header for %s request",
+				method)
+		}
+
+		rec = httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, "/cors/x", nil))
+		if rec.Header().Get(allowOrigin) != "*" {
+			t.Fatalf("expected CORS header for %s request", method)
+		}
+	}
+
+	// Disabling CORS globally also forwards OPTIONS requests to services
+	// that don't disable it themselves.
+	if err := WithCorsDisabled(true)(p); err != nil {
+		t.Fatalf("unable to disable CORS: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "/cors/x", nil))
+	if rec.Header().Get("X-Method") != "OPTIONS" {
+		t.Fatalf("expected OPTIONS request to be forwarded")
+	}
+	if rec.Header().Get(allowOrigin) != "" {
+		t.Fatalf("unexpected CORS header with CORS disabled")
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DefaultDebugHeader is the default header trusted clients can enable
+	// debug flags for a single request in.
+	DefaultDebugHeader = "X-Aperture-Debug"
+
+	// debugFlagTrace is the debug flag that logs everything about the
+	// request at the info level, independent of the log level.
+	debugFlagTrace = "trace"
+
+	// debugFlagNoCache is the debug flag that bypasses the idempotency
+	// cache and the reuse of pending challenges.
+	debugFlagNoCache = "nocache"
+
+	// debugFlagBackend is the prefix of the debug flag that forces the
+	// request to be sent to a specific backend address of the service.
+	debugFlagBackend = "backend="
+)
+
+// debugFlagsCtxKey is the key under which the debug flags of a request are
+// stored in its context.
+type debugFlagsCtxKey struct{}
+
+// debugFlags are the request-scoped behaviors a trusted client enabled with
+// the debug header.
+type debugFlags struct {
+	// trace logs everything about the request at the info level.
+	trace bool
+
+	// noCache bypasses the idempotency cache and the reuse of pending
+	// challenges.
+	noCache bool
+
+	// backend is the backend address of the service the request is sent
+	// to instead of the one chosen by the load balancing.
+	backend string
+}
+
+// WithDebugHeader makes the proxy honor the debug flags that clients from the
+// given trusted networks send in the given header. The flags are a comma
+// separated list of "trace", "nocache" and "backend=<address>". The header is
+// removed from all requests before they reach a backend, and ignored if the
+// client isn't trusted. If the header is empty, the default header is used.
+func WithDebugHeader(header string, trustedCIDRs []string) Option {
+	return func(p *Proxy) error {
+		if len(trustedCIDRs) == 0 {
+			return fmt.Errorf("debug header needs trusted networks")
+		}
+		for _, cidr := range trustedCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid trusted network "+
+					"%s: %v", cidr, err)
+			}
+			p.debugTrusted = append(p.debugTrusted, network)
+		}
+
+		if header == "" {
+			header = DefaultDebugHeader
+		}
+		p.debugHeader = header
+		return nil
+	}
+}
+
+// debugFlags extracts the debug flags of the request if the client is trusted
+// and removes the debug header from the request. Unknown flags are ignored.
+func (p *Proxy) debugFlags(r *http.Request, remoteIP net.IP) debugFlags {
+	var flags debugFlags
+	if p.debugHeader == "" {
+		return flags
+	}
+
+	value := r.Header.Get(p.debugHeader)
+	r.Header.Del(p.debugHeader)
+	if value == "" {
+		return flags
+	}
+
+	var trusted bool
+	for _, network := range p.debugTrusted {
+		if network.Contains(remoteIP) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		log.Warnf("Ignoring debug header of untrusted client %v",
+			remoteIP)
+		return flags
+	}
+
+	for _, flag := range strings.Split(value, ",") {
+		flag = strings.TrimSpace(flag)
+		switch {
+		case flag == debugFlagTrace:
+			flags.trace = true
+
+		case flag == debugFlagNoCache:
+			flags.noCache = true
+
+		case strings.HasPrefix(flag, debugFlagBackend):
+			flags.backend = strings.TrimPrefix(
+				flag, debugFlagBackend,
+			)
+
+		default:
+			log.Debugf("Ignoring unknown debug flag %s", flag)
+		}
+	}
+
+	return flags
+}
+
+// requestDebugFlags returns the debug flags of the request.
+func requestDebugFlags(r *http.Request) debugFlags {
+	flags, _ := r.Context().Value(debugFlagsCtxKey{}).(debugFlags)
+	return flags
+}
+
+// forcedBackendAddress returns the backend address the debug flags of the
+// request force it to be sent to. Only addresses of the service itself can be
+// forced, so the flag can't be used to reach arbitrary hosts.
+func (s *Service) forcedBackendAddress(r *http.Request) (string, bool) {
+	backend := requestDebugFlags(r).backend
+	if backend == "" {
+		return "", false
+	}
+
+	for _, address := range s.backendAddresses() {
+		if address == backend {
+			return address, true
+		}
+	}
+
+	log.Warnf("Ignoring forced backend %s that isn't an address of "+
+		"service %s", backend, s.Name)
+	return "", false
+}
+
+// withDebugFlags adds the debug flags to the context of the request.
+func withDebugFlags(r *http.Request, flags debugFlags) *http.Request {
+	if flags == (debugFlags{}) {
+		return r
+	}
+
+	ctx := context.WithValue(r.Context(), debugFlagsCtxKey{}, flags)
+	return r.WithContext(ctx)
+}
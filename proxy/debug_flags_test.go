@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestDebugFlags makes sure debug flags are only honored for trusted clients
+// and the debug header never reaches the backend.
+func TestDebugFlags(t *testing.T) {
+	t.Parallel()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(DefaultDebugHeader) != "" {
+					_, _ = w.Write([]byte("leaked"))
+					return
+				}
+				_, _ = w.Write([]byte(name))
+			},
+		))
+	}
+	first, second := newBackend("first"), newBackend("second")
+	defer first.Close()
+	defer second.Close()
+	firstAddress := strings.TrimPrefix(first.URL, "http://")
+	secondAddress := strings.TrimPrefix(second.URL, "http://")
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    firstAddress,
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, false, "",
+		WithDebugHeader("", []string{"10.0.0.0/8"}),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	services[0].setAddresses([]string{firstAddress, secondAddress})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		flags      string
+		forced     bool
+	}{{
+		name:       "trusted",
+		remoteAddr: "10.1.2.3:1234",
+		flags:      "trace, backend=" + secondAddress,
+		forced:     true,
+	}, {
+		name:       "untrusted",
+		remoteAddr: "192.168.1.1:1234",
+		flags:      "backend=" + secondAddress,
+	}, {
+		name:       "foreign backend",
+		remoteAddr: "10.1.2.3:1234",
+		flags:      "backend=127.0.0.1:1",
+	}}
+	for _, tc := range tests {
+		// Without a forced backend, the requests alternate between
+		// both backends.
+		seen := make(map[string]bool)
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set(DefaultDebugHeader, tc.flags)
+
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			seen[rec.Body.String()] = true
+		}
+
+		switch {
+		case seen["leaked"]:
+			t.Fatalf("%s: debug header reached backend", tc.name)
+
+		case tc.forced && (len(seen) != 1 || !seen["second"]):
+			t.Fatalf("%s: expected forced backend, got %v",
+				tc.name, seen)
+
+		case !tc.forced && len(seen) != 2:
+			t.Fatalf("%s: expected both backends, got %v",
+				tc.name, seen)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// DefaultDiscountHeader is the default header clients can send a
+	// discount token in.
+	DefaultDiscountHeader = "X-Discount-Token"
+
+	// minDiscountedPrice is the minimum price in satoshis of a discounted
+	// challenge. A price of zero would create an invoice the client could
+	// pay any amount for.
+	minDiscountedPrice = 1
+)
+
+var (
+	// ErrUnknownDiscount is returned if a discount token isn't known.
+	ErrUnknownDiscount = errors.New("unknown discount token")
+)
+
+// DiscountVerifier verifies discount tokens, for example of referral or
+// promotional campaigns, that clients can present to get a challenge with a
+// lower price.
+type DiscountVerifier interface {
+	// DiscountedPrice returns the price a client presenting the given
+	// discount token has to pay for the service instead of the regular
+	// price. An error is returned if the token isn't valid.
+	DiscountedPrice(ctx context.Context, token, serviceName string,
+		price int64) (int64, error)
+}
+
+// staticDiscounts is a DiscountVerifier with a fixed set of discount tokens,
+// each granting a percentage off the regular price of all services.
+type staticDiscounts map[string]uint8
+
+// A compile-time constraint to ensure staticDiscounts implements
+// DiscountVerifier.
+var _ DiscountVerifier = (staticDiscounts)(nil)
+
+// NewStaticDiscounts creates a DiscountVerifier for the given map of discount
+// tokens to the percentage they reduce the price by.
+func NewStaticDiscounts(discounts map[string]uint8) (DiscountVerifier, error) {
+	s := make(staticDiscounts, len(discounts))
+	for token, percent := range discounts {
+		if token == "" {
+			return nil, fmt.Errorf("discount token cannot be empty")
+		}
+		if percent > 100 {
+			return nil, fmt.Errorf("discount of %d%% exceeds 100%%",
+				percent)
+		}
+		s[token] = percent
+	}
+	return s, nil
+}
+
+// DiscountedPrice returns the price reduced by the percentage of the given
+// discount token.
+//
+// NOTE: This is part of the DiscountVerifier interface.
+func (s staticDiscounts) DiscountedPrice(_ context.Context, token, _ string,
+	price int64) (int64, error) {
+
+	percent, ok := s[token]
+	if !ok {
+		return 0, ErrUnknownDiscount
+	}
+	return price * int64(100-percent) / 100, nil
+}
+
+// WithDiscounts allows clients to present a discount token in the given header
+// to get a challenge with a lower price. The tokens are verified by the given
+// verifier.
+func WithDiscounts(header string, verifier DiscountVerifier) Option {
+	return func(p *Proxy) error {
+		if header == "" {
+			header = DefaultDiscountHeader
+		}
+		p.discountHeader = header
+		p.discountVerifier = verifier
+		return nil
+	}
+}
+
+// challengePrice returns the price of the challenge for the given request. If
+// the client presented a valid discount token, the discounted price is used.
+// Invalid tokens are ignored so the client still gets the regular challenge.
+func (p *Proxy) challengePrice(r *http.Request, serviceName string,
+	price int64) int64 {
+
+	if p.discountVerifier == nil {
+		return price
+	}
+	token := r.Header.Get(p.discountHeader)
+	if token == "" {
+		return price
+	}
+
+	discounted, err := p.discountVerifier.DiscountedPrice(
+		r.Context(), token, serviceName, price,
+	)
+	if err != nil {
+		log.Debugf("Ignoring discount token for service %s: %v",
+			serviceName, err)
+		return price
+	}
+
+	if discounted < minDiscountedPrice {
+		discounted = minDiscountedPrice
+	}
+	if discounted > price {
+		discounted = price
+	}
+	return discounted
+}
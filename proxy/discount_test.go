@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestChallengePrice makes sure valid discount tokens reduce the price of the
+// challenge and invalid ones are ignored.
+func TestChallengePrice(t *testing.T) {
+	t.Parallel()
+
+	discounts, err := NewStaticDiscounts(map[string]uint8{
+		"half": 50,
+		"free": 100,
+	})
+	if err != nil {
+		t.Fatalf("unable to create discounts: %v", err)
+	}
+	p := &Proxy{}
+	if err := WithDiscounts("", discounts)(p); err != nil {
+		t.Fatalf("unable to apply option: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		expectedPrice int64
+	}{{
+		name:          "no token",
+		expectedPrice: 100,
+	}, {
+		name:          "unknown token",
+		token:         "foo",
+		expectedPrice: 100,
+	}, {
+		name:          "half price",
+		token:         "half",
+		expectedPrice: 50,
+	}, {
+		name:          "minimum price",
+		token:         "free",
+		expectedPrice: minDiscountedPrice,
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.token != "" {
+				req.Header.Set(DefaultDiscountHeader, test.token)
+			}
+
+			price := p.challengePrice(req, "test", 100)
+			if price != test.expectedPrice {
+				t.Fatalf("expected price %d, got %d",
+					test.expectedPrice, price)
+			}
+		})
+	}
+
+	_, err = NewStaticDiscounts(map[string]uint8{"too-much": 101})
+	if err == nil {
+		t.Fatalf("expected discount over 100%% to be rejected")
+	}
+}
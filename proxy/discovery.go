@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDiscoveryInterval is the default interval in which the
+	// backend addresses of services are discovered.
+	DefaultDiscoveryInterval = 30 * time.Second
+
+	// discoveryTimeout is the maximum time a single discovery may take.
+	discoveryTimeout = 10 * time.Second
+)
+
+// ServiceDiscovery is the interface of a source that produces the current set
+// of backend addresses of a service, for example from a service registry.
+type ServiceDiscovery interface {
+	// Discover returns the current host:port addresses of all backends of
+	// a service.
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// dnsSRVDiscovery discovers the backends of a service through DNS SRV records.
+type dnsSRVDiscovery struct {
+	name     string
+	resolver *net.Resolver
+}
+
+// A compile-time constraint to ensure dnsSRVDiscovery implements
+// ServiceDiscovery.
+var _ ServiceDiscovery = (*dnsSRVDiscovery)(nil)
+
+// NewDNSSRVDiscovery creates a new service discovery that looks up the SRV
+// records of the given name, for example "_api._tcp.example.com".
+func NewDNSSRVDiscovery(name string) ServiceDiscovery {
+	return &dnsSRVDiscovery{
+		name:     name,
+		resolver: net.DefaultResolver,
+	}
+}
+
+// Discover returns the addresses of the targets with the lowest priority value
+// of the SRV records, as those are the ones that should be used.
+//
+// NOTE: This is part of the ServiceDiscovery interface.
+func (d *dnsSRVDiscovery) Discover(ctx context.Context) ([]string, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %s", d.name)
+	}
+
+	// LookupSRV already sorts the records by priority.
+	var addresses []string
+	for _, record := range records {
+		if record.Priority != records[0].Priority {
+			break
+		}
+
+		host := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(
+			host, fmt.Sprintf("%d", record.Port),
+		))
+	}
+
+	// Sort the addresses so we can detect changes easily.
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// DiscoveryManager periodically discovers the backend addresses of all
+// services that are configured to use service discovery and updates their
+// routing. The addresses are updated in place, so all other state of the
+// services, like the freebie counters, is kept. The services are looked up
+// anew for every discovery, so services that were reloaded are discovered as
+// well.
+type DiscoveryManager struct {
+	proxy    *Proxy
+	interval time.Duration
+
+	// discoveries are the discoveries by the SRV name they look up. They
+	// are only accessed by the discovery goroutine.
+	discoveries map[string]ServiceDiscovery
+
+	// newDiscovery creates the discovery for an SRV name. It can be
+	// overwritten in tests.
+	newDiscovery func(name string) ServiceDiscovery
+
+	refresh chan struct{}
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDiscoveryManager creates a new manager for the services of the proxy that
+// have service discovery configured. If no interval is given, the default
+// interval is used.
+func NewDiscoveryManager(p *Proxy, interval time.Duration) *DiscoveryManager {
+	if interval == 0 {
+		interval = DefaultDiscoveryInterval
+	}
+
+	return &DiscoveryManager{
+		proxy:        p,
+		interval:     interval,
+		discoveries:  make(map[string]ServiceDiscovery),
+		newDiscovery: NewDNSSRVDiscovery,
+		refresh:      make(chan struct{}, 1),
+		quit:         make(chan struct{}),
+	}
+}
+
+// Start runs an initial discovery for all services and then keeps updating
+// them periodically in the background.
+func (m *DiscoveryManager) Start() {
+	m.discoverAll()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.discoverAll()
+
+			case <-m.refresh:
+				m.discoverAll()
+
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Refresh triggers a discovery for all services right away instead of waiting
+// for the next interval. It should be called after the services of the proxy
+// were updated so new services don't have to wait for their backends.
+func (m *DiscoveryManager) Refresh() {
+	select {
+	case m.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Stop shuts down the periodic discovery.
+func (m *DiscoveryManager) Stop() {
+	close(m.quit)
+	m.wg.Wait()
+}
+
+// discoverAll discovers the backend addresses of all services and updates
+// them. If the discovery of a service fails, its last known addresses are
+// kept.
+func (m *DiscoveryManager) discoverAll() {
+	for _, service := range m.proxy.currentServices() {
+		if service.DiscoverySRV == "" {
+			continue
+		}
+
+		discovery, ok := m.discoveries[service.DiscoverySRV]
+		if !ok {
+			discovery = m.newDiscovery(service.DiscoverySRV)
+			m.discoveries[service.DiscoverySRV] = discovery
+		}
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), discoveryTimeout,
+		)
+		addresses, err := discovery.Discover(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("Unable to discover backends of service "+
+				"%s: %v", service.Name, err)
+			continue
+		}
+
+		// Discovered addresses must also respect the backend allow
+		// list.
+		allowed := addresses[:0]
+		for _, address := range addresses {
+			if !m.proxy.backendAllowed(address) {
+				log.Errorf("Discovered address %s of service "+
+					"%s is not on the backend allow list",
+					address, service.Name)
+				continue
+			}
+			allowed = append(allowed, address)
+		}
+
+		if service.setAddresses(allowed) {
+			log.Infof("Updated backends of service %s to %v",
+				service.Name, allowed)
+		}
+	}
+}
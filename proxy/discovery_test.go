@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+// mockDiscovery is a service discovery that returns a static list of
+// addresses.
+type mockDiscovery struct {
+	addresses []string
+}
+
+func (m *mockDiscovery) Discover(context.Context) ([]string, error) {
+	return m.addresses, nil
+}
+
+// TestDiscoveryManager makes sure discovered addresses that are allowed are
+// used in turn to reach the backend.
+func TestDiscoveryManager(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{}
+	err := WithBackendAllowList([]string{"^10\\.0\\.0\\.[0-9]+$"})(p)
+	if err != nil {
+		t.Fatalf("unable to set allow list: %v", err)
+	}
+
+	service := &Service{
+		Name:         "test",
+		Address:      "10.0.0.1:80",
+		DiscoverySRV: "_test._tcp.example.com",
+	}
+	p.services = []*Service{service}
+
+	discovery := &mockDiscovery{addresses: []string{
+		"10.0.0.2:80", "10.0.0.3:80", "192.168.0.1:80",
+	}}
+	m := NewDiscoveryManager(p, 0)
+	m.newDiscovery = func(string) ServiceDiscovery {
+		return discovery
+	}
+
+	if service.backendAddress() != "10.0.0.1:80" {
+		t.Fatalf("expected static address before discovery")
+	}
+
+	m.discoverAll()
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[service.backendAddress()] = true
+	}
+	if len(seen) != 2 || !seen["10.0.0.2:80"] || !seen["10.0.0.3:80"] {
+		t.Fatalf("unexpected backend addresses: %v", seen)
+	}
+
+	// A failed or empty discovery keeps the last known addresses.
+	discovery.addresses = nil
+	m.discoverAll()
+	if service.backendAddress() == "10.0.0.1:80" {
+		t.Fatalf("expected discovered addresses to be kept")
+	}
+
+	// A reloaded service is discovered as well instead of the one it
+	// replaced.
+	reloaded := &Service{
+		Name:         "test",
+		DiscoverySRV: "_test._tcp.example.com",
+	}
+	p.services = []*Service{reloaded}
+	discovery.addresses = []string{"10.0.0.4:80"}
+	m.discoverAll()
+	if address := reloaded.backendAddress(); address != "10.0.0.4:80" {
+		t.Fatalf("expected reloaded service to be discovered, got %s",
+			address)
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ErrorFormat is the format the proxy uses for the body of the error responses
+// it sends to HTTP clients itself, without involving a backend.
+type ErrorFormat string
+
+const (
+	// ErrorFormatText sends errors as plain text. This is the default.
+	ErrorFormatText ErrorFormat = "text"
+
+	// ErrorFormatJSON sends errors as a JSON object with the fields error
+	// and code, unless the Accept header of the client rules out JSON.
+	ErrorFormatJSON ErrorFormat = "json"
+)
+
+// errorResponse is the body of an error response in the JSON format.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// WithErrorFormat sets the format of the error responses the proxy sends to
+// HTTP clients. gRPC clients always receive errors in the gRPC trailers.
+func WithErrorFormat(format ErrorFormat) Option {
+	return func(p *Proxy) error {
+		switch format {
+		case "":
+			p.errorFormat = ErrorFormatText
+
+		case ErrorFormatText, ErrorFormatJSON:
+			p.errorFormat = format
+
+		default:
+			return fmt.Errorf("unknown error format %s", format)
+		}
+		return nil
+	}
+}
+
+// acceptsJSON returns true if the Accept header of the request allows a JSON
+// response. A request without an Accept header accepts anything.
+func acceptsJSON(r *http.Request) bool {
+	values := r.Header["Accept"]
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(
+				mediaRange,
+			)
+			if err != nil {
+				continue
+			}
+
+			// A quality of zero explicitly excludes the type.
+			if q, ok := params["q"]; ok && strings.Trim(
+				q, "0.",
+			) == "" {
+				continue
+			}
+
+			switch mediaType {
+			case "application/json", "application/*", "*/*":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeError writes an error response with the given status code to an HTTP
+// client in the configured format.
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request,
+	statusCode int, errInfo string) {
+
+	// Browsers get the error page of the service, if it has one.
+	target, ok := serviceFromRequest(r)
+	if ok && statusCode >= 400 &&
+		target.writeErrorPage(w, r, statusCode, errInfo) {
+
+		return
+	}
+
+	if p.errorFormat != ErrorFormatJSON || statusCode < 400 ||
+		!acceptsJSON(r) {
+
+		http.Error(w, errInfo, statusCode)
+		return
+	}
+
+	body, err := json.Marshal(&errorResponse{
+		Error: errInfo,
+		Code:  statusCode,
+	})
+	if err != nil {
+		http.Error(w, errInfo, statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(append(body, '\n'))
+}
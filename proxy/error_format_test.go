@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestWriteError makes sure error responses are rendered in the configured
+// format, respecting the Accept header of the client.
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		format       ErrorFormat
+		accept       string
+		expectedJSON bool
+	}{{
+		name:         "text",
+		format:       ErrorFormatText,
+		accept:       "application/json",
+		expectedJSON: false,
+	}, {
+		name:         "json without accept",
+		format:       ErrorFormatJSON,
+		expectedJSON: true,
+	}, {
+		name:         "json with wildcard",
+		format:       ErrorFormatJSON,
+		accept:       "text/html, */*;q=0.8",
+		expectedJSON: true,
+	}, {
+		name:         "json not accepted",
+		format:       ErrorFormatJSON,
+		accept:       "text/plain",
+		expectedJSON: false,
+	}, {
+		name:         "json excluded",
+		format:       ErrorFormatJSON,
+		accept:       "text/plain, application/json;q=0",
+		expectedJSON: false,
+	}}
+
+	for _, tc := range tests {
+		p := &Proxy{errorFormat: tc.format}
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+
+		p.sendDirectResponse(
+			w, r, http.StatusPaymentRequired, "payment required",
+		)
+
+		if w.Code != http.StatusPaymentRequired {
+			t.Fatalf("%s: unexpected status %d", tc.name, w.Code)
+		}
+		contentType := w.Header().Get("Content-Type")
+		isJSON := strings.HasPrefix(contentType, "application/json")
+		if isJSON != tc.expectedJSON {
+			t.Fatalf("%s: unexpected content type %s", tc.name,
+				contentType)
+		}
+		if !isJSON {
+			continue
+		}
+
+		var resp errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tc.name, err)
+		}
+		if resp.Error != "payment required" ||
+			resp.Code != http.StatusPaymentRequired {
+
+			t.Fatalf("%s: unexpected response %v", tc.name, resp)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorPageData is the data the error page templates of a service are
+// rendered with.
+type ErrorPageData struct {
+	// Service is the name of the service.
+	Service string
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// StatusText is the standard text of the status code.
+	StatusText string
+
+	// Error is the description of the error.
+	Error string
+
+	// Price is the current price of the service in satoshis.
+	Price int64
+
+	// RetryAfter is the value of the Retry-After header of the response,
+	// if any.
+	RetryAfter string
+}
+
+// compileErrorPages parses the error page templates of the service.
+func (s *Service) compileErrorPages() error {
+	if len(s.ErrorPages) == 0 {
+		s.errorPages = nil
+		return nil
+	}
+
+	errorPages := make(map[string]*template.Template, len(s.ErrorPages))
+	for status, path := range s.ErrorPages {
+		key := strings.ToLower(status)
+		if !validErrorPageKey(key) {
+			return fmt.Errorf("invalid error page status %s, "+
+				"expected a code like 402 or a class like 5xx",
+				status)
+		}
+
+		tmpl, err := template.ParseFiles(path)
+		if err != nil {
+			return fmt.Errorf("unable to parse error page %s: %v",
+				path, err)
+		}
+		errorPages[key] = tmpl
+	}
+	s.errorPages = errorPages
+	return nil
+}
+
+// validErrorPageKey returns true if the given key is an error status code
+// between 400 and 599 or one of the classes 4xx and 5xx.
+func validErrorPageKey(key string) bool {
+	if key == "4xx" || key == "5xx" {
+		return true
+	}
+	code, err := strconv.Atoi(key)
+	return err == nil && code >= 400 && code <= 599
+}
+
+// acceptsHTML returns true if the client explicitly accepts HTML responses,
+// like web browsers do. Clients that accept anything are usually API clients,
+// so they don't count.
+func acceptsHTML(r *http.Request) bool {
+	for _, value := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(
+				mediaRange,
+			)
+			if err != nil {
+				continue
+			}
+
+			// A quality of zero explicitly excludes the type.
+			if q, ok := params["q"]; ok && strings.Trim(
+				q, "0.",
+			) == "" {
+				continue
+			}
+
+			switch mediaType {
+			case "text/html", "application/xhtml+xml":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeErrorPage renders the error page of the service for the given status
+// code, preferring a page for the exact code over one for its class. False is
+// returned if the client doesn't accept HTML or there is no page for the
+// status, in which case nothing was written.
+func (s *Service) writeErrorPage(w http.ResponseWriter, r *http.Request,
+	statusCode int, errInfo string) bool {
+
+	if len(s.errorPages) == 0 || !acceptsHTML(r) {
+		return false
+	}
+
+	tmpl, ok := s.errorPages[strconv.Itoa(statusCode)]
+	if !ok {
+		tmpl, ok = s.errorPages[fmt.Sprintf("%dxx", statusCode/100)]
+	}
+	if !ok {
+		return false
+	}
+
+	var page bytes.Buffer
+	err := tmpl.Execute(&page, &ErrorPageData{
+		Service:    s.Name,
+		StatusCode: statusCode,
+		StatusText: http.StatusText(statusCode),
+		Error:      errInfo,
+		Price:      s.currentPrice(r.Method, time.Now()),
+		RetryAfter: w.Header().Get("Retry-After"),
+	})
+	if err != nil {
+		log.Errorf("Unable to render error page of service %s: %v",
+			s.Name, err)
+		return false
+	}
+
+	w.Header().Set(hdrContentType, "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(page.Bytes())
+	return true
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestErrorPages makes sure browsers get the error page of a service while
+// other clients get the regular error responses.
+func TestErrorPages(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "aperture-error-pages")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "402.html")
+	page := "<p>{{.Service}} costs {{.Price}} sat ({{.StatusCode}})</p>"
+	if err := ioutil.WriteFile(path, []byte(page), 0600); err != nil {
+		t.Fatalf("unable to write template: %v", err)
+	}
+
+	services := []*Service{{
+		Name:       "paid",
+		Address:    "127.0.0.1:1",
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      21,
+		ErrorPages: map[string]string{"402": path},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402, got %d", rec.Code)
+	}
+	expected := "<p>paid costs 21 sat (402)</p>"
+	if body := rec.Body.String(); body != expected {
+		t.Fatalf("expected error page %q, got %q", expected, body)
+	}
+
+	// API clients don't get the error page.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "*/*")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if strings.Contains(rec.Body.String(), "<p>") {
+		t.Fatalf("unexpected error page for API client")
+	}
+
+	services[0].ErrorPages = map[string]string{"200": path}
+	if err := services[0].compileErrorPages(); err == nil {
+		t.Fatalf("expected invalid status to be rejected")
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// defaultETagMaxBodySize is the default maximum size of a response
+	// body that is buffered to compute its ETag.
+	defaultETagMaxBodySize = 1024 * 1024
+)
+
+// ComputedETagConfig is the configuration of the ETags aperture computes for
+// the responses of backends that don't send any themselves.
+type ComputedETagConfig struct {
+	// MaxBodySize is the maximum size of a response body in bytes that is
+	// buffered to compute its ETag. Larger responses are sent without
+	// one. Defaults to 1 MiB.
+	MaxBodySize int64 `long:"maxbodysize" description:"Maximum size of a response body an ETag is computed for"`
+}
+
+// validate makes sure the ETag configuration is valid and sets its defaults.
+func (c *ComputedETagConfig) validate() error {
+	switch {
+	case c.MaxBodySize < 0:
+		return fmt.Errorf("max body size cannot be negative")
+
+	case c.MaxBodySize == 0:
+		c.MaxBodySize = defaultETagMaxBodySize
+	}
+
+	return nil
+}
+
+// addComputedETag adds a strong ETag, the hash of the body, to a cacheable
+// response to a GET request if the service computes ETags and the backend
+// didn't send one. The body is buffered to do so. If the request carries a
+// matching If-None-Match header, the response is replaced with a 304, which
+// gives clients of backends without validators conditional requests as well.
+func (s *Service) addComputedETag(res *http.Response) error {
+	c := s.ComputedETags
+	if c == nil || !etagCacheable(res) {
+		return nil
+	}
+	if res.ContentLength > c.MaxBodySize {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, c.MaxBodySize+1))
+	if err != nil {
+		return fmt.Errorf("unable to read response body to compute "+
+			"ETag: %v", err)
+	}
+	if int64(len(body)) > c.MaxBodySize {
+		log.Debugf("Response body of service %s too large to compute "+
+			"ETag", s.Name)
+		res.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), res.Body),
+			Closer: res.Body,
+		}
+		return nil
+	}
+	_ = res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	hash := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(hash[:]) + `"`
+	res.Header.Set("ETag", etag)
+
+	if !etagMatches(res.Request.Header.Get("If-None-Match"), etag) {
+		return nil
+	}
+
+	// The client already has this response, so only the headers that
+	// describe it are sent again.
+	res.StatusCode = http.StatusNotModified
+	res.Status = http.StatusText(http.StatusNotModified)
+	res.Body = http.NoBody
+	res.ContentLength = 0
+	res.Header.Del("Content-Length")
+	res.Header.Del(hdrContentType)
+
+	return nil
+}
+
+// etagCacheable returns true if an ETag can be computed for the response.
+// That's only the case for successful responses to GET requests that the
+// backend didn't add a validator to and that may be stored. Streaming
+// responses are never buffered.
+func etagCacheable(res *http.Response) bool {
+	req := res.Request
+	if req == nil || req.Method != http.MethodGet ||
+		res.StatusCode != http.StatusOK || isGrpcRequest(req) {
+
+		return false
+	}
+	if res.Header.Get("ETag") != "" {
+		return false
+	}
+
+	contentType := strings.ToLower(res.Header.Get(hdrContentType))
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return false
+	}
+
+	for _, directive := range strings.Split(
+		res.Header.Get("Cache-Control"), ",",
+	) {
+
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// etagMatches returns true if the value of an If-None-Match header matches the
+// given ETag. As required for If-None-Match, ETags are compared weakly, so a
+// weak ETag sent by the client matches the strong one of the response.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestComputedETags makes sure ETags are only computed for cacheable responses
+// without one and that matching conditional requests get a 304.
+func TestComputedETags(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/tagged":
+				w.Header().Set("ETag", `"backend"`)
+
+			case "/nostore":
+				w.Header().Set("Cache-Control", "no-store")
+
+			case "/large":
+				_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+				return
+			}
+			_, _ = w.Write([]byte("body"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		ComputedETags: &ComputedETagConfig{
+			MaxBodySize: 64,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	send := func(method, path,
+		ifNoneMatch string) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(method, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("GET", "/", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" ||
+		rec.Body.String() != "body" {
+
+		t.Fatalf("expected body with ETag, got status %d, ETag %q",
+			rec.Code, etag)
+	}
+
+	rec = send("GET", "/", `"other", W/`+etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected empty 304, got status %d", rec.Code)
+	}
+	if rec.Header().Get("ETag") != etag {
+		t.Fatalf("304 is missing the ETag")
+	}
+
+	rec = send("GET", "/", `"other"`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for other ETag, got %d",
+			rec.Code)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		etag   string
+	}{
+		{method: "POST", path: "/"},
+		{method: "GET", path: "/tagged", etag: `"backend"`},
+		{method: "GET", path: "/nostore"},
+		{method: "GET", path: "/large"},
+	}
+	for _, test := range tests {
+		rec := send(test.method, test.path, "")
+		if rec.Header().Get("ETag") != test.etag {
+			t.Fatalf("%s %s: expected ETag %q, got %q",
+				test.method, test.path, test.etag,
+				rec.Header().Get("ETag"))
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// hdrPriceSat is the header of a challenge that contains the price of
+	// the service in satoshis.
+	hdrPriceSat = "X-Price-Sat"
+
+	// hdrPriceFiat is the header of a challenge that contains the
+	// approximate price of the service in a fiat currency, for display
+	// purposes only.
+	hdrPriceFiat = "X-Price-Fiat"
+
+	// DefaultExchangeRateRefresh is the default interval after which
+	// exchange rates are fetched again.
+	DefaultExchangeRateRefresh = 10 * time.Minute
+
+	// exchangeRateTimeout is the maximum duration of a request to the
+	// exchange rate source.
+	exchangeRateTimeout = 5 * time.Second
+
+	// exchangeRateRetryDelay is the duration after a failed fetch of the
+	// exchange rates before they are fetched again.
+	exchangeRateRetryDelay = 30 * time.Second
+)
+
+// ExchangeRateProvider provides the exchange rates that are used to show the
+// approximate fiat price of a service in its challenge.
+type ExchangeRateProvider interface {
+	// BTCPrice returns the price of one bitcoin in the given currency.
+	BTCPrice(ctx context.Context, currency string) (float64, error)
+}
+
+// rateFetch is a fetch of the exchange rates that is in progress. Concurrent
+// callers wait for the same fetch instead of starting their own.
+type rateFetch struct {
+	// done is closed once the fetch completed, after rates and err are
+	// set.
+	done  chan struct{}
+	rates map[string]float64
+	err   error
+}
+
+// httpExchangeRates is an ExchangeRateProvider that fetches the exchange rates
+// from a URL that returns a JSON object mapping currency codes to the price of
+// one bitcoin, for example {"USD": 10000.5, "EUR": 9000}. The rates are cached
+// for the refresh interval. Outdated rates are still used while new ones are
+// fetched in the background and, if that fails, until the next attempt.
+type httpExchangeRates struct {
+	url     string
+	refresh time.Duration
+
+	rates   map[string]float64
+	fetched time.Time
+
+	// fetchErr is the error of the last fetch if it failed at the time
+	// failed. The rates aren't fetched again before exchangeRateRetryDelay
+	// passed.
+	fetchErr error
+	failed   time.Time
+
+	// pending is the fetch in progress, if any.
+	pending *rateFetch
+
+	mtx sync.Mutex
+}
+
+// A compile-time constraint to ensure httpExchangeRates implements
+// ExchangeRateProvider.
+var _ ExchangeRateProvider = (*httpExchangeRates)(nil)
+
+// NewHTTPExchangeRates creates a new exchange rate provider that fetches the
+// rates from the given URL at most once per refresh interval.
+func NewHTTPExchangeRates(url string,
+	refresh time.Duration) ExchangeRateProvider {
+
+	if refresh == 0 {
+		refresh = DefaultExchangeRateRefresh
+	}
+	return &httpExchangeRates{
+		url:     url,
+		refresh: refresh,
+	}
+}
+
+// BTCPrice returns the price of one bitcoin in the given currency.
+//
+// NOTE: This is part of the ExchangeRateProvider interface.
+func (h *httpExchangeRates) BTCPrice(ctx context.Context,
+	currency string) (float64, error) {
+
+	rates, err := h.currentRates(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch exchange rates: %v", err)
+	}
+
+	rate, ok := rates[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	return rate, nil
+}
+
+// currentRates returns the cached exchange rates. If they are outdated, a
+// fetch is started in the background and the outdated rates are returned in
+// the meantime. Only if there are no rates yet, the caller waits for the
+// fetch. The lock is never held while fetching.
+func (h *httpExchangeRates) currentRates(
+	ctx context.Context) (map[string]float64, error) {
+
+	h.mtx.Lock()
+	now := time.Now()
+	outdated := h.rates == nil || now.Sub(h.fetched) >= h.refresh
+	retry := h.fetchErr == nil ||
+		now.Sub(h.failed) >= exchangeRateRetryDelay
+	if outdated && retry && h.pending == nil {
+		h.pending = &rateFetch{done: make(chan struct{})}
+		go h.fetchRates(h.pending)
+	}
+	rates, fetchErr, pending := h.rates, h.fetchErr, h.pending
+	h.mtx.Unlock()
+
+	switch {
+	case rates != nil:
+		return rates, nil
+
+	// The last fetch failed too recently to try again.
+	case pending == nil:
+		return nil, fetchErr
+	}
+
+	select {
+	case <-pending.done:
+		return pending.rates, pending.err
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchRates fetches the exchange rates for the given pending fetch and
+// caches the result, whether the fetch succeeded or failed. It's not bound to
+// the context of any caller, so a caller that gives up doesn't fail the fetch
+// for the others.
+func (h *httpExchangeRates) fetchRates(pending *rateFetch) {
+	rates, err := h.fetch(context.Background())
+
+	h.mtx.Lock()
+	if err != nil {
+		log.Debugf("Unable to fetch exchange rates: %v", err)
+		h.fetchErr = err
+		h.failed = time.Now()
+	} else {
+		h.rates = rates
+		h.fetched = time.Now()
+		h.fetchErr = nil
+	}
+	h.pending = nil
+	h.mtx.Unlock()
+
+	pending.rates, pending.err = rates, err
+	close(pending.done)
+}
+
+// fetch fetches the current exchange rates from the source.
+func (h *httpExchangeRates) fetch(ctx context.Context) (map[string]float64,
+	error) {
+
+	ctx, cancel := context.WithTimeout(ctx, exchangeRateTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var rates map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// WithExchangeRates sets the provider of the exchange rates that are used to
+// show the approximate fiat price in the challenge of services that have a
+// fiat currency configured.
+func WithExchangeRates(provider ExchangeRateProvider) Option {
+	return func(p *Proxy) error {
+		p.exchangeRates = provider
+		return nil
+	}
+}
+
+// addPriceHeaders adds the price of the challenge in satoshis and, if the
+// service has a fiat currency configured, its approximate value in that
+// currency to the given header. The fiat value is for display purposes only,
+// the satoshi amount of the invoice is what the client is charged.
+func (p *Proxy) addPriceHeaders(header http.Header, r *http.Request,
+	target *Service, price int64) {
+
+	if target.FiatCurrency == "" {
+		return
+	}
+
+	header.Set(hdrPriceSat, strconv.FormatInt(price, 10))
+	if p.exchangeRates == nil {
+		return
+	}
+
+	rate, err := p.exchangeRates.BTCPrice(r.Context(), target.FiatCurrency)
+	if err != nil {
+		log.Debugf("Unable to show fiat price of service %s: %v",
+			target.Name, err)
+		return
+	}
+
+	fiat := float64(price) / btcutil.SatoshiPerBitcoin * rate
+	header.Set(
+		hdrPriceFiat, fmt.Sprintf("%s %s", formatFiat(fiat),
+			strings.ToUpper(target.FiatCurrency)),
+	)
+}
+
+// formatFiat formats a fiat amount with two decimals, or with four
+// significant digits for amounts below one cent.
+func formatFiat(amount float64) string {
+	if amount >= 0.01 {
+		return strconv.FormatFloat(amount, 'f', 2, 64)
+	}
+	return strconv.FormatFloat(amount, 'g', 4, 64)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestFiatPriceHeaders makes sure challenges of services with a fiat currency
+// contain the approximate fiat price next to the satoshi price.
+func TestFiatPriceHeaders(t *testing.T) {
+	t.Parallel()
+
+	rateServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"USD": 50000}`))
+		},
+	))
+	defer rateServer.Close()
+
+	services := []*Service{{
+		Name:         "test",
+		Address:      "127.0.0.1:1",
+		HostRegexp:   ".*",
+		Protocol:     "http",
+		Auth:         "on",
+		Price:        2000,
+		FiatCurrency: "usd",
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, false, "",
+		WithExchangeRates(
+			NewHTTPExchangeRates(rateServer.URL, time.Minute),
+		),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402, got %d", rec.Code)
+	}
+	if price := rec.Header().Get(hdrPriceSat); price != "2000" {
+		t.Fatalf("expected satoshi price 2000, got %s", price)
+	}
+	if price := rec.Header().Get(hdrPriceFiat); price != "1.00 USD" {
+		t.Fatalf("expected fiat price 1.00 USD, got %s", price)
+	}
+}
+
+// TestExchangeRateFetch makes sure concurrent callers share a single fetch of
+// the exchange rates and that a failed fetch isn't retried right away.
+func TestExchangeRateFetch(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fetches int32
+		fail    int32 = 1
+	)
+	release := make(chan struct{})
+	rateServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+			if atomic.LoadInt32(&fail) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`{"USD": 50000}`))
+		},
+	))
+	defer rateServer.Close()
+
+	rates := NewHTTPExchangeRates(rateServer.URL, time.Minute)
+	h := rates.(*httpExchangeRates)
+
+	// All callers wait for the same failing fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rates.BTCPrice(context.Background(), "usd")
+			if err == nil {
+				t.Errorf("expected failed fetch")
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected a single fetch, got %d", n)
+	}
+
+	// The failure is cached, so the rates aren't fetched again right
+	// away.
+	if _, err := rates.BTCPrice(context.Background(), "usd"); err == nil {
+		t.Fatalf("expected cached failure")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected failure to be cached, got %d fetches", n)
+	}
+
+	// Once the retry delay passed, the rates are fetched again.
+	atomic.StoreInt32(&fail, 0)
+	h.mtx.Lock()
+	h.failed = time.Now().Add(-exchangeRateRetryDelay)
+	h.mtx.Unlock()
+	rate, err := rates.BTCPrice(context.Background(), "usd")
+	if err != nil || rate != 50000 {
+		t.Fatalf("expected rate 50000, got %v: %v", rate, err)
+	}
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// acquireConcurrencySlot takes a slot of the concurrency limit of the service
+// for the request. The returned function must be called to release the slot
+// once the request completed. If the slots are shared fairly, the client is
+// identified by its token if it was verified and by its IP address otherwise,
+// so clients can't get a bigger share by making up tokens. If the service
+// doesn't limit concurrency, no slot is needed.
+func (s *Service) acquireConcurrencySlot(r *http.Request, clientIP string,
+	authenticated bool) (func(), error) {
+
+	ctx := r.Context()
+	switch {
+	case s.fairness != nil:
+		client := clientIP
+		if authenticated {
+			if id := tokenIDFromHeader(&r.Header); id != "" {
+				client = id
+			}
+		}
+		if err := s.fairness.acquire(ctx, client); err != nil {
+			return nil, err
+		}
+		return func() {
+			s.fairness.release(client)
+		}, nil
+
+	case s.concurrency != nil:
+		if err := s.concurrency.acquire(ctx); err != nil {
+			return nil, err
+		}
+		return s.concurrency.release, nil
+
+	default:
+		return func() {}, nil
+	}
+}
+
+// fairWaiter is a request that waits for a backend slot in the fair queue.
+type fairWaiter struct {
+	// seq is the position of the request in the order of arrival.
+	seq uint64
+
+	// ready is closed once the request was granted a slot.
+	ready chan struct{}
+
+	// granted is set once the request was granted a slot. It's guarded by
+	// the mutex of the limiter.
+	granted bool
+}
+
+// fairConcurrencyLimiter limits the number of requests that are sent to a
+// backend at the same time like the concurrencyLimiter, but shares the slots
+// fairly between clients if there are more requests than slots.
+//
+// The requests waiting for a slot are queued per client. Whenever a slot
+// becomes free, it's granted to the waiting client that currently holds the
+// fewest slots, and within that client to its oldest request. Ties between
+// clients are broken round-robin, the client that got a slot least recently
+// goes first. This is fair queuing with equal weights that converges to the
+// max-min fair share:
+// a single client can use all slots as long as nobody else waits, but once
+// others are waiting, every freed slot goes to them until all clients with
+// waiting requests hold the same number of slots. An aggressive client can
+// therefore never starve the others, no matter how many requests it queues.
+type fairConcurrencyLimiter struct {
+	maxConcurrent int
+	queueSize     int
+	maxWait       time.Duration
+
+	mu     sync.Mutex
+	inUse  int
+	queued int
+
+	// nextSeq is the next number of the sequence that orders the arrival
+	// of waiting requests and the granting of slots.
+	nextSeq uint64
+
+	// active is the number of slots each client currently holds.
+	active map[string]int
+
+	// lastGrant is the sequence number of the last slot granted to each
+	// client that holds a slot or is waiting for one.
+	lastGrant map[string]uint64
+
+	// waiting are the queued requests of each client in order of
+	// arrival.
+	waiting map[string][]*fairWaiter
+}
+
+// newFairConcurrencyLimiter creates a new fair limiter that allows
+// maxConcurrent requests at the same time. Up to queueSize further requests
+// across all clients wait for at most maxWait for a slot to become free. A
+// maxWait of zero rejects them immediately.
+func newFairConcurrencyLimiter(maxConcurrent, queueSize int,
+	maxWait time.Duration) *fairConcurrencyLimiter {
+
+	return &fairConcurrencyLimiter{
+		maxConcurrent: maxConcurrent,
+		queueSize:     queueSize,
+		maxWait:       maxWait,
+		active:        make(map[string]int),
+		lastGrant:     make(map[string]uint64),
+		waiting:       make(map[string][]*fairWaiter),
+	}
+}
+
+// acquire takes a slot for the given client, waiting in its queue if none is
+// free. If a slot was taken, release must be called with the same client once
+// the request completed. An error is returned if no slot became available or
+// the context was canceled while waiting.
+func (l *fairConcurrencyLimiter) acquire(ctx context.Context,
+	client string) error {
+
+	l.mu.Lock()
+
+	// Requests only get a slot right away if nobody is waiting, otherwise
+	// they'd overtake clients with a better claim to it.
+	if l.inUse < l.maxConcurrent && l.queued == 0 {
+		l.grantLocked(client)
+		l.mu.Unlock()
+		return nil
+	}
+
+	if l.maxWait <= 0 {
+		l.mu.Unlock()
+		return errConcurrencyLimit
+	}
+	if l.queued >= l.queueSize {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+
+	w := &fairWaiter{
+		seq:   l.nextSeq,
+		ready: make(chan struct{}),
+	}
+	l.nextSeq++
+	l.waiting[client] = append(l.waiting[client], w)
+	l.queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+
+	case <-timer.C:
+		err = errConcurrencyLimit
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot might have been granted just as we gave up waiting. We
+	// hand it on to the next request then.
+	if w.granted {
+		l.releaseLocked(client)
+		return err
+	}
+
+	queue := l.waiting[client]
+	for i, queued := range queue {
+		if queued == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(l.waiting, client)
+	} else {
+		l.waiting[client] = queue
+	}
+	l.queued--
+	l.forgetLocked(client)
+
+	return err
+}
+
+// release frees a slot the given client took with acquire.
+func (l *fairConcurrencyLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked(client)
+}
+
+// releaseLocked frees a slot of the given client and grants it to the next
+// waiting request. The mutex must be held.
+func (l *fairConcurrencyLimiter) releaseLocked(client string) {
+	l.active[client]--
+	if l.active[client] <= 0 {
+		delete(l.active, client)
+	}
+	l.inUse--
+	l.forgetLocked(client)
+
+	for l.inUse < l.maxConcurrent && l.queued > 0 {
+		l.grantNextLocked()
+	}
+}
+
+// grantLocked takes a slot for the given client. The mutex must be held.
+func (l *fairConcurrencyLimiter) grantLocked(client string) {
+	l.nextSeq++
+	l.inUse++
+	l.active[client]++
+	l.lastGrant[client] = l.nextSeq
+}
+
+// forgetLocked removes the bookkeeping of a client that neither holds a slot
+// nor waits for one. The mutex must be held.
+func (l *fairConcurrencyLimiter) forgetLocked(client string) {
+	if l.active[client] == 0 && len(l.waiting[client]) == 0 {
+		delete(l.lastGrant, client)
+	}
+}
+
+// grantNextLocked grants a slot to the oldest request of the waiting client
+// that holds the fewest slots and, among those, got a slot least recently. The
+// mutex must be held and at least one request must be waiting.
+func (l *fairConcurrencyLimiter) grantNextLocked() {
+	var (
+		next     string
+		nextHead *fairWaiter
+	)
+	for client, queue := range l.waiting {
+		head := queue[0]
+		switch {
+		case nextHead == nil:
+
+		case l.active[client] > l.active[next]:
+			continue
+
+		case l.active[client] == l.active[next] &&
+			l.lastGrant[client] > l.lastGrant[next]:
+
+			continue
+
+		case l.active[client] == l.active[next] &&
+			l.lastGrant[client] == l.lastGrant[next] &&
+			head.seq > nextHead.seq:
+
+			continue
+		}
+
+		next, nextHead = client, head
+	}
+
+	queue := l.waiting[next]
+	if len(queue) == 1 {
+		delete(l.waiting, next)
+	} else {
+		l.waiting[next] = queue[1:]
+	}
+	l.queued--
+	l.grantLocked(next)
+
+	nextHead.granted = true
+	close(nextHead.ready)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestFairConcurrencyLimiter makes sure a freed slot goes to the waiting
+// client that holds the fewest slots instead of the oldest request.
+func TestFairConcurrencyLimiter(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	limiter := newFairConcurrencyLimiter(1, 10, 5*time.Second)
+
+	waitQueued := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			limiter.mu.Lock()
+			queued := limiter.queued
+			limiter.mu.Unlock()
+			if queued == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("expected %d queued requests", n)
+	}
+
+	if err := limiter.acquire(ctx, "greedy"); err != nil {
+		t.Fatalf("unable to acquire slot: %v", err)
+	}
+
+	// The greedy client queues two more requests before the other client
+	// queues one.
+	granted := make(chan string, 3)
+	acquire := func(client string) {
+		if err := limiter.acquire(ctx, client); err != nil {
+			t.Errorf("unable to acquire slot: %v", err)
+			return
+		}
+		granted <- client
+	}
+	go acquire("greedy")
+	waitQueued(1)
+	go acquire("greedy")
+	waitQueued(2)
+	go acquire("other")
+	waitQueued(3)
+
+	// Although it arrived last, the other client gets the slot first as
+	// it doesn't hold any.
+	limiter.release("greedy")
+	if client := <-granted; client != "other" {
+		t.Fatalf("expected other client to get the slot, got %s",
+			client)
+	}
+
+	limiter.release("other")
+	if client := <-granted; client != "greedy" {
+		t.Fatalf("expected greedy client to get the slot, got %s",
+			client)
+	}
+
+	// Requests that don't get a slot in time are removed from the queue.
+	limiter = newFairConcurrencyLimiter(1, 1, 10*time.Millisecond)
+	_ = limiter.acquire(ctx, "a")
+	if err := limiter.acquire(ctx, "b"); err != errConcurrencyLimit {
+		t.Fatalf("expected concurrency limit error, got %v", err)
+	}
+	if limiter.queued != 0 || len(limiter.waiting) != 0 {
+		t.Fatalf("expected empty queue after timeout")
+	}
+}
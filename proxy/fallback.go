@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// checkFallbackServices makes sure at most one service is designated as the
+// fallback for unmatched requests and that it can handle HTTP requests.
+func checkFallbackServices(services []*Service) error {
+	var fallback *Service
+	for _, service := range services {
+		if !service.Fallback {
+			continue
+		}
+
+		if service.TLSPassthrough {
+			return fmt.Errorf("TLS passthrough service %s cannot "+
+				"be the fallback service", service.Name)
+		}
+		if fallback != nil {
+			return fmt.Errorf("services %s and %s are both "+
+				"fallback services", fallback.Name,
+				service.Name)
+		}
+		fallback = service
+	}
+
+	return nil
+}
+
+// matchFallback returns the fallback service for a request that didn't match
+// any other service. Requests for files the static file server serves are
+// left to it, as are all requests if the fallback service has no healthy
+// backends.
+func (p *Proxy) matchFallback(r *http.Request) (*Service, bool) {
+	for _, service := range p.currentServices() {
+		if !service.Fallback || !service.available() {
+			continue
+		}
+
+		if p.staticClaims(r) {
+			return nil, false
+		}
+
+		log.Debugf("Request [%s%s] didn't match any service, using "+
+			"fallback service [%s].", r.Host, r.URL.Path,
+			service.Name)
+		return service, true
+	}
+
+	return nil, false
+}
+
+// staticClaims returns true if static serving is enabled and the static root
+// contains a file or directory for the path of the request.
+func (p *Proxy) staticClaims(r *http.Request) bool {
+	if p.staticFiles == nil {
+		return false
+	}
+
+	f, err := p.staticFiles.Open(path.Clean("/" + r.URL.Path))
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+
+	return true
+}
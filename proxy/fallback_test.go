@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestFallbackService makes sure the fallback service only handles requests
+// that neither match another service nor a static file.
+func TestFallbackService(t *testing.T) {
+	t.Parallel()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			},
+		))
+	}
+	api := newBackend("api")
+	defer api.Close()
+	catchAll := newBackend("fallback")
+	defer catchAll.Close()
+
+	staticRoot, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatalf("unable to create static root: %v", err)
+	}
+	defer os.RemoveAll(staticRoot)
+	err = ioutil.WriteFile(
+		filepath.Join(staticRoot, "app.js"), []byte("static"),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf("unable to write static file: %v", err)
+	}
+
+	services := []*Service{{
+		Name:       "fallback",
+		Address:    strings.TrimPrefix(catchAll.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		Fallback:   true,
+	}, {
+		Name:       "api",
+		Address:    strings.TrimPrefix(api.URL, "http://"),
+		HostRegexp: ".*",
+		PathRegexp: "^/api/.*$",
+		Protocol:   "http",
+		Auth:       "off",
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, true, staticRoot,
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	testCases := map[string]string{
+		"/api/items": "api",
+		"/app.js":    "static",
+		"/other":     "fallback",
+	}
+	for path, expected := range testCases {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Body.String() != expected {
+			t.Fatalf("expected %s to be served by %s, got %q",
+				path, expected, rec.Body.String())
+		}
+	}
+
+	twoFallbacks := []*Service{
+		{Name: "a", Fallback: true}, {Name: "b", Fallback: true},
+	}
+	if err := checkFallbackServices(twoFallbacks); err == nil {
+		t.Fatalf("expected two fallback services to be rejected")
+	}
+}
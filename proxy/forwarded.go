@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+const (
+	// forwardedHeadersSet is the forwarded headers mode that sets the
+	// X-Forwarded-Proto, -Host and -Port headers from the request aperture
+	// received, replacing any values the client sent.
+	forwardedHeadersSet = "set"
+
+	// forwardedHeadersPreserve is the forwarded headers mode that keeps the
+	// values a proxy in front of aperture set and only adds the ones that
+	// are missing.
+	forwardedHeadersPreserve = "preserve"
+
+	// hdrForwardedProto is the header the scheme of the original request
+	// is sent to the backend in.
+	hdrForwardedProto = "X-Forwarded-Proto"
+
+	// hdrForwardedHost is the header the host of the original request is
+	// sent to the backend in.
+	hdrForwardedHost = "X-Forwarded-Host"
+
+	// hdrForwardedPort is the header the port of the original request is
+	// sent to the backend in.
+	hdrForwardedPort = "X-Forwarded-Port"
+)
+
+// forwardedHeaders returns the headers that tell the backend the scheme, host
+// and port the client sent the request to, so it can construct external URLs.
+// It must be called before the request is rewritten to address the backend.
+// The headers are returned instead of set, so they can be added after the
+// gRPC metadata of the client was filtered.
+func (s *Service) forwardedHeaders(req *http.Request) http.Header {
+	if s.ForwardedHeaders == "" {
+		return nil
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	host := req.Host
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		host, port = h, p
+	}
+
+	values := []struct {
+		name  string
+		value string
+	}{
+		{hdrForwardedProto, proto},
+		{hdrForwardedHost, host},
+		{hdrForwardedPort, port},
+	}
+	header := make(http.Header, len(values))
+	for _, v := range values {
+		// Behind another proxy, the client connected to that one, so
+		// the values it set describe the original request.
+		if s.ForwardedHeaders == forwardedHeadersPreserve &&
+			req.Header.Get(v.name) != "" {
+
+			header[v.name] = req.Header[v.name]
+			continue
+		}
+		header.Set(v.name, v.value)
+	}
+	return header
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestSetForwardedHeaders makes sure the forwarded headers describe the
+// original request in each mode.
+func TestSetForwardedHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		mode          string
+		host          string
+		tls           bool
+		clientProto   string
+		expectedProto string
+		expectedHost  string
+		expectedPort  string
+	}{{
+		name:          "off",
+		host:          "api.example.com",
+		clientProto:   "gopher",
+		expectedProto: "gopher",
+	}, {
+		name:          "set plain",
+		mode:          forwardedHeadersSet,
+		host:          "api.example.com:8080",
+		clientProto:   "https",
+		expectedProto: "http",
+		expectedHost:  "api.example.com",
+		expectedPort:  "8080",
+	}, {
+		name:          "set tls",
+		mode:          forwardedHeadersSet,
+		host:          "api.example.com",
+		tls:           true,
+		expectedProto: "https",
+		expectedHost:  "api.example.com",
+		expectedPort:  "443",
+	}, {
+		name:          "preserve",
+		mode:          forwardedHeadersPreserve,
+		host:          "api.example.com",
+		clientProto:   "https",
+		expectedProto: "https",
+		expectedHost:  "api.example.com",
+		expectedPort:  "80",
+	}}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tc.host
+		req.TLS = nil
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tc.clientProto != "" {
+			req.Header.Set(hdrForwardedProto, tc.clientProto)
+		}
+
+		s := &Service{ForwardedHeaders: tc.mode}
+		for name, values := range s.forwardedHeaders(req) {
+			req.Header[name] = values
+		}
+
+		expected := map[string]string{
+			hdrForwardedProto: tc.expectedProto,
+			hdrForwardedHost:  tc.expectedHost,
+			hdrForwardedPort:  tc.expectedPort,
+		}
+		for name, value := range expected {
+			if req.Header.Get(name) != value {
+				t.Fatalf("%s: expected %s %q, got %q", tc.name,
+					name, value, req.Header.Get(name))
+			}
+		}
+	}
+}
+
+// TestForwardedHeadersGrpcMetadata makes sure the forwarded headers reach gRPC
+// backends that only allow some metadata of the client.
+func TestForwardedHeadersGrpcMetadata(t *testing.T) {
+	t.Parallel()
+
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:              "service",
+		Address:           "127.0.0.1:10009",
+		HostRegexp:        ".*",
+		Protocol:          "https",
+		Auth:              auth.LevelOff,
+		ForwardedHeaders:  forwardedHeadersSet,
+		GrpcMetadataAllow: []string{"x-allowed"},
+	}}, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/pkg.Service/Call", nil)
+	req.Host = "api.example.com"
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	req.Header.Set("X-Other", "value")
+	p.director(req)
+
+	if req.Header.Get("X-Other") != "" {
+		t.Fatalf("expected metadata that isn't allowed to be stripped")
+	}
+	if host := req.Header.Get(hdrForwardedHost); host != "api.example.com" {
+		t.Fatalf("expected forwarded host api.example.com, got %q",
+			host)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// maxFreebieIPv4PrefixLen is the longest prefix IPv4 addresses can be
+	// grouped by. The freebie stores always mask the last byte of IPv4
+	// addresses, so longer prefixes would have no effect.
+	maxFreebieIPv4PrefixLen = 24
+)
+
+// validateFreebiePrefixes makes sure the prefix lengths the freebie keys are
+// grouped by are valid for their address family.
+func (s *Service) validateFreebiePrefixes() error {
+	if s.FreebieIPv4Prefix < 0 ||
+		s.FreebieIPv4Prefix > maxFreebieIPv4PrefixLen {
+
+		return fmt.Errorf("IPv4 prefix length must be between 1 and "+
+			"%d", maxFreebieIPv4PrefixLen)
+	}
+	if s.FreebieIPv6Prefix < 0 || s.FreebieIPv6Prefix > 128 {
+		return fmt.Errorf("IPv6 prefix length must be between 1 and " +
+			"128")
+	}
+	return nil
+}
+
+// freebieIP returns the address the free requests of the client with the
+// given IP address are counted for. If the service groups addresses by a
+// prefix, it's the first address of the client's network, so all clients in
+// that network share the same freebies.
+func (s *Service) freebieIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		if s.FreebieIPv4Prefix == 0 {
+			return ip
+		}
+		return ip4.Mask(net.CIDRMask(s.FreebieIPv4Prefix, 32))
+	}
+
+	if s.FreebieIPv6Prefix == 0 || len(ip) != net.IPv6len {
+		return ip
+	}
+	return ip.Mask(net.CIDRMask(s.FreebieIPv6Prefix, 128))
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+// TestFreebieIP makes sure client addresses are grouped by the configured
+// prefixes only.
+func TestFreebieIP(t *testing.T) {
+	t.Parallel()
+
+	grouped := &Service{FreebieIPv4Prefix: 16, FreebieIPv6Prefix: 64}
+	tests := []struct {
+		service *Service
+		ip      string
+		want    string
+	}{{
+		service: &Service{},
+		ip:      "10.1.2.3",
+		want:    "10.1.2.3",
+	}, {
+		service: &Service{},
+		ip:      "2001:db8:1:2:3::4",
+		want:    "2001:db8:1:2:3::4",
+	}, {
+		service: grouped,
+		ip:      "10.1.2.3",
+		want:    "10.1.0.0",
+	}, {
+		service: grouped,
+		ip:      "::ffff:10.1.2.3",
+		want:    "10.1.0.0",
+	}, {
+		service: grouped,
+		ip:      "2001:db8:1:2:3::4",
+		want:    "2001:db8:1:2::",
+	}}
+
+	for _, test := range tests {
+		ip := test.service.freebieIP(net.ParseIP(test.ip))
+		if ip.String() != test.want {
+			t.Fatalf("expected %s to be grouped as %s, got %s",
+				test.ip, test.want, ip)
+		}
+	}
+
+	invalid := []*Service{
+		{FreebieIPv4Prefix: 25},
+		{FreebieIPv6Prefix: 129},
+		{FreebieIPv4Prefix: -1},
+	}
+	for _, service := range invalid {
+		if err := service.validateFreebiePrefixes(); err == nil {
+			t.Fatalf("expected error for prefixes /%d and /%d",
+				service.FreebieIPv4Prefix,
+				service.FreebieIPv6Prefix)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/lightninglabs/aperture/freebie"
+)
+
+// refundFreebie gives the client back the free request it used if the request
+// was answered with a server error and the service refunds those.
+func (s *Service) refundFreebie(r *http.Request, remoteIP net.IP,
+	status int) {
+
+	if !s.FreebieRefundServerErrors || status < 500 {
+		return
+	}
+
+	db, ok := s.freebieDb.(freebie.RefundDB)
+	if !ok {
+		return
+	}
+
+	if err := db.RefundFreebie(r, remoteIP); err != nil {
+		log.Errorf("Unable to refund freebie of service %s: %v",
+			s.Name, err)
+		return
+	}
+	log.Debugf("Refunded freebie of service %s for request answered "+
+		"with status %d.", s.Name, status)
+}
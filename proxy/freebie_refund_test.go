@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestFreebieRefundServerErrors makes sure free requests answered with a
+// server error aren't counted if the service refunds them.
+func TestFreebieRefundServerErrors(t *testing.T) {
+	t.Parallel()
+
+	status := int32(http.StatusInternalServerError)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		},
+	))
+	defer backend.Close()
+
+	address := strings.TrimPrefix(backend.URL, "http://")
+	services := []*Service{{
+		Name:                      "free",
+		Address:                   address,
+		HostRegexp:                ".*",
+		Protocol:                  "http",
+		Auth:                      "freebie 1",
+		FreebieRefundServerErrors: true,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// Failed requests don't use up the single freebie.
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", rec.Code)
+		}
+	}
+
+	// A successful one does, so the next request needs to be paid for.
+	atomic.StoreInt32(&status, http.StatusOK)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402, got %d", rec.Code)
+	}
+
+	// Cookies are updated before the backend answers, so they can't be
+	// refunded.
+	services[0].FreebieStrategy = freebieStrategyCookie
+	services[0].FreebieCookieKey = strings.Repeat("ab", 32)
+	if err := p.UpdateServices(services); err == nil {
+		t.Fatalf("expected refunds with cookie strategy to fail")
+	}
+}
+
+// TestFreebieNotCountedWhenRejected makes sure free requests that are rejected
+// by a limit of the service don't use up the client's freebies.
+func TestFreebieNotCountedWhenRejected(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:           "free",
+		Address:        strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:     ".*",
+		Protocol:       "http",
+		Auth:           "freebie 2",
+		RateLimit:      0.001,
+		RateLimitBurst: 1,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// The first request uses up the rate limit, the second one is
+	// rejected.
+	var req *http.Request
+	statuses := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, status := range statuses {
+		req = httptest.NewRequest("GET", "/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("expected status %d, got %d", status,
+				rec.Code)
+		}
+	}
+
+	// Only the admitted request was counted, so the client has one
+	// freebie left.
+	service := p.currentServices()[0]
+	ip := service.freebieIP(net.ParseIP("192.0.2.1"))
+	ok, err := service.freebieDb.CanPass(req, ip)
+	if err != nil || !ok {
+		t.Fatalf("expected a freebie to be left: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	// privateNetworks are the networks that are never looked up in the
+	// GeoIP database since they don't belong to a country.
+	privateNetworks = mustParseCIDRs(
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+		"100.64.0.0/10", "fc00::/7",
+	)
+)
+
+// mustParseCIDRs parses the given networks and panics if any of them is
+// invalid.
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// geoRange is a range of IP addresses that belong to a country. The addresses
+// are stored in their 16 byte form so IPv4 and IPv6 ranges can be compared.
+type geoRange struct {
+	first   net.IP
+	last    net.IP
+	country string
+}
+
+// GeoIPDB resolves the country of IP addresses from a list of networks. It is
+// safe for concurrent use.
+type GeoIPDB struct {
+	// ranges is sorted by the first address of each range so lookups
+	// can use a binary search.
+	ranges []geoRange
+}
+
+// LoadGeoIPDB loads a GeoIP database from a CSV file. Each line consists of a
+// network in CIDR notation and the ISO 3166-1 alpha-2 code of its country, for
+// example "192.0.2.0/24,CH". Lines starting with # are ignored. Such a file
+// can be generated from most GeoIP databases that offer a CSV export.
+func LoadGeoIPDB(path string) (*GeoIPDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open GeoIP database: %v",
+			err)
+	}
+	defer file.Close()
+
+	return readGeoIPDB(file)
+}
+
+// readGeoIPDB reads a GeoIP database in the CSV format of LoadGeoIPDB.
+func readGeoIPDB(r io.Reader) (*GeoIPDB, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	db := &GeoIPDB{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP database: %v",
+				err)
+		}
+
+		_, network, err := net.ParseCIDR(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid network in GeoIP "+
+				"database: %v", err)
+		}
+		country := strings.ToUpper(record[1])
+		if len(country) != 2 {
+			return nil, fmt.Errorf("invalid country code %s in "+
+				"GeoIP database", record[1])
+		}
+
+		first := network.IP.To16()
+		last := make(net.IP, net.IPv6len)
+		mask := network.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		db.ranges = append(db.ranges, geoRange{
+			first:   first,
+			last:    last,
+			country: country,
+		})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].first, db.ranges[j].first) < 0
+	})
+	return db, nil
+}
+
+// Country returns the country code of the given IP address or an empty string
+// if the address is private or not part of the database.
+func (g *GeoIPDB) Country(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() {
+
+		return ""
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+
+	// Find the last range that starts at or before the address.
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].first, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	r := g.ranges[i-1]
+	if bytes.Compare(ip, r.last) > 0 {
+		return ""
+	}
+	return r.country
+}
+
+// WithGeoIP sets the database used to resolve the country of clients for the
+// services that forward it to their backend.
+func WithGeoIP(db *GeoIPDB) Option {
+	return func(p *Proxy) error {
+		p.geoIP = db
+		return nil
+	}
+}
+
+// setCountryHeader sets the country of the client in the request header that
+// is forwarded to the backend, if the service asks for it. A value sent by the
+// client itself is always removed so it can't be spoofed.
+func (p *Proxy) setCountryHeader(r *http.Request, target *Service,
+	clientIP net.IP) {
+
+	if target.CountryHeader == "" {
+		return
+	}
+
+	r.Header.Del(target.CountryHeader)
+	if p.geoIP == nil {
+		return
+	}
+	if country := p.geoIP.Country(clientIP); country != "" {
+		r.Header.Set(target.CountryHeader, country)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestGeoIPDB makes sure the country of an address is resolved from the
+// networks of the database.
+func TestGeoIPDB(t *testing.T) {
+	t.Parallel()
+
+	db, err := readGeoIPDB(strings.NewReader(
+		"# network,country\n" +
+			"203.0.113.0/24,ch\n" +
+			"198.51.100.0/25,DE\n" +
+			"2001:db8::/32,US\n",
+	))
+	if err != nil {
+		t.Fatalf("unable to read database: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "203.0.113.1", expected: "CH"},
+		{ip: "203.0.113.255", expected: "CH"},
+		{ip: "198.51.100.127", expected: "DE"},
+		{ip: "198.51.100.128", expected: ""},
+		{ip: "2001:db8::1", expected: "US"},
+		{ip: "2001:db9::1", expected: ""},
+		{ip: "1.1.1.1", expected: ""},
+		{ip: "10.0.0.1", expected: ""},
+		{ip: "127.0.0.1", expected: ""},
+	}
+	for _, tc := range tests {
+		country := db.Country(net.ParseIP(tc.ip))
+		if country != tc.expected {
+			t.Fatalf("expected country %q for %s, got %q",
+				tc.expected, tc.ip, country)
+		}
+	}
+
+	// A country header sent by the client must never reach the backend.
+	p := &Proxy{geoIP: db}
+	service := &Service{CountryHeader: "X-Client-Country"}
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	r.Header.Set("X-Client-Country", "CH")
+	p.setCountryHeader(r, service, net.ParseIP("1.1.1.1"))
+	if country := r.Header.Get("X-Client-Country"); country != "" {
+		t.Fatalf("spoofed country %s was forwarded", country)
+	}
+	p.setCountryHeader(r, service, net.ParseIP("198.51.100.1"))
+	if country := r.Header.Get("X-Client-Country"); country != "DE" {
+		t.Fatalf("expected country DE, got %s", country)
+	}
+
+	_, err = readGeoIPDB(strings.NewReader("1.2.3.4,CH\n"))
+	if err == nil {
+		t.Fatalf("expected error for invalid network")
+	}
+}
+
+// TestCountryHeaderGrpcMetadata makes sure the country header reaches gRPC
+// backends that only allow some metadata of the client.
+func TestCountryHeaderGrpcMetadata(t *testing.T) {
+	t.Parallel()
+
+	db, err := readGeoIPDB(strings.NewReader("192.0.2.0/24,NL\n"))
+	if err != nil {
+		t.Fatalf("unable to read database: %v", err)
+	}
+	p, err := New(auth.NewMockAuthenticator(), []*Service{{
+		Name:              "service",
+		Address:           "127.0.0.1:10009",
+		HostRegexp:        ".*",
+		Protocol:          "https",
+		Auth:              auth.LevelOff,
+		CountryHeader:     "X-Client-Country",
+		GrpcMetadataAllow: []string{"x-allowed"},
+	}}, false, "", WithGeoIP(db))
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// The request of httptest comes from 192.0.2.1.
+	req := httptest.NewRequest("POST", "/pkg.Service/Call", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	p.director(req)
+
+	if country := req.Header.Get("X-Client-Country"); country != "NL" {
+		t.Fatalf("expected country NL, got %q", country)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// hdrGrpcMetadataPrefix is the prefix of header fields that carry gRPC
+	// metadata for REST clients, for example through grpc-gateway.
+	hdrGrpcMetadataPrefix = "Grpc-Metadata-"
+)
+
+var (
+	// grpcReservedHeaders is the set of header fields that are part of the
+	// gRPC protocol itself and are therefore never treated as custom
+	// metadata of a gRPC request.
+	grpcReservedHeaders = map[string]struct{}{
+		"Accept-Encoding":      {},
+		"Authorization":        {},
+		"Content-Length":       {},
+		"Content-Type":         {},
+		"Grpc-Accept-Encoding": {},
+		"Grpc-Encoding":        {},
+		"Grpc-Timeout":         {},
+		"Te":                   {},
+		"User-Agent":           {},
+	}
+)
+
+// metadataKey returns the gRPC metadata key carried in the given header field
+// or false if the field doesn't carry custom metadata. For gRPC requests every
+// non-reserved header field is metadata, for all other requests only the
+// fields with the Grpc-Metadata- prefix are.
+func metadataKey(headerName string, grpcRequest bool) (string, bool) {
+	canonical := http.CanonicalHeaderKey(headerName)
+	if strings.HasPrefix(canonical, hdrGrpcMetadataPrefix) {
+		key := strings.TrimPrefix(canonical, hdrGrpcMetadataPrefix)
+		return strings.ToLower(key), true
+	}
+
+	if !grpcRequest {
+		return "", false
+	}
+	if _, ok := grpcReservedHeaders[canonical]; ok {
+		return "", false
+	}
+	return strings.ToLower(canonical), true
+}
+
+// hasKeyPrefix returns true if the metadata key starts with any of the given
+// prefixes. The comparison is case insensitive.
+func hasKeyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterGrpcMetadata removes all custom gRPC metadata from the request header
+// that the service isn't configured to receive. Keys that match a deny prefix
+// are always removed. If allow prefixes are configured, keys must also match
+// one of them to be forwarded.
+func (s *Service) filterGrpcMetadata(req *http.Request) {
+	if len(s.GrpcMetadataAllow) == 0 && len(s.GrpcMetadataDeny) == 0 {
+		return
+	}
+
+	grpcRequest := isGrpcRequest(req)
+	for name := range req.Header {
+		key, ok := metadataKey(name, grpcRequest)
+		if !ok {
+			continue
+		}
+
+		denied := hasKeyPrefix(key, s.GrpcMetadataDeny)
+		allowed := len(s.GrpcMetadataAllow) == 0 ||
+			hasKeyPrefix(key, s.GrpcMetadataAllow)
+		if denied || !allowed {
+			log.Debugf("Stripping gRPC metadata [%s] from request "+
+				"to service %s.", key, s.Name)
+			req.Header.Del(name)
+		}
+	}
+}
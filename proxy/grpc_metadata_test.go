@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestFilterGrpcMetadata makes sure only the allowed and not denied gRPC
+// metadata is forwarded to the backend.
+func TestFilterGrpcMetadata(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		Name:              "test",
+		GrpcMetadataAllow: []string{"x-public-"},
+		GrpcMetadataDeny:  []string{"x-public-secret"},
+	}
+
+	// For a gRPC request, all non-reserved header fields are metadata.
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	req.Header.Set("X-Public-Id", "1")
+	req.Header.Set("X-Public-Secret-Key", "2")
+	req.Header.Set("X-Internal-User", "3")
+	req.Header.Set("Grpc-Timeout", "1S")
+	service.filterGrpcMetadata(req)
+
+	assertHeader(t, req.Header, "X-Public-Id", true)
+	assertHeader(t, req.Header, "X-Public-Secret-Key", false)
+	assertHeader(t, req.Header, "X-Internal-User", false)
+	assertHeader(t, req.Header, "Grpc-Timeout", true)
+	assertHeader(t, req.Header, hdrContentType, true)
+
+	// For a REST request, only the prefixed fields are metadata.
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Grpc-Metadata-X-Public-Id", "1")
+	req.Header.Set("Grpc-Metadata-X-Internal-User", "2")
+	req.Header.Set("X-Internal-User", "3")
+	service.filterGrpcMetadata(req)
+
+	assertHeader(t, req.Header, "Grpc-Metadata-X-Public-Id", true)
+	assertHeader(t, req.Header, "Grpc-Metadata-X-Internal-User", false)
+	assertHeader(t, req.Header, "X-Internal-User", true)
+}
+
+func assertHeader(t *testing.T, header http.Header, name string,
+	expected bool) {
+
+	t.Helper()
+
+	if (header.Get(name) != "") != expected {
+		t.Fatalf("expected header %s present to be %v", name, expected)
+	}
+}
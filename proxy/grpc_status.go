@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	hdrGrpcStatus  = "Grpc-Status"
+	hdrGrpcMessage = "Grpc-Message"
+)
+
+var (
+	// grpcCodeNames maps the canonical upper case name of each gRPC status
+	// code to the code itself. The names are used to configure custom
+	// mappings in the service configuration.
+	grpcCodeNames = map[string]codes.Code{
+		"OK":                  codes.OK,
+		"CANCELLED":           codes.Canceled,
+		"UNKNOWN":             codes.Unknown,
+		"INVALID_ARGUMENT":    codes.InvalidArgument,
+		"DEADLINE_EXCEEDED":   codes.DeadlineExceeded,
+		"NOT_FOUND":           codes.NotFound,
+		"ALREADY_EXISTS":      codes.AlreadyExists,
+		"PERMISSION_DENIED":   codes.PermissionDenied,
+		"RESOURCE_EXHAUSTED":  codes.ResourceExhausted,
+		"FAILED_PRECONDITION": codes.FailedPrecondition,
+		"ABORTED":             codes.Aborted,
+		"OUT_OF_RANGE":        codes.OutOfRange,
+		"UNIMPLEMENTED":       codes.Unimplemented,
+		"INTERNAL":            codes.Internal,
+		"UNAVAILABLE":         codes.Unavailable,
+		"DATA_LOSS":           codes.DataLoss,
+		"UNAUTHENTICATED":     codes.Unauthenticated,
+	}
+
+	// defaultGrpcToHTTPStatus is the default table used to translate a
+	// gRPC status code returned by a backend into an HTTP status code for
+	// HTTP clients. It follows the mapping used by grpc-gateway:
+	//
+	//   OK                  -> 200 OK
+	//   CANCELLED           -> 408 Request Timeout
+	//   UNKNOWN             -> 500 Internal Server Error
+	//   INVALID_ARGUMENT    -> 400 Bad Request
+	//   DEADLINE_EXCEEDED   -> 504 Gateway Timeout
+	//   NOT_FOUND           -> 404 Not Found
+	//   ALREADY_EXISTS      -> 409 Conflict
+	//   PERMISSION_DENIED   -> 403 Forbidden
+	//   RESOURCE_EXHAUSTED  -> 429 Too Many Requests
+	//   FAILED_PRECONDITION -> 400 Bad Request
+	//   ABORTED             -> 409 Conflict
+	//   OUT_OF_RANGE        -> 400 Bad Request
+	//   UNIMPLEMENTED       -> 501 Not Implemented
+	//   INTERNAL            -> 500 Internal Server Error
+	//   UNAVAILABLE         -> 503 Service Unavailable
+	//   DATA_LOSS           -> 500 Internal Server Error
+	//   UNAUTHENTICATED     -> 401 Unauthorized
+	defaultGrpcToHTTPStatus = map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           http.StatusRequestTimeout,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+)
+
+// isGrpcRequest returns true if the given request was sent by a gRPC client.
+// Every gRPC request should have the Content-Type header field set
+// accordingly so we can use that.
+func isGrpcRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc)
+}
+
+// sendGrpcStatus sends a trailers-only gRPC response with the given status to
+// a gRPC client. Unlike a plain HTTP error, the client can read the status
+// code and message from it.
+func sendGrpcStatus(w http.ResponseWriter, code codes.Code, msg string) {
+	w.Header().Set(hdrContentType, hdrTypeGrpc)
+	w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(code)))
+	w.Header().Set(hdrGrpcMessage, msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseGrpcStatusMapping validates a custom gRPC status to HTTP status mapping
+// from the configuration and returns it keyed by gRPC code.
+func parseGrpcStatusMapping(
+	mapping map[string]int) (map[codes.Code]int, error) {
+
+	res := make(map[codes.Code]int, len(mapping))
+	for name, httpStatus := range mapping {
+		code, ok := grpcCodeNames[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown gRPC status code %s",
+				name)
+		}
+		if http.StatusText(httpStatus) == "" {
+			return nil, fmt.Errorf("invalid HTTP status %d for "+
+				"gRPC status code %s", httpStatus, name)
+		}
+		res[code] = httpStatus
+	}
+
+	return res, nil
+}
+
+// httpStatusFromGrpc returns the HTTP status code a gRPC status code should be
+// translated to, preferring the custom mapping of the service over the default
+// table.
+func (s *Service) httpStatusFromGrpc(code codes.Code) int {
+	if httpStatus, ok := s.grpcStatusMap[code]; ok {
+		return httpStatus
+	}
+	if httpStatus, ok := defaultGrpcToHTTPStatus[code]; ok {
+		return httpStatus
+	}
+	return http.StatusInternalServerError
+}
+
+// translateGrpcStatus rewrites the status of a response from a gRPC backend
+// into an HTTP status code if the original request was sent by a plain HTTP
+// client. Responses to gRPC clients are left untouched so they can read the
+// status from the Grpc-Status field as usual.
+//
+// NOTE: Only trailers-only responses, which is how gRPC servers report errors
+// on calls that didn't send any messages, carry the status in the header. The
+// status of all other responses is only known after the body was sent and can
+// therefore not be translated anymore.
+func translateGrpcStatus(res *http.Response, target *Service) {
+	if res.Request == nil || isGrpcRequest(res.Request) {
+		return
+	}
+	if !strings.HasPrefix(res.Header.Get(hdrContentType), hdrTypeGrpc) {
+		return
+	}
+
+	statusStr := res.Header.Get(hdrGrpcStatus)
+	if statusStr == "" {
+		return
+	}
+	grpcStatus, err := strconv.Atoi(statusStr)
+	if err != nil {
+		log.Debugf("Invalid gRPC status %s in backend response: %v",
+			statusStr, err)
+		return
+	}
+
+	httpStatus := target.httpStatusFromGrpc(codes.Code(grpcStatus))
+	log.Debugf("Translating gRPC status %d (%s) of backend response to "+
+		"HTTP status %d.", grpcStatus, res.Header.Get(hdrGrpcMessage),
+		httpStatus)
+
+	res.StatusCode = httpStatus
+	res.Status = fmt.Sprintf("%d %s", httpStatus,
+		http.StatusText(httpStatus))
+}
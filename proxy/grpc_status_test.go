@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"google.golang.org/grpc/codes"
+)
+
+// TestTranslateGrpcStatus makes sure the gRPC status of a backend response is
+// only translated for HTTP clients and that custom mappings take precedence.
+func TestTranslateGrpcStatus(t *testing.T) {
+	t.Parallel()
+
+	customMap, err := parseGrpcStatusMapping(map[string]int{
+		"not_found": http.StatusGone,
+	})
+	if err != nil {
+		t.Fatalf("unable to parse mapping: %v", err)
+	}
+	service := &Service{grpcStatusMap: customMap}
+
+	tests := []struct {
+		name           string
+		grpcClient     bool
+		code           codes.Code
+		expectedStatus int
+	}{{
+		name:           "http client default mapping",
+		code:           codes.Unavailable,
+		expectedStatus: http.StatusServiceUnavailable,
+	}, {
+		name:           "http client custom mapping",
+		code:           codes.NotFound,
+		expectedStatus: http.StatusGone,
+	}, {
+		name:           "grpc client untouched",
+		grpcClient:     true,
+		code:           codes.NotFound,
+		expectedStatus: http.StatusOK,
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/", nil)
+			if test.grpcClient {
+				req.Header.Set(hdrContentType, hdrTypeGrpc)
+			}
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Request:    req,
+			}
+			res.Header.Set(hdrContentType, hdrTypeGrpc)
+			res.Header.Set(
+				hdrGrpcStatus, strconv.Itoa(int(test.code)),
+			)
+
+			translateGrpcStatus(res, service)
+			if res.StatusCode != test.expectedStatus {
+				t.Fatalf("expected status %d, got %d",
+					test.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+
+	_, err = parseGrpcStatusMapping(map[string]int{"FOO": 400})
+	if err == nil {
+		t.Fatalf("expected unknown code to be rejected")
+	}
+}
+
+// TestGrpcNoMatch makes sure gRPC requests that don't match any service get a
+// gRPC status instead of being dispatched to the static file server.
+func TestGrpcNoMatch(t *testing.T) {
+	t.Parallel()
+
+	services := []*Service{{
+		Name:       "test",
+		Address:    "127.0.0.1:10009",
+		HostRegexp: "^service.example.com$",
+		Auth:       auth.LevelOff,
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, false, "",
+		WithGrpcNoMatchCode("not_found"),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "http://other.example.com/a.B/C", nil)
+	r.Header.Set(hdrContentType, hdrTypeGrpc)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	status := w.Header().Get(hdrGrpcStatus)
+	if w.Code != http.StatusOK ||
+		status != strconv.Itoa(int(codes.NotFound)) {
+
+		t.Fatalf("unexpected response %d with gRPC status %s", w.Code,
+			status)
+	}
+
+	// Plain HTTP clients still get the answer of the static server.
+	r = httptest.NewRequest("GET", "http://other.example.com/a", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// grpcFrameHeaderSize is the size of the header that precedes every
+	// message in a gRPC stream. It consists of a one byte compression flag
+	// and the four byte big endian length of the message.
+	grpcFrameHeaderSize = 5
+
+	// streamReauthFailedMsg is the gRPC status message sent to the client
+	// if a stream is closed because its token is no longer accepted.
+	streamReauthFailedMsg = "payment required to continue stream"
+
+	// streamUsageFailedMsg is the gRPC status message sent to the client
+	// if a stream is closed because its usage couldn't be counted.
+	streamUsageFailedMsg = "unable to count stream usage"
+)
+
+var (
+	// errStreamNotAccepted is returned when re-authenticating a stream if
+	// its token isn't accepted anymore.
+	errStreamNotAccepted = errors.New("token not accepted anymore")
+)
+
+// streamAuthBody wraps the body of a gRPC response and re-authenticates the
+// stream after a number of messages or an interval. The check happens between
+// two messages, so a message is never cut off. If the token isn't accepted
+// anymore, the stream is ended with the Unauthenticated status so the client
+// can pay for a new token and open a new stream. If its usage can't be
+// counted, the stream is ended with the Unavailable status.
+type streamAuthBody struct {
+	body io.ReadCloser
+	res  *http.Response
+
+	// reauth returns an error if the client isn't authenticated anymore
+	// or the usage of its token couldn't be counted.
+	reauth func() error
+
+	everyMessages uint64
+	interval      time.Duration
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	lastAuth  time.Time
+	nextCheck uint64
+	messages  uint64
+
+	// header is the header of the current message and headerRead the
+	// number of its bytes read so far. remaining is the number of bytes
+	// of the message payload that are still to be read.
+	header     [grpcFrameHeaderSize]byte
+	headerRead int
+	remaining  uint32
+
+	revoked   bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// wrapStreamAuth replaces the body of the given gRPC response so the stream is
+// re-authenticated periodically, if the service is configured to do so.
+func (p *Proxy) wrapStreamAuth(res *http.Response, s *Service) {
+	if s.GrpcStreamReauthMessages == 0 && s.GrpcStreamReauthInterval == 0 {
+		return
+	}
+	if !isGrpcRequest(res.Request) ||
+		!s.AuthRequired(res.Request).IsOn() {
+
+		return
+	}
+
+	res.Body = &streamAuthBody{
+		body: res.Body,
+		res:  res,
+		reauth: func() error {
+			return p.reauthStream(res.Request, s)
+		},
+		everyMessages: s.GrpcStreamReauthMessages,
+		interval:      s.GrpcStreamReauthInterval,
+		now:           time.Now,
+		lastAuth:      time.Now(),
+		nextCheck:     s.GrpcStreamReauthMessages,
+	}
+}
+
+// reauthStream checks that the token of the given stream is still accepted and
+// counts the next part of the stream against the usage quota of the token, so
+// a stream is paid for as it goes instead of only once when it's opened.
+func (p *Proxy) reauthStream(r *http.Request, s *Service) error {
+	price := s.currentPrice(r.Method, time.Now())
+	authenticator := p.tokenAuthenticator(&r.Header, s, price)
+	if authenticator == nil {
+		return errStreamNotAccepted
+	}
+	return countUsage(r, s, authenticator)
+}
+
+// atBoundary returns true if the next byte read is the start of a new message.
+func (b *streamAuthBody) atBoundary() bool {
+	return b.headerRead == 0 && b.remaining == 0
+}
+
+// reauthDue returns true if the stream needs to be re-authenticated before the
+// next message is passed on.
+func (b *streamAuthBody) reauthDue() bool {
+	if b.everyMessages > 0 && b.messages >= b.nextCheck {
+		return true
+	}
+	return b.interval > 0 && b.now().Sub(b.lastAuth) >= b.interval
+}
+
+// track updates the framing state with the given bytes of the stream.
+func (b *streamAuthBody) track(data []byte) {
+	for len(data) > 0 {
+		if b.remaining > 0 {
+			n := uint32(len(data))
+			if n > b.remaining {
+				n = b.remaining
+			}
+			b.remaining -= n
+			data = data[n:]
+			continue
+		}
+
+		n := copy(b.header[b.headerRead:], data)
+		b.headerRead += n
+		data = data[n:]
+		if b.headerRead == grpcFrameHeaderSize {
+			b.remaining = binary.BigEndian.Uint32(b.header[1:])
+			b.headerRead = 0
+			b.messages++
+		}
+	}
+}
+
+// Read reads the next bytes of the stream. If the stream needs to be
+// re-authenticated and the token isn't accepted anymore, the stream is ended
+// with the Unauthenticated status.
+func (b *streamAuthBody) Read(p []byte) (int, error) {
+	if b.revoked {
+		return 0, io.EOF
+	}
+
+	if b.atBoundary() && b.reauthDue() {
+		err := b.reauth()
+		switch {
+		case err == errStreamNotAccepted ||
+			errors.Is(err, auth.ErrQuotaExhausted):
+
+			log.Debugf("Closing gRPC stream %s: %v",
+				b.res.Request.URL.Path, err)
+			b.revoke(codes.Unauthenticated, streamReauthFailedMsg)
+			return 0, io.EOF
+
+		case err != nil:
+			log.Errorf("Unable to count usage of gRPC stream %s, "+
+				"closing it: %v", b.res.Request.URL.Path, err)
+			b.revoke(codes.Unavailable, streamUsageFailedMsg)
+			return 0, io.EOF
+		}
+		b.lastAuth = b.now()
+		b.nextCheck = b.messages + b.everyMessages
+	}
+
+	// We never read beyond the current header or message payload so we
+	// get the chance to check again at the next message boundary.
+	limit := grpcFrameHeaderSize - b.headerRead
+	if b.remaining > 0 {
+		limit = int(b.remaining)
+	}
+	if limit < len(p) {
+		p = p[:limit]
+	}
+
+	n, err := b.body.Read(p)
+	b.track(p[:n])
+	return n, err
+}
+
+// revoke closes the stream to the backend and sets the trailer with the given
+// status that tells the client why the stream ended.
+func (b *streamAuthBody) revoke(code codes.Code, msg string) {
+	b.revoked = true
+	_ = b.Close()
+
+	if b.res.Trailer == nil {
+		b.res.Trailer = make(http.Header)
+	}
+	b.res.Trailer.Set(hdrGrpcStatus, strconv.Itoa(int(code)))
+	b.res.Trailer.Set(hdrGrpcMessage, msg)
+}
+
+// Close closes the stream to the backend.
+func (b *streamAuthBody) Close() error {
+	b.closeOnce.Do(func() {
+		b.closeErr = b.body.Close()
+	})
+	return b.closeErr
+}
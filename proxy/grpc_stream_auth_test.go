@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// grpcFrame returns the given payload framed as a gRPC message.
+func grpcFrame(payload string) []byte {
+	frame := make([]byte, grpcFrameHeaderSize)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// TestStreamAuthBody makes sure a gRPC stream is re-authenticated between
+// messages and ended with the Unauthenticated status once the token isn't
+// accepted anymore.
+func TestStreamAuthBody(t *testing.T) {
+	t.Parallel()
+
+	var stream []byte
+	for _, msg := range []string{"one", "two", "three"} {
+		stream = append(stream, grpcFrame(msg)...)
+	}
+
+	for _, accept := range []bool{true, false} {
+		req, _ := http.NewRequest("POST", "/pkg.Service/Stream", nil)
+		res := &http.Response{
+			Body:    ioutil.NopCloser(bytes.NewReader(stream)),
+			Request: req,
+		}
+		checks := 0
+		body := &streamAuthBody{
+			body: res.Body,
+			res:  res,
+			reauth: func() error {
+				checks++
+				if !accept {
+					return errStreamNotAccepted
+				}
+				return nil
+			},
+			everyMessages: 2,
+			nextCheck:     2,
+			now:           time.Now,
+		}
+
+		received, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("unable to read stream: %v", err)
+		}
+		if checks != 1 {
+			t.Fatalf("expected one re-authentication, got %d",
+				checks)
+		}
+
+		if accept {
+			if !bytes.Equal(received, stream) {
+				t.Fatalf("expected complete stream")
+			}
+			if res.Trailer != nil {
+				t.Fatalf("unexpected trailer %v", res.Trailer)
+			}
+			continue
+		}
+
+		expected := append(grpcFrame("one"), grpcFrame("two")...)
+		if !bytes.Equal(received, expected) {
+			t.Fatalf("expected stream to end after two messages, "+
+				"got %x", received)
+		}
+		status := strconv.Itoa(int(codes.Unauthenticated))
+		if res.Trailer.Get(hdrGrpcStatus) != status {
+			t.Fatalf("expected status %s, got %s", status,
+				res.Trailer.Get(hdrGrpcStatus))
+		}
+	}
+}
+
+// TestStreamAuthQuota makes sure every re-authentication of a stream uses up
+// one request of the quota of its token and the stream is ended once the
+// quota is exhausted.
+func TestStreamAuthQuota(t *testing.T) {
+	t.Parallel()
+
+	authenticator := &usageAuthenticator{
+		schemeAuthenticator: schemeAuthenticator{scheme: "LSAT"},
+		quota:               1,
+	}
+	p, err := New(
+		authenticator, []*Service{{
+			Name:                     "service",
+			Address:                  "127.0.0.1:1",
+			HostRegexp:               ".*",
+			Protocol:                 "https",
+			Auth:                     "on",
+			Price:                    1,
+			GrpcStreamReauthMessages: 1,
+		}}, false, "",
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	var stream []byte
+	for _, msg := range []string{"one", "two", "three"} {
+		stream = append(stream, grpcFrame(msg)...)
+	}
+	req, _ := http.NewRequest("POST", "/pkg.Service/Stream", nil)
+	req.Header.Set(hdrContentType, hdrTypeGrpc)
+	req.Header.Set("Authorization", "LSAT token")
+	res := &http.Response{
+		Body:    ioutil.NopCloser(bytes.NewReader(stream)),
+		Request: req,
+	}
+	p.wrapStreamAuth(res, p.currentServices()[0])
+
+	received, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("unable to read stream: %v", err)
+	}
+
+	// The check before the second message uses up the quota, the one
+	// before the third message fails.
+	expected := append(grpcFrame("one"), grpcFrame("two")...)
+	if !bytes.Equal(received, expected) {
+		t.Fatalf("expected stream to end after two messages, got %x",
+			received)
+	}
+	status := strconv.Itoa(int(codes.Unauthenticated))
+	if res.Trailer.Get(hdrGrpcStatus) != status {
+		t.Fatalf("expected status %s, got %s", status,
+			res.Trailer.Get(hdrGrpcStatus))
+	}
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxCapturedHeaderBytes is the maximum size of a request header block
+	// that is captured. It matches the default limit of the HTTP server.
+	maxCapturedHeaderBytes = http.DefaultMaxHeaderBytes + 4096
+
+	// maxCapturedHeaders is the maximum number of header blocks of
+	// pipelined requests that are queued on a connection.
+	maxCapturedHeaders = 16
+)
+
+// captureState is the part of an HTTP/1.x request the capturing connection is
+// currently reading.
+type captureState uint8
+
+const (
+	captureHeader captureState = iota
+	captureBody
+	captureChunkSize
+	captureChunkData
+	captureTrailer
+)
+
+// rawHeaderField is a header field of a request exactly as the client sent it.
+type rawHeaderField struct {
+	Name  string
+	Value string
+}
+
+// capturedHeader is the request line and the header fields of a request in
+// the order and casing they were sent in.
+type capturedHeader struct {
+	requestLine string
+	fields      []rawHeaderField
+}
+
+// headerCaptureConnCtxKey is the key under which the capturing connection of a
+// request is stored in its context.
+type headerCaptureConnCtxKey struct{}
+
+// headerCaptureListener is a listener that captures the raw header fields of
+// the HTTP/1.x requests on its connections. The HTTP server normalizes the
+// casing of header names and doesn't keep their order, so this is the only
+// place the original form is available.
+type headerCaptureListener struct {
+	net.Listener
+}
+
+// NewHeaderCaptureListener wraps a listener so the raw header fields of the
+// requests on its connections are available to services that preserve the
+// order and casing of headers. It only works for plaintext HTTP/1.x
+// connections, the HTTP server must use HeaderCaptureConnContext.
+func NewHeaderCaptureListener(l net.Listener) net.Listener {
+	return &headerCaptureListener{Listener: l}
+}
+
+// Accept waits for the next connection and wraps it so its request headers
+// are captured.
+func (l *headerCaptureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerCaptureConn{Conn: conn}, nil
+}
+
+// HeaderCaptureConnContext adds the capturing connection of a request to its
+// context. It is meant to be used as the ConnContext of the HTTP server.
+func HeaderCaptureConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*headerCaptureConn); ok {
+		return context.WithValue(ctx, headerCaptureConnCtxKey{}, conn)
+	}
+	return ctx
+}
+
+// headerCaptureConn is a connection that parses the HTTP/1.x requests it
+// reads just enough to capture their header blocks. Bodies are skipped
+// according to their framing. If the connection switches protocols or the
+// data can't be parsed, capturing stops.
+type headerCaptureConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	state     captureState
+	buf       []byte
+	remaining int64
+	disabled  bool
+	headers   []*capturedHeader
+}
+
+// Read reads from the connection and captures the header blocks in the data.
+func (c *headerCaptureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.consume(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// pop returns the captured header of the next request on the connection. The
+// header is only returned if its request line matches the request, otherwise
+// the captured data is out of sync and discarded.
+func (c *headerCaptureConn) pop(r *http.Request) *capturedHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.headers) == 0 {
+		return nil
+	}
+	header := c.headers[0]
+	c.headers = c.headers[1:]
+
+	parts := strings.Split(header.requestLine, " ")
+	if len(parts) != 3 || parts[0] != r.Method ||
+		parts[1] != r.RequestURI {
+
+		log.Debugf("Captured request line %q doesn't match request, "+
+			"discarding headers.", header.requestLine)
+		c.headers = nil
+		return nil
+	}
+	return header
+}
+
+// disable stops capturing headers on the connection.
+//
+// NOTE: The mutex must be held.
+func (c *headerCaptureConn) disable() {
+	c.disabled = true
+	c.buf = nil
+	c.headers = nil
+}
+
+// consume feeds data read from the connection to the parser.
+//
+// NOTE: The mutex must be held.
+func (c *headerCaptureConn) consume(data []byte) {
+	for len(data) > 0 && !c.disabled {
+		switch c.state {
+		case captureHeader:
+			// Empty lines before a request are ignored.
+			if len(c.buf) == 0 {
+				data = bytes.TrimLeft(data, "\r\n")
+				if len(data) == 0 {
+					return
+				}
+			}
+
+			start := len(c.buf) - 3
+			if start < 0 {
+				start = 0
+			}
+			c.buf = append(c.buf, data...)
+			end := bytes.Index(c.buf[start:], []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(c.buf) > maxCapturedHeaderBytes {
+					c.disable()
+				}
+				return
+			}
+			end += start + 4
+
+			block, rest := c.buf[:end], c.buf[end:]
+			data = append([]byte(nil), rest...)
+			c.buf = nil
+			c.parseHeader(block)
+
+		case captureBody, captureChunkData:
+			n := int64(len(data))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			data = data[n:]
+			if c.remaining > 0 {
+				return
+			}
+
+			if c.state == captureBody {
+				c.state = captureHeader
+			} else {
+				c.state = captureChunkSize
+			}
+
+		case captureChunkSize, captureTrailer:
+			end := bytes.IndexByte(data, '\n')
+			if end < 0 {
+				c.buf = append(c.buf, data...)
+				if len(c.buf) > maxCapturedHeaderBytes {
+					c.disable()
+				}
+				return
+			}
+			line := string(append(c.buf, data[:end]...))
+			line = strings.TrimRight(line, "\r")
+			data = data[end+1:]
+			c.buf = nil
+
+			if c.state == captureTrailer {
+				if line == "" {
+					c.state = captureHeader
+				}
+				continue
+			}
+
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				line = line[:i]
+			}
+			size, err := strconv.ParseInt(
+				strings.TrimSpace(line), 16, 64,
+			)
+			if err != nil || size < 0 {
+				c.disable()
+				return
+			}
+			if size == 0 {
+				c.state = captureTrailer
+				continue
+			}
+
+			// The chunk data is followed by a line break.
+			c.remaining = size + 2
+			c.state = captureChunkData
+		}
+	}
+}
+
+// parseHeader parses a complete header block, queues it and prepares for the
+// body of the request.
+//
+// NOTE: The mutex must be held.
+func (c *headerCaptureConn) parseHeader(block []byte) {
+	lines := strings.Split(
+		strings.TrimSuffix(string(block), "\r\n\r\n"), "\r\n",
+	)
+
+	// An HTTP/2 connection preface means the connection doesn't use
+	// HTTP/1.x anymore.
+	header := &capturedHeader{requestLine: lines[0]}
+	if strings.HasPrefix(header.requestLine, "PRI ") {
+		c.disable()
+		return
+	}
+
+	var (
+		contentLength int64
+		chunked       bool
+		upgrade       bool
+	)
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || line[0] == ' ' || line[0] == '\t' {
+			c.disable()
+			return
+		}
+
+		field := rawHeaderField{
+			Name:  line[:i],
+			Value: strings.TrimSpace(line[i+1:]),
+		}
+		header.fields = append(header.fields, field)
+
+		switch http.CanonicalHeaderKey(field.Name) {
+		case "Content-Length":
+			n, err := strconv.ParseInt(field.Value, 10, 64)
+			if err != nil || n < 0 {
+				c.disable()
+				return
+			}
+			contentLength = n
+
+		case "Transfer-Encoding":
+			chunked = strings.Contains(
+				strings.ToLower(field.Value), "chunked",
+			)
+
+		case "Upgrade":
+			upgrade = true
+		}
+	}
+
+	if len(c.headers) >= maxCapturedHeaders {
+		c.disable()
+		return
+	}
+	c.headers = append(c.headers, header)
+
+	switch {
+	// After a protocol switch, the connection doesn't carry HTTP/1.x
+	// requests anymore.
+	case upgrade:
+		c.disabled = true
+
+	case chunked:
+		c.state = captureChunkSize
+
+	case contentLength > 0:
+		c.remaining = contentLength
+		c.state = captureBody
+
+	default:
+		c.state = captureHeader
+	}
+}
+
+// capturedHeaderFields returns the header fields of the request in the order
+// and casing the client sent them in, if they were captured.
+func capturedHeaderFields(r *http.Request) ([]rawHeaderField, bool) {
+	if r.ProtoMajor != 1 {
+		return nil, false
+	}
+
+	value := r.Context().Value(headerCaptureConnCtxKey{})
+	conn, ok := value.(*headerCaptureConn)
+	if !ok {
+		return nil, false
+	}
+
+	header := conn.pop(r)
+	if header == nil {
+		return nil, false
+	}
+	return header.fields, true
+}
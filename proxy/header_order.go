@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// rawHeaderFieldsCtxKey is the key under which the captured header fields of a
+// request are stored in the context of the request to a backend that preserves
+// their order and casing.
+type rawHeaderFieldsCtxKey struct{}
+
+// framingHeaders are the header fields that are written by the transport
+// itself instead of being copied from the request.
+var framingHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Expect":            true,
+}
+
+// headerValueReplacer removes line breaks from header values so they can't
+// inject fields into the request.
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// withRawHeaderFields remembers the captured header fields of the request in
+// its context if the service preserves the order and casing of headers. The
+// captured fields of every HTTP/1.x request are consumed, so the ones of later
+// requests on the same connection stay in sync.
+func (s *Service) withRawHeaderFields(r *http.Request) *http.Request {
+	fields, ok := capturedHeaderFields(r)
+	if !ok || !s.PreserveHeaderOrder {
+		return r
+	}
+
+	ctx := context.WithValue(r.Context(), rawHeaderFieldsCtxKey{}, fields)
+	return r.WithContext(ctx)
+}
+
+// orderedHeaderTransport is a transport that sends requests with captured
+// header fields over HTTP/1.1 itself, writing the fields in the order and
+// casing the client sent them in. The standard transport is used for all
+// other requests.
+type orderedHeaderTransport struct {
+	base      http.RoundTripper
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+}
+
+// RoundTrip sends the request to the backend and returns its response.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *orderedHeaderTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	value := req.Context().Value(rawHeaderFieldsCtxKey{})
+	fields, ok := value.([]rawHeaderField)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	conn, err := t.dial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection is only used for this single request and closed
+	// once the response was read or the request is canceled.
+	var closeOnce sync.Once
+	done := make(chan struct{})
+	closeConn := func() {
+		closeOnce.Do(func() {
+			close(done)
+			_ = conn.Close()
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConn()
+		case <-done:
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	err = writeOrderedRequest(w, req, fields)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		closeConn()
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		closeConn()
+		return nil, err
+	}
+	res.Body = &closingBody{ReadCloser: res.Body, close: closeConn}
+	return res, nil
+}
+
+// dial opens a connection to the backend of the request, using TLS for https
+// backends.
+func (t *orderedHeaderTransport) dial(ctx context.Context,
+	req *http.Request) (net.Conn, error) {
+
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host, port = req.URL.Host, "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	conn, err := t.dialer.DialContext(
+		ctx, "tcp", net.JoinHostPort(host, port),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return conn, nil
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("TLS handshake with backend failed: %v",
+			err)
+	}
+	return tlsConn, nil
+}
+
+// closingBody closes the connection of a response once its body is closed.
+type closingBody struct {
+	io.ReadCloser
+	close func()
+}
+
+// Close closes the body and the connection it was read from.
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.close()
+	return err
+}
+
+// writeOrderedRequest writes the request in HTTP/1.1 format. The header fields
+// the client sent are written first, in their original order and casing, with
+// the values the request has now. Fields that were added on the way to the
+// backend follow in sorted order, fields that were removed are left out.
+func writeOrderedRequest(w *bufio.Writer, req *http.Request,
+	fields []rawHeaderField) error {
+
+	_, err := fmt.Fprintf(
+		w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI(),
+	)
+	if err != nil {
+		return err
+	}
+
+	writeField := func(name, value string) {
+		_, _ = fmt.Fprintf(
+			w, "%s: %s\r\n", name,
+			headerValueReplacer.Replace(value),
+		)
+	}
+
+	var (
+		written    = make(map[string]int)
+		lengthName = "Content-Length"
+		hostDone   bool
+	)
+	for _, field := range fields {
+		key := http.CanonicalHeaderKey(field.Name)
+		switch {
+		case key == "Host" && !hostDone:
+			writeField(field.Name, req.Host)
+			hostDone = true
+			continue
+
+		case key == "Content-Length":
+			lengthName = field.Name
+			continue
+
+		case framingHeaders[key]:
+			continue
+		}
+
+		// Repeated fields get the values of the request in turn.
+		values := req.Header[key]
+		if i := written[key]; i < len(values) {
+			writeField(field.Name, values[i])
+			written[key] = i + 1
+		}
+	}
+	if !hostDone {
+		writeField("Host", req.Host)
+	}
+
+	keys := make([]string, 0, len(req.Header))
+	for key := range req.Header {
+		if !framingHeaders[http.CanonicalHeaderKey(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range req.Header[key][written[key]:] {
+			writeField(key, value)
+		}
+	}
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	chunked := hasBody && req.ContentLength < 0
+	switch {
+	case chunked:
+		writeField("Transfer-Encoding", "chunked")
+
+	case req.ContentLength > 0:
+		writeField(lengthName, fmt.Sprintf("%d", req.ContentLength))
+
+	case req.Method == "POST" || req.Method == "PUT" ||
+		req.Method == "PATCH":
+
+		writeField(lengthName, "0")
+	}
+	writeField("Connection", "close")
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	if !hasBody {
+		return nil
+	}
+	defer req.Body.Close()
+
+	if !chunked {
+		_, err := io.CopyN(w, req.Body, req.ContentLength)
+		return err
+	}
+
+	cw := httputil.NewChunkedWriter(w)
+	if _, err := io.Copy(cw, req.Body); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	_, err = w.WriteString("\r\n")
+	return err
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestHeaderCaptureConn makes sure the header blocks of consecutive requests
+// on a connection are captured, skipping their bodies.
+func TestHeaderCaptureConn(t *testing.T) {
+	t.Parallel()
+
+	c := &headerCaptureConn{}
+	data := "POST /a HTTP/1.1\r\nhost: x\r\nContent-Length: 5\r\n\r\n" +
+		"hello" +
+		"POST /b HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n" +
+		"\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nX-B: 1\r\nx-a: 2\r\n\r\n"
+
+	// The data arrives in small pieces like it would from the network.
+	for i := 0; i < len(data); i += 7 {
+		end := i + 7
+		if end > len(data) {
+			end = len(data)
+		}
+		c.consume([]byte(data[i:end]))
+	}
+
+	if c.disabled || len(c.headers) != 3 {
+		t.Fatalf("expected 3 captured headers, got %d", len(c.headers))
+	}
+	last := c.headers[2]
+	if last.requestLine != "GET /c HTTP/1.1" ||
+		last.fields[0].Name != "X-B" || last.fields[1].Name != "x-a" {
+
+		t.Fatalf("unexpected captured header: %v", last)
+	}
+}
+
+// TestPreserveHeaderOrder makes sure the headers of a request reach the
+// backend in their original order and casing.
+func TestPreserveHeaderOrder(t *testing.T) {
+	t.Parallel()
+
+	// The backend records the raw header block it receives.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer backend.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var lines []string
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		received <- lines
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n" +
+			"Content-Length: 0\r\n\r\n"))
+	}()
+
+	services := []*Service{{
+		Name:                "picky",
+		Address:             backend.Addr().String(),
+		HostRegexp:          ".*",
+		Protocol:            "http",
+		Auth:                "off",
+		PreserveHeaderOrder: true,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	server := &http.Server{
+		Handler:     p,
+		ConnContext: HeaderCaptureConnContext,
+	}
+	go func() {
+		_ = server.Serve(NewHeaderCaptureListener(listener))
+	}()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /x HTTP/1.1\r\nhost: example.com\r\n" +
+		"x-Zeta: 1\r\nX-ALPHA: 2\r\nx-zeta: 3\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+
+	// The host is rewritten to the one of the backend but keeps its
+	// position and casing.
+	lines := <-received
+	expected := []string{
+		"GET /x HTTP/1.1", "host: " + backend.Addr().String(),
+		"x-Zeta: 1", "X-ALPHA: 2", "x-zeta: 3",
+	}
+	if len(lines) < len(expected) {
+		t.Fatalf("expected at least %d lines, got %v", len(expected),
+			lines)
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Fatalf("expected line %d to be %q, got %q", i, line,
+				lines[i])
+		}
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validateRequestHeaders rejects requests that look like header injection or
+// request smuggling attempts, even if the HTTP server accepted them. These
+// patterns are rejected:
+//   - a header field name that isn't a valid token as defined in RFC 7230,
+//     for example one containing a space, colon or control character.
+//   - a header field value that contains a control character other than the
+//     horizontal tab, which includes CR, LF and NUL.
+//   - a Content-Length together with a Transfer-Encoding.
+//   - multiple Content-Length values.
+//   - a Host that contains a control character or whitespace.
+func validateRequestHeaders(r *http.Request) error {
+	for name, values := range r.Header {
+		if !validHeaderFieldName(name) {
+			return fmt.Errorf("invalid header field name %q", name)
+		}
+		for _, value := range values {
+			if !validHeaderFieldValue(value) {
+				return fmt.Errorf("invalid value of header "+
+					"field %s", name)
+			}
+		}
+	}
+
+	// The server removes the Transfer-Encoding from the header once it
+	// parsed it, so it has to be checked in the request itself.
+	contentLength := r.Header["Content-Length"]
+	if len(contentLength) > 0 && len(r.TransferEncoding) > 0 {
+		return fmt.Errorf("both Content-Length and Transfer-Encoding " +
+			"set")
+	}
+	if len(contentLength) > 1 {
+		return fmt.Errorf("multiple Content-Length values")
+	}
+
+	if strings.IndexFunc(r.Host, isSpaceOrControl) >= 0 {
+		return fmt.Errorf("invalid host %q", r.Host)
+	}
+
+	return nil
+}
+
+// dropInvalidHeaderFields removes all header fields with an invalid name or
+// value from the request to the backend. The fields of the client were already
+// validated, but some are added or changed by the proxy based on what the
+// client sent, like the parts captured from the path, and must never allow a
+// client to inject header fields into the request to the backend.
+func (s *Service) dropInvalidHeaderFields(req *http.Request) {
+	for name, values := range req.Header {
+		valid := validHeaderFieldName(name)
+		for _, value := range values {
+			valid = valid && validHeaderFieldValue(value)
+		}
+		if !valid {
+			log.Warnf("Dropping invalid header field %q from "+
+				"request to service %s", name, s.Name)
+			delete(req.Header, name)
+		}
+	}
+}
+
+// validHeaderFieldName returns true if the name is a non-empty token as
+// defined in RFC 7230.
+func validHeaderFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenChar returns true if the byte is allowed in a token as defined in RFC
+// 7230.
+func isTokenChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", b) >= 0
+	}
+}
+
+// validHeaderFieldValue returns true if the value doesn't contain any control
+// characters except the horizontal tab.
+func validHeaderFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if (b < ' ' && b != '\t') || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isSpaceOrControl returns true for whitespace and control characters.
+func isSpaceOrControl(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
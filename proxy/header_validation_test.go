@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestValidateRequestHeaders makes sure requests with header injection or
+// smuggling patterns are rejected.
+func TestValidateRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		valid  bool
+	}{{
+		name: "valid",
+		modify: func(r *http.Request) {
+			r.Header.Set("X-Custom", "value\twith tab")
+			r.Header.Set("Content-Length", "5")
+		},
+		valid: true,
+	}, {
+		name: "CRLF in value",
+		modify: func(r *http.Request) {
+			r.Header["X-Custom"] = []string{"a\r\nX-Injected: b"}
+		},
+	}, {
+		name: "NUL in value",
+		modify: func(r *http.Request) {
+			r.Header["X-Custom"] = []string{"a\x00b"}
+		},
+	}, {
+		name: "invalid name",
+		modify: func(r *http.Request) {
+			r.Header["X Custom"] = []string{"a"}
+		},
+	}, {
+		name: "length and chunked",
+		modify: func(r *http.Request) {
+			r.Header.Set("Content-Length", "5")
+			r.TransferEncoding = []string{"chunked"}
+		},
+	}, {
+		name: "multiple lengths",
+		modify: func(r *http.Request) {
+			r.Header["Content-Length"] = []string{"5", "6"}
+		},
+	}, {
+		name: "invalid host",
+		modify: func(r *http.Request) {
+			r.Host = "example.com\r\nX-Injected: b"
+		},
+	}}
+	for _, tc := range tests {
+		req := httptest.NewRequest("POST", "/", nil)
+		tc.modify(req)
+
+		err := validateRequestHeaders(req)
+		if tc.valid && err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+	}
+
+	// Header fields added by the proxy are dropped if they're invalid.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header["X-Captured"] = []string{"a\nX-Injected: b"}
+	req.Header.Set("X-Valid", "value")
+	(&Service{Name: "test"}).dropInvalidHeaderFields(req)
+	if _, ok := req.Header["X-Captured"]; ok {
+		t.Fatalf("expected invalid field to be dropped")
+	}
+	if req.Header.Get("X-Valid") != "value" {
+		t.Fatalf("expected valid field to be kept")
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// DefaultHealthCheckInterval is the default interval in which the
+	// backends of a service are health checked.
+	DefaultHealthCheckInterval = 10 * time.Second
+
+	// defaultGrpcHealthCheckPath is the path of the standard gRPC health
+	// checking protocol.
+	defaultGrpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+	// healthCheckHTTP is the health check type that sends a GET request
+	// and expects a 2xx status code.
+	healthCheckHTTP = "http"
+
+	// healthCheckGrpc is the health check type that uses the standard gRPC
+	// health checking protocol and expects the SERVING status.
+	healthCheckGrpc = "grpc"
+)
+
+var (
+	// grpcHealthCheckRequest is an empty grpc.health.v1.HealthCheckRequest
+	// message framed for a gRPC stream, which asks for the health of the
+	// whole server.
+	grpcHealthCheckRequest = []byte{0, 0, 0, 0, 0}
+
+	// grpcHealthServing is the encoded grpc.health.v1.HealthCheckResponse
+	// message with the SERVING status.
+	grpcHealthServing = []byte{0x08, 0x01}
+)
+
+// HealthChecker periodically probes the backends of all services that have a
+// health check configured. Unhealthy backends are excluded from routing until
+// they recover. A service without any healthy backend isn't matched at all.
+type HealthChecker struct {
+	proxy *Proxy
+
+	// checks are the quit channels of the running health checks. Each
+	// check looks up its service by name before every probe, so it keeps
+	// checking the service after it was reloaded.
+	checks map[healthCheck]chan struct{}
+	mtx    sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// healthCheck identifies the periodic health check of a service.
+type healthCheck struct {
+	service  string
+	interval time.Duration
+}
+
+// NewHealthChecker creates a new health checker for the services of the proxy
+// that have a health check configured.
+func NewHealthChecker(p *Proxy) *HealthChecker {
+	return &HealthChecker{
+		proxy:  p,
+		checks: make(map[healthCheck]chan struct{}),
+		quit:   make(chan struct{}),
+	}
+}
+
+// Start runs an initial health check for all services and then keeps checking
+// them periodically in the background.
+func (h *HealthChecker) Start() {
+	h.Refresh()
+}
+
+// Refresh starts checking the services of the proxy that have a health check
+// configured and aren't checked yet, and stops checking those that are gone.
+// It should be called after the services of the proxy were updated.
+func (h *HealthChecker) Refresh() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	wanted := make(map[healthCheck]*Service)
+	for _, service := range h.proxy.currentServices() {
+		if !service.healthChecked() {
+			continue
+		}
+
+		interval := service.HealthCheckInterval
+		if interval == 0 {
+			interval = DefaultHealthCheckInterval
+		}
+		wanted[healthCheck{service.Name, interval}] = service
+	}
+
+	for check, quit := range h.checks {
+		if _, ok := wanted[check]; !ok {
+			close(quit)
+			delete(h.checks, check)
+		}
+	}
+
+	for check, service := range wanted {
+		if _, ok := h.checks[check]; ok {
+			continue
+		}
+
+		h.checkService(service)
+
+		quit := make(chan struct{})
+		h.checks[check] = quit
+
+		h.wg.Add(1)
+		go h.run(check, quit)
+	}
+}
+
+// run periodically checks the current service with the name of the check until
+// either the check or the health checker is stopped.
+func (h *HealthChecker) run(check healthCheck, quit chan struct{}) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(check.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, service := range h.proxy.currentServices() {
+				if service.Name == check.service &&
+					service.healthChecked() {
+
+					h.checkService(service)
+				}
+			}
+
+		case <-quit:
+			return
+
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+// Stop shuts down the periodic health checks.
+func (h *HealthChecker) Stop() {
+	close(h.quit)
+	h.wg.Wait()
+}
+
+// healthChecked returns true if the backends of the service are health
+// checked.
+func (s *Service) healthChecked() bool {
+	return s.HealthCheckPath != "" || s.HealthCheckType == healthCheckGrpc
+}
+
+// checkService probes all backends of the given service and updates their
+// health.
+func (h *HealthChecker) checkService(service *Service) {
+	for _, address := range service.backendAddresses() {
+		err := h.probe(service, address)
+		if service.setHealth(address, err == nil) {
+			if err != nil {
+				log.Warnf("Backend %s of service %s is "+
+					"unhealthy: %v", address, service.Name,
+					err)
+			} else {
+				log.Infof("Backend %s of service %s is "+
+					"healthy again", address, service.Name)
+			}
+		}
+	}
+}
+
+// probe sends a single health check request to the given backend address of
+// the service and returns an error if the backend isn't healthy.
+func (h *HealthChecker) probe(service *Service, address string) error {
+	timeout := service.HealthCheckInterval / 2
+	if timeout == 0 {
+		timeout = DefaultHealthCheckInterval / 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path := service.HealthCheckPath
+	grpc := service.HealthCheckType == healthCheckGrpc
+	if grpc && path == "" {
+		path = defaultGrpcHealthCheckPath
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+	url := fmt.Sprintf("%s://%s%s", service.Protocol, address, path)
+	if grpc {
+		req, err = http.NewRequest(
+			"POST", url, bytes.NewReader(grpcHealthCheckRequest),
+		)
+		if err == nil {
+			req.Header.Set(hdrContentType, hdrTypeGrpc)
+			req.Header.Set("TE", "trailers")
+		}
+	} else {
+		req, err = http.NewRequest("GET", url, nil)
+	}
+	if err != nil {
+		return err
+	}
+	for name, value := range service.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// The service is needed to route the probe through its backend proxy.
+	ctx = context.WithValue(ctx, serviceCtxKey{}, service)
+	resp, err := h.proxy.backendTransport().RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if !grpc {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	// The gRPC status is only known once the body was read completely.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	status := resp.Trailer.Get(hdrGrpcStatus)
+	if status == "" {
+		status = resp.Header.Get(hdrGrpcStatus)
+	}
+	if status != strconv.Itoa(int(codes.OK)) {
+		return fmt.Errorf("unexpected gRPC status %s", status)
+	}
+	if len(body) < grpcFrameHeaderSize ||
+		!bytes.Equal(body[grpcFrameHeaderSize:], grpcHealthServing) {
+
+		return fmt.Errorf("backend not serving")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestHealthChecker makes sure unhealthy backends are excluded from routing and
+// that a service without healthy backends isn't matched anymore.
+func TestHealthChecker(t *testing.T) {
+	t.Parallel()
+
+	var healthy [2]int32
+	var addresses []string
+	for i := range healthy {
+		i := i
+		atomic.StoreInt32(&healthy[i], 1)
+		backend := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&healthy[i]) == 1 {
+					return
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		))
+		defer backend.Close()
+		addresses = append(
+			addresses, strings.TrimPrefix(backend.URL, "http://"),
+		)
+	}
+
+	services := []*Service{{
+		Name:            "test",
+		Address:         addresses[0],
+		HostRegexp:      ".*",
+		Protocol:        "http",
+		Auth:            auth.LevelOff,
+		HealthCheckPath: "/healthz",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	service := services[0]
+	service.setAddresses(addresses)
+	checker := NewHealthChecker(p)
+
+	// With the second backend failing, only the first one is used.
+	atomic.StoreInt32(&healthy[1], 0)
+	checker.checkService(service)
+	for i := 0; i < 4; i++ {
+		if address := service.backendAddress(); address != addresses[0] {
+			t.Fatalf("expected healthy backend %s, got %s",
+				addresses[0], address)
+		}
+	}
+
+	// Without any healthy backend, the service isn't matched anymore.
+	atomic.StoreInt32(&healthy[0], 0)
+	checker.checkService(service)
+	req := httptest.NewRequest("GET", "/", nil)
+	if _, ok := p.matchService(req); ok {
+		t.Fatalf("expected service without healthy backends to be " +
+			"skipped")
+	}
+
+	// Once a backend recovers, the service is used again.
+	atomic.StoreInt32(&healthy[1], 1)
+	checker.checkService(service)
+	if _, ok := p.matchService(req); !ok {
+		t.Fatalf("expected recovered service to be matched")
+	}
+	if address := service.backendAddress(); address != addresses[1] {
+		t.Fatalf("expected healthy backend %s, got %s", addresses[1],
+			address)
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// grpcHealthServingStatus and grpcHealthNotServingStatus are the
+	// values of the status enum of grpc.health.v1.HealthCheckResponse.
+	grpcHealthServingStatus    = 1
+	grpcHealthNotServingStatus = 2
+
+	// maxGrpcHealthRequestSize is the maximum size of a health check
+	// request we read.
+	maxGrpcHealthRequestSize = 1024
+)
+
+var (
+	// errInvalidHealthRequest is returned if a health check request can't
+	// be decoded.
+	errInvalidHealthRequest = errors.New("invalid health check request")
+)
+
+// WithGrpcHealth makes the proxy answer requests of the standard gRPC health
+// checking protocol itself instead of forwarding them to a backend. The
+// requests don't need to be authenticated.
+func WithGrpcHealth(enabled bool) Option {
+	return func(p *Proxy) error {
+		p.grpcHealth = enabled
+		return nil
+	}
+}
+
+// isGrpcHealthCheck returns true if the request is a gRPC health check the
+// proxy should answer itself.
+func (p *Proxy) isGrpcHealthCheck(r *http.Request) bool {
+	return p.grpcHealth && isGrpcRequest(r) &&
+		r.URL.Path == defaultGrpcHealthCheckPath
+}
+
+// decodeHealthCheckRequest returns the service name of a framed
+// grpc.health.v1.HealthCheckRequest message.
+func decodeHealthCheckRequest(body []byte) (string, error) {
+	if len(body) < grpcFrameHeaderSize || body[0] != 0 {
+		return "", errInvalidHealthRequest
+	}
+	length := binary.BigEndian.Uint32(body[1:grpcFrameHeaderSize])
+	msg := body[grpcFrameHeaderSize:]
+	if uint32(len(msg)) != length {
+		return "", errInvalidHealthRequest
+	}
+
+	// The message only has the service name as field 1, but we skip over
+	// any other fields a newer client might send.
+	var service string
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return "", errInvalidHealthRequest
+		}
+		msg = msg[n:]
+
+		var size uint64
+		switch key & 0x7 {
+		// Varint.
+		case 0:
+			_, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return "", errInvalidHealthRequest
+			}
+			size = uint64(n)
+
+		// Fixed 64 bit.
+		case 1:
+			size = 8
+
+		// Length delimited.
+		case 2:
+			fieldLength, n := binary.Uvarint(msg)
+			if n <= 0 || fieldLength > uint64(len(msg)-n) {
+				return "", errInvalidHealthRequest
+			}
+			if key>>3 == 1 {
+				service = string(msg[n : n+int(fieldLength)])
+			}
+			size = uint64(n) + fieldLength
+
+		// Fixed 32 bit.
+		case 5:
+			size = 4
+
+		default:
+			return "", errInvalidHealthRequest
+		}
+
+		if size > uint64(len(msg)) {
+			return "", errInvalidHealthRequest
+		}
+		msg = msg[size:]
+	}
+
+	return service, nil
+}
+
+// serviceHealth returns true if the service with the given name is able to
+// serve requests. An empty name refers to the proxy as a whole, which is
+// considered healthy as long as at least one of its services is. False is
+// returned as the second value if there is no service with the name.
+func (p *Proxy) serviceHealth(name string) (bool, bool) {
+	services := p.currentServices()
+	if name == "" {
+		for _, service := range services {
+			if service.available() {
+				return true, true
+			}
+		}
+		return len(services) == 0, true
+	}
+
+	for _, service := range services {
+		if service.Name == name {
+			return service.available(), true
+		}
+	}
+	return false, false
+}
+
+// serveGrpcHealth answers a Check call of the gRPC health checking protocol
+// with the health of the requested service.
+func (p *Proxy) serveGrpcHealth(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(
+		io.LimitReader(r.Body, maxGrpcHealthRequestSize),
+	)
+	if err != nil {
+		sendGrpcStatus(w, codes.Internal, err.Error())
+		return
+	}
+	name, err := decodeHealthCheckRequest(body)
+	if err != nil {
+		sendGrpcStatus(w, codes.InvalidArgument, err.Error())
+		return
+	}
+
+	healthy, ok := p.serviceHealth(name)
+	if !ok {
+		sendGrpcStatus(w, codes.NotFound, "unknown service "+name)
+		return
+	}
+
+	status := byte(grpcHealthNotServingStatus)
+	if healthy {
+		status = grpcHealthServingStatus
+	}
+	msg := []byte{0x08, status}
+	frame := make([]byte, grpcFrameHeaderSize, grpcFrameHeaderSize+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	w.Header().Set(hdrContentType, hdrTypeGrpc)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(frame)
+
+	// The status of a gRPC call is sent in the trailer.
+	w.Header().Set(
+		http.TrailerPrefix+hdrGrpcStatus, strconv.Itoa(int(codes.OK)),
+	)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+// TestServeGrpcHealth makes sure the proxy answers gRPC health checks with the
+// health of the requested service.
+func TestServeGrpcHealth(t *testing.T) {
+	t.Parallel()
+
+	healthy := &Service{Name: "healthy", Address: "127.0.0.1:10009"}
+	unhealthy := &Service{Name: "unhealthy", Address: "127.0.0.1:10010"}
+	unhealthy.setHealth(unhealthy.Address, false)
+
+	p := &Proxy{
+		services:   []*Service{healthy, unhealthy},
+		grpcHealth: true,
+	}
+
+	tests := []struct {
+		name           string
+		request        []byte
+		expectedCode   codes.Code
+		expectedStatus byte
+	}{{
+		name:           "server",
+		request:        grpcHealthCheckRequest,
+		expectedCode:   codes.OK,
+		expectedStatus: grpcHealthServingStatus,
+	}, {
+		name: "healthy service",
+		request: append(
+			[]byte{0, 0, 0, 0, 9, 0x0a, 7}, "healthy"...,
+		),
+		expectedCode:   codes.OK,
+		expectedStatus: grpcHealthServingStatus,
+	}, {
+		name: "unhealthy service",
+		request: append(
+			[]byte{0, 0, 0, 0, 11, 0x0a, 9}, "unhealthy"...,
+		),
+		expectedCode:   codes.OK,
+		expectedStatus: grpcHealthNotServingStatus,
+	}, {
+		name: "unknown service",
+		request: append(
+			[]byte{0, 0, 0, 0, 9, 0x0a, 7}, "unknown"...,
+		),
+		expectedCode: codes.NotFound,
+	}, {
+		name:         "invalid request",
+		request:      []byte{0, 0, 0, 0, 2, 0x0a},
+		expectedCode: codes.InvalidArgument,
+	}}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(
+			"POST", defaultGrpcHealthCheckPath,
+			bytes.NewReader(tc.request),
+		)
+		r.Header.Set(hdrContentType, hdrTypeGrpc)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+
+		res := w.Result()
+		body, _ := ioutil.ReadAll(res.Body)
+		status := res.Trailer.Get(hdrGrpcStatus)
+		if status == "" {
+			status = res.Header.Get(hdrGrpcStatus)
+		}
+		if res.StatusCode != http.StatusOK ||
+			status != strconv.Itoa(int(tc.expectedCode)) {
+
+			t.Fatalf("%s: unexpected response %d with gRPC "+
+				"status %s", tc.name, res.StatusCode, status)
+		}
+		if tc.expectedCode != codes.OK {
+			continue
+		}
+
+		expected := []byte{0, 0, 0, 0, 2, 0x08, tc.expectedStatus}
+		if !bytes.Equal(body, expected) {
+			t.Fatalf("%s: unexpected response %x", tc.name, body)
+		}
+	}
+}
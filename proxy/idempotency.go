@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hdrIdempotencyKey is the header clients send a unique key for a
+	// request in, so that retries of the request can be detected.
+	hdrIdempotencyKey = "Idempotency-Key"
+
+	// hdrIdempotentReplayed is the header that is set on responses that
+	// were replayed from the store instead of being sent by the backend.
+	hdrIdempotentReplayed = "Idempotent-Replayed"
+
+	// defaultIdempotencyMaxEntries is the default maximum number of
+	// responses stored per service.
+	defaultIdempotencyMaxEntries = 1000
+
+	// defaultIdempotencyMaxBody is the default maximum size of a response
+	// body in bytes that is stored.
+	defaultIdempotencyMaxBody = 1024 * 1024
+)
+
+var (
+	// defaultIdempotencyMethods are the methods of requests that are
+	// deduplicated if none are configured.
+	defaultIdempotencyMethods = []string{"POST", "PATCH"}
+
+	// errIdempotencyInFlight is returned if a request with the same
+	// idempotency key is still being processed.
+	errIdempotencyInFlight = errors.New("request with the same " +
+		"idempotency key is in progress")
+)
+
+// storedResponse is a response of a backend that is replayed to retries of a
+// request.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// replay sends the stored response to the client.
+func (s *storedResponse) replay(w http.ResponseWriter) {
+	for name, values := range s.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set(hdrIdempotentReplayed, "true")
+	w.WriteHeader(s.status)
+	_, _ = w.Write(s.body)
+}
+
+// idempotencyEntry is a single idempotency key in the store. The response is
+// nil as long as the first request with the key is in flight.
+type idempotencyEntry struct {
+	key      string
+	expiry   time.Time
+	response *storedResponse
+}
+
+// idempotencyStore is a bounded in-memory store of the responses to requests
+// with an idempotency key. Keys expire after the configured window. If the
+// store is full, the oldest key is evicted.
+type idempotencyStore struct {
+	window     time.Duration
+	maxEntries int
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	// entries maps each key to its element in the list which is ordered
+	// by the time the key was first seen, newest first.
+	entries map[string]*list.Element
+	order   *list.List
+	mtx     sync.Mutex
+}
+
+// newIdempotencyStore creates a new store that keeps at most maxEntries
+// responses for the given window.
+func newIdempotencyStore(window time.Duration,
+	maxEntries int) *idempotencyStore {
+
+	return &idempotencyStore{
+		window:     window,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// remove deletes the given element from both the map and the list.
+//
+// NOTE: The mutex must be held when calling this method.
+func (s *idempotencyStore) remove(elem *list.Element) {
+	entry := s.order.Remove(elem).(*idempotencyEntry)
+	delete(s.entries, entry.key)
+}
+
+// begin looks up the given key. If a response is stored for it, the response
+// is returned. If a request with the key is still in flight,
+// errIdempotencyInFlight is returned. Otherwise the key is recorded as in
+// flight and nil is returned, in which case finish must be called once the
+// request completed.
+func (s *idempotencyStore) begin(key string) (*storedResponse, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*idempotencyEntry)
+		switch {
+		case now.After(entry.expiry):
+			s.remove(elem)
+
+		case entry.response == nil:
+			return nil, errIdempotencyInFlight
+
+		default:
+			return entry.response, nil
+		}
+	}
+
+	// The oldest entries are at the back of the list, so we can stop at
+	// the first one that hasn't expired yet.
+	for elem := s.order.Back(); elem != nil; elem = s.order.Back() {
+		if !now.After(elem.Value.(*idempotencyEntry).expiry) {
+			break
+		}
+		s.remove(elem)
+	}
+	for s.order.Len() >= s.maxEntries {
+		s.remove(s.order.Back())
+	}
+
+	s.entries[key] = s.order.PushFront(&idempotencyEntry{
+		key:    key,
+		expiry: now.Add(s.window),
+	})
+	return nil, nil
+}
+
+// finish stores the response to the request with the given key. If the
+// response is nil, the key is removed so the request can be retried.
+func (s *idempotencyStore) finish(key string, response *storedResponse) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	if response == nil {
+		s.remove(elem)
+		return
+	}
+
+	entry := elem.Value.(*idempotencyEntry)
+	entry.response = response
+	entry.expiry = s.now().Add(s.window)
+}
+
+// responseCapture is an http.ResponseWriter that keeps a copy of the response
+// it sends to the client, up to a maximum body size.
+type responseCapture struct {
+	http.ResponseWriter
+
+	status    int
+	body      bytes.Buffer
+	maxBody   int
+	truncated bool
+}
+
+// WriteHeader records the status code and sends it to the client.
+func (c *responseCapture) WriteHeader(statusCode int) {
+	if c.status == 0 {
+		c.status = statusCode
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the given data and sends it to the client.
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.body.Len()+len(b) > c.maxBody {
+		c.truncated = true
+	}
+	if !c.truncated {
+		_, _ = c.body.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client if the underlying response
+// writer supports it.
+func (c *responseCapture) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection to the client. Whatever is
+// sent over a hijacked connection can't be replayed, so the response isn't
+// stored.
+func (c *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c.truncated = true
+	return hijack(c.ResponseWriter)
+}
+
+// Unwrap returns the wrapped response writer so the http package can access
+// optional interfaces it implements.
+func (c *responseCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// response returns the captured response if it should be replayed to retries.
+// Incomplete responses and errors that might be temporary are not stored so
+// the request can be retried.
+func (c *responseCapture) response() *storedResponse {
+	switch {
+	case c.status == 0 || c.truncated:
+		return nil
+
+	case c.status == http.StatusTooManyRequests ||
+		c.status >= http.StatusInternalServerError:
+
+		return nil
+	}
+
+	header := make(http.Header, len(c.Header()))
+	for name, values := range c.Header() {
+		header[name] = append([]string(nil), values...)
+	}
+	return &storedResponse{
+		status: c.status,
+		header: header,
+		body:   c.body.Bytes(),
+	}
+}
+
+// idempotencyKey returns the key under which the response to the request is
+// stored, or an empty string if the request isn't deduplicated. The key is
+// scoped to the client's verified token or, without one, its IP address so
+// clients can't obtain each other's responses.
+func (s *Service) idempotencyKey(r *http.Request, clientIP string,
+	authenticated bool) string {
+
+	if s.idempotency == nil || isGrpcRequest(r) {
+		return ""
+	}
+
+	key := r.Header.Get(hdrIdempotencyKey)
+	if key == "" {
+		return ""
+	}
+
+	methods := s.IdempotencyMethods
+	if len(methods) == 0 {
+		methods = defaultIdempotencyMethods
+	}
+	for _, method := range methods {
+		if !strings.EqualFold(method, r.Method) {
+			continue
+		}
+
+		// A token that wasn't verified could be anyone's.
+		client := clientIP
+		tokenID := tokenIDFromHeader(&r.Header)
+		if authenticated && tokenID != "" {
+			client = tokenID
+		}
+		return client + "\x00" + r.Method + "\x00" + key
+	}
+	return ""
+}
+
+// captureResponse wraps the given response writer so the response can be
+// stored once the request completed.
+func (s *Service) captureResponse(w http.ResponseWriter) *responseCapture {
+	maxBody := s.IdempotencyMaxBody
+	if maxBody == 0 {
+		maxBody = defaultIdempotencyMaxBody
+	}
+	return &responseCapture{
+		ResponseWriter: w,
+		maxBody:        maxBody,
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestIdempotencyStore makes sure the store keeps responses for the configured
+// window and rejects concurrent requests with the same key.
+func TestIdempotencyStore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	store := newIdempotencyStore(time.Minute, 2)
+	store.now = func() time.Time {
+		return now
+	}
+
+	// The first request with a key may pass, a concurrent one not.
+	if stored, err := store.begin("a"); err != nil || stored != nil {
+		t.Fatalf("expected new key, got %v, %v", stored, err)
+	}
+	if _, err := store.begin("a"); err != errIdempotencyInFlight {
+		t.Fatalf("expected in flight error, got %v", err)
+	}
+
+	// Once the response is stored, it is returned for retries.
+	response := &storedResponse{status: http.StatusCreated}
+	store.finish("a", response)
+	if stored, err := store.begin("a"); err != nil || stored != response {
+		t.Fatalf("expected stored response, got %v, %v", stored, err)
+	}
+
+	// A failed request isn't stored so it can be retried.
+	_, _ = store.begin("b")
+	store.finish("b", nil)
+	if stored, err := store.begin("b"); err != nil || stored != nil {
+		t.Fatalf("expected new key, got %v, %v", stored, err)
+	}
+
+	// Adding a third key evicts the oldest one.
+	_, _ = store.begin("c")
+	if stored, _ := store.begin("a"); stored != nil {
+		t.Fatalf("expected key to be evicted")
+	}
+
+	// After the window, keys expire.
+	store.finish("c", response)
+	now = now.Add(2 * time.Minute)
+	if stored, err := store.begin("c"); err != nil || stored != nil {
+		t.Fatalf("expected expired key, got %v, %v", stored, err)
+	}
+}
+
+// TestIdempotentRequests makes sure retries of a request with an idempotency
+// key are answered from the stored response.
+func TestIdempotentRequests(t *testing.T) {
+	t.Parallel()
+
+	var numRequests int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&numRequests, 1)
+
+			// The connection breaks after half of the body.
+			if r.URL.Path == "/broken" {
+				w.Header().Set("Content-Length", "14")
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte("create"))
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				_ = conn.Close()
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("created"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:              "test",
+		Address:           strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:        ".*",
+		Protocol:          "http",
+		Auth:              auth.LevelOff,
+		IdempotencyWindow: time.Minute,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	var sendPath func(method, path, key string) *http.Response
+	send := func(method, key string) *http.Response {
+		return sendPath(method, "/order", key)
+	}
+	sendPath = func(method, path, key string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if key != "" {
+			req.Header.Set(hdrIdempotencyKey, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unable to send request: %v", err)
+		}
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := send("POST", "key-1")
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated ||
+			string(body) != "created" {
+
+			t.Fatalf("unexpected response %d: %s",
+				resp.StatusCode, body)
+		}
+		replayed := resp.Header.Get(hdrIdempotentReplayed) != ""
+		if replayed != (i == 1) {
+			t.Fatalf("unexpected replay header in response %d", i)
+		}
+	}
+	if n := atomic.LoadInt32(&numRequests); n != 1 {
+		t.Fatalf("expected 1 backend request, got %d", n)
+	}
+
+	// Requests with another key, without a key or with a method that
+	// isn't deduplicated reach the backend.
+	for _, resp := range []*http.Response{
+		send("POST", "key-2"), send("POST", ""), send("GET", "key-1"),
+	} {
+		_ = resp.Body.Close()
+	}
+	if n := atomic.LoadInt32(&numRequests); n != 4 {
+		t.Fatalf("expected 4 backend requests, got %d", n)
+	}
+
+	// A response that broke off isn't stored, so its retry reaches the
+	// backend again.
+	for i := 0; i < 2; i++ {
+		resp := sendPath("POST", "/broken", "key-3")
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.Header.Get(hdrIdempotentReplayed) != "" {
+			t.Fatalf("expected broken response to not be replayed")
+		}
+	}
+	if n := atomic.LoadInt32(&numRequests); n != 6 {
+		t.Fatalf("expected 6 backend requests, got %d", n)
+	}
+}
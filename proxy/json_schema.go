@@ -0,0 +1,495 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// defaultSchemaMaxBodySize is the default maximum size of a request
+	// body that is buffered to be validated against a JSON schema.
+	defaultSchemaMaxBodySize = 1024 * 1024
+)
+
+// schemaAnnotations are the schema keywords that don't affect validation and
+// are therefore accepted but ignored.
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+// RequestSchemaConfig is the configuration of the JSON schema the bodies of
+// requests to a service are validated against.
+type RequestSchemaConfig struct {
+	// File is the path to the file that contains the JSON schema.
+	File string `long:"file" description:"Path to the JSON schema request bodies are validated against"`
+
+	// MaxBodySize is the maximum size of a request body in bytes that is
+	// buffered to be validated. Defaults to 1 MiB.
+	MaxBodySize int64 `long:"maxbodysize" description:"Maximum size of a request body that is validated"`
+
+	// RejectOversized rejects requests with bodies larger than
+	// MaxBodySize with status 413. By default they're forwarded without
+	// being validated.
+	RejectOversized bool `long:"rejectoversized" description:"Reject request bodies that are too large to be validated"`
+}
+
+// jsonSchema is a compiled JSON schema. Only a subset of the keywords of the
+// specification is supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum and maximum.
+type jsonSchema struct {
+	types                []string
+	enum                 []interface{}
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	noAdditional         bool
+	items                *jsonSchema
+	minItems, maxItems   *float64
+	minLength, maxLength *float64
+	minimum, maximum     *float64
+	pattern              *regexp.Regexp
+}
+
+// loadRequestSchema reads and compiles the JSON schema of the service.
+func (s *Service) loadRequestSchema() error {
+	c := s.RequestSchema
+	if c.File == "" {
+		return fmt.Errorf("schema file missing")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max body size cannot be negative")
+	}
+
+	content, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return fmt.Errorf("unable to read schema file: %v", err)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return fmt.Errorf("unable to parse schema file: %v", err)
+	}
+
+	schema, err := compileJSONSchema(raw, "$")
+	if err != nil {
+		return err
+	}
+	s.requestSchema = schema
+
+	return nil
+}
+
+// compileJSONSchema compiles the decoded schema at the given location.
+// Keywords that aren't supported result in an error, so a schema is never
+// enforced only partially without anyone noticing.
+func compileJSONSchema(raw interface{}, at string) (*jsonSchema, error) {
+	// The boolean schemas either allow everything or nothing.
+	if b, ok := raw.(bool); ok {
+		if b {
+			return &jsonSchema{}, nil
+		}
+		return &jsonSchema{enum: []interface{}{}}, nil
+	}
+
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object", at)
+	}
+
+	schema := &jsonSchema{}
+	for keyword, value := range obj {
+		var err error
+		switch keyword {
+		case "type":
+			schema.types, err = compileSchemaTypes(value)
+
+		case "enum":
+			values, ok := value.([]interface{})
+			if !ok {
+				err = fmt.Errorf("must be an array")
+			}
+			schema.enum = values
+
+		case "const":
+			schema.enum = []interface{}{value}
+
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("must be an object")
+				break
+			}
+			schema.properties = make(map[string]*jsonSchema)
+			for name, prop := range props {
+				propSchema, err := compileJSONSchema(
+					prop, at+"."+name,
+				)
+				if err != nil {
+					return nil, err
+				}
+				schema.properties[name] = propSchema
+			}
+
+		case "required":
+			names, ok := value.([]interface{})
+			if !ok {
+				err = fmt.Errorf("must be an array")
+			}
+			for _, name := range names {
+				name, ok := name.(string)
+				if !ok {
+					err = fmt.Errorf("must only " +
+						"contain strings")
+					break
+				}
+				schema.required = append(schema.required, name)
+			}
+
+		case "additionalProperties":
+			if b, ok := value.(bool); ok {
+				schema.noAdditional = !b
+				break
+			}
+			schema.additionalProperties, err = compileJSONSchema(
+				value, at+".additionalProperties",
+			)
+			if err != nil {
+				return nil, err
+			}
+
+		case "items":
+			schema.items, err = compileJSONSchema(value, at+"[]")
+			if err != nil {
+				return nil, err
+			}
+
+		case "minItems":
+			schema.minItems, err = schemaCount(value)
+
+		case "maxItems":
+			schema.maxItems, err = schemaCount(value)
+
+		case "minLength":
+			schema.minLength, err = schemaCount(value)
+
+		case "maxLength":
+			schema.maxLength, err = schemaCount(value)
+
+		case "minimum":
+			schema.minimum, err = schemaNumber(value)
+
+		case "maximum":
+			schema.maximum, err = schemaNumber(value)
+
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("must be a string")
+				break
+			}
+			schema.pattern, err = regexp.Compile(pattern)
+
+		default:
+			if !schemaAnnotations[keyword] {
+				return nil, fmt.Errorf("%s: unsupported "+
+					"keyword %s", at, keyword)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %v", at,
+				keyword, err)
+		}
+	}
+
+	return schema, nil
+}
+
+// compileSchemaTypes returns the types of the type keyword, which is either a
+// single type or an array of types.
+func compileSchemaTypes(value interface{}) ([]string, error) {
+	var types []string
+	switch value := value.(type) {
+	case string:
+		types = []string{value}
+
+	case []interface{}:
+		for _, t := range value {
+			t, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("must only contain " +
+					"strings")
+			}
+			types = append(types, t)
+		}
+
+	default:
+		return nil, fmt.Errorf("must be a string or an array")
+	}
+
+	for _, t := range types {
+		switch t {
+		case "null", "boolean", "object", "array", "number",
+			"string", "integer":
+
+		default:
+			return nil, fmt.Errorf("unknown type %s", t)
+		}
+	}
+
+	return types, nil
+}
+
+// schemaNumber returns the value of a numeric keyword.
+func schemaNumber(value interface{}) (*float64, error) {
+	n, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("must be a number")
+	}
+	return &n, nil
+}
+
+// schemaCount returns the value of a keyword that must be a non-negative
+// integer.
+func schemaCount(value interface{}) (*float64, error) {
+	n, err := schemaNumber(value)
+	if err != nil || *n < 0 || *n != math.Trunc(*n) {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// validate makes sure the decoded JSON value at the given location conforms
+// to the schema.
+func (s *jsonSchema) validate(value interface{}, at string) error {
+	if len(s.types) > 0 && !s.matchesType(value) {
+		return fmt.Errorf("%s: must be of type %s", at,
+			strings.Join(s.types, " or "))
+	}
+
+	if s.enum != nil {
+		var found bool
+		for _, allowed := range s.enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not allowed", at)
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(value, at)
+
+	case []interface{}:
+		n := float64(len(value))
+		if s.minItems != nil && n < *s.minItems {
+			return fmt.Errorf("%s: must have at least %v items",
+				at, *s.minItems)
+		}
+		if s.maxItems != nil && n > *s.maxItems {
+			return fmt.Errorf("%s: must have at most %v items",
+				at, *s.maxItems)
+		}
+		if s.items == nil {
+			return nil
+		}
+		for i, item := range value {
+			itemAt := fmt.Sprintf("%s[%d]", at, i)
+			if err := s.items.validate(item, itemAt); err != nil {
+				return err
+			}
+		}
+
+	case string:
+		n := float64(utf8.RuneCountInString(value))
+		if s.minLength != nil && n < *s.minLength {
+			return fmt.Errorf("%s: must be at least %v characters",
+				at, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fmt.Errorf("%s: must be at most %v characters",
+				at, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			return fmt.Errorf("%s: must match pattern %s", at,
+				s.pattern)
+		}
+
+	case float64:
+		if s.minimum != nil && value < *s.minimum {
+			return fmt.Errorf("%s: must be at least %v", at,
+				*s.minimum)
+		}
+		if s.maximum != nil && value > *s.maximum {
+			return fmt.Errorf("%s: must be at most %v", at,
+				*s.maximum)
+		}
+	}
+
+	return nil
+}
+
+// validateObject validates the properties of an object.
+func (s *jsonSchema) validateObject(obj map[string]interface{},
+	at string) error {
+
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			return fmt.Errorf("%s: missing property %s", at, name)
+		}
+	}
+
+	// The properties are checked in a fixed order so the reported error
+	// is the same for the same body.
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propSchema, ok := s.properties[name]
+		switch {
+		case ok:
+
+		case s.noAdditional:
+			return fmt.Errorf("%s: unknown property %s", at, name)
+
+		case s.additionalProperties != nil:
+			propSchema = s.additionalProperties
+
+		default:
+			continue
+		}
+
+		err := propSchema.validate(obj[name], at+"."+name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchesType returns true if the value is of one of the types of the schema.
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	for _, t := range s.types {
+		var ok bool
+		switch value := value.(type) {
+		case nil:
+			ok = t == "null"
+		case bool:
+			ok = t == "boolean"
+		case map[string]interface{}:
+			ok = t == "object"
+		case []interface{}:
+			ok = t == "array"
+		case string:
+			ok = t == "string"
+		case float64:
+			ok = t == "number" ||
+				(t == "integer" && value == math.Trunc(value))
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isJSONContentType returns true if the request declares a JSON body, either
+// as application/json or a type with the +json suffix.
+func isJSONContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// validateRequestBody validates the JSON body of the request against the
+// schema of the service. Requests without a JSON content type aren't
+// validated. If the request must be rejected, the status code and reason are
+// returned. The body is buffered and restored for the backend.
+func (s *Service) validateRequestBody(r *http.Request) (int, error) {
+	if s.requestSchema == nil || !isJSONContentType(r) {
+		return 0, nil
+	}
+
+	maxSize := s.RequestSchema.MaxBodySize
+	if maxSize == 0 {
+		maxSize = defaultSchemaMaxBodySize
+	}
+
+	if r.ContentLength > maxSize {
+		return s.oversizedBody()
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+
+		// Whatever we managed to read, the backend still needs to get
+		// the full body.
+		r.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+			Closer: r.Body,
+		}
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("unable to "+
+				"read request body: %v", err)
+		}
+		if int64(len(body)) > maxSize {
+			return s.oversizedBody()
+		}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid JSON body: "+
+			"%v", err)
+	}
+
+	if err := s.requestSchema.validate(value, "$"); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("request body "+
+			"doesn't match schema: %v", err)
+	}
+
+	return 0, nil
+}
+
+// oversizedBody returns how a request with a body that is too large to be
+// validated is handled.
+func (s *Service) oversizedBody() (int, error) {
+	if !s.RequestSchema.RejectOversized {
+		log.Debugf("Request body too large to be validated for "+
+			"service %s, skipping validation", s.Name)
+		return 0, nil
+	}
+	return http.StatusRequestEntityTooLarge, fmt.Errorf("request body " +
+		"too large")
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRequestSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["name", "amount"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {
+			"type": "string",
+			"minLength": 1,
+			"pattern": "^[a-z]+$"
+		},
+		"amount": {"type": "integer", "minimum": 1, "maximum": 1000},
+		"memo": {"type": ["string", "null"], "maxLength": 5},
+		"tags": {
+			"type": "array",
+			"maxItems": 2,
+			"items": {"enum": ["a", "b"]}
+		}
+	}
+}`
+
+// TestValidateRequestBody makes sure request bodies are validated against the
+// JSON schema of a service and are still intact afterwards.
+func TestValidateRequestBody(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	schemaFile := filepath.Join(dir, "schema.json")
+	err = ioutil.WriteFile(schemaFile, []byte(testRequestSchema), 0600)
+	if err != nil {
+		t.Fatalf("unable to write schema: %v", err)
+	}
+
+	s := &Service{
+		Name: "test",
+		RequestSchema: &RequestSchemaConfig{
+			File:        schemaFile,
+			MaxBodySize: 100,
+		},
+	}
+	if err := s.loadRequestSchema(); err != nil {
+		t.Fatalf("unable to load schema: %v", err)
+	}
+
+	const appJSON = "application/json"
+	testCases := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{appJSON, `{"name":"abc","amount":5}`, 0},
+		{
+			"application/json; charset=utf-8",
+			`{"name":"abc","amount":5,"memo":null,"tags":["a"]}`,
+			0,
+		},
+		{"application/problem+json", `{"name":"abc"}`, 400},
+		{appJSON, `{"name":"abc","amount":5.5}`, 400},
+		{appJSON, `{"name":"ABC","amount":5}`, 400},
+		{appJSON, `{"name":"abc","amount":0}`, 400},
+		{appJSON, `{"name":"abc","amount":5,"x":1}`, 400},
+		{appJSON, `{"name":"a","amount":5,"memo":"abcdef"}`, 400},
+		{appJSON, `{"name":"a","amount":5,"tags":["c"]}`, 400},
+		{appJSON, `[]`, 400},
+		{appJSON, `{"name":`, 400},
+		{appJSON, ``, 400},
+		{"text/plain", `not json`, 0},
+		{"", `not json`, 0},
+		{appJSON, strings.Repeat(" ", 101), 0},
+	}
+	for _, tc := range testCases {
+		r, _ := http.NewRequest(
+			"POST", "http://x/", strings.NewReader(tc.body),
+		)
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+
+		status, err := s.validateRequestBody(r)
+		if status != tc.status {
+			t.Fatalf("expected status %d for body %q, got %d: %v",
+				tc.status, tc.body, status, err)
+		}
+		if (err == nil) != (status == 0) {
+			t.Fatalf("unexpected error for body %q: %v", tc.body,
+				err)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("unable to read body: %v", err)
+		}
+		if string(body) != tc.body {
+			t.Fatalf("expected body %q to be restored, got %q",
+				tc.body, body)
+		}
+	}
+
+	// Oversized bodies can also be rejected, whether their length is
+	// declared or not.
+	s.RequestSchema.RejectOversized = true
+	body := strings.NewReader(strings.Repeat(" ", 101))
+	r, _ := http.NewRequest("POST", "http://x/", body)
+	r.Header.Set("Content-Type", "application/json")
+	if status, _ := s.validateRequestBody(r); status != 413 {
+		t.Fatalf("expected status 413, got %d", status)
+	}
+	r.ContentLength = -1
+	if status, _ := s.validateRequestBody(r); status != 413 {
+		t.Fatalf("expected status 413, got %d", status)
+	}
+
+	invalidSchemas := []string{
+		`[]`, `{"type": "nope"}`, `{"oneOf": []}`,
+		`{"minLength": -1}`, `{"pattern": "("}`,
+		`{"properties": {"a": {"$ref": "#"}}}`,
+	}
+	for _, invalid := range invalidSchemas {
+		err := ioutil.WriteFile(schemaFile, []byte(invalid), 0600)
+		if err != nil {
+			t.Fatalf("unable to write schema: %v", err)
+		}
+		if err := s.loadRequestSchema(); err == nil {
+			t.Fatalf("expected schema %s to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencySampleSize is the maximum number of latencies kept per
+	// service and interval to compute the percentiles from. Once more
+	// requests were completed, a uniform random sample of them is kept.
+	latencySampleSize = 1024
+)
+
+// latencyWindow collects the latencies and errors of the requests to a service
+// that were completed during the current report interval.
+type latencyWindow struct {
+	mtx sync.Mutex
+
+	// requests and errors are the number of completed requests and of
+	// those answered with a 5xx status.
+	requests uint64
+	errors   uint64
+
+	// samples is a uniform random sample of the latencies of all
+	// completed requests, at most latencySampleSize of them.
+	samples []time.Duration
+}
+
+// add records a completed request. The sample is maintained with reservoir
+// sampling so its memory is bounded no matter how many requests there are.
+func (w *latencyWindow) add(latency time.Duration, status int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.requests++
+	if status >= http.StatusInternalServerError {
+		w.errors++
+	}
+
+	if len(w.samples) < latencySampleSize {
+		w.samples = append(w.samples, latency)
+		return
+	}
+	if i := rand.Int63n(int64(w.requests)); i < latencySampleSize {
+		w.samples[i] = latency
+	}
+}
+
+// reset returns the collected requests, errors and latency sample and starts
+// a new interval.
+func (w *latencyWindow) reset() (uint64, uint64, []time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	requests, errors, samples := w.requests, w.errors, w.samples
+	w.requests, w.errors, w.samples = 0, 0, nil
+	return requests, errors, samples
+}
+
+// latencyPercentile returns the given percentile of the sorted latencies using
+// the nearest rank method.
+func latencyPercentile(sorted []time.Duration,
+	percentile float64) time.Duration {
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// LatencyReporter periodically logs a summary of the requests to each service
+// that were completed during the last interval: their number, the number of
+// errors and the 50th, 95th and 99th latency percentile.
+type LatencyReporter struct {
+	proxy    *Proxy
+	interval time.Duration
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewLatencyReporter creates a new latency reporter for the services of the
+// proxy that logs a summary in the given interval.
+func NewLatencyReporter(p *Proxy, interval time.Duration) *LatencyReporter {
+	return &LatencyReporter{
+		proxy:    p,
+		interval: interval,
+		quit:     make(chan struct{}),
+	}
+}
+
+// Start makes the proxy record the latencies of the requests and logs their
+// summary periodically in the background.
+func (l *LatencyReporter) Start() {
+	atomic.StoreInt32(&l.proxy.recordLatencies, 1)
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.report()
+
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop shuts down the periodic reports and the recording of latencies.
+func (l *LatencyReporter) Stop() {
+	close(l.quit)
+	l.wg.Wait()
+
+	atomic.StoreInt32(&l.proxy.recordLatencies, 0)
+}
+
+// report logs the summary of the last interval of all services that had
+// requests and starts a new interval.
+func (l *LatencyReporter) report() {
+	for _, service := range l.proxy.currentServices() {
+		requests, errors, samples := service.latencies.reset()
+		if requests == 0 {
+			continue
+		}
+
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i] < samples[j]
+		})
+		log.Infof("Service %s in the last %v: %d requests, %d "+
+			"errors, latency p50=%v p95=%v p99=%v", service.Name,
+			l.interval, requests, errors,
+			latencyPercentile(samples, 50),
+			latencyPercentile(samples, 95),
+			latencyPercentile(samples, 99))
+	}
+}
+
+// recordLatency adds the latency of a completed request to the current report
+// interval of the service, if latencies are reported at all.
+func (p *Proxy) recordLatency(s *Service, latency time.Duration, status int) {
+	if atomic.LoadInt32(&p.recordLatencies) == 0 {
+		return
+	}
+	s.latencies.add(latency, status)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestLatencyWindow makes sure the latency sample stays bounded, errors are
+// counted and each interval starts fresh.
+func TestLatencyWindow(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{}
+	service := &Service{Name: "test"}
+
+	// Nothing is recorded while no reporter is running.
+	p.recordLatency(service, time.Second, http.StatusOK)
+	if requests, _, _ := service.latencies.reset(); requests != 0 {
+		t.Fatalf("expected no recorded requests, got %d", requests)
+	}
+
+	reporter := NewLatencyReporter(p, time.Hour)
+	reporter.Start()
+	defer reporter.Stop()
+
+	const total = 3 * latencySampleSize
+	for i := 1; i <= total; i++ {
+		status := http.StatusOK
+		if i%10 == 0 {
+			status = http.StatusBadGateway
+		}
+		p.recordLatency(service, time.Duration(i), status)
+	}
+
+	requests, errors, samples := service.latencies.reset()
+	if requests != total || errors != total/10 {
+		t.Fatalf("unexpected counts: %d requests, %d errors",
+			requests, errors)
+	}
+	if len(samples) != latencySampleSize {
+		t.Fatalf("expected %d samples, got %d", latencySampleSize,
+			len(samples))
+	}
+
+	requests, _, samples = service.latencies.reset()
+	if requests != 0 || len(samples) != 0 {
+		t.Fatalf("expected a fresh interval")
+	}
+
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if latencyPercentile(sorted, 50) != 5 ||
+		latencyPercentile(sorted, 95) != 10 ||
+		latencyPercentile(nil, 99) != 0 {
+
+		t.Fatalf("unexpected percentiles")
+	}
+}
@@ -31,6 +31,10 @@ func UseLogger(logger btclog.Logger) {
 type PrefixLog struct {
 	logger btclog.Logger
 	prefix string
+
+	// verbose logs trace and debug messages at the info level so they're
+	// logged independent of the log level.
+	verbose bool
 }
 
 // NewRemoteIPPrefixLog returns a new prefix logger that logs the remote IP
@@ -38,6 +42,16 @@ type PrefixLog struct {
 func NewRemoteIPPrefixLog(logger btclog.Logger, remoteAddr string) (net.IP,
 	*PrefixLog) {
 
+	remoteIP := parseRemoteIP(remoteAddr)
+	return remoteIP, &PrefixLog{
+		logger: logger,
+		prefix: remoteIP.String(),
+	}
+}
+
+// parseRemoteIP returns the IP address of the given remote address of a
+// request, or the unspecified address if it can't be parsed.
+func parseRemoteIP(remoteAddr string) net.IP {
 	remoteHost, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
 		remoteHost = "0.0.0.0"
@@ -46,15 +60,29 @@ func NewRemoteIPPrefixLog(logger btclog.Logger, remoteAddr string) (net.IP,
 	if remoteIP == nil {
 		remoteIP = net.IPv4zero
 	}
-	return remoteIP, &PrefixLog{
-		logger: logger,
-		prefix: remoteIP.String(),
+	return remoteIP
+}
+
+// Tracef formats message according to format specifier and writes to
+// log with LevelTrace.
+func (s *PrefixLog) Tracef(format string, params ...interface{}) {
+	if s.verbose {
+		s.Infof(format, params...)
+		return
 	}
+	s.logger.Tracef(
+		fmt.Sprintf("%s %s", s.prefix, format),
+		params...,
+	)
 }
 
 // Debugf formats message according to format specifier and writes to
 // log with LevelDebug.
 func (s *PrefixLog) Debugf(format string, params ...interface{}) {
+	if s.verbose {
+		s.Infof(format, params...)
+		return
+	}
 	s.logger.Debugf(
 		fmt.Sprintf("%s %s", s.prefix, format),
 		params...,
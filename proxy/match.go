@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+)
+
+// MatchMode is the mode the proxy uses to match a request to one of the
+// configured backend services.
+type MatchMode string
+
+const (
+	// MatchFirst selects the first service in the list of services that
+	// matches the request. This is the default mode.
+	MatchFirst MatchMode = "first"
+
+	// MatchSpecific selects the service with the highest priority that
+	// matches the request. If multiple services have the same priority,
+	// the one with the most specific path expression, meaning the longest
+	// literal prefix after its ^ anchor, is selected. Only if that is equal
+	// too, the order of the list decides.
+	MatchSpecific MatchMode = "specific"
+)
+
+// matchScore returns the specificity of a service's path expression, which is
+// the length of the literal prefix every matching path must start with. Only
+// expressions anchored with ^ have such a prefix, since an unanchored one can
+// match its literal anywhere in the path, so they get the lowest score of any
+// path expression. A service without a path expression matches every path and
+// has the lowest score.
+func (s *Service) matchScore() int {
+	if s.PathRegexp == "" {
+		return 0
+	}
+
+	re, err := syntax.Parse(s.PathRegexp, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat ||
+		re.Sub[0].Op != syntax.OpBeginText {
+
+		return 1
+	}
+
+	// The parser merges consecutive literals, so the literal following
+	// the anchor is the whole prefix, unless it's case insensitive.
+	prefix := re.Sub[1]
+	if prefix.Op != syntax.OpLiteral || prefix.Flags&syntax.FoldCase != 0 {
+		return 1
+	}
+	return len(string(prefix.Rune)) + 1
+}
+
+// matches returns true if the host and path of the request match the regular
+// expressions of the service.
+func (s *Service) matches(req *http.Request) bool {
+	hostRegexp := regexp.MustCompile(s.HostRegexp)
+	if !hostRegexp.MatchString(req.Host) {
+		return false
+	}
+
+	if s.PathRegexp == "" {
+		return true
+	}
+	pathRegexp := regexp.MustCompile(s.PathRegexp)
+	return pathRegexp.MatchString(req.URL.Path)
+}
+
+// matchSpecificService scores all backend services that match an HTTP request
+// and returns the most specific one, independent of the order of the list.
+func matchSpecificService(req *http.Request,
+	services []*Service) (*Service, bool) {
+
+	var (
+		best      *Service
+		bestScore int
+	)
+	for _, service := range services {
+		if service.TLSPassthrough || service.Fallback ||
+			!service.available() || !service.matches(req) {
+
+			continue
+		}
+
+		score := service.matchScore()
+		switch {
+		case best == nil:
+
+		case service.Priority < best.Priority:
+			continue
+
+		case service.Priority == best.Priority && score <= bestScore:
+			continue
+		}
+
+		best, bestScore = service, score
+	}
+
+	if best == nil {
+		log.Errorf("No backend service matched request [%s%s].",
+			req.Host, req.URL.Path)
+		return nil, false
+	}
+
+	log.Debugf("Request [%s%s] matched service [%s] with priority %d and "+
+		"score %d.", req.Host, req.URL.Path, best.Address,
+		best.Priority, bestScore)
+	return best, true
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestMatchSpecificService makes sure the most specific service is matched
+// independent of the order of the services.
+func TestMatchSpecificService(t *testing.T) {
+	t.Parallel()
+
+	catchAll := &Service{
+		Name:       "catch-all",
+		HostRegexp: ".*",
+	}
+	api := &Service{
+		Name:       "api",
+		HostRegexp: ".*",
+		PathRegexp: "^/api/.*$",
+	}
+	apiV2 := &Service{
+		Name:       "api-v2",
+		HostRegexp: ".*",
+		PathRegexp: "^/api/v2/.*$",
+	}
+	// An unanchored expression can match its literal anywhere in the
+	// path, so it isn't more specific than a shorter anchored one.
+	admin := &Service{
+		Name:       "admin",
+		HostRegexp: ".*",
+		PathRegexp: "/api/v2/admin",
+	}
+	services := []*Service{catchAll, admin, api, apiV2}
+
+	tests := []struct {
+		path     string
+		expected *Service
+	}{
+		{path: "/index.html", expected: catchAll},
+		{path: "/api/foo", expected: api},
+		{path: "/api/v2/foo", expected: apiV2},
+		{path: "/api/v2/admin", expected: apiV2},
+		{path: "/v1/api/v2/admin", expected: admin},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		target, ok := matchSpecificService(req, services)
+		if !ok {
+			t.Fatalf("expected %s to match", test.path)
+		}
+		if target != test.expected {
+			t.Fatalf("expected %s to match service %s, got %s",
+				test.path, test.expected.Name, target.Name)
+		}
+
+		// The first match mode picks the catch-all service for every
+		// request.
+		target, _ = matchService(req, services)
+		if target != catchAll {
+			t.Fatalf("expected first match to be catch-all")
+		}
+	}
+
+	// A higher priority wins over a more specific path.
+	catchAll.Priority = 1
+	req, _ := http.NewRequest("GET", "/api/v2/foo", nil)
+	target, _ := matchSpecificService(req, services)
+	if target != catchAll {
+		t.Fatalf("expected priority to take precedence, got %s",
+			target.Name)
+	}
+}
+
+// TestBackendAllowList makes sure services pointing to hosts that aren't on
+// the backend allow list are rejected.
+func TestBackendAllowList(t *testing.T) {
+	t.Parallel()
+
+	p := &Proxy{}
+	err := WithBackendAllowList([]string{"^127\\.0\\.0\\.1$"})(p)
+	if err != nil {
+		t.Fatalf("unable to set allow list: %v", err)
+	}
+
+	err = p.checkBackendAllowList([]*Service{{Address: "127.0.0.1:8080"}})
+	if err != nil {
+		t.Fatalf("expected allowed address to pass: %v", err)
+	}
+
+	err = p.checkBackendAllowList([]*Service{{
+		Address: "169.254.169.254:80",
+	}})
+	if err == nil {
+		t.Fatalf("expected address not on allow list to be rejected")
+	}
+
+	err = p.checkBackendAllowList([]*Service{{
+		Address:       "127.0.0.1:8080",
+		ShadowAddress: "169.254.169.254:80",
+	}})
+	if err == nil {
+		t.Fatalf("expected shadow address not on allow list to be " +
+			"rejected")
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// overridableMethods are the methods a POST request can be turned into with
+// the method override header of a service. Safe methods are left out on
+// purpose, since turning a POST into a GET could bypass the checks that are
+// only done for requests with side effects.
+var overridableMethods = map[string]bool{
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// applyMethodOverride replaces the method of a POST request with the one in the
+// method override header of the service, if it has one, so clients that can
+// only send GET and POST requests can still use other methods. The header is
+// always removed so it never reaches the backend, and ignored on requests with
+// other methods. An error is returned if the header contains a method that
+// can't be overridden.
+func (s *Service) applyMethodOverride(r *http.Request) error {
+	if s.MethodOverrideHeader == "" {
+		return nil
+	}
+
+	method := strings.ToUpper(
+		strings.TrimSpace(r.Header.Get(s.MethodOverrideHeader)),
+	)
+	r.Header.Del(s.MethodOverrideHeader)
+	if method == "" || r.Method != "POST" {
+		return nil
+	}
+
+	if !overridableMethods[method] {
+		return fmt.Errorf("method %s can't be overridden with %s",
+			r.Method, method)
+	}
+
+	log.Debugf("Overriding method of request to service %s with %s",
+		s.Name, method)
+	r.Method = method
+	return nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestApplyMethodOverride makes sure only POST requests can be overridden with
+// the allowed methods and the header is always removed.
+func TestApplyMethodOverride(t *testing.T) {
+	t.Parallel()
+
+	const header = "X-HTTP-Method-Override"
+
+	tests := []struct {
+		name     string
+		disabled bool
+		method   string
+		override string
+		result   string
+		valid    bool
+	}{{
+		name:     "disabled",
+		disabled: true,
+		method:   "POST",
+		override: "DELETE",
+		result:   "POST",
+		valid:    true,
+	}, {
+		name:     "override",
+		method:   "POST",
+		override: " delete",
+		result:   "DELETE",
+		valid:    true,
+	}, {
+		name:   "no override",
+		method: "POST",
+		result: "POST",
+		valid:  true,
+	}, {
+		name:     "not post",
+		method:   "GET",
+		override: "DELETE",
+		result:   "GET",
+		valid:    true,
+	}, {
+		name:     "safe method",
+		method:   "POST",
+		override: "GET",
+	}}
+	for _, tc := range tests {
+		service := &Service{Name: "test"}
+		if !tc.disabled {
+			service.MethodOverrideHeader = header
+		}
+
+		req := httptest.NewRequest(tc.method, "/", nil)
+		req.Header.Set(header, tc.override)
+		err := service.applyMethodOverride(req)
+		switch {
+		case !tc.valid:
+			if err == nil {
+				t.Fatalf("%s: expected error", tc.name)
+			}
+			continue
+
+		case err != nil:
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+
+		if req.Method != tc.result {
+			t.Fatalf("%s: expected method %s, got %s", tc.name,
+				tc.result, req.Method)
+		}
+		stripped := req.Header.Get(header) == ""
+		if stripped == tc.disabled && tc.override != "" {
+			t.Fatalf("%s: unexpected header %q", tc.name,
+				req.Header.Get(header))
+		}
+	}
+}
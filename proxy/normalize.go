@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// multiSlashReplacer is used to collapse consecutive slashes.
+	multiSlashReplacer = strings.NewReplacer("//", "/")
+)
+
+// normalizePath normalizes the path of the given URL according to the path
+// normalization options of the service. By default, the path is forwarded to
+// the backend exactly as it was sent by the client.
+//
+// The normalization is applied while the service is matched, see
+// matchNormalized, so the service, the auth whitelist and the backend always
+// see the same path. Otherwise a path like /public/../private could match a
+// whitelist entry for /public/ while the backend serves /private.
+func (s *Service) normalizePath(u *url.URL) {
+	if !s.PathDecode && !s.PathMergeSlashes && !s.PathResolveDots {
+		return
+	}
+
+	// Unless the path should be decoded, we work on the escaped path so
+	// encoded characters like %2F are preserved and not mistaken for path
+	// separators.
+	p := u.EscapedPath()
+	if s.PathDecode {
+		p = u.Path
+	}
+
+	if s.PathMergeSlashes {
+		for strings.Contains(p, "//") {
+			p = multiSlashReplacer.Replace(p)
+		}
+	}
+
+	if s.PathResolveDots && p != "" {
+		cleaned := path.Clean(p)
+		if strings.HasSuffix(p, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		p = cleaned
+	}
+
+	if s.PathDecode {
+		u.Path = p
+		u.RawPath = ""
+		return
+	}
+
+	decoded, err := url.PathUnescape(p)
+	if err != nil {
+		// The escaped path came from a parsed URL, so this can't
+		// happen. We leave the path untouched just in case.
+		log.Errorf("Unable to unescape normalized path %s: %v", p, err)
+		return
+	}
+	u.Path = decoded
+	u.RawPath = p
+}
+
+// matchNormalized matches a service to the request by its normalized path, so
+// the service that prices and authorizes a request is also the one whose
+// backend serves the path it receives. Since the normalization depends on the
+// service, the path normalized as the first matching service expects must
+// match that same service again. Otherwise, like with /cheap/../premium, the
+// request isn't matched at all. The path of a matched request is normalized.
+func (p *Proxy) matchNormalized(r *http.Request) (*Service, bool) {
+	target, ok := p.matchService(r)
+	if !ok {
+		return nil, false
+	}
+
+	normalized := *r.URL
+	target.normalizePath(&normalized)
+	if normalized.Path == r.URL.Path &&
+		normalized.RawPath == r.URL.RawPath {
+
+		return target, true
+	}
+
+	// Only a shallow copy is needed to match the normalized path.
+	normalizedReq := r.WithContext(r.Context())
+	normalizedReq.URL = &normalized
+	match, ok := p.matchService(normalizedReq)
+	if !ok || match != target {
+		log.Debugf("Normalized path %s of request %s doesn't match "+
+			"service %s anymore", normalized.Path, r.URL.Path,
+			target.Name)
+		return nil, false
+	}
+
+	*r.URL = normalized
+	return target, true
+}
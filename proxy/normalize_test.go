@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestNormalizePath makes sure the path normalization options of a service
+// are applied as configured.
+func TestNormalizePath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		service         *Service
+		path            string
+		expectedEscaped string
+	}{{
+		name:            "untouched by default",
+		service:         &Service{},
+		path:            "/a//b/../c%2Fd",
+		expectedEscaped: "/a//b/../c%2Fd",
+	}, {
+		name:            "merge slashes",
+		service:         &Service{PathMergeSlashes: true},
+		path:            "/a///b//c/",
+		expectedEscaped: "/a/b/c/",
+	}, {
+		name:            "resolve dots keeps encoding",
+		service:         &Service{PathResolveDots: true},
+		path:            "/a/./b/../c%2F..%2Fd/",
+		expectedEscaped: "/a/c%2F..%2Fd/",
+	}, {
+		name: "decode and resolve dots",
+		service: &Service{
+			PathDecode:      true,
+			PathResolveDots: true,
+		},
+		path:            "/a/b/%2E%2E%2F%2E%2E/c",
+		expectedEscaped: "/c",
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			u, err := url.Parse("http://example.com" + test.path)
+			if err != nil {
+				t.Fatalf("unable to parse URL: %v", err)
+			}
+
+			test.service.normalizePath(u)
+			if u.EscapedPath() != test.expectedEscaped {
+				t.Fatalf("expected path %s, got %s",
+					test.expectedEscaped, u.EscapedPath())
+			}
+		})
+	}
+}
+
+// TestMatchNormalized makes sure a request is matched by the path its backend
+// receives, so a path can't be priced as one service and served as another.
+func TestMatchNormalized(t *testing.T) {
+	t.Parallel()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name + " " + r.URL.Path))
+			},
+		))
+	}
+	cheap, premium := newBackend("cheap"), newBackend("premium")
+	defer cheap.Close()
+	defer premium.Close()
+
+	services := []*Service{{
+		Name:            "cheap",
+		Address:         strings.TrimPrefix(cheap.URL, "http://"),
+		HostRegexp:      ".*",
+		PathRegexp:      "^/cheap",
+		Protocol:        "http",
+		Auth:            "off",
+		PathResolveDots: true,
+	}, {
+		Name:       "premium",
+		Address:    strings.TrimPrefix(premium.URL, "http://"),
+		HostRegexp: ".*",
+		PathRegexp: "^/premium",
+		Protocol:   "http",
+		Auth:       "on",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		response string
+	}{{
+		path:     "/cheap/./a/../b",
+		status:   http.StatusOK,
+		response: "cheap /cheap/b",
+	}, {
+		path:   "/cheap/../premium",
+		status: http.StatusNotFound,
+	}}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.URL.Path = test.path
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d: %s",
+				test.path, test.status, rec.Code,
+				rec.Body.String())
+		}
+		if test.response != "" && rec.Body.String() != test.response {
+			t.Fatalf("%s: unexpected response %q", test.path,
+				rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// observeRejection returns true if the service only observes its auth policy
+// instead of enforcing it. The request that would have been rejected with
+// status 402 for the given reason is then logged and counted in the stats of
+// the service, and the caller serves it anyway.
+func (s *Service) observeRejection(prefixLog *PrefixLog, reason string) bool {
+	if !s.ObserveAuth {
+		return false
+	}
+
+	prefixLog.Infof("%s, serving request of service %s that would have "+
+		"been rejected with 402 in observe-only mode.", reason, s.Name)
+	atomic.AddUint64(&s.stats.observed, 1)
+	return true
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestObserveAuth makes sure requests that would need to be paid for are
+// served and counted in observe-only mode, and rejected otherwise.
+func TestObserveAuth(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	services := []*Service{{
+		Name:        "observed",
+		Address:     address,
+		HostRegexp:  "^observed$",
+		Protocol:    "http",
+		Auth:        "freebie 1",
+		ObserveAuth: true,
+	}, {
+		Name:       "enforced",
+		Address:    address,
+		HostRegexp: "^enforced$",
+		Protocol:   "http",
+		Auth:       "freebie 1",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	send := func(host string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The first request of both services is free, the following ones
+	// need to be paid for, which is only enforced by one service.
+	for i := 0; i < 3; i++ {
+		if code := send("observed"); code != http.StatusOK {
+			t.Fatalf("expected status 200 in observe-only mode, "+
+				"got %d", code)
+		}
+	}
+	if code := send("enforced"); code != http.StatusOK {
+		t.Fatalf("expected free request, got %d", code)
+	}
+	if code := send("enforced"); code != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402, got %d", code)
+	}
+
+	for _, stats := range p.Stats() {
+		var want uint64
+		if stats.Service == "observed" {
+			want = 2
+		}
+		if stats.ObservedRejections != want {
+			t.Fatalf("expected %d observed rejections of %s, got "+
+				"%d", want, stats.Service,
+				stats.ObservedRejections)
+		}
+	}
+}
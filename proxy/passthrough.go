@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// clientHelloTimeout is the maximum time a client may take to send
+	// its TLS ClientHello after connecting.
+	clientHelloTimeout = 10 * time.Second
+)
+
+var (
+	// errListenerClosed is returned when accepting a connection from a
+	// closed passthrough listener.
+	errListenerClosed = errors.New("passthrough listener closed")
+
+	// errHelloRead is used to abort the TLS handshake as soon as the
+	// ClientHello was read.
+	errHelloRead = errors.New("client hello read")
+)
+
+// sniffConn is a connection that reads from the given reader and refuses to
+// write anything. It is used to parse the ClientHello of a connection without
+// responding to it.
+type sniffConn struct {
+	net.Conn
+
+	reader io.Reader
+}
+
+// Read reads from the reader of the connection.
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write discards the data and returns an error.
+func (c *sniffConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// prefixConn is a connection that first returns the data that was already read
+// from it while looking at the ClientHello.
+type prefixConn struct {
+	net.Conn
+
+	reader io.Reader
+}
+
+// Read first reads the data that was already consumed from the connection and
+// then continues with the connection itself.
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// peekServerName reads the TLS ClientHello from the given connection and
+// returns the server name the client requested. All data read from the
+// connection is also written to the buffer so it can be replayed. An empty
+// name is returned if the client doesn't send one or doesn't speak TLS.
+func peekServerName(conn net.Conn, buf *bytes.Buffer) string {
+	var serverName string
+	sniff := &sniffConn{
+		Conn:   conn,
+		reader: io.TeeReader(conn, buf),
+	}
+	_ = tls.Server(sniff, &tls.Config{
+		GetConfigForClient: func(
+			hello *tls.ClientHelloInfo) (*tls.Config, error) {
+
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	return serverName
+}
+
+// PassthroughListener is a listener that routes TLS connections for services
+// configured for TLS passthrough directly to their backend, based on the
+// server name in the ClientHello. The connections aren't decrypted, so none of
+// the authentication or pricing of the proxy applies to them. All other
+// connections are returned by Accept as usual.
+type PassthroughListener struct {
+	net.Listener
+
+	proxy   *Proxy
+	conns   chan net.Conn
+	errChan chan error
+
+	quit      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// A compile-time constraint to ensure PassthroughListener implements
+// net.Listener.
+var _ net.Listener = (*PassthroughListener)(nil)
+
+// NewPassthroughListener creates a new listener that routes the connections to
+// passthrough services of the given proxy to their backends and hands all
+// other connections of the underlying listener to the caller of Accept.
+func NewPassthroughListener(listener net.Listener,
+	p *Proxy) *PassthroughListener {
+
+	l := &PassthroughListener{
+		Listener: listener,
+		proxy:    p,
+		conns:    make(chan net.Conn),
+		errChan:  make(chan error),
+		quit:     make(chan struct{}),
+	}
+
+	l.wg.Add(1)
+	go l.acceptLoop()
+
+	return l
+}
+
+// acceptLoop accepts the connections of the underlying listener. Each
+// connection is inspected in its own goroutine so a slow client can't block
+// any other connections.
+func (l *PassthroughListener) acceptLoop() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errChan <- err:
+			case <-l.quit:
+				return
+			}
+
+			if netErr, ok := err.(net.Error); ok &&
+				netErr.Temporary() {
+
+				continue
+			}
+			return
+		}
+
+		go l.handleConn(conn)
+	}
+}
+
+// handleConn routes the connection to the backend of the passthrough service
+// matching its server name or, if there is none, hands it to Accept.
+func (l *PassthroughListener) handleConn(conn net.Conn) {
+	var buf bytes.Buffer
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName := peekServerName(conn, &buf)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	prefixed := &prefixConn{
+		Conn:   conn,
+		reader: io.MultiReader(&buf, conn),
+	}
+
+	target, ok := l.proxy.matchPassthrough(serverName)
+	if !ok {
+		select {
+		case l.conns <- prefixed:
+		case <-l.quit:
+			_ = conn.Close()
+		}
+		return
+	}
+
+	l.proxy.passthrough(conn, prefixed, target)
+}
+
+// Accept returns the next connection that isn't for a passthrough service.
+func (l *PassthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+
+	case err := <-l.errChan:
+		return nil, err
+
+	case <-l.quit:
+		return nil, errListenerClosed
+	}
+}
+
+// Close stops accepting new connections and closes the underlying listener.
+// Connections that are already passed through are not affected.
+func (l *PassthroughListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		err = l.Listener.Close()
+		l.wg.Wait()
+	})
+	return err
+}
+
+// matchPassthrough returns the first available passthrough service whose host
+// regular expression matches the given server name.
+func (p *Proxy) matchPassthrough(serverName string) (*Service, bool) {
+	if serverName == "" {
+		return nil, false
+	}
+
+	for _, service := range p.currentServices() {
+		if !service.TLSPassthrough || !service.available() {
+			continue
+		}
+
+		hostRegexp := regexp.MustCompile(service.HostRegexp)
+		if hostRegexp.MatchString(serverName) {
+			return service, true
+		}
+	}
+	return nil, false
+}
+
+// passthrough connects the client connection to a backend of the target
+// service and copies the data in both directions until both sides are done.
+// The client is read from through the given reader which also returns the data
+// that was consumed already.
+func (p *Proxy) passthrough(conn net.Conn, client io.Reader, target *Service) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	address := target.backendAddress()
+	backend, err := net.DialTimeout("tcp", address, p.dialTimeout)
+	if err != nil {
+		log.Errorf("Error connecting to passthrough backend %s of "+
+			"service %s: %v", address, target.Name, err)
+		return
+	}
+	defer func() {
+		_ = backend.Close()
+	}()
+
+	log.Debugf("Passing connection from %v through to backend %s of "+
+		"service %s", conn.RemoteAddr(), address, target.Name)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(backend, client)
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(conn, backend)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite signals the end of the data to the peer of the connection while
+// still allowing data to be read from it, if the connection supports it.
+func closeWrite(conn net.Conn) {
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = halfCloser.CloseWrite()
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestPassthroughListener makes sure TLS connections are passed through to the
+// backend of a passthrough service based on their server name while all other
+// connections are returned by Accept.
+func TestPassthroughListener(t *testing.T) {
+	backend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer backend.Close()
+	backendAddress := backend.Listener.Addr().String()
+
+	p := &Proxy{
+		services: []*Service{{
+			Name:           "passthrough",
+			HostRegexp:     "^passthrough.example.com$",
+			Address:        backendAddress,
+			TLSPassthrough: true,
+		}},
+		dialTimeout: time.Second,
+	}
+
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	listener := NewPassthroughListener(netListener, p)
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	// A connection for the passthrough service must end up at the backend
+	// which presents its own certificate.
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         "passthrough.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to connect to passthrough service: %v", err)
+	}
+	peerCert := conn.ConnectionState().PeerCertificates[0]
+	_ = conn.Close()
+	backendCert := backend.Certificate()
+	if !bytes.Equal(peerCert.Raw, backendCert.Raw) {
+		t.Fatalf("connection was not passed through to backend")
+	}
+
+	// Any other connection is handed to the caller of Accept, including
+	// the data that was already read from it.
+	go func() {
+		conn, err := tls.Dial("tcp", address, &tls.Config{
+			ServerName:         "other.example.com",
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept connection: %v", err)
+	}
+	defer accepted.Close()
+
+	header := make([]byte, 1)
+	if _, err := accepted.Read(header); err != nil {
+		t.Fatalf("unable to read from accepted connection: %v", err)
+	}
+	const recordTypeHandshake = 0x16
+	if header[0] != recordTypeHandshake {
+		t.Fatalf("expected TLS handshake record, got %x", header[0])
+	}
+}
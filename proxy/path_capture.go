@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// pathCapturesCtxKey is the key under which the values of the capture groups
+// of the path expression that matched a request are stored in its context.
+type pathCapturesCtxKey struct{}
+
+// captureIndex returns the index of the capture group of the path expression
+// with the given name or number, or -1 if there is none.
+func captureIndex(pathRegexp *regexp.Regexp, group string) int {
+	if index, err := strconv.Atoi(group); err == nil {
+		if index < 1 || index > pathRegexp.NumSubexp() {
+			return -1
+		}
+		return index
+	}
+	for index, name := range pathRegexp.SubexpNames() {
+		if index > 0 && name == group {
+			return index
+		}
+	}
+	return -1
+}
+
+// validatePathCaptureHeaders makes sure every capture group that should be
+// forwarded exists in the path expression of the service.
+func (s *Service) validatePathCaptureHeaders() error {
+	if len(s.PathCaptureHeaders) == 0 {
+		return nil
+	}
+
+	pathRegexp, err := regexp.Compile(s.PathRegexp)
+	if err != nil {
+		return err
+	}
+	for header, group := range s.PathCaptureHeaders {
+		if captureIndex(pathRegexp, group) < 0 {
+			return fmt.Errorf("path expression has no capture "+
+				"group %s for header %s", group, header)
+		}
+	}
+	return nil
+}
+
+// withPathCaptures stores the values of the capture groups of the path
+// expression that matched the request in its context, so they can be
+// forwarded to the backend once the request is proxied.
+func (s *Service) withPathCaptures(r *http.Request) *http.Request {
+	if len(s.PathCaptureHeaders) == 0 {
+		return r
+	}
+
+	pathRegexp := regexp.MustCompile(s.PathRegexp)
+	match := pathRegexp.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return r
+	}
+
+	captures := make(map[string]string, len(s.PathCaptureHeaders))
+	for header, group := range s.PathCaptureHeaders {
+		index := captureIndex(pathRegexp, group)
+		if index < 0 || match[index] == "" {
+			continue
+		}
+		captures[header] = match[index]
+	}
+
+	ctx := context.WithValue(r.Context(), pathCapturesCtxKey{}, captures)
+	return r.WithContext(ctx)
+}
+
+// setPathCaptureHeaders sets the configured headers of the request to the
+// backend to the values of the capture groups of the path expression. Headers
+// of capture groups that were empty or didn't participate in the match are
+// left out. Headers with the same names sent by the client are always removed
+// so they can't be spoofed.
+func (s *Service) setPathCaptureHeaders(req *http.Request) {
+	if len(s.PathCaptureHeaders) == 0 {
+		return
+	}
+
+	ctx := req.Context()
+	captures, _ := ctx.Value(pathCapturesCtxKey{}).(map[string]string)
+	for header := range s.PathCaptureHeaders {
+		req.Header.Del(header)
+		if value, ok := captures[header]; ok {
+			req.Header.Set(header, value)
+		}
+	}
+}
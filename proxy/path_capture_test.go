@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPathCaptureHeaders makes sure the capture groups of the path expression
+// are forwarded in the configured headers and client values are removed.
+func TestPathCaptureHeaders(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{
+		PathRegexp: "^/items/(?P<id>[0-9]+)(/(sub))?",
+		PathCaptureHeaders: map[string]string{
+			"X-Resource-Id": "id",
+			"X-Sub":         "3",
+		},
+	}
+	if err := s.validatePathCaptureHeaders(); err != nil {
+		t.Fatalf("unexpected invalid headers: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/items/42", nil)
+	req.Header.Set("X-Sub", "spoofed")
+	req = s.withPathCaptures(req)
+	s.setPathCaptureHeaders(req)
+
+	if id := req.Header.Get("X-Resource-Id"); id != "42" {
+		t.Fatalf("expected resource ID 42, got %s", id)
+	}
+	if _, ok := req.Header["X-Sub"]; ok {
+		t.Fatalf("expected header of absent group to be removed")
+	}
+
+	req = httptest.NewRequest("GET", "/items/1/sub", nil)
+	req = s.withPathCaptures(req)
+	s.setPathCaptureHeaders(req)
+	if sub := req.Header.Get("X-Sub"); sub != "sub" {
+		t.Fatalf("expected sub capture, got %s", sub)
+	}
+
+	s.PathCaptureHeaders = map[string]string{"X-Foo": "missing"}
+	if err := s.validatePathCaptureHeaders(); err == nil {
+		t.Fatalf("expected unknown group to be rejected")
+	}
+	s.PathCaptureHeaders = map[string]string{"X-Foo": "4"}
+	if err := s.validatePathCaptureHeaders(); err == nil {
+		t.Fatalf("expected out of range group to be rejected")
+	}
+}
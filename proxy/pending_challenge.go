@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+const (
+	// maxPendingChallenges is the maximum number of outstanding challenges
+	// that are remembered per service.
+	maxPendingChallenges = 10000
+
+	// challengeCookiePrefix is the prefix of the name of the cookie that
+	// identifies a client to reuse its challenges. The service name is
+	// appended to it.
+	challengeCookiePrefix = "aperture_challenge_"
+
+	// challengeIDSize is the size in bytes of the random client ID in the
+	// challenge cookie.
+	challengeIDSize = 16
+)
+
+var (
+	// challengeHeaderFields are the header fields of a challenge that are
+	// sent to the client and remembered to reuse it.
+	challengeHeaderFields = []string{
+		hdrWWWAuthenticate, auth.HeaderInvoiceExpiry,
+	}
+)
+
+// pendingChallenge is a challenge that was sent to a client that didn't
+// present a valid token yet.
+type pendingChallenge struct {
+	header    http.Header
+	listPrice int64
+	price     int64
+	expiry    time.Time
+}
+
+// challengeStore remembers the challenges that were recently sent to clients
+// so that a client that retries before its payment has been turned into a
+// valid token gets the same invoice again instead of a new one it might pay
+// as well.
+type challengeStore struct {
+	window time.Duration
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	entries map[string]*pendingChallenge
+	mtx     sync.Mutex
+}
+
+// newChallengeStore creates a new store that remembers challenges for the
+// given window.
+func newChallengeStore(window time.Duration) *challengeStore {
+	return &challengeStore{
+		window:  window,
+		now:     time.Now,
+		entries: make(map[string]*pendingChallenge),
+	}
+}
+
+// get returns the header of the challenge that is outstanding for the given
+// key or nil if there is none. Challenges for a different price than the
+// current one are not reused. Neither are those for a different list price,
+// the price before any discount, since their tokens are only valid for
+// requests up to the list price they were created for.
+func (s *challengeStore) get(key string, listPrice,
+	price int64) http.Header {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	challenge, ok := s.entries[key]
+	switch {
+	case !ok:
+		return nil
+
+	case s.now().After(challenge.expiry):
+		delete(s.entries, key)
+		return nil
+
+	case challenge.listPrice != listPrice || challenge.price != price:
+		return nil
+	}
+
+	return challenge.header
+}
+
+// add remembers the challenge that was sent for the given key. If the store is
+// full even after removing all expired challenges, the challenge is not
+// remembered.
+func (s *challengeStore) add(key string, listPrice, price int64,
+	header http.Header) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	if len(s.entries) >= maxPendingChallenges {
+		for k, challenge := range s.entries {
+			if now.After(challenge.expiry) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	if _, ok := s.entries[key]; !ok &&
+		len(s.entries) >= maxPendingChallenges {
+
+		return
+	}
+
+	s.entries[key] = &pendingChallenge{
+		header:    header,
+		listPrice: listPrice,
+		price:     price,
+		expiry:    now.Add(s.window),
+	}
+}
+
+// challengeKey returns the key under which the challenge for the request is
+// remembered. Challenges are scoped to the client and the requested resource.
+// The IP address doesn't identify a client, many of them share one behind a
+// NAT or Tor, so each client is given a random ID in a cookie instead. If the
+// client didn't send one yet, a new ID is set in the response. Clients that
+// don't keep cookies therefore get a new challenge each time.
+func (s *Service) challengeKey(w http.ResponseWriter,
+	r *http.Request) (string, error) {
+
+	name := challengeCookiePrefix + s.Name
+	cookie, err := r.Cookie(name)
+	if err == nil && len(cookie.Value) == 2*challengeIDSize {
+		return cookie.Value + "\x00" + r.URL.Path, nil
+	}
+
+	var id [challengeIDSize]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	value := hex.EncodeToString(id[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(s.challenges.window / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return value + "\x00" + r.URL.Path, nil
+}
+
+// challengeHeader returns a new header with only the fields of the challenge in
+// the given one. Authenticators write their challenge into the header of the
+// request, which must never be sent back or be reused for another request.
+func challengeHeader(header http.Header) http.Header {
+	challenge := make(http.Header)
+	for _, name := range challengeHeaderFields {
+		if values, ok := header[name]; ok {
+			challenge[name] = append([]string(nil), values...)
+		}
+	}
+	return challenge
+}
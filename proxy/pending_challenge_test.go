@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/mint"
+)
+
+// TestChallengeStore makes sure outstanding challenges are reused for the
+// configured window and only for the same prices.
+func TestChallengeStore(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	store := newChallengeStore(time.Minute)
+	store.now = func() time.Time {
+		return now
+	}
+
+	if header := store.get("a", 10, 10); header != nil {
+		t.Fatalf("expected no challenge, got %v", header)
+	}
+
+	challenge := http.Header{"Www-Authenticate": []string{"LSAT a"}}
+	store.add("a", 20, 10, challenge)
+	if header := store.get("a", 20, 10); header.Get("Www-Authenticate") !=
+		"LSAT a" {
+
+		t.Fatalf("expected stored challenge, got %v", header)
+	}
+
+	// A challenge for a different price must not be reused.
+	if header := store.get("a", 20, 20); header != nil {
+		t.Fatalf("expected no challenge for new price, got %v", header)
+	}
+
+	// Neither must one for a different list price, for example after
+	// the price schedule switched to peak prices while the discounted
+	// price stayed the same.
+	if header := store.get("a", 30, 10); header != nil {
+		t.Fatalf("expected no challenge for new list price, got %v",
+			header)
+	}
+
+	// Once the window passed, a new challenge is needed.
+	now = now.Add(time.Minute + time.Second)
+	if header := store.get("a", 20, 10); header != nil {
+		t.Fatalf("expected expired challenge, got %v", header)
+	}
+}
+
+// countingAuthenticator rejects all tokens and numbers its challenges. Like
+// the LSAT authenticator, it writes them into the header of the request.
+type countingAuthenticator struct {
+	challenges int32
+}
+
+// Accept rejects every token.
+func (a *countingAuthenticator) Accept(*http.Header, string) bool {
+	return false
+}
+
+// FreshChallengeHeader returns a new numbered challenge.
+func (a *countingAuthenticator) FreshChallengeHeader(r *http.Request, _ string,
+	_ int64, _ *mint.ChallengeParams) (http.Header, error) {
+
+	n := atomic.AddInt32(&a.challenges, 1)
+	header := r.Header
+	header.Set("WWW-Authenticate", fmt.Sprintf("LSAT challenge%d", n))
+	return header, nil
+}
+
+// TestChallengeReuse makes sure a challenge is only reused for the client it
+// was sent to, identified by its cookie rather than its IP address, and that
+// no header of the request ends up in the challenge.
+func TestChallengeReuse(t *testing.T) {
+	t.Parallel()
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    "127.0.0.1:1",
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+		Challenge: &ChallengeConfig{
+			ReuseWindow: time.Minute,
+		},
+	}}
+	p, err := New(&countingAuthenticator{}, services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// Both clients share the same IP address, like clients behind a NAT
+	// or Tor.
+	send := func(authorization string,
+		cookies []*http.Cookie) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.RemoteAddr = "127.0.0.1:1000"
+		req.Header.Set("Authorization", authorization)
+		req.Header.Set("X-Secret", authorization)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusPaymentRequired {
+			t.Fatalf("expected status 402, got %d", rec.Code)
+		}
+		return rec
+	}
+	assertNoRequestHeaders := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+
+		for _, name := range []string{"Authorization", "X-Secret"} {
+			if value := rec.Header().Get(name); value != "" {
+				t.Fatalf("request header %s leaked into "+
+					"challenge: %s", name, value)
+			}
+		}
+	}
+
+	first := send("Bearer a", nil)
+	assertNoRequestHeaders(first)
+	cookies := first.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected challenge cookie, got %v", cookies)
+	}
+	challenge := first.Header().Get("WWW-Authenticate")
+
+	// The same client gets the same challenge again.
+	retry := send("Bearer a", cookies)
+	assertNoRequestHeaders(retry)
+	if retry.Header().Get("WWW-Authenticate") != challenge {
+		t.Fatalf("expected challenge to be reused")
+	}
+
+	// Another client with the same address never sees it.
+	other := send("Bearer b", nil)
+	assertNoRequestHeaders(other)
+	if other.Header().Get("WWW-Authenticate") == challenge {
+		t.Fatalf("challenge was reused for another client")
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// weekdays maps the configurable names of the days of the week to
+	// their time.Weekday.
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// PriceRule is a rule of a price schedule that sets the price of a service for
+// a time window on certain days of the week. The times are wall clock times in
+// the timezone of the schedule, so a window keeps its local times across
+// daylight saving time transitions. Windows that lie in the hour that is
+// skipped when the clocks are set forward don't apply on that day.
+type PriceRule struct {
+	// Days is the list of days the rule applies to, for example
+	// ["mon", "fri"]. If empty, the rule applies to every day.
+	Days []string `long:"days" description:"Days of the week the rule applies to, every day if empty"`
+
+	// Start is the time of day in the format HH:MM the rule starts to
+	// apply at.
+	Start string `long:"start" description:"Time of day in the format HH:MM the rule starts at"`
+
+	// End is the time of day in the format HH:MM the rule stops to apply
+	// at. If it's before the start, the window extends past midnight into
+	// the next day. If it's equal to the start, the rule applies all day.
+	End string `long:"end" description:"Time of day in the format HH:MM the rule ends at"`
+
+	// Price is the price in satoshis during the time window.
+	Price int64 `long:"price" description:"Price in satoshis during the time window"`
+
+	window *dailyWindow
+}
+
+// dailyWindow is a time window on certain days of the week. The times are wall
+// clock times, so a window keeps its local times across daylight saving time
+// transitions.
+type dailyWindow struct {
+	// days are the days the window applies to, all days if nil.
+	days map[time.Weekday]bool
+
+	// start and end are the minutes since midnight the window starts and
+	// ends at.
+	start, end int
+}
+
+// parseTimeOfDay parses a time of day in the format HH:MM and returns it as
+// minutes since midnight.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s, must be HH:MM",
+			value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseDailyWindow parses the days and the start and end times in the format
+// HH:MM of a time window. If the end is before the start, the window extends
+// past midnight into the next day. If it's equal to the start, the window
+// spans the whole day.
+func parseDailyWindow(days []string, start, end string) (*dailyWindow,
+	error) {
+
+	w := &dailyWindow{}
+
+	var err error
+	if w.start, err = parseTimeOfDay(start); err != nil {
+		return nil, err
+	}
+	if w.end, err = parseTimeOfDay(end); err != nil {
+		return nil, err
+	}
+
+	if len(days) > 0 {
+		w.days = make(map[time.Weekday]bool, len(days))
+	}
+	for _, day := range days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %s", day)
+		}
+		w.days[weekday] = true
+	}
+
+	return w, nil
+}
+
+// appliesOn returns true if the window applies on the given day.
+func (w *dailyWindow) appliesOn(day time.Weekday) bool {
+	return w.days == nil || w.days[day]
+}
+
+// matches returns true if the given local time lies in the window.
+func (w *dailyWindow) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	switch {
+	// The window spans the whole day.
+	case w.start == w.end:
+		return w.appliesOn(day)
+
+	case w.start < w.end:
+		return w.appliesOn(day) && minute >= w.start &&
+			minute < w.end
+
+	// The window extends past midnight, so the part after midnight
+	// belongs to the window of the previous day.
+	default:
+		if minute >= w.start {
+			return w.appliesOn(day)
+		}
+		previousDay := (day + 6) % 7
+		return minute < w.end && w.appliesOn(previousDay)
+	}
+}
+
+// compile parses the days and times of the rule.
+func (p *PriceRule) compile() error {
+	if p.Price <= 0 || p.Price > maxServicePrice {
+		return fmt.Errorf("price %d of rule must be between 1 and %d",
+			p.Price, int64(maxServicePrice))
+	}
+
+	window, err := parseDailyWindow(p.Days, p.Start, p.End)
+	if err != nil {
+		return err
+	}
+	p.window = window
+
+	return nil
+}
+
+// matches returns true if the rule applies at the given local time.
+func (p *PriceRule) matches(t time.Time) bool {
+	return p.window.matches(t)
+}
+
+// compilePriceSchedule parses the price schedule and its timezone.
+func (s *Service) compilePriceSchedule() error {
+	s.priceLocation = time.UTC
+	if s.PriceTimezone != "" {
+		loc, err := time.LoadLocation(s.PriceTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid price timezone: %v", err)
+		}
+		s.priceLocation = loc
+	}
+
+	for _, rule := range s.PriceSchedule {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("invalid price rule: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateMethodPrices makes sure the method specific prices of the service are
+// within the allowed range and brings their method names into upper case.
+func (s *Service) validateMethodPrices() error {
+	methodPrices := make(map[string]int64, len(s.MethodPrices))
+	for method, price := range s.MethodPrices {
+		switch {
+		case method == "":
+			return fmt.Errorf("method price needs a method")
+
+		case price <= 0:
+			return fmt.Errorf("price of method %s must be "+
+				"positive", method)
+
+		case price > maxServicePrice:
+			return fmt.Errorf("price of method %s exceeds the "+
+				"maximum", method)
+		}
+		methodPrices[strings.ToUpper(method)] = price
+	}
+	s.MethodPrices = methodPrices
+
+	return nil
+}
+
+// currentPrice returns the price of a request with the given method to the
+// service at the given time. The first rule of the price schedule that matches
+// the time decides the price. If none matches, the price of the method or the
+// static price of the service is used.
+func (s *Service) currentPrice(method string, now time.Time) int64 {
+	price := s.Price
+	if methodPrice, ok := s.MethodPrices[method]; ok {
+		price = methodPrice
+	}
+
+	if len(s.PriceSchedule) == 0 {
+		return price
+	}
+
+	local := now.In(s.priceLocation)
+	for _, rule := range s.PriceSchedule {
+		if rule.matches(local) {
+			return rule.Price
+		}
+	}
+	return price
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCurrentPrice makes sure the price of a service follows its price
+// schedule.
+func TestCurrentPrice(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		Price:         10,
+		PriceTimezone: "Europe/Zurich",
+		PriceSchedule: []*PriceRule{{
+			Days:  []string{"mon", "tue", "wed", "thu", "fri"},
+			Start: "09:00",
+			End:   "17:00",
+			Price: 50,
+		}, {
+			Days:  []string{"fri"},
+			Start: "22:00",
+			End:   "06:00",
+			Price: 1,
+		}},
+	}
+	if err := service.compilePriceSchedule(); err != nil {
+		t.Fatalf("unable to compile price schedule: %v", err)
+	}
+
+	loc, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatalf("unable to load location: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		time     time.Time
+		expected int64
+	}{{
+		name:     "weekday peak",
+		time:     time.Date(2020, 3, 2, 9, 0, 0, 0, loc),
+		expected: 50,
+	}, {
+		name:     "end is exclusive",
+		time:     time.Date(2020, 3, 2, 17, 0, 0, 0, loc),
+		expected: 10,
+	}, {
+		name:     "weekend",
+		time:     time.Date(2020, 3, 7, 12, 0, 0, 0, loc),
+		expected: 10,
+	}, {
+		name:     "across midnight before",
+		time:     time.Date(2020, 3, 6, 23, 30, 0, 0, loc),
+		expected: 1,
+	}, {
+		name:     "across midnight after",
+		time:     time.Date(2020, 3, 7, 5, 59, 0, 0, loc),
+		expected: 1,
+	}, {
+		name:     "across midnight wrong day",
+		time:     time.Date(2020, 3, 6, 5, 0, 0, 0, loc),
+		expected: 10,
+	}, {
+		name:     "other timezone",
+		time:     time.Date(2020, 3, 2, 8, 30, 0, 0, time.UTC),
+		expected: 50,
+	}}
+
+	for _, tc := range tests {
+		price := service.currentPrice("GET", tc.time)
+		if price != tc.expected {
+			t.Fatalf("%s: expected price %d, got %d", tc.name,
+				tc.expected, price)
+		}
+	}
+}
+
+// TestInvalidPriceSchedule makes sure invalid rules are rejected.
+func TestInvalidPriceSchedule(t *testing.T) {
+	t.Parallel()
+
+	rules := []*PriceRule{
+		{Start: "9:00am", End: "17:00", Price: 1},
+		{Start: "09:00", End: "24:00", Price: 1},
+		{
+			Days:  []string{"monday"},
+			Start: "09:00",
+			End:   "17:00",
+			Price: 1,
+		},
+		{Start: "09:00", End: "17:00", Price: 0},
+	}
+	for _, rule := range rules {
+		service := &Service{PriceSchedule: []*PriceRule{rule}}
+		if err := service.compilePriceSchedule(); err == nil {
+			t.Fatalf("expected error for rule %v", rule)
+		}
+	}
+}
+
+// TestMethodPrices makes sure requests are priced by their method and the
+// price schedule still takes precedence.
+func TestMethodPrices(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		Price:        1,
+		MethodPrices: map[string]int64{"post": 10},
+		PriceSchedule: []*PriceRule{{
+			Days:  []string{"sat"},
+			Start: "00:00",
+			End:   "00:00",
+			Price: 5,
+		}},
+	}
+	if err := service.compilePriceSchedule(); err != nil {
+		t.Fatalf("unable to compile price schedule: %v", err)
+	}
+	if err := service.validateMethodPrices(); err != nil {
+		t.Fatalf("unable to validate method prices: %v", err)
+	}
+
+	friday := time.Date(2020, 3, 6, 12, 0, 0, 0, time.UTC)
+	saturday := time.Date(2020, 3, 7, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		method   string
+		time     time.Time
+		expected int64
+	}{
+		{"GET", friday, 1},
+		{"POST", friday, 10},
+		{"POST", saturday, 5},
+	}
+	for _, tc := range tests {
+		price := service.currentPrice(tc.method, tc.time)
+		if price != tc.expected {
+			t.Fatalf("expected price %d for %s at %v, got %d",
+				tc.expected, tc.method, tc.time, price)
+		}
+	}
+
+	for _, price := range []int64{0, -1, maxServicePrice + 1} {
+		service := &Service{
+			MethodPrices: map[string]int64{"PUT": price},
+		}
+		if err := service.validateMethodPrices(); err == nil {
+			t.Fatalf("expected price %d to be invalid", price)
+		}
+	}
+}
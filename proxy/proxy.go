@@ -1,17 +1,27 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/btcsuite/btclog"
 	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
 	"github.com/lightninglabs/aperture/lsat"
 	"google.golang.org/grpc/codes"
 )
@@ -25,43 +35,297 @@ const (
 	formatPattern  = "- - \"%s %s %s\" \"%s\" \"%s\""
 	hdrContentType = "Content-Type"
 	hdrTypeGrpc    = "application/grpc"
+
+	// statusClientClosedRequest is the non-standard status code that is
+	// recorded if the client closed the connection before a response was
+	// sent.
+	statusClientClosedRequest = 499
+
+	// DefaultBackendDialTimeout is the default maximum duration of
+	// establishing a connection to a backend.
+	DefaultBackendDialTimeout = 5 * time.Second
+
+	// backendKeepAlive is the interval of the TCP keep-alive probes on
+	// connections to backends.
+	backendKeepAlive = 30 * time.Second
 )
 
+// serviceCtxKey is the key under which the matched backend service is stored
+// in the context of a request once it was matched.
+type serviceCtxKey struct{}
+
+// serviceFromRequest returns the backend service that was matched to the given
+// request.
+func serviceFromRequest(r *http.Request) (*Service, bool) {
+	target, ok := r.Context().Value(serviceCtxKey{}).(*Service)
+	return target, ok
+}
+
+// authenticatedCtxKey is the key under which the information whether the token
+// of a request was verified is stored in the context of a request that is
+// forwarded to the backend.
+type authenticatedCtxKey struct{}
+
+// authenticatedRequest returns true if the token of the given request was
+// verified before it was handed to the reverse proxy.
+func authenticatedRequest(r *http.Request) bool {
+	authenticated, _ := r.Context().Value(authenticatedCtxKey{}).(bool)
+	return authenticated
+}
+
 // Proxy is a HTTP, HTTP/2 and gRPC handler that takes an incoming request,
 // uses its authenticator to validate the request's headers, and either returns
 // a challenge to the client or forwards the request to another server and
 // proxies the response back to the client.
 type Proxy struct {
-	proxyBackend  *httputil.ReverseProxy
+	// proxyBackend, transport and services are replaced together when the
+	// services are updated and must only be accessed with the mutex held.
+	proxyBackend *httputil.ReverseProxy
+	transport    http.RoundTripper
+	services     []*Service
+	servicesMtx  sync.RWMutex
+
 	staticServer  http.Handler
+	staticFiles   http.FileSystem
 	authenticator auth.Authenticator
-	services      []*Service
+	matchMode     MatchMode
+
+	// backendAllowList is an optional list of regular expressions one of
+	// which the host of every backend service address must match.
+	backendAllowList []*regexp.Regexp
+
+	// strictPathRegexp requires every service to have a path regular
+	// expression instead of treating an empty one as match-all.
+	strictPathRegexp bool
+
+	// accessLog is an optional writer the request log entries are written
+	// to instead of the application log.
+	accessLog io.Writer
+
+	// discountHeader is the header clients can present a discount token
+	// in that is verified by the discountVerifier, if one is set.
+	discountHeader   string
+	discountVerifier DiscountVerifier
+
+	// exchangeRates is the optional provider of exchange rates used to
+	// show fiat prices in challenges.
+	exchangeRates ExchangeRateProvider
+
+	// errorFormat is the format of the error responses sent to HTTP
+	// clients.
+	errorFormat ErrorFormat
+
+	// dialTimeout is the maximum duration of establishing a connection to
+	// a backend.
+	dialTimeout time.Duration
+
+	// grpcNoMatchCode is the gRPC status code sent to gRPC clients whose
+	// request doesn't match any service.
+	grpcNoMatchCode codes.Code
+
+	// grpcHealth is set if the proxy answers gRPC health checks itself.
+	grpcHealth bool
+
+	// accountCaveat is the condition of the caveat that names the account
+	// of a token. Requests are only tagged with accounts if it is set.
+	// accountHeader is the header the account is sent to the backend in.
+	accountCaveat string
+	accountHeader string
+
+	// recordLatencies is set while a LatencyReporter is running. It must
+	// be accessed atomically.
+	recordLatencies int32
+
+	// geoIP is the optional database used to resolve the country of
+	// clients.
+	geoIP *GeoIPDB
+
+	// authenticators are the additional authenticators services can
+	// select by name instead of the default one.
+	authenticators map[string]auth.Authenticator
+
+	// webhook is the optional webhook events in the authentication
+	// lifecycle of requests are sent to.
+	webhook *Webhook
+
+	// statsPath is the path the usage stats are served on if a statsToken
+	// is set, which requests for them must present.
+	statsPath  string
+	statsToken string
+
+	// configExportPath is the path the effective configuration of the
+	// services is served on if a configExportToken is set, which requests
+	// for it must present.
+	configExportPath  string
+	configExportToken string
+
+	// debugHeader is the header clients from the debugTrusted networks can
+	// enable debug flags for a single request in.
+	debugHeader  string
+	debugTrusted []*net.IPNet
+
+	// wellKnownPath is the path the discovery document of the services is
+	// served on, if it's served at all.
+	wellKnownPath string
+
+	// warmUpEnd is the time until which requests are served without
+	// payment after the proxy was started.
+	warmUpEnd time.Time
+
+	// corsDisabled is set if no CORS headers are added for any service.
+	corsDisabled bool
+
+	// freebieDiskDB is the optional on-disk database of services that
+	// use the disk freebie strategy.
+	freebieDiskDB *freebie.BoltDB
+}
+
+// Option is a functional option that modifies the default behavior of the
+// proxy.
+type Option func(*Proxy) error
+
+// WithMatchMode sets the mode the proxy uses to match requests to backend
+// services.
+func WithMatchMode(mode MatchMode) Option {
+	return func(p *Proxy) error {
+		switch mode {
+		case "":
+			p.matchMode = MatchFirst
+
+		case MatchFirst, MatchSpecific:
+			p.matchMode = mode
+
+		default:
+			return fmt.Errorf("unknown service match mode %s", mode)
+		}
+		return nil
+	}
+}
+
+// WithBackendAllowList restricts the hosts backend services can be configured
+// to. Each entry is a regular expression that is matched against the host part
+// of a service's address. An empty list disables the check.
+func WithBackendAllowList(allowList []string) Option {
+	return func(p *Proxy) error {
+		p.backendAllowList = nil
+		for _, entry := range allowList {
+			hostRegexp, err := regexp.Compile(entry)
+			if err != nil {
+				return fmt.Errorf("invalid backend allow list "+
+					"entry %s: %v", entry, err)
+			}
+			p.backendAllowList = append(
+				p.backendAllowList, hostRegexp,
+			)
+		}
+		return nil
+	}
+}
+
+// WithStrictPathRegexp requires every service to be configured with a path
+// regular expression. By default, a service without one matches every path of
+// its host.
+func WithStrictPathRegexp(strict bool) Option {
+	return func(p *Proxy) error {
+		p.strictPathRegexp = strict
+		return nil
+	}
+}
+
+// WithFreebieDiskDB sets the on-disk database that keeps the freebie counts of
+// services with the disk freebie strategy. The caller is responsible for
+// closing it after the proxy was shut down.
+func WithFreebieDiskDB(db *freebie.BoltDB) Option {
+	return func(p *Proxy) error {
+		p.freebieDiskDB = db
+		return nil
+	}
+}
+
+// WithAccessLog sets a writer the request log entries are written to instead
+// of the application log. The entries use the combined log format and include
+// the response status.
+func WithAccessLog(w io.Writer) Option {
+	return func(p *Proxy) error {
+		p.accessLog = w
+		return nil
+	}
+}
+
+// WithBackendDialTimeout sets the maximum duration of establishing a connection
+// to a backend. If a backend can't be reached in time, the request fails with
+// a bad gateway status. A value of zero sets the default timeout.
+func WithBackendDialTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) error {
+		switch {
+		case timeout == 0:
+			p.dialTimeout = DefaultBackendDialTimeout
+
+		case timeout < 0:
+			return fmt.Errorf("backend dial timeout cannot be " +
+				"negative")
+
+		default:
+			p.dialTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithGrpcNoMatchCode sets the gRPC status code, by its canonical name like
+// "NOT_FOUND", that gRPC clients receive if their request doesn't match any
+// service. An empty name sets the default of UNIMPLEMENTED, which is what gRPC
+// servers return for unknown methods.
+func WithGrpcNoMatchCode(name string) Option {
+	return func(p *Proxy) error {
+		if name == "" {
+			p.grpcNoMatchCode = codes.Unimplemented
+			return nil
+		}
+
+		code, ok := grpcCodeNames[strings.ToUpper(name)]
+		if !ok || code == codes.OK {
+			return fmt.Errorf("invalid gRPC status code %s for "+
+				"unmatched requests", name)
+		}
+		p.grpcNoMatchCode = code
+		return nil
+	}
 }
 
 // New returns a new Proxy instance that proxies between the services specified,
 // using the auth to validate each request's headers and get new challenge
 // headers if necessary.
 func New(auth auth.Authenticator, services []*Service, serveStatic bool,
-	staticRoot string) (*Proxy, error) {
+	staticRoot string, opts ...Option) (*Proxy, error) {
+
+	proxy := &Proxy{
+		authenticator:   auth,
+		matchMode:       MatchFirst,
+		errorFormat:     ErrorFormatText,
+		dialTimeout:     DefaultBackendDialTimeout,
+		grpcNoMatchCode: codes.Unimplemented,
+	}
 
 	// By default the static file server only returns 404 answers for
 	// security reasons. Serving files from the staticRoot directory has to
 	// be enabled intentionally.
-	staticServer := http.NotFoundHandler()
+	proxy.staticServer = http.HandlerFunc(proxy.notFound)
 	if serveStatic {
 		if len(strings.TrimSpace(staticRoot)) == 0 {
 			return nil, fmt.Errorf("staticroot cannot be empty, " +
 				"must contain path to directory that " +
 				"contains index.html")
 		}
-		staticServer = http.FileServer(http.Dir(staticRoot))
+		proxy.staticFiles = http.Dir(staticRoot)
+		proxy.staticServer = http.FileServer(proxy.staticFiles)
 	}
-
-	proxy := &Proxy{
-		staticServer:  staticServer,
-		authenticator: auth,
-		services:      services,
+	for _, opt := range opts {
+		if err := opt(proxy); err != nil {
+			return nil, err
+		}
 	}
+
 	err := proxy.UpdateServices(services)
 	if err != nil {
 		return nil, err
@@ -76,25 +340,103 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Parse and log the remote IP address. We also need the parsed IP
 	// address for the freebie count.
 	remoteIP, prefixLog := NewRemoteIPPrefixLog(log, r.RemoteAddr)
+
+	// Trusted clients can enable debug behaviors for this request only.
+	flags := p.debugFlags(r, remoteIP)
+	r = withDebugFlags(r, flags)
+	prefixLog.verbose = flags.trace
+
+	// We keep track of the status we send to the client, so we know if a
+	// request can be subject to log sampling.
+	recorder := newStatusRecorder(w)
+	w = recorder
+
+	var target *Service
 	logRequest := func() {
-		prefixLog.Infof(formatPattern, r.Method, r.RequestURI, r.Proto,
-			r.Referer(), r.UserAgent())
+		if target != nil && !target.sampleRequestLog(recorder) {
+			return
+		}
+		if p.accessLog != nil {
+			p.writeAccessLog(r, target, recorder.Status())
+			return
+		}
+		prefixLog.Infof(formatPattern, r.Method,
+			p.loggedRequestURI(r, target), r.Proto,
+			loggedHeader(target, r, "Referer"),
+			loggedHeader(target, r, "User-Agent"))
 	}
 	defer logRequest()
 
+	// Requests that try to inject header fields or to be interpreted
+	// differently by the backend never make it any further.
+	if err := validateRequestHeaders(r); err != nil {
+		prefixLog.Infof("Invalid request header: %v. Sending 400.", err)
+		p.sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// For OPTIONS requests we only need to set the CORS headers, not serve
-	// any content;
-	if r.Method == "OPTIONS" {
+	// any content. If CORS is disabled, they're forwarded to the backend
+	// like any other request.
+	if p.isCorsPreflight(r) {
 		addCorsHeaders(w.Header())
-		sendDirectResponse(w, r, http.StatusOK, "")
+		p.sendDirectResponse(w, r, http.StatusOK, "")
+		return
+	}
+
+	// Operators can fetch the usage stats of all services with their
+	// admin token.
+	if p.isStatsRequest(r) {
+		p.serveStats(w, r)
 		return
 	}
 
-	// Requests that can't be matched to a service backend will be
-	// dispatched to the static file server. If the file exists in the
-	// static file folder it will be served, otherwise the static server
-	// will return a 404 for us.
-	target, ok := matchService(r, p.services)
+	// Clients can discover the services and their prices without paying.
+	if p.isWellKnownRequest(r) {
+		p.serveWellKnown(w, r)
+		return
+	}
+
+	// They can also check which configuration is actually running.
+	if p.isConfigExportRequest(r) {
+		p.serveConfigExport(w, r)
+		return
+	}
+
+	// Health checks of the proxy itself are answered without requiring
+	// any authentication.
+	if p.isGrpcHealthCheck(r) {
+		p.serveGrpcHealth(w, r)
+		return
+	}
+
+	// Requests that can't be matched to a service backend are handled by
+	// the fallback service, if there is one and the static file server
+	// doesn't have a file for them. Otherwise they will be dispatched to
+	// the static file server. If the file exists in the static file
+	// folder it will be served, otherwise the static server will return a
+	// 404 for us.
+	//
+	// The path is brought into the shape the backend expects while the
+	// service is matched, so the service, its auth whitelist and the
+	// backend all see the same path.
+	var ok bool
+	target, ok = p.matchNormalized(r)
+	if !ok {
+		target, ok = p.matchFallback(r)
+		if ok {
+			target.normalizePath(r.URL)
+		}
+	}
+	if !ok && isGrpcRequest(r) {
+		// gRPC clients can't make sense of the static file server's
+		// answers, so they get a status they understand instead.
+		prefixLog.Debugf("No service for gRPC request %s.", r.URL.Path)
+		sendGrpcStatus(
+			w, p.grpcNoMatchCode, "no service for "+r.URL.Path,
+		)
+		return
+	}
 	if !ok {
 		prefixLog.Debugf("Dispatching request %s to static file "+
 			"server.", r.URL.Path)
@@ -102,56 +444,445 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients that can't set headers may send their token in the URL. We
+	// move it to the header where it's expected right away, so it's
+	// removed from the URL before the request is logged, no matter how
+	// it's answered.
+	target.extractQueryToken(r)
+
+	// We remember the matched service so the responses to the request,
+	// including our own error responses, can be tailored to it.
+	ctx := context.WithValue(r.Context(), serviceCtxKey{}, target)
+	r = target.withPathCaptures(r.WithContext(ctx))
+	r = target.withRawHeaderFields(r)
+	r = target.withExternalOrigin(r)
+	ctx = r.Context()
+
+	// Clients that can't send all methods tunnel them through POST. The
+	// method is replaced before anything depends on it, like the price.
+	if err := target.applyMethodOverride(r); err != nil {
+		prefixLog.Infof("Invalid method override: %v. Sending 400.",
+			err)
+		p.sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Keep track of the activity of the service for the stats endpoint.
+	var forwarded bool
+	start := time.Now()
+	target.stats.begin()
+	defer func() {
+		latency := time.Since(start)
+		target.stats.end(latency, recorder.Status(), forwarded)
+		p.recordLatency(target, latency, recorder.Status())
+	}()
+
+	// Formatting all headers is expensive, so we only do it if they are
+	// actually logged.
+	if log.Level() <= btclog.LevelTrace || flags.trace {
+		prefixLog.Tracef("Headers of request to service %s: %v",
+			target.Name, loggedHeaders(target, r.Header))
+	}
+
+	// A disabled service still claims its requests, so clients can tell
+	// it apart from one that doesn't exist.
+	if !p.checkDisabled(w, r, target) {
+		prefixLog.Infof("Service %s is disabled.", target.Name)
+		return
+	}
+
+	// Some services are only available to clients that authenticated
+	// themselves with a certificate during the TLS handshake.
+	if target.RequireClientCert && !hasClientCert(r) {
+		prefixLog.Infof("Missing client certificate. Sending 403.")
+		p.sendDirectResponse(
+			w, r, http.StatusForbidden,
+			"client certificate required",
+		)
+		return
+	}
+
+	// Services can be restricted to certain times of the day.
+	if !p.checkAccessSchedule(w, r, target, time.Now()) {
+		prefixLog.Infof("Outside of access schedule. Sending %d.",
+			target.AccessSchedule.Status)
+		return
+	}
+
+	// Requests with content the service doesn't accept are rejected
+	// before they reach the authentication or the backend.
+	if !target.contentTypeAllowed(r) {
+		prefixLog.Infof("Unsupported content type %s. Sending 415.",
+			r.Header.Get("Content-Type"))
+		p.sendDirectResponse(
+			w, r, http.StatusUnsupportedMediaType,
+			"unsupported content type",
+		)
+		return
+	}
+
+	// The same goes for requests that ask for a format the service
+	// doesn't want to serve.
+	if !target.acceptAllowed(r) {
+		prefixLog.Infof("Unacceptable formats %s. Sending 406.",
+			r.Header.Get("Accept"))
+		p.sendDirectResponse(
+			w, r, http.StatusNotAcceptable, "not acceptable",
+		)
+		return
+	}
+
+	// Bodies that don't conform to the schema of the service never reach
+	// the backend.
+	if status, err := target.validateRequestBody(r); err != nil {
+		prefixLog.Infof("Rejecting request body: %v. Sending %d.", err,
+			status)
+		p.sendDirectResponse(w, r, status, err.Error())
+		return
+	}
+
+	// A token that is present but can't be decoded most likely indicates
+	// a bug in the client, which it should learn about instead of being
+	// treated like a client that didn't send a token at all.
+	_, _, err := lsat.FromHeader(&r.Header)
+	if errors.Is(err, lsat.ErrMalformedHeader) {
+		prefixLog.Infof("Malformed token: %v. Sending 400.", err)
+		p.sendDirectResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// Determine auth level required to access service and dispatch request
 	// accordingly.
+	//
+	// Tokens are only accepted if they were paid for at least the current
+	// price of the request.
+	var (
+		authenticated bool
+		tokenAuth     auth.Authenticator
+
+		// freebie is set if the request passes as a free request of
+		// the client with the freebie IP. It's only counted once the
+		// request is admitted to the backend.
+		freebie   bool
+		freebieIP net.IP
+	)
+	price := target.currentPrice(r.Method, time.Now())
 	authLevel := target.AuthRequired(r)
 	switch {
 	case authLevel.IsOn():
-		if !p.authenticator.Accept(&r.Header, target.Name) {
+		tokenAuth = p.tokenAuthenticator(&r.Header, target, price)
+		if tokenAuth == nil {
+			if p.inWarmUp() {
+				prefixLog.Infof("Authentication failed, " +
+					"serving request without payment " +
+					"during warm-up.")
+				break
+			}
+			if target.observeRejection(
+				prefixLog, "Authentication failed",
+			) {
+
+				break
+			}
 			prefixLog.Infof("Authentication failed. Sending 402.")
-			p.handlePaymentRequired(w, r, target.Name, target.Price)
+			p.handlePaymentRequired(w, r, target)
 			return
 		}
+		authenticated = true
+		atomic.AddUint64(&target.stats.paid, 1)
+		p.notifyEvent(
+			EventPaymentAccepted, r, target, price, true,
+		)
 
 	case authLevel.IsFreebie():
 		// We only need to respect the freebie counter if the user
 		// is not authenticated at all.
-		if !p.authenticator.Accept(&r.Header, target.Name) {
-			ok, err := target.freebieDb.CanPass(r, remoteIP)
+		tokenAuth = p.tokenAuthenticator(&r.Header, target, price)
+		authenticated = tokenAuth != nil
+		if authenticated {
+			atomic.AddUint64(&target.stats.paid, 1)
+			p.notifyEvent(
+				EventPaymentAccepted, r, target, price, true,
+			)
+		}
+		if !authenticated {
+			// Clients in the same network can share their
+			// freebies.
+			freebieIP = target.freebieIP(remoteIP)
+			ok, err := target.freebieDb.CanPass(r, freebieIP)
 			if err != nil {
 				prefixLog.Errorf("Error querying freebie db: "+
 					"%v", err)
-				sendDirectResponse(
-					w, r, http.StatusInternalServerError,
-					"freebie DB failure",
-				)
-				return
+				if !p.handleFreebieDBError(w, r, target) {
+					return
+				}
+
+				// The request is served without being
+				// counted.
+				break
+			}
+			if !ok && p.inWarmUp() {
+				prefixLog.Infof("No freebies left, serving " +
+					"request without payment during " +
+					"warm-up.")
+				break
+			}
+			if !ok && target.observeRejection(
+				prefixLog, "No freebies left",
+			) {
+
+				break
 			}
 			if !ok {
-				p.handlePaymentRequired(w, r, target.Name, target.Price)
+				p.handlePaymentRequired(w, r, target)
 				return
 			}
-			_, err = target.freebieDb.TallyFreebie(r, remoteIP)
-			if err != nil {
-				prefixLog.Errorf("Error updating freebie db: "+
-					"%v", err)
-				sendDirectResponse(
-					w, r, http.StatusInternalServerError,
-					"freebie DB failure",
-				)
+			freebie = true
+		}
+	}
+
+	// Usage can be attributed to the account the token was issued to.
+	ctx = p.withAccount(ctx, r, authenticated)
+	r = r.WithContext(ctx)
+
+	// Retries of a request with an idempotency key that the backend
+	// already answered get the stored response instead of reaching the
+	// backend again.
+	idempotencyKey := target.idempotencyKey(
+		r, remoteIP.String(), authenticated,
+	)
+	if idempotencyKey != "" && !flags.noCache {
+		stored, err := target.idempotency.begin(idempotencyKey)
+		switch {
+		case err != nil:
+			p.sendDirectResponse(
+				w, r, http.StatusConflict, err.Error(),
+			)
+			return
+
+		case stored != nil:
+			prefixLog.Debugf("Replaying stored response for "+
+				"idempotent request to service %s",
+				target.Name)
+			stored.replay(w)
+			return
+		}
+
+		capture := target.captureResponse(w)
+		w = capture
+		defer func() {
+			// A response that was aborted, for example because
+			// the backend connection broke while the body was
+			// copied, is incomplete and must not be replayed.
+			if err := recover(); err != nil {
+				target.idempotency.finish(idempotencyKey, nil)
+				panic(err)
+			}
+
+			target.idempotency.finish(
+				idempotencyKey, capture.response(),
+			)
+		}()
+	}
+
+	// A single client must not tie up the backend with many slow requests
+	// at the same time.
+	releaseClient, err := target.acquireClientInFlight(
+		r, remoteIP.String(), authenticated,
+	)
+	if err != nil {
+		prefixLog.Debugf("In-flight limit of service %s reached: %v",
+			target.Name, err)
+		p.sendDirectResponse(
+			w, r, http.StatusTooManyRequests, err.Error(),
+		)
+		return
+	}
+	defer releaseClient()
+
+	// Make sure we don't exceed the rate the backend can handle. Requests
+	// are either queued until the backend has capacity again or rejected.
+	if target.rateLimiter != nil {
+		delay, err := target.rateLimiter.wait(r.Context())
+		switch {
+		case err == errRateLimited:
+			prefixLog.Debugf("Backend rate limit of service %s "+
+				"exceeded", target.Name)
+			p.notifyEvent(
+				EventRateLimited, r, target,
+				target.currentPrice(r.Method, time.Now()),
+				authenticated,
+			)
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			w.Header().Set(
+				"Retry-After", strconv.Itoa(retryAfter),
+			)
+			p.sendDirectResponse(
+				w, r, http.StatusTooManyRequests, err.Error(),
+			)
+			return
+
+		case err != nil:
+			// The client gave up while the request was queued,
+			// so there's nobody to respond to anymore.
+			recorder.status = statusClientClosedRequest
+			return
+		}
+	}
+
+	// Make sure the backend doesn't get more concurrent requests than it
+	// can handle. Requests are either queued until a slot is free or
+	// rejected.
+	releaseSlot, err := target.acquireConcurrencySlot(
+		r, remoteIP.String(), authenticated,
+	)
+	switch {
+	case err == errConcurrencyLimit || err == errQueueFull:
+		prefixLog.Debugf("Backend concurrency limit of service %s "+
+			"reached: %v", target.Name, err)
+		p.sendDirectResponse(
+			w, r, http.StatusServiceUnavailable, err.Error(),
+		)
+		return
+
+	case err != nil:
+		// The client gave up while the request was queued.
+		recorder.status = statusClientClosedRequest
+		return
+	}
+	defer releaseSlot()
+
+	// Now that the request is admitted, it uses up one request of the
+	// quota of its token.
+	// The usage store being unavailable is no reason to make the client
+	// pay again, so only an exhausted quota leads to a new challenge.
+	err = countUsage(r, target, tokenAuth)
+	switch {
+	case errors.Is(err, auth.ErrQuotaExhausted):
+		prefixLog.Infof("%v. Sending 402.", err)
+		p.handlePaymentRequired(w, r, target)
+		return
+
+	case err != nil:
+		prefixLog.Errorf("Unable to count token usage: %v", err)
+		p.sendDirectResponse(
+			w, r, http.StatusServiceUnavailable,
+			"unable to count token usage",
+		)
+		return
+	}
+
+	// The same goes for free requests, so requests that are rejected by
+	// any of the limits don't use up the freebies of the client.
+	if freebie {
+		left, err := tallyFreebie(w, r, target.freebieDb, freebieIP)
+		switch {
+		case err != nil:
+			prefixLog.Errorf("Error updating freebie db: %v", err)
+			if !p.handleFreebieDBError(w, r, target) {
 				return
 			}
+
+		default:
+			target.addFreebieHeaders(w.Header(), left)
+			atomic.AddUint64(&target.stats.freebie, 1)
+
+			// Clients aren't charged for free requests that
+			// failed, if requested.
+			defer func() {
+				target.refundFreebie(
+					r, freebieIP, recorder.Status(),
+				)
+			}()
+			p.notifyEvent(EventFreebieGranted, r, target, 0, false)
 		}
 	}
 
 	// If we got here, it means everything is OK to pass the request to the
-	// service backend via the reverse proxy.
-	p.proxyBackend.ServeHTTP(w, r)
+	// service backend via the reverse proxy. The context is derived from
+	// the client request, so the backend request is canceled as soon as
+	// the client disconnects.
+	ctx = context.WithValue(ctx, authenticatedCtxKey{}, authenticated)
+	if timeout := target.requestTimeout(r.Method); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// If a shadow backend is configured, a copy of the request is sent
+	// there as well without affecting the response to the client.
+	if target.ShadowAddress != "" {
+		body, ok := target.shadowBody(r)
+		if ok {
+			p.mirrorRequest(target, r.WithContext(ctx), body)
+		}
+	}
+
+	body := target.countRequestBody(r)
+	forwarded = true
+	p.backend().ServeHTTP(w, r.WithContext(ctx))
+
+	// Now that the request completed, we know how much data was actually
+	// transferred and can report it for usage based billing.
+	target.reportUsage(r, authenticated, body, recorder)
+}
+
+// handleFreebieDBError handles a failure of the freebie DB of the target
+// service according to its fail policy. True is returned if the request should
+// be served anyway, otherwise a response was already sent to the client.
+func (p *Proxy) handleFreebieDBError(w http.ResponseWriter, r *http.Request,
+	target *Service) bool {
+
+	switch target.FreebieFailPolicy {
+	case freebieFailOpen:
+		return true
+
+	case freebieFailPayment:
+		p.handlePaymentRequired(w, r, target)
+		return false
+
+	default:
+		p.sendDirectResponse(
+			w, r, http.StatusInternalServerError,
+			"freebie DB failure",
+		)
+		return false
+	}
+}
+
+// tallyFreebie counts one free request of the client in the given freebie
+// store and returns the number of free requests the client has left. Stores
+// that keep their state on the client side are given access to the response so
+// they can update it.
+func tallyFreebie(w http.ResponseWriter, r *http.Request, db freebie.DB,
+	remoteIP net.IP) (freebie.Count, error) {
+
+	if cookieDb, ok := db.(freebie.CookieDB); ok {
+		return cookieDb.TallyFreebieCookie(w, r, remoteIP)
+	}
+	return db.TallyFreebie(r, remoteIP)
 }
 
 // UpdateServices re-configures the proxy to use a new set of backend services.
+// The new services are fully prepared, together with the transport to their
+// backends, before they replace the running ones at once. If anything about
+// them is invalid, an error is returned and the proxy keeps running with its
+// current configuration. The services must be new instances, the running ones
+// are never modified.
 func (p *Proxy) UpdateServices(services []*Service) error {
-	err := prepareServices(services)
+	err := p.checkBackendAllowList(services)
+	if err != nil {
+		return err
+	}
+
+	err = p.checkAuthenticators(services)
+	if err != nil {
+		return err
+	}
+
+	err = prepareServices(
+		services, p.strictPathRegexp, p.freebieDiskDB,
+	)
 	if err != nil {
 		return err
 	}
@@ -160,7 +891,13 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 	if err != nil {
 		return err
 	}
+	dialer := &net.Dialer{
+		Timeout:   p.dialTimeout,
+		KeepAlive: backendKeepAlive,
+	}
 	transport := &http.Transport{
+		Proxy:             backendProxy,
+		DialContext:       dialer.DialContext,
 		ForceAttemptHTTP2: true,
 		TLSClientConfig: &tls.Config{
 			RootCAs:            certPool,
@@ -168,52 +905,307 @@ func (p *Proxy) UpdateServices(services []*Service) error {
 		},
 	}
 
-	p.proxyBackend = &httputil.ReverseProxy{
-		Director:  p.director,
-		Transport: transport,
+	proxyBackend := &httputil.ReverseProxy{
+		Director: p.director,
+		Transport: &redirectTransport{
+			base: &orderedHeaderTransport{
+				base:      transport,
+				dialer:    dialer,
+				tlsConfig: transport.TLSClientConfig,
+			},
+		},
 		ModifyResponse: func(res *http.Response) error {
-			addCorsHeaders(res.Header)
+			target, ok := serviceFromRequest(res.Request)
+			if p.corsEnabled(target) {
+				addCorsHeaders(res.Header)
+			}
+			if ok {
+				// Nothing about a response is used before
+				// it's known to come from the backend.
+				err := target.verifyResponse(res)
+				if err != nil {
+					return err
+				}
+
+				translateGrpcStatus(res, target)
+				target.addServedByHeader(res.Header)
+				target.addDefaultResponseHeaders(res.Header)
+				p.wrapStreamAuth(res, target)
+
+				err = target.rewriteResponse(res)
+				if err != nil {
+					return err
+				}
+
+				// The ETag must cover the body the client
+				// actually receives.
+				return target.addComputedETag(res)
+			}
 			return nil
 		},
 
+		ErrorHandler: p.handleBackendError,
+
 		// A negative value means to flush immediately after each write
 		// to the client.
 		FlushInterval: -1,
 	}
 
+	// Services that are still configured keep what they learned while
+	// running.
+	inheritServiceState(p.currentServices(), services)
+
+	p.servicesMtx.Lock()
+	p.services = services
+	p.transport = transport
+	p.proxyBackend = proxyBackend
+	p.servicesMtx.Unlock()
+
 	return nil
 }
 
+// currentServices returns the services the proxy is currently configured with.
+func (p *Proxy) currentServices() []*Service {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.services
+}
+
+// backend returns the reverse proxy that forwards requests to the backends of
+// the current services.
+func (p *Proxy) backend() *httputil.ReverseProxy {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.proxyBackend
+}
+
+// backendTransport returns the transport to the backends of the current
+// services.
+func (p *Proxy) backendTransport() http.RoundTripper {
+	p.servicesMtx.RLock()
+	defer p.servicesMtx.RUnlock()
+
+	return p.transport
+}
+
+// handleBackendError is called by the reverse proxy if the request to the
+// backend failed. The backend request is bound to the context of the client
+// request, so if the client disconnects, the backend request is canceled too.
+// In that case there is no one left to send an error response to.
+func (p *Proxy) handleBackendError(w http.ResponseWriter, r *http.Request,
+	err error) {
+
+	if r.Context().Err() == context.Canceled {
+		log.Debugf("Client disconnected, aborted backend request %s: %v",
+			r.URL.Path, err)
+
+		// There's no standard status code for this case, so we record
+		// the non-standard 499 that is commonly used for it so the
+		// request log shows what happened.
+		if recorder, ok := w.(*statusRecorder); ok {
+			recorder.status = statusClientClosedRequest
+		}
+		return
+	}
+
+	if r.Context().Err() == context.DeadlineExceeded {
+		log.Infof("Backend request %s timed out: %v", r.URL.Path, err)
+
+		if isGrpcRequest(r) {
+			sendGrpcStatus(
+				w, codes.DeadlineExceeded, "backend timed out",
+			)
+			return
+		}
+		p.writeError(
+			w, r, http.StatusGatewayTimeout, "backend timed out",
+		)
+		return
+	}
+
+	log.Errorf("Error proxying request %s to backend: %v", r.URL.Path,
+		err)
+
+	// gRPC clients map the status to a retryable error code themselves,
+	// so we don't overwrite it with a gRPC status.
+	if isGrpcRequest(r) {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	p.writeError(w, r, http.StatusBadGateway, "backend unavailable")
+}
+
+// notFound responds to requests that don't match any service if serving static
+// files is disabled.
+func (p *Proxy) notFound(w http.ResponseWriter, r *http.Request) {
+	p.writeError(w, r, http.StatusNotFound, "404 page not found")
+}
+
+// checkBackendAllowList makes sure the address of every service, and the
+// address requests are mirrored to, points to a host that is on the backend
+// allow list, if one is configured. This prevents the proxy from being pointed
+// at internal endpoints through a manipulated configuration.
+func (p *Proxy) checkBackendAllowList(services []*Service) error {
+	if len(p.backendAllowList) == 0 {
+		return nil
+	}
+
+	for _, service := range services {
+		// Mirrored requests carry the same credentials and body as
+		// the ones sent to the backend.
+		if service.ShadowAddress != "" &&
+			!p.backendAllowed(service.ShadowAddress) {
+
+			return fmt.Errorf("shadow address %s of service %s is "+
+				"not on the backend allow list",
+				service.ShadowAddress, service.Name)
+		}
+
+		if service.Address == "" && service.DiscoverySRV != "" {
+			continue
+		}
+
+		if !p.backendAllowed(service.Address) {
+			return fmt.Errorf("address %s of service %s is not on "+
+				"the backend allow list", service.Address,
+				service.Name)
+		}
+	}
+
+	return nil
+}
+
+// backendAllowed returns true if the host of the given backend address matches
+// the backend allow list or if there is no allow list.
+func (p *Proxy) backendAllowed(address string) bool {
+	if len(p.backendAllowList) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	for _, hostRegexp := range p.backendAllowList {
+		if hostRegexp.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
 // director is a method that rewrites an incoming request to be forwarded to a
 // backend service.
 func (p *Proxy) director(req *http.Request) {
-	target, ok := matchService(req, p.services)
+	// The service was already matched before the request was handed to
+	// the reverse proxy.
+	target, ok := serviceFromRequest(req)
+	if !ok {
+		target, ok = p.matchNormalized(req)
+	}
 	if ok {
-		// Rewrite address and protocol in the request so the
-		// real service is called instead.
-		req.Host = target.Address
-		req.URL.Host = target.Address
-		req.URL.Scheme = target.Protocol
-
-		// Make sure we always forward the authorization in the correct/
-		// default format so the backend knows what to do with it.
-		mac, preimage, err := lsat.FromHeader(&req.Header)
-		if err == nil {
-			// It could be that there is no auth information because
-			// none is needed for this particular request. So we
-			// only continue if no error is set.
-			err := lsat.SetHeader(&req.Header, mac, preimage)
-			if err != nil {
-				log.Errorf("could not set header: %v", err)
-			}
+		address, forced := target.forcedBackendAddress(req)
+		if !forced {
+			address = target.backendAddress()
 		}
+		p.prepareBackendRequest(target, req, address, target.Protocol)
+	}
+}
+
+// prepareBackendRequest rewrites the request of a client to be sent to the
+// given address of the service's backend with the given protocol. Everything
+// the client sent that the backend must not receive is removed and the fields
+// the backend expects are added.
+func (p *Proxy) prepareBackendRequest(target *Service, req *http.Request,
+	address, protocol string) {
+
+	// The backend may need to know where the client sent the request to
+	// before we address it to the backend.
+	forwarded := target.forwardedHeaders(req)
+
+	// Rewrite address and protocol in the request so the real service is
+	// called instead.
+	req.Host = address
+	req.URL.Host = address
+	req.URL.Scheme = protocol
+
+	// Only forward the query parameters the backend expects.
+	// This happens before the rewrite so the parameters the
+	// rewrite adds are kept.
+	target.filterQueryParams(req)
+
+	// Adapt the public path of the request to the one the
+	// backend expects.
+	target.rewriteRequest(req)
+
+	// Make sure we always forward the authorization in the correct/
+	// default format so the backend knows what to do with it. We
+	// need to extract it before filtering the metadata as it might
+	// be sent as such.
+	mac, preimage, err := lsat.FromHeader(&req.Header)
+
+	// Strip all gRPC metadata the backend doesn't want to receive
+	// from the client.
+	target.filterGrpcMetadata(req)
+
+	// The forwarded headers are added by the proxy, so they must not be
+	// stripped as metadata of the client.
+	for name, values := range forwarded {
+		req.Header[name] = values
+	}
+
+	// Let the backend know where the client is from, if requested. Like
+	// the forwarded headers, this isn't metadata of the client.
+	p.setCountryHeader(req, target, parseRemoteIP(req.RemoteAddr))
+
+	switch {
+	// Some backends don't want the token at all or only the
+	// information who the verified client is.
+	case target.BackendAuth != "" &&
+		target.BackendAuth != backendAuthForward:
+
+		target.replaceBackendAuth(req)
 
-		// Now overwrite header fields of the client request
-		// with the fields from the configuration file.
-		for name, value := range target.Headers {
-			req.Header.Add(name, value)
+	// It could be that there is no auth information because none is
+	// needed for this particular request. So we only continue if no
+	// error is set.
+	case err == nil:
+		err := lsat.SetHeader(&req.Header, mac, preimage)
+		if err != nil {
+			log.Errorf("could not set header: %v", err)
 		}
 	}
+
+	// Responses that are rewritten must not be compressed by the
+	// backend.
+	target.prepareResponseRewrite(req)
+
+	// Pass on the parts of the path the service's path
+	// expression captured.
+	target.setPathCaptureHeaders(req)
+
+	// Now overwrite header fields of the client request
+	// with the fields from the configuration file.
+	for name, value := range target.Headers {
+		req.Header.Add(name, value)
+	}
+
+	// The backend can bill the account of the request.
+	p.setAccountHeader(req)
+
+	// None of the header fields must allow injecting further
+	// fields into the request to the backend.
+	target.dropInvalidHeaderFields(req)
+
+	// The body is compressed after all other changes to the
+	// request, but before it is signed.
+	target.compressRequest(req)
+
+	// The signature must be added last so it covers the request
+	// exactly as the backend receives it.
+	target.signRequest(req, time.Now())
 }
 
 // certPool builds a pool of x509 certificates from the backend services.
@@ -238,10 +1230,38 @@ func certPool(services []*Service) (*x509.CertPool, error) {
 	return cp, nil
 }
 
+// matchService matches a backend service to an HTTP request according to the
+// configured match mode.
+func (p *Proxy) matchService(req *http.Request) (*Service, bool) {
+	services := p.currentServices()
+	if p.matchMode == MatchSpecific {
+		return matchSpecificService(req, services)
+	}
+	return matchService(req, services)
+}
+
 // matchService tries to match a backend service to an HTTP request by regular
 // expression matching the host and path.
 func matchService(req *http.Request, services []*Service) (*Service, bool) {
 	for _, service := range services {
+		// Passthrough services are only reached by their TLS server
+		// name, never through the HTTP proxy.
+		if service.TLSPassthrough {
+			continue
+		}
+
+		// The fallback service only handles requests that don't
+		// match any other service.
+		if service.Fallback {
+			continue
+		}
+
+		if !service.available() {
+			log.Tracef("Skipping service [%s] without healthy "+
+				"backends.", service.Name)
+			continue
+		}
+
 		hostRegexp := regexp.MustCompile(service.HostRegexp)
 		if !hostRegexp.MatchString(req.Host) {
 			log.Tracef("Req host [%s] doesn't match [%s].",
@@ -283,57 +1303,116 @@ func addCorsHeaders(header http.Header) {
 
 	header.Add("Access-Control-Allow-Origin", "*")
 	header.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	header.Add("Access-Control-Expose-Headers", "WWW-Authenticate")
+	header.Add(
+		"Access-Control-Expose-Headers",
+		"WWW-Authenticate, Accept-Ranges, Content-Range, "+
+			"X-Price-Sat, X-Price-Fiat, X-Invoice-Expiry, "+
+			"Idempotent-Replayed",
+	)
 	header.Add(
 		"Access-Control-Allow-Headers",
-		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate",
+		"Authorization, Grpc-Metadata-macaroon, WWW-Authenticate, "+
+			"Range, If-Range, Idempotency-Key",
 	)
 }
 
 // handlePaymentRequired returns fresh challenge header fields and status code
 // to the client signaling that a payment is required to fulfil the request.
 func (p *Proxy) handlePaymentRequired(w http.ResponseWriter, r *http.Request,
-	serviceName string, servicePrice int64) {
+	target *Service) {
 
-	addCorsHeaders(r.Header)
+	if p.corsEnabled(target) {
+		addCorsHeaders(w.Header())
+	}
 
-	header, err := p.authenticator.FreshChallengeHeader(r, serviceName, servicePrice)
-	if err != nil {
-		log.Errorf("Error creating new challenge header: %v", err)
-		sendDirectResponse(
-			w, r, http.StatusInternalServerError,
-			"challenge failure",
+	// Slow down clients that probe the paywall. If too many of them do so
+	// at once, they have to come back later.
+	if !target.delayChallenge(r.Context()) {
+		w.Header().Set("Retry-After", strconv.Itoa(
+			target.Challenge.retryAfter(),
+		))
+		p.sendDirectResponse(
+			w, r, http.StatusServiceUnavailable,
+			"too many pending challenges",
 		)
 		return
 	}
 
+	// Clients with a valid discount token get a cheaper challenge.
+	listPrice := target.currentPrice(r.Method, time.Now())
+	servicePrice := p.challengePrice(r, target.Name, listPrice)
+
+	// A client that retries before its payment turned into a valid token
+	// gets the same challenge again so it doesn't pay twice.
+	var (
+		header http.Header
+		key    string
+	)
+	if target.challenges != nil && !requestDebugFlags(r).noCache {
+		var err error
+		key, err = target.challengeKey(w, r)
+		if err != nil {
+			log.Errorf("Unable to create challenge cookie: %v", err)
+		}
+		if key != "" {
+			header = target.challenges.get(
+				key, listPrice, servicePrice,
+			)
+		}
+	}
+	if header == nil {
+		fresh, err := p.freshChallengeHeader(
+			r, target, listPrice, servicePrice,
+		)
+		if err != nil {
+			log.Errorf("Error creating new challenge header: %v",
+				err)
+			p.sendDirectResponse(
+				w, r, http.StatusInternalServerError,
+				"challenge failure",
+			)
+			return
+		}
+		header = challengeHeader(fresh)
+
+		if key != "" {
+			target.challenges.add(
+				key, listPrice, servicePrice, header,
+			)
+		}
+		p.notifyEvent(
+			EventChallengeIssued, r, target, servicePrice, false,
+		)
+	}
+
 	for name, value := range header {
 		w.Header().Set(name, value[0])
 		for i := 1; i < len(value); i++ {
 			w.Header().Add(name, value[i])
 		}
 	}
+	p.addPriceHeaders(w.Header(), r, target, servicePrice)
 
-	sendDirectResponse(w, r, http.StatusPaymentRequired, "payment required")
+	p.sendDirectResponse(
+		w, r, http.StatusPaymentRequired, "payment required",
+	)
 }
 
 // sendDirectResponse sends a response directly to the client without proxying
 // anything to a backend. The given error is transported in a way the client can
 // understand. This means, for a gRPC client it is sent as specific header
 // fields.
-func sendDirectResponse(w http.ResponseWriter, r *http.Request,
-	statusCode int, errInfo string) {
+func (p *Proxy) sendDirectResponse(w http.ResponseWriter,
+	r *http.Request, statusCode int, errInfo string) {
 
-	// Find out if the client is a normal HTTP or a gRPC client. Every gRPC
-	// request should have the Content-Type header field set accordingly
-	// so we can use that.
+	// Find out if the client is a normal HTTP or a gRPC client.
 	switch {
-	case strings.HasPrefix(r.Header.Get(hdrContentType), hdrTypeGrpc):
-		w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Internal)))
-		w.Header().Set("Grpc-Message", errInfo)
+	case isGrpcRequest(r):
+		w.Header().Set(hdrGrpcStatus, strconv.Itoa(int(codes.Internal)))
+		w.Header().Set(hdrGrpcMessage, errInfo)
 		w.WriteHeader(statusCode)
 
 	default:
-		http.Error(w, errInfo, statusCode)
+		p.writeError(w, r, statusCode, errInfo)
 	}
 }
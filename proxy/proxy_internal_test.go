@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/freebie"
+)
+
+// TestClientDisconnectCancelsBackend makes sure a backend request is canceled
+// once the client disconnects.
+func TestClientDisconnectCancelsBackend(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			select {
+			case <-r.Context().Done():
+				close(canceled)
+			case <-time.After(5 * time.Second):
+			}
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "test",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       auth.LevelOff,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", server.URL+"/slow", nil)
+	req = req.WithContext(ctx)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		errChan <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("backend request not started")
+	}
+	cancel()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("backend request not canceled")
+	}
+	<-errChan
+}
+
+// TestRangeRequest makes sure HTTP Range requests and the partial content
+// responses of the backend are passed through the proxy.
+func TestRangeRequest(t *testing.T) {
+	t.Parallel()
+
+	content := strings.NewReader("0123456789")
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "file", time.Time{}, content)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "test",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "freebie 1",
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/file", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Content-Range") != "bytes 2-4/10" {
+		t.Fatalf("unexpected content range: %s",
+			resp.Header.Get("Content-Range"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "234" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+
+	// The range request used up the freebie, so the next one requires
+	// payment.
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to make request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402, got %d", resp.StatusCode)
+	}
+}
+
+// TestRequireClientCert makes sure services that require a TLS client
+// certificate reject requests without a verified one.
+func TestRequireClientCert(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:              "test",
+		Address:           strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:        ".*",
+		Protocol:          "http",
+		Auth:              auth.LevelOff,
+		RequireClientCert: true,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	// A request without TLS or without a verified chain is rejected.
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", rec.Code)
+	}
+
+	// With a verified client certificate, the request is proxied.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{}}},
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+}
+
+// failingFreebieDB is a freebie DB that always fails.
+type failingFreebieDB struct{}
+
+func (failingFreebieDB) CanPass(*http.Request, net.IP) (bool, error) {
+	return false, errors.New("freebie DB down")
+}
+
+func (failingFreebieDB) TallyFreebie(*http.Request, net.IP) (freebie.Count,
+	error) {
+
+	return 0, errors.New("freebie DB down")
+}
+
+// TestFreebieFailPolicy makes sure a failing freebie DB is handled according
+// to the fail policy of the service.
+func TestFreebieFailPolicy(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		policy         string
+		expectedStatus int
+	}{{
+		policy:         "",
+		expectedStatus: http.StatusInternalServerError,
+	}, {
+		policy:         freebieFailOpen,
+		expectedStatus: http.StatusOK,
+	}, {
+		policy:         freebieFailPayment,
+		expectedStatus: http.StatusPaymentRequired,
+	}}
+
+	for _, test := range tests {
+		services := []*Service{{
+			Name:              "test",
+			Address:           address,
+			HostRegexp:        ".*",
+			Protocol:          "http",
+			Auth:              "freebie 1",
+			FreebieFailPolicy: test.policy,
+		}}
+		p, err := New(auth.NewMockAuthenticator(), services, false, "")
+		if err != nil {
+			t.Fatalf("unable to create proxy: %v", err)
+		}
+		services[0].freebieDb = failingFreebieDB{}
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != test.expectedStatus {
+			t.Fatalf("policy %q: expected status %d, got %d",
+				test.policy, test.expectedStatus, rec.Code)
+		}
+	}
+}
+
+// TestDefaultResponseHeaders makes sure default response headers are only
+// added if the backend didn't set them.
+func TestDefaultResponseHeaders(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		DefaultResponseHeaders: map[string]string{
+			"cache-control":          "no-store",
+			"X-Content-Type-Options": "nosniff",
+		},
+	}
+	header := http.Header{}
+	header.Set("Cache-Control", "max-age=60")
+	service.addDefaultResponseHeaders(header)
+
+	if value := header.Get("Cache-Control"); value != "max-age=60" {
+		t.Fatalf("backend header was overwritten with %s", value)
+	}
+	if value := header.Get("X-Content-Type-Options"); value != "nosniff" {
+		t.Fatalf("default header not added, got %s", value)
+	}
+}
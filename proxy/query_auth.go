@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// lsatAuthPrefix is the prefix of an LSAT in the Authorization header.
+	lsatAuthPrefix = "LSAT "
+)
+
+// extractQueryToken moves an LSAT that was sent in the configured query
+// parameter of the request into the Authorization header, so it can be
+// validated like any other token. The parameter is always removed from the
+// request so the token is neither forwarded to the backend nor written to the
+// request log. The value is expected in the same format as in the header,
+// <macBase64>:<preimageHex>, optionally prefixed with "LSAT ".
+func (s *Service) extractQueryToken(r *http.Request) {
+	if s.AuthQueryParam == "" {
+		return
+	}
+
+	query := r.URL.Query()
+	if _, ok := query[s.AuthQueryParam]; !ok {
+		return
+	}
+	token := query.Get(s.AuthQueryParam)
+	query.Del(s.AuthQueryParam)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+
+	// A token in the header always takes precedence.
+	if token == "" || r.Header.Get(lsat.HeaderAuthorization) != "" {
+		return
+	}
+	if !strings.HasPrefix(token, lsatAuthPrefix) {
+		token = lsatAuthPrefix + token
+	}
+	r.Header.Set(lsat.HeaderAuthorization, token)
+}
+
+// loggedRequestURI returns the URI of the request as it's written to the
+// request log. The token of a request that was matched to a service has
+// already been removed, but requests that are answered before, for example
+// because of an invalid header, may still carry it, so the query parameters
+// that any service accepts tokens in are removed from their URI.
+func (p *Proxy) loggedRequestURI(r *http.Request, target *Service) string {
+	if target != nil {
+		return r.RequestURI
+	}
+
+	query := r.URL.Query()
+	scrubbed := false
+	for _, service := range p.currentServices() {
+		if service.AuthQueryParam == "" {
+			continue
+		}
+		if _, ok := query[service.AuthQueryParam]; ok {
+			query.Del(service.AuthQueryParam)
+			scrubbed = true
+		}
+	}
+	if !scrubbed {
+		return r.RequestURI
+	}
+
+	uri := *r.URL
+	uri.RawQuery = query.Encode()
+	return uri.RequestURI()
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// TestExtractQueryToken makes sure a token in the query is moved to the header
+// and removed from the URL.
+func TestExtractQueryToken(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{AuthQueryParam: "lsat"}
+
+	req := httptest.NewRequest("GET", "/file?lsat=mac%3Apre&foo=bar", nil)
+	service.extractQueryToken(req)
+	if req.Header.Get(lsat.HeaderAuthorization) != "LSAT mac:pre" {
+		t.Fatalf("unexpected auth header: %s",
+			req.Header.Get(lsat.HeaderAuthorization))
+	}
+	if req.URL.RawQuery != "foo=bar" || req.RequestURI != "/file?foo=bar" {
+		t.Fatalf("token not stripped from URL: %s", req.RequestURI)
+	}
+
+	// A header token takes precedence but the query is still stripped.
+	req = httptest.NewRequest("GET", "/file?lsat=mac%3Apre", nil)
+	req.Header.Set(lsat.HeaderAuthorization, "LSAT other")
+	service.extractQueryToken(req)
+	if req.Header.Get(lsat.HeaderAuthorization) != "LSAT other" {
+		t.Fatalf("header token was overwritten")
+	}
+	if req.URL.RawQuery != "" {
+		t.Fatalf("token not stripped from URL: %s", req.URL.RawQuery)
+	}
+}
+
+// TestQueryTokenNotLogged makes sure a token in the query is removed before the
+// request is logged, even if the request is rejected before it's
+// authenticated.
+func TestQueryTokenNotLogged(t *testing.T) {
+	t.Parallel()
+
+	var log bytes.Buffer
+	p, err := New(
+		auth.NewMockAuthenticator(), []*Service{{
+			Name:           "service",
+			Address:        "127.0.0.1:1",
+			HostRegexp:     ".*",
+			Protocol:       "http",
+			Auth:           "on",
+			AuthQueryParam: "lsat",
+			Disabled:       true,
+		}}, false, "", WithAccessLog(&log),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/file?lsat=secret", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rec.Code)
+	}
+	if strings.Contains(log.String(), "secret") {
+		t.Fatalf("token was logged: %s", log.String())
+	}
+	if !strings.Contains(log.String(), "GET /file ") {
+		t.Fatalf("request was not logged: %s", log.String())
+	}
+
+	// Requests with an invalid header are rejected before they're matched
+	// to a service, but their token isn't logged either.
+	log.Reset()
+	req := httptest.NewRequest("GET", "/file?lsat=secret&foo=bar", nil)
+	req.Header["Content-Length"] = []string{"1", "2"}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rec.Code)
+	}
+	if strings.Contains(log.String(), "secret") {
+		t.Fatalf("token was logged: %s", log.String())
+	}
+	if !strings.Contains(log.String(), "GET /file?foo=bar ") {
+		t.Fatalf("request was not logged: %s", log.String())
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// filterQueryParams removes all query parameters from the request to the
+// backend that aren't in the allowed list of the service. The remaining
+// parameters are sorted by name, so equivalent requests reach the backend with
+// the same query. Services without an allowed list forward the query
+// unchanged.
+func (s *Service) filterQueryParams(req *http.Request) {
+	if len(s.AllowedQueryParams) == 0 || req.URL.RawQuery == "" {
+		return
+	}
+
+	query := req.URL.Query()
+	for name := range query {
+		if !s.queryParamAllowed(name) {
+			log.Debugf("Stripping query parameter [%s] from "+
+				"request to service %s.", name, s.Name)
+			query.Del(name)
+		}
+	}
+	req.URL.RawQuery = query.Encode()
+}
+
+// queryParamAllowed returns true if the query parameter with the given name is
+// in the allowed list of the service. Names are case sensitive.
+func (s *Service) queryParamAllowed(name string) bool {
+	for _, allowed := range s.AllowedQueryParams {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestFilterQueryParams makes sure only the allowed query parameters are
+// forwarded to the backend.
+func TestFilterQueryParams(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		allowed []string
+		query   string
+		result  string
+	}{{
+		name:   "no allow list",
+		query:  "b=2&a=1&debug=true",
+		result: "b=2&a=1&debug=true",
+	}, {
+		name:    "strip unknown",
+		allowed: []string{"a", "b"},
+		query:   "b=2&debug=true&a=1&a=3",
+		result:  "a=1&a=3&b=2",
+	}, {
+		name:    "case sensitive",
+		allowed: []string{"a"},
+		query:   "A=1",
+		result:  "",
+	}, {
+		name:    "empty query",
+		allowed: []string{"a"},
+		query:   "",
+		result:  "",
+	}}
+	for _, tc := range tests {
+		service := &Service{
+			Name:               "test",
+			AllowedQueryParams: tc.allowed,
+		}
+		req := httptest.NewRequest("GET", "/path?"+tc.query, nil)
+		service.filterQueryParams(req)
+
+		if req.URL.RawQuery != tc.result {
+			t.Fatalf("%s: expected query %q, got %q", tc.name,
+				tc.result, req.URL.RawQuery)
+		}
+	}
+}
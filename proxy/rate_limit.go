@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// errRateLimited is returned if a request can't be sent to the backend
+	// within the maximum wait time because its request budget is
+	// exhausted.
+	errRateLimited = errors.New("backend rate limit exceeded")
+)
+
+// tokenBucket is a simple token bucket that limits the rate of requests sent
+// to a backend. Tokens are added at a constant rate up to the burst size and
+// each request takes one token.
+type tokenBucket struct {
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+
+	// burstSetting is the burst the bucket was configured with, zero if
+	// the burst is derived from the rate.
+	burstSetting int
+
+	// now returns the current time. It can be overwritten in tests.
+	now func() time.Time
+
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+// newTokenBucket creates a new full token bucket that allows rate requests per
+// second with bursts of up to burst requests. Requests wait for at most
+// maxWait for a token to become available, a maxWait of zero rejects them
+// immediately. A rate of zero doesn't limit requests at all.
+func newTokenBucket(rate float64, burst int,
+	maxWait time.Duration) *tokenBucket {
+
+	return &tokenBucket{
+		rate:         rate,
+		burst:        bucketBurst(rate, burst),
+		maxWait:      maxWait,
+		burstSetting: burst,
+		now:          time.Now,
+		tokens:       bucketBurst(rate, burst),
+		last:         time.Now(),
+	}
+}
+
+// bucketBurst returns the burst size of a bucket with the given rate. If no
+// burst is given, it allows the requests of one second.
+func bucketBurst(rate float64, burst int) float64 {
+	if burst < 1 {
+		return math.Max(1, math.Ceil(rate))
+	}
+	return float64(burst)
+}
+
+// update changes the limits of the bucket. The tokens that accumulated under
+// the old rate are kept, up to the new burst size, so clients neither get a
+// fresh burst nor lose their budget. Requests that are already queued keep
+// their reserved tokens.
+func (b *tokenBucket) update(rate float64, burst int,
+	maxWait time.Duration) {
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := b.now()
+	newBurst := bucketBurst(rate, burst)
+	if b.rate > 0 {
+		elapsed := now.Sub(b.last).Seconds()
+		b.tokens = math.Min(newBurst, b.tokens+elapsed*b.rate)
+	} else {
+		// The bucket wasn't limiting before, so it starts full.
+		b.tokens = newBurst
+	}
+
+	b.last = now
+	b.rate = rate
+	b.burst = newBurst
+	b.maxWait = maxWait
+	b.burstSetting = burst
+}
+
+// settings returns the rate, burst and maximum wait time the bucket is
+// currently configured with. They differ from the settings the service was
+// loaded with once its rate limits were updated at runtime.
+func (b *tokenBucket) settings() (float64, int, time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.rate, b.burstSetting, b.maxWait
+}
+
+// reserve takes a token from the bucket and returns how long the caller needs
+// to wait before it can use it. If the token wouldn't become available within
+// the maximum wait time, no token is taken and false is returned together with
+// the time it would take instead.
+func (b *tokenBucket) reserve() (time.Duration, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.rate <= 0 {
+		return 0, true
+	}
+
+	now := b.now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0, true
+	}
+
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	if wait > b.maxWait {
+		b.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+// cancel returns a token that was reserved but not used to the bucket.
+func (b *tokenBucket) cancel() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// UpdateRateLimits applies the rate limit settings of the given services to
+// the running services with the same name. The changes take effect
+// immediately without losing the state of the limiters. Services that aren't
+// running are skipped, they can only be added by restarting. The settings of
+// the running services stay as they were loaded, the limiters hold the current
+// ones.
+func (p *Proxy) UpdateRateLimits(services []*Service) error {
+	for _, service := range services {
+		if service.RateLimit < 0 || service.RateLimitBurst < 0 ||
+			service.RateLimitMaxWait < 0 {
+
+			return fmt.Errorf("rate limit settings of service %s "+
+				"cannot be negative", service.Name)
+		}
+	}
+
+	for _, service := range services {
+		var running *Service
+		for _, s := range p.currentServices() {
+			if s.Name == service.Name {
+				running = s
+				break
+			}
+		}
+		if running == nil || running.rateLimiter == nil {
+			log.Warnf("Unable to update rate limit of unknown "+
+				"service %s", service.Name)
+			continue
+		}
+
+		running.rateLimiter.update(
+			service.RateLimit, service.RateLimitBurst,
+			service.RateLimitMaxWait,
+		)
+		log.Infof("Updated rate limit of service %s: rate=%v, "+
+			"burst=%d, maxwait=%v", service.Name, service.RateLimit,
+			service.RateLimitBurst, service.RateLimitMaxWait)
+	}
+	return nil
+}
+
+// wait blocks until a token is available or the context is canceled. If the
+// token wouldn't become available within the maximum wait time,
+// errRateLimited is returned immediately together with the time it would take
+// instead.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	delay, ok := b.reserve()
+	if !ok {
+		return delay, errRateLimited
+	}
+	if delay == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return 0, nil
+
+	case <-ctx.Done():
+		b.cancel()
+		return 0, ctx.Err()
+	}
+}
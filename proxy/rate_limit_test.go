@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestTokenBucket makes sure the token bucket allows bursts, refills at the
+// configured rate and only queues requests up to the maximum wait time.
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	b := newTokenBucket(2, 2, time.Second)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// The burst can be used right away.
+	for i := 0; i < 2; i++ {
+		assertReserve(t, b, 0, true)
+	}
+
+	// With a rate of two requests per second, the next two requests need
+	// to wait half a second each.
+	assertReserve(t, b, 500*time.Millisecond, true)
+	assertReserve(t, b, time.Second, true)
+
+	// The next one would exceed the maximum wait time.
+	assertReserve(t, b, 1500*time.Millisecond, false)
+
+	// After the queued requests went through and the bucket refilled, the
+	// burst is available again.
+	now = now.Add(2 * time.Second)
+	assertReserve(t, b, 0, true)
+
+	// Without a maximum wait time, requests are rejected right away and a
+	// canceled wait returns its token.
+	b = newTokenBucket(1, 1, 0)
+	b.now = func() time.Time { return now }
+	b.last = now
+	assertReserve(t, b, 0, true)
+	if _, err := b.wait(context.Background()); err != errRateLimited {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	b.maxWait = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.wait(ctx); err != context.Canceled {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	assertReserve(t, b, time.Second, true)
+}
+
+func assertReserve(t *testing.T, b *tokenBucket, expectedWait time.Duration,
+	expectedOk bool) {
+
+	t.Helper()
+
+	wait, ok := b.reserve()
+	if ok != expectedOk {
+		t.Fatalf("expected reserve to return %v, got %v", expectedOk,
+			ok)
+	}
+	if wait != expectedWait {
+		t.Fatalf("expected wait of %v, got %v", expectedWait, wait)
+	}
+}
+
+// TestTokenBucketUpdate makes sure the limits of a bucket can be changed
+// without resetting the tokens it accumulated.
+func TestTokenBucketUpdate(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	b := newTokenBucket(0, 0, 0)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// Without a rate, requests are never limited.
+	for i := 0; i < 10; i++ {
+		assertReserve(t, b, 0, true)
+	}
+
+	// Setting a limit starts with a full burst.
+	b.update(1, 2, 0)
+	assertReserve(t, b, 0, true)
+	assertReserve(t, b, 0, true)
+	assertReserve(t, b, time.Second, false)
+
+	// Tightening the limit keeps the empty bucket empty and the refill
+	// uses the new rate.
+	b.update(0.5, 1, 0)
+	now = now.Add(time.Second)
+	assertReserve(t, b, time.Second, false)
+	now = now.Add(time.Second)
+	assertReserve(t, b, 0, true)
+}
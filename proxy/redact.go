@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// redactedValue is the placeholder that is logged instead of the value
+	// of a redacted header.
+	redactedValue = "[redacted]"
+)
+
+var (
+	// alwaysRedactedHeaders are the headers that carry credentials and are
+	// never logged, independent of the configuration of a service.
+	alwaysRedactedHeaders = []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		"Macaroon", "Grpc-Metadata-Macaroon",
+	}
+)
+
+// isRedactedHeader returns true if the value of the header with the given name
+// must not be logged for requests to the given service. The service may be nil
+// for requests that didn't match any service.
+func isRedactedHeader(s *Service, name string) bool {
+	for _, redacted := range alwaysRedactedHeaders {
+		if strings.EqualFold(redacted, name) {
+			return true
+		}
+	}
+	if s == nil {
+		return false
+	}
+	for _, redacted := range s.RedactHeaders {
+		if strings.EqualFold(redacted, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedHeader returns the value of the request header with the given name as
+// it may be written to a log, which is the placeholder if the header is
+// redacted.
+func loggedHeader(s *Service, r *http.Request, name string) string {
+	value := r.Header.Get(name)
+	if value != "" && isRedactedHeader(s, name) {
+		return redactedValue
+	}
+	return value
+}
+
+// loggedHeaders returns a copy of the given header in which the values of all
+// redacted headers are replaced by the placeholder.
+func loggedHeaders(s *Service, header http.Header) http.Header {
+	logged := make(http.Header, len(header))
+	for name, values := range header {
+		if isRedactedHeader(s, name) {
+			logged[name] = []string{redactedValue}
+			continue
+		}
+		logged[name] = values
+	}
+	return logged
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRedactHeaders makes sure credentials and the configured headers of a
+// service are never logged.
+func TestRedactHeaders(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{RedactHeaders: []string{"x-user-email"}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "LSAT foo:bar")
+	r.Header.Set("X-User-Email", "alice@example.com")
+	r.Header.Set("User-Agent", "test")
+
+	if value := loggedHeader(s, r, "X-User-Email"); value != redactedValue {
+		t.Fatalf("expected redacted header, got %s", value)
+	}
+	value := loggedHeader(nil, r, "X-User-Email")
+	if value == redactedValue {
+		t.Fatalf("expected header without service to be logged")
+	}
+	if value := loggedHeader(s, r, "User-Agent"); value != "test" {
+		t.Fatalf("expected user agent to be logged, got %s", value)
+	}
+	if value := loggedHeader(s, r, "Referer"); value != "" {
+		t.Fatalf("expected empty value for missing header, got %s",
+			value)
+	}
+
+	logged := loggedHeaders(nil, r.Header)
+	if logged.Get("Authorization") != redactedValue {
+		t.Fatalf("expected authorization to always be redacted, got %s",
+			logged.Get("Authorization"))
+	}
+	if r.Header.Get("Authorization") != "LSAT foo:bar" {
+		t.Fatalf("request header must not be modified")
+	}
+
+	logged = loggedHeaders(s, http.Header{
+		"X-User-Email": []string{"alice@example.com"},
+	})
+	if logged.Get("X-User-Email") != redactedValue {
+		t.Fatalf("expected configured header to be redacted")
+	}
+}
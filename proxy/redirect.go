@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultMaxRedirects is the default maximum number of redirects that
+	// are followed for a request to a service that follows redirects.
+	defaultMaxRedirects = 10
+)
+
+var (
+	// errTooManyRedirects is returned if the backend redirected a request
+	// more often than the service allows.
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// redirectTransport is a transport that follows the redirects of the backends
+// of services that are configured to do so, instead of relaying them to the
+// client. All other responses are returned unchanged.
+type redirectTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip sends the request to the backend and follows its redirects if the
+// service of the request wants them to be followed.
+//
+// NOTE: This is part of the http.RoundTripper interface.
+func (t *redirectTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	target, ok := serviceFromRequest(req)
+	if !ok || !target.FollowRedirects {
+		return res, nil
+	}
+
+	maxRedirects := target.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+	for redirects := 0; ; redirects++ {
+		next := redirectRequest(req, res)
+		if next == nil {
+			return res, nil
+		}
+
+		// The body of the redirect isn't needed, but reading it allows
+		// the connection to be reused.
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+		_ = res.Body.Close()
+
+		if redirects == maxRedirects {
+			return nil, fmt.Errorf("%w of %s after %d",
+				errTooManyRedirects, req.URL.Path, redirects)
+		}
+
+		log.Debugf("Following redirect of service %s to %s",
+			target.Name, next.URL)
+
+		// The signature of the original request covers its method and
+		// path, so the backend would reject it for the redirect.
+		target.signRequest(next, time.Now())
+
+		req = next
+		res, err = t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// redirectRequest returns the request that follows the redirect of the given
+// response, or nil if the response isn't a redirect that can be followed. Only
+// redirects to the same backend are followed, so a backend can't make the
+// proxy send requests to arbitrary hosts. 301, 302 and 303 redirects are
+// followed with a GET request without a body, HEAD requests stay HEAD
+// requests. 307 and 308 redirects keep the method and are only followed for
+// requests without a body, since the body was already sent to the backend.
+// The returned request still carries the signature of the given one.
+func redirectRequest(req *http.Request, res *http.Response) *http.Request {
+	method := req.Method
+	switch res.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusSeeOther:
+
+		if method != "HEAD" {
+			method = "GET"
+		}
+
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if req.ContentLength != 0 {
+			return nil
+		}
+
+	default:
+		return nil
+	}
+
+	location, err := res.Location()
+	if err != nil {
+		return nil
+	}
+	if location.Scheme != req.URL.Scheme || location.Host != req.URL.Host {
+		return nil
+	}
+
+	next := req.Clone(req.Context())
+	next.Method = method
+	next.URL = location
+	if method != req.Method {
+		next.Body = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Length")
+		next.Header.Del(hdrContentType)
+	}
+	return next
+}
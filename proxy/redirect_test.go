@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestFollowRedirects makes sure redirects are relayed to the client by
+// default and only followed to the same backend up to the limit otherwise.
+func TestFollowRedirects(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/a":
+				http.Redirect(w, r, "/b", http.StatusFound)
+
+			case "/loop":
+				http.Redirect(
+					w, r, "/loop", http.StatusFound,
+				)
+
+			case "/external":
+				http.Redirect(
+					w, r, "http://example.com/",
+					http.StatusFound,
+				)
+
+			default:
+				_, _ = w.Write([]byte(r.Method + r.URL.Path))
+			}
+		},
+	))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+
+	newProxy := func(follow bool) *Proxy {
+		services := []*Service{{
+			Name:            "service",
+			Address:         address,
+			HostRegexp:      ".*",
+			Protocol:        "http",
+			Auth:            "off",
+			FollowRedirects: follow,
+			MaxRedirects:    3,
+		}}
+		p, err := New(auth.NewMockAuthenticator(), services, false, "")
+		if err != nil {
+			t.Fatalf("unable to create proxy: %v", err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name   string
+		follow bool
+		method string
+		path   string
+		status int
+		body   string
+	}{{
+		name:   "relay by default",
+		method: "GET",
+		path:   "/a",
+		status: http.StatusFound,
+	}, {
+		name:   "follow",
+		follow: true,
+		method: "GET",
+		path:   "/a",
+		status: http.StatusOK,
+		body:   "GET/b",
+	}, {
+		name:   "post becomes get",
+		follow: true,
+		method: "POST",
+		path:   "/a",
+		status: http.StatusOK,
+		body:   "GET/b",
+	}, {
+		name:   "loop",
+		follow: true,
+		method: "GET",
+		path:   "/loop",
+		status: http.StatusBadGateway,
+	}, {
+		name:   "other host",
+		follow: true,
+		method: "GET",
+		path:   "/external",
+		status: http.StatusFound,
+	}}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		newProxy(tc.follow).ServeHTTP(
+			rec, httptest.NewRequest(tc.method, tc.path, nil),
+		)
+		if rec.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d", tc.name,
+				tc.status, rec.Code)
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Fatalf("%s: expected body %s, got %s", tc.name,
+				tc.body, rec.Body.String())
+		}
+	}
+}
+
+// TestFollowRedirectsSigned makes sure a followed redirect is signed for the
+// path it is sent to.
+func TestFollowRedirectsSigned(t *testing.T) {
+	t.Parallel()
+
+	secret := strings.Repeat("s", minSigningSecretSize)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/a" {
+				http.Redirect(w, r, "/b", http.StatusFound)
+				return
+			}
+
+			timestamp := r.Header.Get(
+				DefaultSignatureTimestampHeader,
+			)
+			bodyHash := sha256.Sum256(nil)
+			mac := hmac.New(sha256.New, []byte(secret))
+			_, _ = mac.Write([]byte("GET\n" + r.URL.Path + "\n" +
+				timestamp + "\n" +
+				hex.EncodeToString(bodyHash[:]) + "\n"))
+			expected := hex.EncodeToString(mac.Sum(nil))
+			if r.Header.Get(DefaultSignatureHeader) != expected {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:            "service",
+		Address:         strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:      ".*",
+		Protocol:        "http",
+		Auth:            "off",
+		FollowRedirects: true,
+		RequestSigning: &RequestSigningConfig{
+			Secret: secret,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/a", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+}
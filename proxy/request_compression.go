@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// defaultCompressionMinSize is the default minimum size in bytes of a
+	// request body to be compressed.
+	defaultCompressionMinSize = 1024
+)
+
+// RequestCompressionConfig is the configuration of the compression of request
+// bodies that are sent to the backend of a service. The backend must accept
+// gzip encoded request bodies.
+type RequestCompressionConfig struct {
+	// MinSize is the minimum size in bytes of a request body to be
+	// compressed. Bodies of unknown size are always compressed. Defaults
+	// to 1024 bytes.
+	MinSize int64 `long:"minsize" description:"Minimum size in bytes of request bodies to compress, 1024 if not set"`
+
+	// Level is the gzip compression level from 1 (fastest) to 9 (best).
+	// Defaults to the default level of gzip.
+	Level int `long:"level" description:"Gzip compression level from 1 to 9"`
+}
+
+// validate makes sure the compression settings are valid and sets their
+// defaults.
+func (c *RequestCompressionConfig) validate() error {
+	switch {
+	case c.MinSize < 0:
+		return fmt.Errorf("negative minimum size")
+
+	case c.MinSize == 0:
+		c.MinSize = defaultCompressionMinSize
+	}
+
+	switch {
+	case c.Level == 0:
+		c.Level = gzip.DefaultCompression
+
+	case c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression:
+		return fmt.Errorf("invalid compression level %d, must be "+
+			"between %d and %d", c.Level, gzip.BestSpeed,
+			gzip.BestCompression)
+	}
+
+	return nil
+}
+
+// compressRequest replaces the body of the request to the backend with its
+// gzip compressed form if the service compresses request bodies. The body is
+// compressed while it is sent, so it's never buffered, and its compressed size
+// is unknown. Only bodies that are signed are compressed up front, so their
+// size is known and their signature can cover the compressed body. Bodies that
+// are already encoded, smaller than the minimum size and those of gRPC
+// requests, which have their own compression, are sent unchanged.
+func (s *Service) compressRequest(req *http.Request) {
+	config := s.RequestCompression
+	if config == nil || req.Body == nil || req.Body == http.NoBody ||
+		req.ContentLength == 0 || isGrpcRequest(req) ||
+		req.Header.Get("Content-Encoding") != "" {
+
+		return
+	}
+	if req.ContentLength > 0 && req.ContentLength < config.MinSize {
+		return
+	}
+
+	if s.RequestSigning != nil && req.ContentLength > 0 &&
+		req.ContentLength <= s.signingMaxBodySize() {
+
+		s.compressSignedRequest(req)
+		return
+	}
+
+	body := req.Body
+	reader, writer := io.Pipe()
+	go func() {
+		defer body.Close()
+
+		gz, err := gzip.NewWriterLevel(writer, config.Level)
+		if err == nil {
+			_, err = io.Copy(gz, body)
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+
+		// The transport closes the reader if it stops sending the
+		// body, which ends the copy.
+		_ = writer.CloseWithError(err)
+	}()
+
+	req.Body = reader
+	req.ContentLength = -1
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Encoding", "gzip")
+}
+
+// compressSignedRequest replaces the body of the request with its gzip
+// compressed form in a buffer. If the body can't be read, it's sent unchanged.
+func (s *Service) compressSignedRequest(req *http.Request) {
+	body, err := ioutil.ReadAll(
+		io.LimitReader(req.Body, req.ContentLength),
+	)
+	var compressed bytes.Buffer
+	if err == nil {
+		var gz *gzip.Writer
+		gz, err = gzip.NewWriterLevel(
+			&compressed, s.RequestCompression.Level,
+		)
+		if err == nil {
+			_, err = gz.Write(body)
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+	}
+
+	if err != nil {
+		log.Debugf("Unable to compress request body for service %s: "+
+			"%v", s.Name, err)
+
+		// Whatever we managed to read, the backend still needs to
+		// get the full body.
+		req.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+			Closer: req.Body,
+		}
+		return
+	}
+
+	req.Body = readCloser{
+		Reader: bytes.NewReader(compressed.Bytes()),
+		Closer: req.Body,
+	}
+	req.ContentLength = int64(compressed.Len())
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Encoding", "gzip")
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestRequestCompression makes sure request bodies are only compressed if they
+// are large enough and not encoded already, and that the backend receives them
+// unchanged after decompressing them.
+func TestRequestCompression(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			encoding := r.Header.Get("Content-Encoding")
+
+			var body []byte
+			switch encoding {
+			case "gzip":
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(),
+						http.StatusBadRequest)
+					return
+				}
+				body, err = ioutil.ReadAll(gz)
+				if err != nil {
+					http.Error(w, err.Error(),
+						http.StatusBadRequest)
+					return
+				}
+
+			default:
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+
+			w.Header().Set("X-Encoding", encoding)
+			_, _ = w.Write(body)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		RequestCompression: &RequestCompressionConfig{
+			MinSize: 16,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	large := strings.Repeat("compressible ", 100)
+	tests := []struct {
+		name         string
+		body         string
+		sentEncoding string
+		encoding     string
+	}{{
+		name:     "large body",
+		body:     large,
+		encoding: "gzip",
+	}, {
+		name: "small body",
+		body: "tiny",
+	}, {
+		name:         "already encoded",
+		body:         large,
+		sentEncoding: "identity",
+		encoding:     "identity",
+	}}
+
+	for _, test := range tests {
+		body := strings.NewReader(test.body)
+		req := httptest.NewRequest("POST", "http://example.com/", body)
+		if test.sentEncoding != "" {
+			req.Header.Set(
+				"Content-Encoding", test.sentEncoding,
+			)
+		}
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", test.name,
+				rec.Code, rec.Body.String())
+		}
+		encoding := rec.Header().Get("X-Encoding")
+		if encoding != test.encoding {
+			t.Fatalf("%s: expected encoding %q, got %q", test.name,
+				test.encoding, encoding)
+		}
+		if rec.Body.String() != test.body {
+			t.Fatalf("%s: backend received unexpected body",
+				test.name)
+		}
+	}
+}
+
+// TestRequestCompressionSigned makes sure the signature of a compressed request
+// covers the compressed body the backend receives.
+func TestRequestCompressionSigned(t *testing.T) {
+	t.Parallel()
+
+	s := &Service{
+		Name: "test",
+		RequestCompression: &RequestCompressionConfig{
+			MinSize: 16,
+		},
+		RequestSigning: &RequestSigningConfig{
+			Secret: strings.Repeat("s", minSigningSecretSize),
+		},
+	}
+	if err := s.RequestCompression.validate(); err != nil {
+		t.Fatalf("unexpected invalid config: %v", err)
+	}
+
+	large := strings.Repeat("compressible ", 100)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(large))
+	s.compressRequest(req)
+	if req.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected body to be compressed")
+	}
+	if req.ContentLength <= 0 {
+		t.Fatalf("expected known compressed size, got %d",
+			req.ContentLength)
+	}
+
+	hash := s.signingBodyHash(req)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || int64(len(body)) != req.ContentLength {
+		t.Fatalf("unexpected compressed body of %d bytes: %v",
+			len(body), err)
+	}
+	bodyHash := sha256.Sum256(body)
+	if hash != hex.EncodeToString(bodyHash[:]) {
+		t.Fatalf("signature doesn't cover the compressed body: %s",
+			hash)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to decompress body: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil || string(decompressed) != large {
+		t.Fatalf("unexpected decompressed body: %v", err)
+	}
+}
+
+// TestRequestCompressionValidate makes sure invalid compression settings are
+// rejected and defaults are set.
+func TestRequestCompressionValidate(t *testing.T) {
+	t.Parallel()
+
+	config := &RequestCompressionConfig{}
+	if err := config.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.MinSize != defaultCompressionMinSize ||
+		config.Level != gzip.DefaultCompression {
+
+		t.Fatalf("unexpected defaults: %+v", config)
+	}
+
+	invalid := []*RequestCompressionConfig{
+		{MinSize: -1},
+		{Level: 10},
+		{Level: -3},
+	}
+	for _, config := range invalid {
+		if err := config.validate(); err == nil {
+			t.Fatalf("expected error for %+v", config)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSignatureHeader is the default header the signature of a
+	// request is sent to the backend in.
+	DefaultSignatureHeader = "X-Aperture-Signature"
+
+	// DefaultSignatureTimestampHeader is the default header the time a
+	// request was signed at is sent to the backend in.
+	DefaultSignatureTimestampHeader = "X-Aperture-Timestamp"
+
+	// signFieldMethod, signFieldHost, signFieldPath, signFieldQuery,
+	// signFieldTimestamp and signFieldBody are the parts of a request
+	// that can be signed.
+	signFieldMethod    = "method"
+	signFieldHost      = "host"
+	signFieldPath      = "path"
+	signFieldQuery     = "query"
+	signFieldTimestamp = "timestamp"
+	signFieldBody      = "body"
+
+	// unsignedPayload is signed instead of the body hash if the body
+	// can't be buffered, for example for streaming requests.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// minSigningSecretSize is the minimum length of the shared secret.
+	minSigningSecretSize = 32
+
+	// defaultSigningMaxBodySize is the default maximum size of a request
+	// body that is buffered to be signed.
+	defaultSigningMaxBodySize = 1024 * 1024
+)
+
+var (
+	// defaultSignedFields are the parts of a request that are signed if
+	// none are configured.
+	defaultSignedFields = []string{
+		signFieldMethod, signFieldPath, signFieldTimestamp,
+		signFieldBody,
+	}
+)
+
+// RequestSigningConfig is the configuration of the HMAC signature aperture
+// adds to the requests it forwards to a backend. The backend can verify it to
+// make sure requests came through aperture.
+//
+// The signature is the hex encoded HMAC-SHA256 with the shared secret over the
+// signed fields of the request, each followed by a newline, in the configured
+// order. The method is upper case, the path is the escaped path and the query
+// the raw query the backend receives, the host is the backend address, the
+// timestamp is the value of the timestamp header and the body is the hex
+// encoded SHA256 hash of the body or UNSIGNED-PAYLOAD if the body is too
+// large or of unknown size.
+type RequestSigningConfig struct {
+	// Secret is the secret shared with the backend. It must be at least
+	// 32 characters long.
+	Secret string `long:"secret" description:"Secret shared with the backend, at least 32 characters"`
+
+	// Fields is the ordered list of the signed parts of the request, out
+	// of method, host, path, query, timestamp and body. Defaults to
+	// method, path, timestamp and body. The timestamp is always required
+	// so backends can reject replayed requests.
+	Fields []string `long:"fields" description:"Ordered list of signed request parts: method, host, path, query, timestamp, body"`
+
+	// Header is the header the signature is sent in. Defaults to
+	// X-Aperture-Signature.
+	Header string `long:"header" description:"Header the signature is sent in"`
+
+	// TimestampHeader is the header the unix time the request was signed
+	// at is sent in. Defaults to X-Aperture-Timestamp.
+	TimestampHeader string `long:"timestampheader" description:"Header the signing time is sent in"`
+
+	// MaxBodySize is the maximum size of a request body in bytes that is
+	// buffered to be signed. Defaults to 1 MiB.
+	MaxBodySize int64 `long:"maxbodysize" description:"Maximum size of a request body that is signed"`
+}
+
+// validate makes sure the request signing configuration is valid.
+func (c *RequestSigningConfig) validate() error {
+	if len(c.Secret) < minSigningSecretSize {
+		return fmt.Errorf("signing secret must be at least %d "+
+			"characters", minSigningSecretSize)
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max body size cannot be negative")
+	}
+
+	var timestamp bool
+	for _, field := range c.Fields {
+		switch field {
+		case signFieldMethod, signFieldHost, signFieldPath,
+			signFieldQuery, signFieldBody:
+
+		case signFieldTimestamp:
+			timestamp = true
+
+		default:
+			return fmt.Errorf("unknown signed field %s", field)
+		}
+	}
+	if len(c.Fields) > 0 && !timestamp {
+		return fmt.Errorf("signed fields must include the timestamp")
+	}
+	return nil
+}
+
+// signRequest adds the timestamp and signature headers to the request that is
+// forwarded to the backend, if the service signs its requests. Headers with
+// the same names sent by the client are always replaced.
+func (s *Service) signRequest(req *http.Request, now time.Time) {
+	c := s.RequestSigning
+	if c == nil {
+		return
+	}
+
+	sigHeader := c.Header
+	if sigHeader == "" {
+		sigHeader = DefaultSignatureHeader
+	}
+	timestampHeader := c.TimestampHeader
+	if timestampHeader == "" {
+		timestampHeader = DefaultSignatureTimestampHeader
+	}
+	fields := c.Fields
+	if len(fields) == 0 {
+		fields = defaultSignedFields
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	for _, field := range fields {
+		var value string
+		switch field {
+		case signFieldMethod:
+			value = strings.ToUpper(req.Method)
+
+		case signFieldHost:
+			value = req.Host
+
+		case signFieldPath:
+			value = req.URL.EscapedPath()
+
+		case signFieldQuery:
+			value = req.URL.RawQuery
+
+		case signFieldTimestamp:
+			value = timestamp
+
+		case signFieldBody:
+			value = s.signingBodyHash(req)
+		}
+		_, _ = mac.Write([]byte(value))
+		_, _ = mac.Write([]byte{'\n'})
+	}
+
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(sigHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// signingMaxBodySize returns the maximum size of a request body that is
+// buffered to be signed.
+func (s *Service) signingMaxBodySize() int64 {
+	if s.RequestSigning.MaxBodySize == 0 {
+		return defaultSigningMaxBodySize
+	}
+	return s.RequestSigning.MaxBodySize
+}
+
+// signingBodyHash returns the hex encoded SHA256 hash of the request body. The
+// body is buffered and replaced so it can still be forwarded in full. Bodies
+// that are too large or of unknown size aren't buffered so we never have to
+// wait for a streaming client, unsignedPayload is returned for them instead.
+func (s *Service) signingBodyHash(req *http.Request) string {
+	maxSize := s.signingMaxBodySize()
+
+	if req.Body == nil || req.Body == http.NoBody ||
+		req.ContentLength == 0 {
+
+		hash := sha256.Sum256(nil)
+		return hex.EncodeToString(hash[:])
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxSize {
+		return unsignedPayload
+	}
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(req.Body, req.ContentLength),
+	)
+
+	// Whatever we managed to read, the backend still needs to get the
+	// full body.
+	req.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+		Closer: req.Body,
+	}
+	if err != nil {
+		log.Debugf("Unable to buffer request body to sign for service "+
+			"%s: %v", s.Name, err)
+		return unsignedPayload
+	}
+
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignRequest makes sure the signature covers the configured fields and
+// the body is still forwarded in full.
+func TestSignRequest(t *testing.T) {
+	t.Parallel()
+
+	secret := strings.Repeat("s", minSigningSecretSize)
+	s := &Service{
+		Name: "test",
+		RequestSigning: &RequestSigningConfig{
+			Secret: secret,
+		},
+	}
+	if err := s.RequestSigning.validate(); err != nil {
+		t.Fatalf("unexpected invalid config: %v", err)
+	}
+
+	req := httptest.NewRequest(
+		"POST", "/foo?bar=1", strings.NewReader("hi"),
+	)
+	req.Header.Set(DefaultSignatureHeader, "spoofed")
+	s.signRequest(req, time.Unix(1000, 0))
+
+	bodyHash := sha256.Sum256([]byte("hi"))
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte("POST\n/foo\n1000\n" +
+		hex.EncodeToString(bodyHash[:]) + "\n"))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if sig := req.Header.Get(DefaultSignatureHeader); sig != expected {
+		t.Fatalf("expected signature %s, got %s", expected, sig)
+	}
+	timestamp := req.Header.Get(DefaultSignatureTimestampHeader)
+	if timestamp != "1000" {
+		t.Fatalf("expected timestamp 1000, got %s", timestamp)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil || string(body) != "hi" {
+		t.Fatalf("expected full body, got %q, %v", body, err)
+	}
+
+	// Bodies of unknown size are not signed.
+	req = httptest.NewRequest("POST", "/foo", strings.NewReader("hi"))
+	req.ContentLength = -1
+	if hash := s.signingBodyHash(req); hash != unsignedPayload {
+		t.Fatalf("expected unsigned payload, got %s", hash)
+	}
+
+	invalid := []*RequestSigningConfig{
+		{Secret: "short"},
+		{Secret: secret, Fields: []string{"method", "path"}},
+		{Secret: secret, Fields: []string{"timestamp", "cookie"}},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Fatalf("expected config %+v to be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultRewriteMaxBodySize is the default maximum size of a response
+	// body that is buffered to be rewritten.
+	defaultRewriteMaxBodySize = 1024 * 1024
+)
+
+var (
+	// defaultRewriteContentTypes are the content types of the response
+	// bodies that are rewritten if none are configured.
+	defaultRewriteContentTypes = []string{"text/html", "application/json"}
+)
+
+// externalOriginCtxKey is the key under which the scheme and host the client
+// sent a request to are stored in its context.
+type externalOriginCtxKey struct{}
+
+// ResponseRewriteConfig is the configuration of the rewriting of absolute URLs
+// of the backend in its responses.
+type ResponseRewriteConfig struct {
+	// ContentTypes is the list of media types like "text/html" or
+	// "text/*" of the response bodies that are rewritten. Defaults to
+	// text/html and application/json.
+	ContentTypes []string `long:"contenttypes" description:"Content types of the response bodies that are rewritten"`
+
+	// MaxBodySize is the maximum size of a response body in bytes that is
+	// buffered to be rewritten. Larger bodies are passed on unchanged.
+	// Defaults to 1 MiB.
+	MaxBodySize int64 `long:"maxbodysize" description:"Maximum size of a response body that is rewritten"`
+}
+
+// validate makes sure the response rewrite configuration is valid and brings
+// the content types into their canonical form.
+func (c *ResponseRewriteConfig) validate() error {
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max body size cannot be negative")
+	}
+
+	if len(c.ContentTypes) == 0 {
+		c.ContentTypes = defaultRewriteContentTypes
+	}
+	contentTypes := make([]string, 0, len(c.ContentTypes))
+	for _, contentType := range c.ContentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid content type %s",
+				contentType)
+		}
+		contentTypes = append(contentTypes, mediaType)
+	}
+	c.ContentTypes = contentTypes
+
+	return nil
+}
+
+// withExternalOrigin remembers the scheme and host the client sent the request
+// to in its context if the service rewrites the URLs in its responses.
+func (s *Service) withExternalOrigin(r *http.Request) *http.Request {
+	if s.ResponseRewrite == nil {
+		return r
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	origin := scheme + "://" + r.Host
+
+	ctx := context.WithValue(r.Context(), externalOriginCtxKey{}, origin)
+	return r.WithContext(ctx)
+}
+
+// prepareResponseRewrite makes sure the backend doesn't compress responses
+// that might have to be rewritten. The standard transport then asks for
+// compressed responses itself and decompresses them transparently.
+func (s *Service) prepareResponseRewrite(req *http.Request) {
+	if s.ResponseRewrite != nil {
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// rewriteResponse replaces the absolute URLs of the backend in the Location
+// header and the body of the response with the URLs the client used. Bodies
+// that are compressed, of other content types or too large are passed on
+// unchanged.
+func (s *Service) rewriteResponse(res *http.Response) error {
+	if s.ResponseRewrite == nil || res.Request == nil {
+		return nil
+	}
+	value := res.Request.Context().Value(externalOriginCtxKey{})
+	external, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	internal := res.Request.URL.Scheme + "://" + res.Request.URL.Host
+	if internal == external {
+		return nil
+	}
+
+	if location := res.Header.Get("Location"); location != "" {
+		res.Header.Set(
+			"Location", replaceOrigin(location, internal, external),
+		)
+	}
+
+	if !s.rewritesBody(res) {
+		return nil
+	}
+
+	maxSize := s.ResponseRewrite.MaxBodySize
+	if maxSize == 0 {
+		maxSize = defaultRewriteMaxBodySize
+	}
+	if res.ContentLength > maxSize {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return fmt.Errorf("unable to read response body to rewrite: "+
+			"%v", err)
+	}
+	if int64(len(body)) > maxSize {
+		log.Debugf("Response body of service %s too large to be "+
+			"rewritten", s.Name)
+		res.Body = readCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), res.Body),
+			Closer: res.Body,
+		}
+		return nil
+	}
+	_ = res.Body.Close()
+
+	body = bytes.Replace(body, []byte(internal), []byte(external), -1)
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.Header.Del("Transfer-Encoding")
+
+	return nil
+}
+
+// rewritesBody returns true if the body of the response is of a content type
+// that is rewritten and isn't compressed.
+func (s *Service) rewritesBody(res *http.Response) bool {
+	if res.Body == nil || res.Body == http.NoBody {
+		return false
+	}
+
+	encoding := res.Header.Get("Content-Encoding")
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		log.Debugf("Not rewriting response body of service %s with "+
+			"content encoding %s", s.Name, encoding)
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(
+		res.Header.Get("Content-Type"),
+	)
+	if err != nil {
+		return false
+	}
+	for _, contentType := range s.ResponseRewrite.ContentTypes {
+		if mediaTypeMatches(contentType, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceOrigin replaces the internal origin at the start of a URL with the
+// external one.
+func replaceOrigin(url, internal, external string) string {
+	if url == internal || strings.HasPrefix(url, internal+"/") ||
+		strings.HasPrefix(url, internal+"?") {
+
+		return external + url[len(internal):]
+	}
+	return url
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestRewriteResponse makes sure the URLs of the backend are replaced with the
+// external ones in the Location header and the bodies of the configured
+// content types, even if the backend would compress them.
+func TestRewriteResponse(t *testing.T) {
+	t.Parallel()
+
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := fmt.Sprintf(`{"next":"%s/page/2"}`, backendURL)
+			contentType := "application/json"
+			switch r.URL.Path {
+			case "/redirect":
+				w.Header().Set("Location", backendURL+"/new")
+				w.WriteHeader(http.StatusFound)
+				return
+
+			case "/text":
+				contentType = "text/plain"
+
+			case "/large":
+				body += strings.Repeat(" ", 100)
+			}
+
+			w.Header().Set("Content-Type", contentType)
+			if !strings.Contains(
+				r.Header.Get("Accept-Encoding"), "gzip",
+			) {
+
+				_, _ = w.Write([]byte(body))
+				return
+			}
+
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			_, _ = gz.Write([]byte(body))
+			_ = gz.Close()
+		},
+	))
+	defer backend.Close()
+	backendURL = backend.URL
+
+	services := []*Service{{
+		Name:       "rewrite",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		ResponseRewrite: &ResponseRewriteConfig{
+			MaxBodySize: 100,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// The client's transport asks for compressed responses as well.
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unable to get %s: %v", path, err)
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("unable to read body: %v", err)
+		}
+		return res, string(body)
+	}
+
+	res, body := get("/json")
+	expected := fmt.Sprintf(`{"next":"%s/page/2"}`, server.URL)
+	if body != expected {
+		t.Fatalf("expected rewritten body %s, got %s", expected, body)
+	}
+	if res.ContentLength != int64(len(expected)) {
+		t.Fatalf("expected content length %d, got %d", len(expected),
+			res.ContentLength)
+	}
+
+	res, _ = get("/redirect")
+	if res.Header.Get("Location") != server.URL+"/new" {
+		t.Fatalf("expected rewritten location, got %s",
+			res.Header.Get("Location"))
+	}
+
+	_, body = get("/text")
+	if !strings.Contains(body, backend.URL) {
+		t.Fatalf("expected other content types to be unchanged, "+
+			"got %s", body)
+	}
+
+	_, body = get("/large")
+	if !strings.Contains(body, backend.URL) {
+		t.Fatalf("expected large body to be unchanged, got %s", body)
+	}
+}
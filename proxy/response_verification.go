@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// DefaultResponseSignatureHeader is the default header backends send
+	// the signature of their responses in.
+	DefaultResponseSignatureHeader = "X-Backend-Signature"
+)
+
+var (
+	// errUnverifiedResponse is returned if the signature of a backend
+	// response is missing or invalid.
+	errUnverifiedResponse = errors.New("unverified backend response")
+)
+
+// ResponseVerificationConfig is the configuration of the verification of the
+// HMAC signature the backend adds to its responses. Responses without a valid
+// signature are replaced with a 502, so a man in the middle on the network
+// between aperture and the backend can't forge or alter them.
+//
+// The signature is the hex encoded HMAC-SHA256 with the shared secret over the
+// decimal status code and the hex encoded SHA256 hash of the body as sent by
+// the backend, each followed by a newline.
+type ResponseVerificationConfig struct {
+	// Secret is the secret shared with the backend. It must be at least
+	// 32 characters long.
+	Secret string `long:"secret" description:"Secret shared with the backend, at least 32 characters"`
+
+	// Header is the header the backend sends the signature in. Defaults
+	// to X-Backend-Signature.
+	Header string `long:"header" description:"Header the backend sends the signature in"`
+
+	// MaxBodySize is the maximum size of a response body in bytes that is
+	// buffered to be verified. Larger responses can't be verified and are
+	// replaced with a 502. Defaults to 1 MiB.
+	MaxBodySize int64 `long:"maxbodysize" description:"Maximum size of a response body that can be verified"`
+}
+
+// validate makes sure the response verification configuration is valid and
+// sets its defaults.
+func (c *ResponseVerificationConfig) validate() error {
+	if len(c.Secret) < minSigningSecretSize {
+		return fmt.Errorf("verification secret must be at least %d "+
+			"characters", minSigningSecretSize)
+	}
+
+	switch {
+	case c.MaxBodySize < 0:
+		return fmt.Errorf("max body size cannot be negative")
+
+	case c.MaxBodySize == 0:
+		c.MaxBodySize = defaultSigningMaxBodySize
+	}
+
+	if c.Header == "" {
+		c.Header = DefaultResponseSignatureHeader
+	}
+
+	return nil
+}
+
+// verifyResponse checks the signature of the backend response if the service
+// verifies its responses. The body is buffered to do so and replaced so it can
+// still be sent to the client. The signature header is removed, since it's of
+// no use to the client. An error is returned for responses that can't be
+// verified, which makes the reverse proxy answer the request with a 502.
+func (s *Service) verifyResponse(res *http.Response) error {
+	c := s.ResponseVerification
+	if c == nil {
+		return nil
+	}
+
+	signature, err := hex.DecodeString(res.Header.Get(c.Header))
+	res.Header.Del(c.Header)
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("%w: missing or malformed signature",
+			errUnverifiedResponse)
+	}
+
+	if res.ContentLength > c.MaxBodySize {
+		return fmt.Errorf("%w: body of %d bytes too large",
+			errUnverifiedResponse, res.ContentLength)
+	}
+	body, err := ioutil.ReadAll(
+		io.LimitReader(res.Body, c.MaxBodySize+1),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: unable to read body: %v",
+			errUnverifiedResponse, err)
+	}
+	if int64(len(body)) > c.MaxBodySize {
+		return fmt.Errorf("%w: body too large", errUnverifiedResponse)
+	}
+	_ = res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	_, _ = mac.Write([]byte(strconv.Itoa(res.StatusCode)))
+	_, _ = mac.Write([]byte{'\n'})
+	_, _ = mac.Write([]byte(hex.EncodeToString(bodyHash[:])))
+	_, _ = mac.Write([]byte{'\n'})
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("%w: invalid signature",
+			errUnverifiedResponse)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestResponseVerification makes sure only responses with a valid signature
+// reach the client.
+func TestResponseVerification(t *testing.T) {
+	t.Parallel()
+
+	const secret = "a-secret-of-at-least-32-characters"
+	sign := func(status int, body string) string {
+		bodyHash := sha256.Sum256([]byte(body))
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write([]byte(strconv.Itoa(status) + "\n"))
+		_, _ = mac.Write([]byte(hex.EncodeToString(bodyHash[:])))
+		_, _ = mac.Write([]byte("\n"))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := "response"
+			switch r.URL.Path {
+			case "/valid":
+				w.Header().Set(
+					DefaultResponseSignatureHeader,
+					sign(http.StatusOK, body),
+				)
+
+			case "/altered":
+				w.Header().Set(
+					DefaultResponseSignatureHeader,
+					sign(http.StatusOK, body),
+				)
+				body = "altered"
+
+			case "/large":
+				body = strings.Repeat("x", 100)
+				w.Header().Set(
+					DefaultResponseSignatureHeader,
+					sign(http.StatusOK, body),
+				)
+			}
+			_, _ = w.Write([]byte(body))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "service",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		ResponseVerification: &ResponseVerificationConfig{
+			Secret:      secret,
+			MaxBodySize: 64,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/valid", status: http.StatusOK},
+		{path: "/unsigned", status: http.StatusBadGateway},
+		{path: "/altered", status: http.StatusBadGateway},
+		{path: "/large", status: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected status %d, got %d", test.path,
+				test.status, rec.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if rec.Body.String() != "response" {
+			t.Fatalf("unexpected body %q", rec.Body.String())
+		}
+		if rec.Header().Get(DefaultResponseSignatureHeader) != "" {
+			t.Fatalf("signature header was sent to the client")
+		}
+	}
+
+	short := &ResponseVerificationConfig{Secret: "short"}
+	if err := short.validate(); err == nil {
+		t.Fatalf("expected short secret to be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+var (
+	// errHijackUnsupported is returned if a connection is hijacked through
+	// a response writer that doesn't support it.
+	errHijackUnsupported = errors.New("response writer doesn't support " +
+		"hijacking")
+)
+
+// statusRecorder is an http.ResponseWriter that keeps track of the status code
+// that was sent to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+
+	// written is the number of bytes of the response body that were sent
+	// to the client.
+	written int64
+}
+
+// newStatusRecorder wraps the given response writer to record its status.
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w}
+}
+
+// WriteHeader records the status code and sends it to the client.
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.status == 0 {
+		s.status = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write sends the given data to the client. If no status code was sent yet,
+// an implicit 200 is recorded.
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client if the underlying response
+// writer supports it. The reverse proxy relies on this to stream responses.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection to the client. The reverse
+// proxy needs this for protocol upgrades like WebSockets. Before Go 1.20 it
+// doesn't look for it through Unwrap, so it must be implemented directly. The
+// reverse proxy only hijacks the connection to switch protocols, so that is
+// the status that is recorded.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(s.ResponseWriter)
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped response writer so the http package can access
+// optional interfaces it implements.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// hijack takes over the connection of the given response writer if it
+// supports it.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijackUnsupported
+	}
+	return hijacker.Hijack()
+}
+
+// Status returns the status code that was sent to the client. If nothing was
+// sent at all, 200 is returned as that is what the server will send.
+func (s *statusRecorder) Status() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// isError returns true if the response that was sent to the client signals an
+// error, either through its HTTP status or through a gRPC status other than OK.
+func (s *statusRecorder) isError() bool {
+	status := s.Status()
+	if status < 200 || status >= 300 {
+		return true
+	}
+
+	// For gRPC responses, the status is either sent in the header for
+	// trailers-only responses or in the trailer.
+	header := s.Header()
+	grpcStatus := header.Get(hdrGrpcStatus)
+	if grpcStatus == "" {
+		grpcStatus = header.Get(http.TrailerPrefix + hdrGrpcStatus)
+	}
+	return grpcStatus != "" && grpcStatus != "0"
+}
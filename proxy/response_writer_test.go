@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestSampleRequestLog makes sure only every Nth successful request is sampled
+// while errors are always logged.
+func TestSampleRequestLog(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{LogSampleRate: 3}
+
+	var sampled int
+	for i := 0; i < 9; i++ {
+		rec := newStatusRecorder(httptest.NewRecorder())
+		rec.WriteHeader(http.StatusOK)
+		if service.sampleRequestLog(rec) {
+			sampled++
+		}
+	}
+	if sampled != 3 {
+		t.Fatalf("expected 3 sampled requests, got %d", sampled)
+	}
+
+	rec := newStatusRecorder(httptest.NewRecorder())
+	rec.WriteHeader(http.StatusPaymentRequired)
+	for i := 0; i < 3; i++ {
+		if !service.sampleRequestLog(rec) {
+			t.Fatalf("expected error response to always be logged")
+		}
+	}
+
+	rec = newStatusRecorder(httptest.NewRecorder())
+	rec.Header().Set(hdrGrpcStatus, "5")
+	rec.WriteHeader(http.StatusOK)
+	if !service.sampleRequestLog(rec) {
+		t.Fatalf("expected gRPC error response to always be logged")
+	}
+}
+
+// TestUpgrade makes sure protocol upgrades like WebSockets pass through the
+// response writers the proxy wraps the client connection in.
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	// Before Go 1.20, the reverse proxy only hijacks writers that
+	// implement http.Hijacker themselves.
+	var (
+		_ http.Hijacker = (*statusRecorder)(nil)
+		_ http.Hijacker = (*responseCapture)(nil)
+	)
+
+	// The backend switches to a protocol that echoes everything back.
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = rw.WriteString("HTTP/1.1 101 Switching " +
+				"Protocols\r\nConnection: Upgrade\r\n" +
+				"Upgrade: echo\r\n\r\n")
+			_ = rw.Flush()
+			_, _ = io.Copy(conn, rw)
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:              "service",
+		Address:           strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:        ".*",
+		Protocol:          "http",
+		Auth:              auth.LevelOff,
+		IdempotencyWindow: time.Minute,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// The idempotency key makes the request go through the response
+	// capture as well.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("unable to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\n" +
+		"Content-Length: 0\r\nConnection: Upgrade\r\n" +
+		"Upgrade: echo\r\nIdempotency-Key: key\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unable to read response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d",
+			http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("unable to send message: %v", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatalf("unable to read echo: %v", err)
+	}
+	if string(echo) != "ping" {
+		t.Fatalf("expected echo ping, got %s", echo)
+	}
+}
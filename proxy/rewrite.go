@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// rewriteVarRegexp matches a variable like "{id}" in a rewrite
+	// template.
+	rewriteVarRegexp = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+)
+
+// PathRewrite is a rule to rewrite the path of a request before it is sent to
+// the backend. Variables in the form of "{name}" are extracted from the request
+// path and can be used in the new path, its query and in header values. For
+// example a rule from "/v1/users/{id}" to "/internal/user?uid={id}" rewrites
+// a request to "/v1/users/42" into a request to "/internal/user?uid=42". A
+// variable matches a single path segment.
+type PathRewrite struct {
+	// From is the template the path of a request must match completely for
+	// the rule to be applied.
+	From string `long:"from" description:"Path template to match, for example /v1/users/{id}"`
+
+	// To is the template of the new path and optional query of the
+	// request. Any query of the original request is appended.
+	To string `long:"to" description:"Template of the new path, for example /internal/user?uid={id}"`
+
+	// Headers is an optional map of header names to value templates that
+	// are set on the rewritten request.
+	Headers map[string]string `long:"headers" description:"Header fields to set on the rewritten request"`
+
+	// fromRegexp is the compiled From template.
+	fromRegexp *regexp.Regexp
+}
+
+// compile turns the From template of the rule into a regular expression and
+// makes sure the other templates only use variables that are defined in it.
+func (p *PathRewrite) compile() error {
+	if !strings.HasPrefix(p.From, "/") || !strings.HasPrefix(p.To, "/") {
+		return fmt.Errorf("rewrite templates must start with '/'")
+	}
+
+	var (
+		pattern strings.Builder
+		vars    = make(map[string]struct{})
+		last    int
+	)
+	pattern.WriteString("^")
+	for _, loc := range rewriteVarRegexp.FindAllStringSubmatchIndex(
+		p.From, -1,
+	) {
+		name := p.From[loc[2]:loc[3]]
+		if _, ok := vars[name]; ok {
+			return fmt.Errorf("duplicate variable %s in rewrite "+
+				"template %s", name, p.From)
+		}
+		vars[name] = struct{}{}
+
+		pattern.WriteString(regexp.QuoteMeta(p.From[last:loc[0]]))
+		pattern.WriteString("(?P<" + name + ">[^/]+)")
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(p.From[last:]))
+	pattern.WriteString("$")
+
+	templates := []string{p.To}
+	for _, value := range p.Headers {
+		templates = append(templates, value)
+	}
+	for _, template := range templates {
+		for _, match := range rewriteVarRegexp.FindAllStringSubmatch(
+			template, -1,
+		) {
+			if _, ok := vars[match[1]]; !ok {
+				return fmt.Errorf("unknown variable %s in "+
+					"rewrite template %s", match[1],
+					template)
+			}
+		}
+	}
+
+	var err error
+	p.fromRegexp, err = regexp.Compile(pattern.String())
+	return err
+}
+
+// apply rewrites the given request if its path matches the rule. True is
+// returned if the request was rewritten.
+func (p *PathRewrite) apply(req *http.Request) bool {
+	match := p.fromRegexp.FindStringSubmatch(req.URL.Path)
+	if match == nil {
+		return false
+	}
+
+	vars := make(map[string]string, len(match)-1)
+	for i, name := range p.fromRegexp.SubexpNames() {
+		if name != "" {
+			vars[name] = match[i]
+		}
+	}
+	expand := func(template string, escape func(string) string) string {
+		return rewriteVarRegexp.ReplaceAllStringFunc(
+			template, func(v string) string {
+				return escape(vars[v[1:len(v)-1]])
+			},
+		)
+	}
+	noEscape := func(s string) string { return s }
+
+	newPath, newQuery := p.To, ""
+	if idx := strings.Index(p.To, "?"); idx >= 0 {
+		newPath, newQuery = p.To[:idx], p.To[idx+1:]
+	}
+
+	req.URL.Path = expand(newPath, noEscape)
+	req.URL.RawPath = ""
+	newQuery = expand(newQuery, url.QueryEscape)
+	switch {
+	case newQuery == "":
+	case req.URL.RawQuery == "":
+		req.URL.RawQuery = newQuery
+	default:
+		req.URL.RawQuery = newQuery + "&" + req.URL.RawQuery
+	}
+
+	for name, value := range p.Headers {
+		req.Header.Set(name, expand(value, noEscape))
+	}
+
+	return true
+}
+
+// rewriteRequest applies the first path rewrite rule of the service that
+// matches the request.
+func (s *Service) rewriteRequest(req *http.Request) {
+	for _, rule := range s.PathRewrites {
+		if rule.apply(req) {
+			log.Tracef("Rewrote request path for service %s to %s",
+				s.Name, req.URL.Path)
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestPathRewrite makes sure request paths are rewritten according to the
+// first matching template and that invalid templates are rejected.
+func TestPathRewrite(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		PathRewrites: []*PathRewrite{{
+			From: "/v1/users/{id}",
+			To:   "/internal/user?uid={id}",
+			Headers: map[string]string{
+				"X-User-Id": "{id}",
+			},
+		}, {
+			From: "/v1/{kind}/{id}/items",
+			To:   "/internal/{kind}/items/{id}",
+		}},
+	}
+	if err := prepareServices([]*Service{service}, false, nil); err != nil {
+		t.Fatalf("unable to prepare service: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		url           string
+		expectedPath  string
+		expectedQuery string
+		expectedID    string
+	}{{
+		name:          "query template",
+		url:           "http://example.com/v1/users/a%20b?x=1",
+		expectedPath:  "/internal/user",
+		expectedQuery: "uid=a+b&x=1",
+		expectedID:    "a b",
+	}, {
+		name:         "path template",
+		url:          "http://example.com/v1/orders/7/items",
+		expectedPath: "/internal/orders/items/7",
+	}, {
+		name:         "no match",
+		url:          "http://example.com/v1/users/7/extra",
+		expectedPath: "/v1/users/7/extra",
+	}}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", test.url, nil)
+			if err != nil {
+				t.Fatalf("unable to create request: %v", err)
+			}
+
+			service.rewriteRequest(req)
+			if req.URL.Path != test.expectedPath {
+				t.Fatalf("expected path %s, got %s",
+					test.expectedPath, req.URL.Path)
+			}
+			if req.URL.RawQuery != test.expectedQuery {
+				t.Fatalf("expected query %s, got %s",
+					test.expectedQuery, req.URL.RawQuery)
+			}
+			id := req.Header.Get("X-User-Id")
+			if id != test.expectedID {
+				t.Fatalf("expected user ID %s, got %s",
+					test.expectedID, id)
+			}
+		})
+	}
+
+	invalid := &Service{
+		PathRewrites: []*PathRewrite{{
+			From: "/v1/users/{id}",
+			To:   "/internal/{uid}",
+		}},
+	}
+	if err := prepareServices([]*Service{invalid}, false, nil); err == nil {
+		t.Fatalf("expected unknown variable to be rejected")
+	}
+}
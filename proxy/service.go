@@ -4,14 +4,21 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcutil"
 	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/freebie"
+	"google.golang.org/grpc/codes"
 )
 
 var (
@@ -28,6 +35,43 @@ const (
 	// maxServicePrice is the maximum price in satoshis that can be used
 	// to create an invoice through lnd.
 	maxServicePrice = btcutil.SatoshiPerBitcoin * 100000
+
+	// freebieStrategyIP is the freebie strategy that counts free requests
+	// per IP address.
+	freebieStrategyIP = "ip"
+
+	// freebieStrategyCookie is the freebie strategy that counts free
+	// requests in a signed cookie on the client side.
+	freebieStrategyCookie = "cookie"
+
+	// freebieStrategyDisk is the freebie strategy that counts free
+	// requests per IP address in the on-disk freebie database.
+	freebieStrategyDisk = "disk"
+
+	// freebieFailError is the freebie fail policy that responds with an
+	// internal server error if the freebie DB fails.
+	freebieFailError = "error"
+
+	// freebieFailOpen is the freebie fail policy that serves the request
+	// as if the client still had free requests left if the freebie DB
+	// fails.
+	freebieFailOpen = "open"
+
+	// freebieFailPayment is the freebie fail policy that requires the
+	// client to pay if the freebie DB fails.
+	freebieFailPayment = "payment"
+
+	// hdrFreebieLimit is the header that contains the number of free
+	// requests a client has in total.
+	hdrFreebieLimit = "X-Freebie-Limit"
+
+	// hdrFreebieRemaining is the header that contains the number of free
+	// requests a client has left.
+	hdrFreebieRemaining = "X-Freebie-Remaining"
+
+	// freebieCookiePrefix is the prefix of the name of the cookie that is
+	// used to count free requests. The service name is appended to it.
+	freebieCookiePrefix = "aperture_freebie_"
 )
 
 // Service generically specifies configuration data for backend services to the
@@ -39,19 +83,108 @@ type Service struct {
 	// TLSCertPath is the optional path to the service's TLS certificate.
 	TLSCertPath string `long:"tlscertpath" description:"Path to the service's TLS certificate"`
 
+	// Disabled turns the service off without removing it, for example
+	// during maintenance. Requests that match it are answered with the
+	// DisabledResponse instead of falling through to the next service or
+	// the static file server. Services can be disabled and enabled again
+	// at runtime by reloading them.
+	Disabled bool `long:"disabled" description:"Answer all requests of the service with the disabled response"`
+
+	// DisabledResponse is the response requests are answered with while
+	// the service is disabled. Defaults to status 503.
+	DisabledResponse *DisabledResponseConfig `long:"disabledresponse" description:"Response to requests while the service is disabled"`
+
 	// Address is the service's IP address and port.
 	Address string `long:"address" description:"service instance rpc address"`
 
+	// DiscoverySRV is an optional DNS SRV name, for example
+	// "_api._tcp.example.com", that is used to periodically discover the
+	// backend addresses of the service. If addresses are discovered,
+	// requests are distributed among them and Address is only used until
+	// the first discovery succeeded.
+	DiscoverySRV string `long:"discoverysrv" description:"DNS SRV name to discover the backend addresses of the service"`
+
+	// HealthCheckPath is the path that is probed to check the health of
+	// each backend of the service. With the "http" health check type a GET
+	// request must be answered with a 2xx status code. Unhealthy backends
+	// are excluded from routing until they recover and a service without
+	// any healthy backend isn't matched at all. If empty, no HTTP health
+	// checks are done.
+	HealthCheckPath string `long:"healthcheckpath" description:"Path that is probed to check the health of the backends"`
+
+	// HealthCheckType is the type of the health check, either "http" (the
+	// default) or "grpc" to use the standard gRPC health checking protocol.
+	// The gRPC health check uses the path of the grpc.health.v1 service if
+	// no path is set.
+	HealthCheckType string `long:"healthchecktype" description:"Type of the health check, either 'http' or 'grpc'"`
+
+	// HealthCheckInterval is the interval in which the backends are
+	// probed. If zero, a default of 10 seconds is used.
+	HealthCheckInterval time.Duration `long:"healthcheckinterval" description:"Interval in which the backends are health checked"`
+
 	// Protocol is the protocol that should be used to connect to the
 	// service. Currently supported is http and https.
 	Protocol string `long:"protocol" description:"service instance protocol"`
 
+	// Timeout is the maximum duration of a request to the backend,
+	// including reading its response. Requests that take longer are
+	// aborted and answered with status 504. If zero, requests aren't
+	// limited.
+	Timeout time.Duration `long:"timeout" description:"Maximum duration of a request to the backend"`
+
+	// FollowRedirects makes the proxy follow redirects of the backend to
+	// the same backend itself instead of relaying them to the client, which
+	// is the default. Redirects to other hosts are always relayed.
+	FollowRedirects bool `long:"followredirects" description:"Follow redirects of the backend to itself instead of relaying them to the client"`
+
+	// MaxRedirects is the maximum number of redirects followed for a
+	// single request if FollowRedirects is set. Requests that are
+	// redirected more often fail with status 502. Defaults to 10.
+	MaxRedirects int `long:"maxredirects" description:"Maximum number of redirects followed per request, 10 if not set"`
+
+	// RequestCompression optionally makes the proxy compress request
+	// bodies with gzip before they are sent to the backend, which must
+	// accept gzip encoded bodies. Compressed bodies are sent without a
+	// Content-Length, so signed requests don't cover their body.
+	RequestCompression *RequestCompressionConfig `long:"requestcompression" description:"Configuration of the compression of request bodies sent to the backend"`
+
+	// MethodOverrideHeader is the name of an optional header, usually
+	// X-HTTP-Method-Override, that clients which can only send GET and
+	// POST requests use to tunnel PUT, PATCH and DELETE requests through
+	// POST. The header is never forwarded to the backend.
+	MethodOverrideHeader string `long:"methodoverrideheader" description:"Header that overrides the method of POST requests with PUT, PATCH or DELETE"`
+
+	// MethodTimeouts optionally sets a different timeout for requests with
+	// certain HTTP methods, for example a longer one for POST requests
+	// that trigger heavy processing. Methods that aren't listed use
+	// Timeout. A zero value doesn't limit requests with that method.
+	MethodTimeouts map[string]time.Duration `long:"methodtimeouts" description:"Maximum durations of requests to the backend by HTTP method"`
+
 	// Auth is the authentication level required for this service to be
 	// accessed. Valid values are "on" for full authentication, "freebie X"
 	// for X free requests per IP address before authentication is required
-	// or "off" for no authentication.
+	// or "off" for no authentication. Note that each HTTP Range request,
+	// for example to resume a download, counts as a separate request.
 	Auth auth.Level `long:"auth" description:"required authentication"`
 
+	// ObserveAuth puts the auth policy of the service in observe-only
+	// mode. Tokens are still verified and freebies counted, but requests
+	// that would be rejected with status 402 are logged, counted in the
+	// stats and served anyway. This allows a new price or auth level to be
+	// validated against real traffic before it is enforced.
+	ObserveAuth bool `long:"observeauth" description:"Only log and count requests that the auth policy would reject instead of rejecting them"`
+
+	// Authenticator is the name of the authenticator that validates the
+	// tokens of this service and creates its challenges. If empty, the
+	// default authenticator is used.
+	Authenticator string `long:"authenticator" description:"Name of the authenticator of the service, the default one is used if empty"`
+
+	// PaymentOptions are the names of additional authenticators whose
+	// challenges are offered to clients next to the one of Authenticator.
+	// Tokens of any of them are accepted. If empty, only a single
+	// challenge is offered.
+	PaymentOptions []string `long:"paymentoptions" description:"Names of additional authenticators whose challenges are offered as alternative payment options"`
+
 	// HostRegexp is a regular expression that is tested against the 'Host'
 	// HTTP header field to find out if this service should be used.
 	HostRegexp string `long:"hostregexp" description:"Regular expression to match the host against"`
@@ -60,6 +193,77 @@ type Service struct {
 	// of the URL of a request to find out if this service should be used.
 	PathRegexp string `long:"pathregexp" description:"Regular expression to match the path of the URL against"`
 
+	// PathCaptureHeaders optionally maps header names to the names or
+	// numbers of capture groups of PathRegexp. The values the groups
+	// captured in the path of a request are sent to the backend in these
+	// headers. Headers of groups that are empty or didn't participate in
+	// the match are left out, and headers with the same names sent by the
+	// client are always removed.
+	PathCaptureHeaders map[string]string `long:"pathcaptureheaders" description:"Headers the capture groups of the path expression are sent to the backend in"`
+
+	// Priority is the priority of the service if the proxy uses the
+	// "specific" match mode. If multiple services match a request, the one
+	// with the highest priority is used. It is ignored in the default
+	// "first" match mode where the order of the services decides.
+	Priority int `long:"priority" description:"Priority of the service when using the specific match mode"`
+
+	// PathDecode can be set to forward the path to the backend with
+	// percent-encoded characters decoded, for example %2F as a path
+	// separator. By default the encoding is preserved. Decoding changes the
+	// path structure the backend sees, so combine it with PathResolveDots
+	// to prevent encoded dot segments like %2E%2E from being turned into
+	// a path traversal.
+	PathDecode bool `long:"pathdecode" description:"Decode percent-encoded characters in the path before forwarding it"`
+
+	// PathMergeSlashes can be set to collapse consecutive slashes in the
+	// path into a single one before it is forwarded to the backend.
+	PathMergeSlashes bool `long:"pathmergeslashes" description:"Collapse consecutive slashes in the path before forwarding it"`
+
+	// PathResolveDots can be set to resolve dot segments like /./ and /../
+	// in the path before it is forwarded to the backend. This protects
+	// backends that would resolve them on their own against path traversal
+	// outside of the paths the service and its auth whitelist cover. Only
+	// literal dots are resolved unless PathDecode is set as well.
+	PathResolveDots bool `long:"pathresolvedots" description:"Resolve dot segments in the path before forwarding it"`
+
+	// PathRewrites is an optional list of rules to rewrite the path of a
+	// request before it is sent to the backend. The first rule that
+	// matches the path of a request is applied.
+	PathRewrites []*PathRewrite `long:"pathrewrites" description:"List of rules to rewrite the path of requests to the backend"`
+
+	// BackendAuth decides how the token of the client is passed to the
+	// backend. With "forward", the default, it's sent in the standard
+	// Authorization header. With "strip", it's removed from the request.
+	// With "tokenid", it's replaced by the ID of the token in the
+	// BackendAuthHeader, which is only set if the token was verified and
+	// is always cleared otherwise, so the backend can trust it.
+	BackendAuth string `long:"backendauth" description:"How the token is passed to the backend, either 'forward', 'strip' or 'tokenid'"`
+
+	// BackendAuthHeader is the header the ID of a verified token is sent
+	// to the backend in if BackendAuth is "tokenid". Defaults to
+	// X-Lsat-Token-Id.
+	BackendAuthHeader string `long:"backendauthheader" description:"Header the verified token ID is sent to the backend in"`
+
+	// ForwardedHeaders optionally tells the backend the scheme, host and
+	// port the client sent the request to in the X-Forwarded-Proto,
+	// X-Forwarded-Host and X-Forwarded-Port headers, so it can construct
+	// external URLs. With "set", they're set from the request aperture
+	// received, replacing the values sent by the client. With "preserve",
+	// values set by a proxy in front of aperture are kept and only missing
+	// ones are added. If empty, the headers are passed on unchanged.
+	ForwardedHeaders string `long:"forwardedheaders" description:"How the X-Forwarded-Proto, -Host and -Port headers are set, either 'set' or 'preserve'"`
+
+	// RequestSigning optionally signs the requests that are forwarded to
+	// the backend with an HMAC, so the backend can reject requests that
+	// didn't come through aperture.
+	RequestSigning *RequestSigningConfig `long:"requestsigning" description:"Configuration of the HMAC signature of requests sent to the backend"`
+
+	// ResponseVerification optionally makes aperture verify the HMAC
+	// signature the backend adds to its responses, replacing responses
+	// without a valid one with a 502. Verified responses are buffered in
+	// full before they are sent to the client.
+	ResponseVerification *ResponseVerificationConfig `long:"responseverification" description:"Configuration of the verification of the HMAC signature of backend responses"`
+
 	// Headers is a map of strings that defines header name and values that
 	// should always be passed to the backend service, overwriting any
 	// headers with the same name that might have been set by the client
@@ -84,6 +288,112 @@ type Service struct {
 	// service's endpoint.
 	Price int64 `long:"price" description:"Static LSAT value in satoshis to be used for this service"`
 
+	// RequireClientCert can be set to only allow clients that present a
+	// TLS client certificate that was verified against the client CA of
+	// the proxy. Requests without one are rejected with status 403 before
+	// any other authentication takes place. This can be combined with an
+	// LSAT or used on its own with Auth set to "off".
+	RequireClientCert bool `long:"requireclientcert" description:"Require a verified TLS client certificate to access the service"`
+
+	// AllowedContentTypes is an optional list of media types like
+	// "application/json" or "image/*" the Content-Type of requests must
+	// match. Other requests are rejected with status 415 before any
+	// authentication takes place. Requests without a body don't need to
+	// declare a content type. "application/grpc" also allows all of its
+	// variants like "application/grpc+proto".
+	AllowedContentTypes []string `long:"allowedcontenttypes" description:"Content types of requests the service accepts"`
+
+	// AllowedAcceptTypes is an optional list of media types like
+	// "application/json" or "image/*" that clients can ask for in the
+	// Accept header. Requests that only accept other formats are rejected
+	// with status 406 before any authentication takes place. Requests
+	// without an Accept header are allowed and the header is forwarded
+	// unchanged.
+	AllowedAcceptTypes []string `long:"allowedaccepttypes" description:"Media types clients can ask for in the Accept header"`
+
+	// RequestSchema optionally validates the JSON bodies of requests
+	// against a JSON schema. Requests that don't conform to it are
+	// rejected with status 400 before they reach the backend. Requests
+	// without a JSON content type aren't validated.
+	RequestSchema *RequestSchemaConfig `long:"requestschema" description:"Configuration of the JSON schema request bodies are validated against"`
+
+	// BackendProxy is the optional URL of a SOCKS5 or HTTP(S) proxy the
+	// connections to the backends of the service are routed through, for
+	// example socks5://127.0.0.1:9050 to reach an onion service through
+	// Tor. Credentials of authenticated proxies are given as the user info
+	// of the URL. Host names are resolved by SOCKS5 proxies.
+	BackendProxy string `long:"backendproxy" description:"URL of a SOCKS5 or HTTP proxy to reach the backends through"`
+
+	// TLSPassthrough routes TLS connections whose server name matches
+	// HostRegexp directly to the backend without terminating TLS. The
+	// proxy can't read the requests of such connections, so neither
+	// authentication nor pricing nor any other request based option
+	// applies to the service. Only its host expression and backend address
+	// are used.
+	TLSPassthrough bool `long:"tlspassthrough" description:"Pass TLS connections for the host through to the backend without authentication"`
+
+	// Fallback designates the service as the one that handles all
+	// requests that don't match any other service, with its own
+	// authentication and pricing. Its host and path expressions are
+	// ignored. Requests for files the static file server has are still
+	// served by it. At most one service can be the fallback.
+	Fallback bool `long:"fallback" description:"Handle all requests that don't match any other service"`
+
+	// CountryHeader is the name of an optional request header the country
+	// code of the client is sent to the backend in, resolved from its IP
+	// address through the GeoIP database. The header is omitted if the
+	// country is unknown, and a value sent by the client is never passed
+	// on.
+	CountryHeader string `long:"countryheader" description:"Request header the country code of the client is forwarded in"`
+
+	// Challenge optionally customizes the challenges of the service, for
+	// example with a meaningful invoice description.
+	Challenge *ChallengeConfig `long:"challenge" description:"Configuration of the challenges of the service"`
+
+	// PriceSchedule is an optional list of rules that set a different price
+	// for certain times of the day, for example for peak and off-peak
+	// pricing. The first rule that matches the time of a request decides
+	// the price, so more specific rules should come first. If no rule
+	// matches, Price is used.
+	PriceSchedule []*PriceRule `long:"priceschedule" description:"Rules to set the price based on the time of day"`
+
+	// MethodPrices optionally sets a different price for requests with
+	// the given HTTP methods, for example so writes cost more than reads
+	// of the same path. Methods that aren't listed use Price. A matching
+	// rule of the price schedule takes precedence over both. Only the
+	// tokens of services with method prices or a price schedule are bound
+	// to the price they were bought for.
+	MethodPrices map[string]int64 `long:"methodprices" description:"Prices in satoshis of requests by HTTP method"`
+
+	// PriceTimezone is the name of the timezone the times of the price
+	// schedule are in, for example "Europe/Zurich". Defaults to UTC.
+	PriceTimezone string `long:"pricetimezone" description:"Timezone of the price schedule"`
+
+	// AccessSchedule optionally restricts the access to the service to
+	// certain times of the day. Requests outside of its windows are
+	// rejected before any authentication takes place.
+	AccessSchedule *AccessScheduleConfig `long:"accessschedule" description:"Time windows the service can be accessed in"`
+
+	// FiatCurrency is an optional currency code, for example "USD". If
+	// set, challenges of the service contain the price in satoshis and,
+	// if an exchange rate source is configured, its approximate value in
+	// that currency in the X-Price-Sat and X-Price-Fiat headers. The fiat
+	// value is for display only, clients are always charged in satoshis.
+	FiatCurrency string `long:"fiatcurrency" description:"Currency to show the approximate price of the service in"`
+
+	// AuthQueryParam is the name of an optional query parameter that can
+	// carry the LSAT for clients that can't set any headers, for example
+	// in links. The parameter is removed before the request is forwarded
+	// or logged. Since URLs can leak through logs or referrers, this is
+	// disabled by default.
+	AuthQueryParam string `long:"authqueryparam" description:"Name of the query parameter that can carry the LSAT"`
+
+	// Quota is the maximum number of requests a single LSAT can be used
+	// for to access this service. Once the quota is exhausted, the token
+	// is no longer accepted and a new one must be paid for. A value of zero
+	// means no limit.
+	Quota uint64 `long:"quota" description:"Maximum number of requests per LSAT, 0 for no limit"`
+
 	// AuthWhitelistPaths is an optional list of regular expressions that
 	// are matched against the path of the URL of a request. If the request
 	// URL matches any of those regular expressions, the call is treated as
@@ -92,7 +402,316 @@ type Service struct {
 	// /package_name.ServiceName/MethodName
 	AuthWhitelistPaths []string `long:"authwhitelistpaths" description:"List of regular expressions for paths that don't require authentication'"`
 
-	freebieDb freebie.DB
+	// FreebieMaxKeys is the maximum number of IP address keys the
+	// in-memory freebie store keeps track of. Once the limit is reached,
+	// the least recently used key is evicted which resets its freebie
+	// count. A value of zero means no limit.
+	FreebieMaxKeys int `long:"freebiemaxkeys" description:"Maximum number of keys tracked by the freebie store, 0 for no limit"`
+
+	// FreebieKeyTTL is the duration after which an idle key is removed
+	// from the in-memory freebie store, resetting its freebie count. A
+	// value of zero means keys never expire.
+	FreebieKeyTTL time.Duration `long:"freebiekeyttl" description:"Duration after which idle keys are removed from the freebie store, 0 to never expire"`
+
+	// FreebieIPv4Prefix optionally groups the IPv4 addresses that free
+	// requests are counted for by a prefix of the given length, so all
+	// clients in such a network share the same freebies. The freebie
+	// stores always group them by /24, so only shorter prefixes can be
+	// set.
+	FreebieIPv4Prefix int `long:"freebieipv4prefix" description:"Length of the prefix IPv4 addresses share their freebies in, at most 24"`
+
+	// FreebieIPv6Prefix optionally groups the IPv6 addresses that free
+	// requests are counted for by a prefix of the given length, usually 64.
+	// If not set, every IPv6 address has its own freebies.
+	FreebieIPv6Prefix int `long:"freebieipv6prefix" description:"Length of the prefix IPv6 addresses share their freebies in"`
+
+	// FreebieHeaders can be set to inform clients about the free tier by
+	// adding the X-Freebie-Limit and X-Freebie-Remaining headers to every
+	// response that was served as a freebie. This is disabled by default
+	// to not reveal the policy.
+	FreebieHeaders bool `long:"freebieheaders" description:"Add headers with the freebie limit and remaining freebies to freebie responses"`
+
+	// FreebieStrategy is the strategy used to keep track of free requests
+	// if Auth is set to "freebie X". Valid values are "ip" (the default)
+	// to count the requests per IP address on the server side, "cookie"
+	// to count them in a signed cookie on the client side and "disk" to
+	// count them per IP address in the on-disk freebie database, so the
+	// counts survive restarts.
+	FreebieStrategy string `long:"freebiestrategy" description:"Strategy to keep track of freebies, either 'ip', 'cookie' or 'disk'"`
+
+	// FreebieCookieKey is the hex encoded key of at least 32 bytes that is
+	// used to sign freebie cookies. It is required if FreebieStrategy is
+	// set to "cookie". Changing the key invalidates all issued cookies.
+	FreebieCookieKey string `long:"freebiecookiekey" description:"Hex encoded key to sign freebie cookies with"`
+
+	// FreebieFailPolicy decides what happens to a request that isn't
+	// authenticated if the freebie DB fails. With "error", the default,
+	// the client gets an internal server error. With "open", the request
+	// is served for free. With "payment", the client gets a challenge as
+	// if its free requests were used up.
+	FreebieFailPolicy string `long:"freebiefailpolicy" description:"Behavior if the freebie DB fails, either 'error', 'open' or 'payment'"`
+
+	// FreebieRefundServerErrors gives clients back the free request they
+	// used if it's answered with a 5xx status, so they aren't charged for
+	// requests the backend failed to serve. By default, every request
+	// that passes as a freebie is counted regardless of its outcome. Only
+	// the "ip" and "disk" freebie strategies support this, since cookies
+	// are already updated before the backend answers.
+	FreebieRefundServerErrors bool `long:"freebierefundservererrors" description:"Don't count free requests that are answered with a 5xx status"`
+
+	// AllowedQueryParams is an optional list of query parameter names
+	// that are forwarded to the backend. If set, all other parameters are
+	// stripped from the request to the backend. Services are matched and
+	// the auth query parameter is extracted before the query is filtered,
+	// so both still see the parameters the client sent.
+	AllowedQueryParams []string `long:"allowedqueryparams" description:"List of query parameter names to forward to the backend, all others are stripped"`
+
+	// GrpcMetadataAllow is an optional list of gRPC metadata key prefixes
+	// that are forwarded to the backend. If set, any custom metadata sent
+	// by the client that doesn't match one of the prefixes is stripped.
+	// Metadata is sent as plain header fields by gRPC clients and as
+	// Grpc-Metadata- prefixed header fields by REST clients.
+	GrpcMetadataAllow []string `long:"grpcmetadataallow" description:"List of gRPC metadata key prefixes to forward to the backend"`
+
+	// GrpcMetadataDeny is an optional list of gRPC metadata key prefixes
+	// that are always stripped from client requests, even if they match an
+	// allowed prefix. This prevents clients from spoofing metadata that
+	// the backend expects to be set internally.
+	GrpcMetadataDeny []string `long:"grpcmetadatadeny" description:"List of gRPC metadata key prefixes to strip from client requests"`
+
+	// GrpcStreamReauthMessages enables pay-as-you-go gRPC streaming. If
+	// set, the token of a gRPC stream that requires authentication is
+	// checked again every time this number of messages were sent by the
+	// backend, and each check uses up one request of its usage quota. If
+	// it isn't accepted anymore, for example because its usage quota is
+	// exhausted, the stream is ended with the Unauthenticated status and
+	// the client needs to open a new stream with a fresh token.
+	GrpcStreamReauthMessages uint64 `long:"grpcstreamreauthmessages" description:"Re-authenticate gRPC streams every N messages from the backend"`
+
+	// GrpcStreamReauthInterval is like GrpcStreamReauthMessages but
+	// re-authenticates gRPC streams after the given duration. The check
+	// happens before the next message is passed to the client.
+	GrpcStreamReauthInterval time.Duration `long:"grpcstreamreauthinterval" description:"Re-authenticate gRPC streams after this duration"`
+
+	// GrpcStatusMapping is an optional map of gRPC status code names (for
+	// example "NOT_FOUND") to HTTP status codes. It overrides the default
+	// mapping that is used to translate the gRPC status of a backend
+	// response into an HTTP status code for clients that don't speak gRPC.
+	GrpcStatusMapping map[string]int `long:"grpcstatusmapping" description:"Custom mapping of gRPC status code names to HTTP status codes for HTTP clients"`
+
+	// ShadowAddress is the optional address of a shadow backend. If set, a
+	// copy of each request that is forwarded to the service is also sent
+	// to the shadow backend. Its response is discarded and never affects
+	// the response to the client. Only requests with a known body size not
+	// exceeding ShadowMaxBodySize are mirrored, which excludes streaming
+	// requests such as gRPC calls.
+	ShadowAddress string `long:"shadowaddress" description:"Address of a shadow backend to mirror requests to"`
+
+	// ShadowProtocol is the protocol used to connect to the shadow backend.
+	// If empty, the protocol of the service is used.
+	ShadowProtocol string `long:"shadowprotocol" description:"Protocol used to connect to the shadow backend"`
+
+	// ShadowTimeout is the maximum duration of a mirrored request. If zero,
+	// a default of 10 seconds is used.
+	ShadowTimeout time.Duration `long:"shadowtimeout" description:"Maximum duration of a request to the shadow backend"`
+
+	// ShadowMaxBodySize is the maximum size in bytes of a request body that
+	// is buffered to be mirrored. If zero, a default of 1 MiB is used.
+	ShadowMaxBodySize int64 `long:"shadowmaxbodysize" description:"Maximum request body size in bytes to mirror to the shadow backend"`
+
+	// ServedByHeader is the name of an optional response header that is
+	// added to every response from this service to indicate which service
+	// handled the request, for example "X-Served-By". This is disabled by
+	// default to not leak any information about the internal topology.
+	ServedByHeader string `long:"servedbyheader" description:"Name of the response header that indicates which service handled the request"`
+
+	// ServedByLabel is the value of the ServedByHeader. If empty, the name
+	// of the service is used.
+	ServedByLabel string `long:"servedbylabel" description:"Value of the served-by header, defaults to the service name"`
+
+	// PreserveHeaderOrder forwards the request header fields to the
+	// backend in the order and casing the client sent them in, for
+	// backends that are sensitive to it. The request is then sent over a
+	// dedicated HTTP/1.1 connection. This only works for HTTP/1.x requests
+	// that aperture receives without TLS, for example behind a TLS
+	// terminating load balancer. Other requests are forwarded as usual.
+	PreserveHeaderOrder bool `long:"preserveheaderorder" description:"Forward request headers in their original order and casing"`
+
+	// DisableCors turns off the CORS headers for this service. OPTIONS
+	// requests to it are then forwarded to the backend, which is
+	// expected to handle CORS itself.
+	DisableCors bool `long:"disablecors" description:"Don't add CORS headers and forward OPTIONS requests to the backend"`
+
+	// DefaultResponseHeaders are header fields that are added to the
+	// responses of the backend only if the backend didn't set them
+	// itself, for example a default Cache-Control policy. Headers that
+	// aperture sets on its own, like the CORS and served-by headers, are
+	// set before the defaults and therefore take precedence over them.
+	DefaultResponseHeaders map[string]string `long:"defaultresponseheaders" description:"Header fields to add to responses if the backend didn't set them"`
+
+	// ResponseRewrite optionally replaces the absolute URLs of the backend
+	// in its responses with the scheme and host the client sent the
+	// request to. This is meant for backends that can't be configured to
+	// generate external URLs. The Location header and the bodies of the
+	// configured content types are rewritten. Bodies are buffered for
+	// that, so larger ones are passed on unchanged.
+	ResponseRewrite *ResponseRewriteConfig `long:"responserewrite" description:"Configuration of the rewriting of backend URLs in responses"`
+
+	// ComputedETags optionally makes aperture add an ETag computed from
+	// the body to cacheable responses to GET requests that the backend
+	// didn't add one to, and answer matching conditional requests with a
+	// 304 itself. Bodies are buffered for that, so larger ones are passed
+	// on without an ETag.
+	ComputedETags *ComputedETagConfig `long:"computedetags" description:"Configuration of the ETags computed for responses without one"`
+
+	// UsageReportURL is the optional URL of a billing endpoint that a
+	// report about each request proxied to the service is sent to once the
+	// request completed. The report is a JSON encoded UsageReport that
+	// contains the number of request and response body bytes that were
+	// transferred, which allows billing based on the actual usage.
+	UsageReportURL string `long:"usagereporturl" description:"URL of the endpoint to report the usage of each request to"`
+
+	// RateLimit is the maximum number of requests per second that are sent
+	// to the backend of the service, regardless of the client that sends
+	// them. This protects backends with a limited capacity or third-party
+	// APIs with a quota. A value of zero means no limit.
+	RateLimit float64 `long:"ratelimit" description:"Maximum number of requests per second sent to the backend, 0 for no limit"`
+
+	// RateLimitBurst is the number of requests that can be sent to the
+	// backend at once if no requests were sent for a while. If zero, the
+	// rate limit rounded up is used.
+	RateLimitBurst int `long:"ratelimitburst" description:"Maximum burst of requests sent to the backend"`
+
+	// RateLimitMaxWait is the maximum duration a request is queued if the
+	// rate limit of the backend is exhausted. Requests that would need to
+	// wait longer are rejected with status 429. A value of zero rejects
+	// them immediately.
+	RateLimitMaxWait time.Duration `long:"ratelimitmaxwait" description:"Maximum duration to queue a request if the backend rate limit is exhausted, 0 to reject immediately"`
+
+	// MaxConcurrentRequests is the maximum number of requests that are
+	// sent to the backend at the same time. Further requests are queued
+	// or rejected with status 503. A value of zero disables the limit.
+	MaxConcurrentRequests int `long:"maxconcurrentrequests" description:"Maximum number of concurrent requests sent to the backend"`
+
+	// ConcurrencyMaxWait is the maximum duration a request waits for a
+	// free slot if MaxConcurrentRequests is reached. A value of zero
+	// rejects such requests immediately.
+	ConcurrencyMaxWait time.Duration `long:"concurrencymaxwait" description:"Maximum duration to queue a request if the concurrency limit is reached, 0 to reject immediately"`
+
+	// ConcurrencyQueueSize is the maximum number of requests that wait
+	// for a free slot at the same time. Requests that don't fit into the
+	// queue are rejected immediately. Defaults to MaxConcurrentRequests.
+	ConcurrencyQueueSize int `long:"concurrencyqueuesize" description:"Maximum number of requests waiting for a free slot"`
+
+	// ConcurrencyFairness shares the slots of MaxConcurrentRequests
+	// fairly between clients, identified by their token or IP address,
+	// instead of granting them to queued requests in order of arrival. A
+	// freed slot always goes to the waiting client that holds the fewest
+	// slots, so a single client can't starve the others.
+	ConcurrencyFairness bool `long:"concurrencyfairness" description:"Share the concurrency limit fairly between clients"`
+
+	// MaxClientInFlight is the maximum number of requests a single client,
+	// identified by its verified token or IP address, can have in flight
+	// at the same time. Further requests of the client are rejected with
+	// status 429 until some of its requests completed. A value of zero
+	// disables the limit.
+	MaxClientInFlight int `long:"maxclientinflight" description:"Maximum number of requests a single client can have in flight"`
+
+	// InFlightMaxClients is the maximum number of clients whose in-flight
+	// requests are tracked at the same time. Requests of further clients
+	// aren't limited until tracked clients completed all their requests.
+	// Defaults to 10000.
+	InFlightMaxClients int `long:"inflightmaxclients" description:"Maximum number of clients whose in-flight requests are tracked"`
+
+	// IdempotencyWindow is the duration the responses to requests with an
+	// Idempotency-Key header are stored for. Retries of such a request by
+	// the same client within the window get the stored response without
+	// the request reaching the backend again. A value of zero disables
+	// the deduplication.
+	IdempotencyWindow time.Duration `long:"idempotencywindow" description:"Duration responses to requests with an Idempotency-Key header are stored for"`
+
+	// IdempotencyMethods is the list of methods of requests that are
+	// deduplicated. Defaults to POST and PATCH.
+	IdempotencyMethods []string `long:"idempotencymethods" description:"Methods of requests that are deduplicated by their Idempotency-Key header"`
+
+	// IdempotencyMaxEntries is the maximum number of responses that are
+	// stored. If exceeded, the oldest response is evicted. Defaults to
+	// 1000.
+	IdempotencyMaxEntries int `long:"idempotencymaxentries" description:"Maximum number of stored responses for idempotent requests"`
+
+	// IdempotencyMaxBody is the maximum size of a response body in bytes
+	// that is stored. Larger responses aren't deduplicated. Defaults to
+	// 1 MiB.
+	IdempotencyMaxBody int `long:"idempotencymaxbody" description:"Maximum size of a stored response body in bytes"`
+
+	// LogSampleRate is the rate at which successful requests to this
+	// service are written to the request log. A value of N means only every
+	// Nth request is logged. Requests that result in an error or a status
+	// code other than 2xx are always logged. A value of 0 or 1 logs every
+	// request.
+	LogSampleRate uint64 `long:"logsamplerate" description:"Only log every Nth successful request to this service"`
+
+	// ErrorPages optionally maps HTTP status codes like "402" or classes
+	// like "5xx" to the paths of HTML templates that are rendered for the
+	// error responses of this service to clients that accept HTML. The
+	// templates are rendered with an ErrorPageData.
+	ErrorPages map[string]string `long:"errorpages" description:"Paths of HTML templates for error responses by status code or class"`
+
+	// RedactHeaders is a list of request headers whose values are replaced
+	// by a placeholder wherever requests to this service are logged.
+	// Headers that carry credentials, like Authorization or Cookie, are
+	// always redacted.
+	RedactHeaders []string `long:"redactheaders" description:"Request headers whose values are never logged"`
+
+	freebieDb     freebie.DB
+	grpcStatusMap map[codes.Code]int
+	rateLimiter   *tokenBucket
+	concurrency   *concurrencyLimiter
+	fairness      *fairConcurrencyLimiter
+	idempotency   *idempotencyStore
+	challenges    *challengeStore
+	priceLocation *time.Location
+	requestSchema *jsonSchema
+
+	// clientInFlight limits the requests each client can have in flight.
+	clientInFlight *clientInFlightLimiter
+
+	// usageReports limits the number of usage reports that are being sent
+	// at the same time. Each report holds a slot while it's sent.
+	usageReports chan struct{}
+
+	// shadowRequests limits the number of requests that are being mirrored
+	// to the shadow backend at the same time.
+	shadowRequests chan struct{}
+
+	// backendProxyURL is the parsed URL of the backend proxy.
+	backendProxyURL *url.URL
+
+	// stats are the counters of the activity of the service.
+	stats serviceStats
+
+	// latencies are the requests of the current latency report interval.
+	latencies latencyWindow
+
+	// errorPages are the compiled error page templates by status code or
+	// class.
+	errorPages map[string]*template.Template
+
+	// requestCounter counts the successful requests to the service for log
+	// sampling. It must be accessed atomically.
+	requestCounter uint64
+
+	// addresses is the list of discovered backend addresses, if service
+	// discovery is used. nextAddress is used to distribute the requests
+	// among them and must be accessed atomically.
+	addresses   []string
+	nextAddress uint64
+
+	// unhealthy is the set of backend addresses that failed their last
+	// health check.
+	unhealthy map[string]struct{}
+
+	addressMtx sync.RWMutex
 }
 
 // AuthRequired determines the auth level required for a given request.
@@ -111,15 +730,417 @@ func (s *Service) AuthRequired(r *http.Request) auth.Level {
 	return s.Auth
 }
 
+// hasClientCert returns true if the client of the request presented a TLS
+// client certificate that was verified during the handshake.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// backendAddress returns the address a request to the service should be sent
+// to. If backend addresses were discovered, they are used in turn. Backends
+// that failed their health check are skipped unless none is healthy.
+func (s *Service) backendAddress() string {
+	s.addressMtx.RLock()
+	defer s.addressMtx.RUnlock()
+
+	addresses := s.addresses
+	if len(addresses) == 0 {
+		addresses = []string{s.Address}
+	}
+
+	healthy := addresses
+	if len(s.unhealthy) > 0 {
+		healthy = make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			if _, ok := s.unhealthy[address]; !ok {
+				healthy = append(healthy, address)
+			}
+		}
+		if len(healthy) == 0 {
+			healthy = addresses
+		}
+	}
+
+	if len(healthy) == 1 {
+		return healthy[0]
+	}
+	next := atomic.AddUint64(&s.nextAddress, 1)
+	return healthy[next%uint64(len(healthy))]
+}
+
+// backendAddresses returns all current backend addresses of the service.
+func (s *Service) backendAddresses() []string {
+	s.addressMtx.RLock()
+	defer s.addressMtx.RUnlock()
+
+	if len(s.addresses) == 0 {
+		return []string{s.Address}
+	}
+	return append([]string(nil), s.addresses...)
+}
+
+// available returns false if all backends of the service failed their health
+// check, in which case the service shouldn't be used to serve requests.
+func (s *Service) available() bool {
+	s.addressMtx.RLock()
+	defer s.addressMtx.RUnlock()
+
+	if len(s.unhealthy) == 0 {
+		return true
+	}
+
+	addresses := s.addresses
+	if len(addresses) == 0 {
+		addresses = []string{s.Address}
+	}
+	for _, address := range addresses {
+		if _, ok := s.unhealthy[address]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setHealth records the result of a health check of the given backend address.
+// True is returned if the health of the backend changed.
+func (s *Service) setHealth(address string, healthy bool) bool {
+	s.addressMtx.Lock()
+	defer s.addressMtx.Unlock()
+
+	_, wasUnhealthy := s.unhealthy[address]
+	switch {
+	case healthy && wasUnhealthy:
+		delete(s.unhealthy, address)
+		return true
+
+	case !healthy && !wasUnhealthy:
+		if s.unhealthy == nil {
+			s.unhealthy = make(map[string]struct{})
+		}
+		s.unhealthy[address] = struct{}{}
+		return true
+
+	default:
+		return false
+	}
+}
+
+// setAddresses replaces the discovered backend addresses of the service. An
+// empty list is ignored so the last known addresses are kept. True is returned
+// if the addresses changed.
+func (s *Service) setAddresses(addresses []string) bool {
+	if len(addresses) == 0 {
+		return false
+	}
+
+	s.addressMtx.Lock()
+	defer s.addressMtx.Unlock()
+
+	if strings.Join(s.addresses, ",") == strings.Join(addresses, ",") {
+		return false
+	}
+	s.addresses = append([]string(nil), addresses...)
+	return true
+}
+
+// addFreebieHeaders adds the headers that inform the client about the free
+// requests it has left, if configured.
+func (s *Service) addFreebieHeaders(header http.Header, left freebie.Count) {
+	if !s.FreebieHeaders {
+		return
+	}
+
+	limit := s.Auth.FreebieCount()
+	header.Set(hdrFreebieLimit, strconv.Itoa(int(limit)))
+	header.Set(hdrFreebieRemaining, strconv.Itoa(int(left)))
+}
+
+// addServedByHeader adds the header that indicates which service handled the
+// request to the response, if configured.
+func (s *Service) addServedByHeader(header http.Header) {
+	if s.ServedByHeader == "" {
+		return
+	}
+
+	label := s.ServedByLabel
+	if label == "" {
+		label = s.Name
+	}
+	header.Set(s.ServedByHeader, label)
+}
+
+// addDefaultResponseHeaders adds the default response headers of the service
+// that aren't present in the given header yet. Existing values are never
+// overwritten.
+func (s *Service) addDefaultResponseHeaders(header http.Header) {
+	for name, value := range s.DefaultResponseHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			continue
+		}
+		header.Set(name, value)
+	}
+}
+
+// sampleRequestLog returns true if the request that resulted in the given
+// response should be written to the request log.
+func (s *Service) sampleRequestLog(res *statusRecorder) bool {
+	if s.LogSampleRate <= 1 || res.isError() {
+		return true
+	}
+
+	count := atomic.AddUint64(&s.requestCounter, 1)
+	return count%s.LogSampleRate == 1
+}
+
+// newFreebieDB creates the freebie store for a service according to its
+// configured freebie strategy. The on-disk database is only needed for the
+// disk strategy.
+func newFreebieDB(service *Service,
+	diskDB *freebie.BoltDB) (freebie.DB, error) {
+
+	newIPStore := func() (freebie.DB, error) {
+		if service.FreebieMaxKeys < 0 {
+			return nil, fmt.Errorf("negative freebie max keys set "+
+				"for service %s", service.Name)
+		}
+		return freebie.NewBoundedMemIPMaskStore(
+			service.Auth.FreebieCount(), service.FreebieMaxKeys,
+			service.FreebieKeyTTL,
+		), nil
+	}
+
+	switch service.FreebieStrategy {
+	case "", freebieStrategyIP:
+		return newIPStore()
+
+	case freebieStrategyCookie:
+		key, err := hex.DecodeString(service.FreebieCookieKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid freebie cookie key for "+
+				"service %s: %v", service.Name, err)
+		}
+		// Clients without a cookie are counted by their IP address,
+		// otherwise they'd get new freebies by dropping the cookie.
+		fallback, err := newIPStore()
+		if err != nil {
+			return nil, err
+		}
+		db, err := freebie.NewCookieStore(
+			service.Auth.FreebieCount(),
+			freebieCookiePrefix+service.Name, key, fallback,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create freebie "+
+				"cookie store for service %s: %v",
+				service.Name, err)
+		}
+		return db, nil
+
+	case freebieStrategyDisk:
+		if diskDB == nil {
+			return nil, fmt.Errorf("freebie strategy of service "+
+				"%s requires the freebie DB to be configured",
+				service.Name)
+		}
+		db, err := diskDB.NewStore(
+			service.Name, service.Auth.FreebieCount(),
+			service.FreebieKeyTTL,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create freebie "+
+				"store for service %s: %v", service.Name, err)
+		}
+		return db, nil
+
+	default:
+		return nil, fmt.Errorf("unknown freebie strategy %s for "+
+			"service %s", service.FreebieStrategy, service.Name)
+	}
+}
+
 // prepareServices prepares the backend service configurations to be used by the
-// proxy.
-func prepareServices(services []*Service) error {
+// proxy. If strictPathRegexp is set, services without a path regular
+// expression are rejected instead of matching every path. The optional diskDB
+// is the on-disk database of services with the disk freebie strategy.
+func prepareServices(services []*Service, strictPathRegexp bool,
+	diskDB *freebie.BoltDB) error {
+
+	if err := checkFallbackServices(services); err != nil {
+		return err
+	}
+
 	for _, service := range services {
+		// An empty path expression matches every path of the host.
+		// Since that is easily misunderstood as matching nothing, it
+		// can be required to be explicit about it. The fallback service
+		// doesn't use its path expression.
+		if strictPathRegexp && service.PathRegexp == "" &&
+			!service.Fallback {
+
+			return fmt.Errorf("empty path regexp for service %s, "+
+				"use '.*' to match all paths", service.Name)
+		}
+
+		if err := service.validateAuthSettings(); err != nil {
+			return fmt.Errorf("invalid auth settings of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		if service.TLSPassthrough {
+			if service.HostRegexp == "" {
+				return fmt.Errorf("TLS passthrough service %s "+
+					"needs a host regexp", service.Name)
+			}
+			log.Warnf("Service %s uses TLS passthrough, its "+
+				"connections are not authenticated or paid",
+				service.Name)
+		}
+
+		if err := service.parseBackendProxy(); err != nil {
+			return fmt.Errorf("invalid backend proxy of service "+
+				"%s: %v", service.Name, err)
+		}
+
+		switch service.BackendAuth {
+		case "", backendAuthForward, backendAuthStrip,
+			backendAuthTokenID:
+
+		default:
+			return fmt.Errorf("unknown backend auth mode %s for "+
+				"service %s", service.BackendAuth, service.Name)
+		}
+
+		switch service.ForwardedHeaders {
+		case "", forwardedHeadersSet, forwardedHeadersPreserve:
+
+		default:
+			return fmt.Errorf("unknown forwarded headers mode %s "+
+				"for service %s", service.ForwardedHeaders,
+				service.Name)
+		}
+
+		if service.MaxRedirects < 0 {
+			return fmt.Errorf("negative max redirects set for "+
+				"service %s", service.Name)
+		}
+
+		if service.DisabledResponse != nil {
+			err := service.DisabledResponse.validate()
+			if err != nil {
+				return fmt.Errorf("invalid disabled response "+
+					"of service %s: %v", service.Name, err)
+			}
+		}
+
+		if service.RequestCompression != nil {
+			err := service.RequestCompression.validate()
+			if err != nil {
+				return fmt.Errorf("invalid request compression "+
+					"config for service %s: %v",
+					service.Name, err)
+			}
+		}
+
+		if err := service.validateTimeouts(); err != nil {
+			return fmt.Errorf("invalid timeouts of service %s: %v",
+				service.Name, err)
+		}
+
+		if err := service.validateContentTypes(); err != nil {
+			return fmt.Errorf("invalid allowed content or accept "+
+				"types of service %s: %v", service.Name, err)
+		}
+
+		if service.ResponseRewrite != nil {
+			err := service.ResponseRewrite.validate()
+			if err != nil {
+				return fmt.Errorf("invalid response rewrite "+
+					"config for service %s: %v",
+					service.Name, err)
+			}
+		}
+
+		if service.ComputedETags != nil {
+			err := service.ComputedETags.validate()
+			if err != nil {
+				return fmt.Errorf("invalid computed ETag "+
+					"config for service %s: %v",
+					service.Name, err)
+			}
+		}
+
+		if service.RequestSchema != nil {
+			if err := service.loadRequestSchema(); err != nil {
+				return fmt.Errorf("invalid request schema of "+
+					"service %s: %v", service.Name, err)
+			}
+		}
+
+		if err := service.validatePathCaptureHeaders(); err != nil {
+			return fmt.Errorf("invalid path capture headers of "+
+				"service %s: %v", service.Name, err)
+		}
+
+		if err := service.compileErrorPages(); err != nil {
+			return fmt.Errorf("invalid error pages of service %s: "+
+				"%v", service.Name, err)
+		}
+
+		if service.RequestSigning != nil {
+			err := service.RequestSigning.validate()
+			if err != nil {
+				return fmt.Errorf("invalid request signing "+
+					"config for service %s: %v",
+					service.Name, err)
+			}
+		}
+
+		if service.ResponseVerification != nil {
+			err := service.ResponseVerification.validate()
+			if err != nil {
+				return fmt.Errorf("invalid response "+
+					"verification config for service "+
+					"%s: %v", service.Name, err)
+			}
+		}
+
+		switch service.HealthCheckType {
+		case "", healthCheckHTTP, healthCheckGrpc:
+
+		default:
+			return fmt.Errorf("unknown health check type %s for "+
+				"service %s", service.HealthCheckType,
+				service.Name)
+		}
+
+		switch service.FreebieFailPolicy {
+		case "", freebieFailError, freebieFailOpen, freebieFailPayment:
+
+		default:
+			return fmt.Errorf("unknown freebie fail policy %s for "+
+				"service %s", service.FreebieFailPolicy,
+				service.Name)
+		}
+
 		// Each freebie enabled service gets its own store.
 		if service.Auth.IsFreebie() {
-			service.freebieDb = freebie.NewMemIPMaskStore(
-				service.Auth.FreebieCount(),
-			)
+			if err := service.validateFreebiePrefixes(); err != nil {
+				return fmt.Errorf("invalid freebie prefix of "+
+					"service %s: %v", service.Name, err)
+			}
+
+			freebieDb, err := newFreebieDB(service, diskDB)
+			if err != nil {
+				return err
+			}
+			service.freebieDb = freebieDb
+
+			_, ok := freebieDb.(freebie.RefundDB)
+			if service.FreebieRefundServerErrors && !ok {
+				return fmt.Errorf("freebie strategy of "+
+					"service %s doesn't support refunds",
+					service.Name)
+			}
 		}
 
 		// Replace placeholders/directives in the header fields with the
@@ -159,6 +1180,17 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
+		// The same goes for the host and path expressions, which are
+		// compiled again for every request that is matched.
+		if _, err := regexp.Compile(service.HostRegexp); err != nil {
+			return fmt.Errorf("invalid host regexp of service "+
+				"%s: %v", service.Name, err)
+		}
+		if _, err := regexp.Compile(service.PathRegexp); err != nil {
+			return fmt.Errorf("invalid path regexp of service "+
+				"%s: %v", service.Name, err)
+		}
+
 		// Make sure all whitelist regular expression entries actually
 		// compile so we run into an eventual panic during startup and
 		// not only when the request happens.
@@ -170,6 +1202,140 @@ func prepareServices(services []*Service) error {
 			}
 		}
 
+		if service.RateLimit < 0 || service.RateLimitBurst < 0 ||
+			service.RateLimitMaxWait < 0 {
+
+			return fmt.Errorf("rate limit settings of service %s "+
+				"cannot be negative", service.Name)
+		}
+
+		// The limiter is created even without a limit so one can be
+		// set while the service is running.
+		service.rateLimiter = newTokenBucket(
+			service.RateLimit, service.RateLimitBurst,
+			service.RateLimitMaxWait,
+		)
+
+		if service.MaxConcurrentRequests < 0 ||
+			service.ConcurrencyMaxWait < 0 ||
+			service.ConcurrencyQueueSize < 0 {
+
+			return fmt.Errorf("concurrency settings of service %s "+
+				"cannot be negative", service.Name)
+		}
+		if service.MaxConcurrentRequests > 0 {
+			queueSize := service.ConcurrencyQueueSize
+			if queueSize == 0 {
+				queueSize = service.MaxConcurrentRequests
+			}
+			if service.ConcurrencyFairness {
+				service.fairness = newFairConcurrencyLimiter(
+					service.MaxConcurrentRequests,
+					queueSize, service.ConcurrencyMaxWait,
+				)
+			} else {
+				service.concurrency = newConcurrencyLimiter(
+					service.MaxConcurrentRequests,
+					queueSize, service.ConcurrencyMaxWait,
+				)
+			}
+		}
+
+		if service.MaxClientInFlight < 0 ||
+			service.InFlightMaxClients < 0 {
+
+			return fmt.Errorf("in-flight limits of service %s "+
+				"cannot be negative", service.Name)
+		}
+		if service.MaxClientInFlight > 0 {
+			maxClients := service.InFlightMaxClients
+			if maxClients == 0 {
+				maxClients = defaultInFlightMaxClients
+			}
+			service.clientInFlight = newClientInFlightLimiter(
+				service.MaxClientInFlight, maxClients,
+			)
+		}
+
+		if service.IdempotencyWindow < 0 ||
+			service.IdempotencyMaxEntries < 0 ||
+			service.IdempotencyMaxBody < 0 {
+
+			return fmt.Errorf("idempotency settings of service %s "+
+				"cannot be negative", service.Name)
+		}
+		if service.IdempotencyWindow > 0 {
+			maxEntries := service.IdempotencyMaxEntries
+			if maxEntries == 0 {
+				maxEntries = defaultIdempotencyMaxEntries
+			}
+			service.idempotency = newIdempotencyStore(
+				service.IdempotencyWindow, maxEntries,
+			)
+		}
+
+		if service.ShadowMaxBodySize < 0 {
+			return fmt.Errorf("negative shadow max body size for "+
+				"service %s", service.Name)
+		}
+		if service.ShadowAddress != "" {
+			service.shadowRequests = make(
+				chan struct{}, maxPendingShadowRequests,
+			)
+		}
+
+		if service.UsageReportURL != "" {
+			service.usageReports = make(
+				chan struct{}, maxPendingUsageReports,
+			)
+		}
+
+		if service.Challenge != nil {
+			if err := service.Challenge.validate(); err != nil {
+				return fmt.Errorf("invalid challenge config "+
+					"for service %s: %v", service.Name, err)
+			}
+			if service.Challenge.ReuseWindow > 0 {
+				service.challenges = newChallengeStore(
+					service.Challenge.ReuseWindow,
+				)
+			}
+		}
+
+		if service.AccessSchedule != nil {
+			err := service.AccessSchedule.compile()
+			if err != nil {
+				return fmt.Errorf("invalid access schedule "+
+					"for service %s: %v", service.Name,
+					err)
+			}
+		}
+
+		if err := service.compilePriceSchedule(); err != nil {
+			return fmt.Errorf("invalid price schedule for service "+
+				"%s: %v", service.Name, err)
+		}
+
+		// Compile the path rewrite templates once so only the matching
+		// needs to be done for every request.
+		for _, rule := range service.PathRewrites {
+			if err := rule.compile(); err != nil {
+				return fmt.Errorf("invalid path rewrite for "+
+					"service %s: %v", service.Name, err)
+			}
+		}
+
+		// Parse the custom gRPC status mapping now so we don't have to
+		// do that for every response.
+		grpcStatusMap, err := parseGrpcStatusMapping(
+			service.GrpcStatusMapping,
+		)
+		if err != nil {
+			return fmt.Errorf("invalid gRPC status mapping for "+
+				"service %s: %v", service.Name, err)
+		}
+		service.grpcStatusMap = grpcStatusMap
+
 		// Check that the price for the service is not negative and not
 		// more than the maximum amount allowed by lnd. If no price, or
 		// a price of zero satoshis, is set the then default price of 1
@@ -186,6 +1352,11 @@ func prepareServices(services []*Service) error {
 			return fmt.Errorf("maximum price exceeded for "+
 				"service %s", service.Name)
 		}
+
+		if err := service.validateMethodPrices(); err != nil {
+			return fmt.Errorf("invalid method prices of service "+
+				"%s: %v", service.Name, err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultDisabledMessage is the default message of the response to
+	// requests for a disabled service.
+	defaultDisabledMessage = "service temporarily disabled"
+)
+
+// DisabledResponseConfig is the response requests for a disabled service are
+// answered with. It tells clients that the service exists but is turned off
+// for now, unlike the 404 for paths no service is configured for.
+type DisabledResponseConfig struct {
+	// Status is the HTTP status of the response. Defaults to 503.
+	Status int `long:"status" description:"Status of responses to requests for the disabled service, 503 if not set"`
+
+	// Message is the message of the response. Defaults to "service
+	// temporarily disabled".
+	Message string `long:"message" description:"Message of responses to requests for the disabled service"`
+
+	// RetryAfter is the duration after which clients should try again,
+	// sent in the Retry-After header. If zero, the header isn't sent.
+	RetryAfter time.Duration `long:"retryafter" description:"Duration after which clients should retry, sent in the Retry-After header"`
+}
+
+// validate makes sure the response is valid and sets its defaults.
+func (c *DisabledResponseConfig) validate() error {
+	switch {
+	case c.Status == 0:
+		c.Status = http.StatusServiceUnavailable
+
+	case c.Status < 400 || c.Status > 599:
+		return fmt.Errorf("invalid status %d, must be an error status",
+			c.Status)
+	}
+
+	if c.Message == "" {
+		c.Message = defaultDisabledMessage
+	}
+
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("negative retry after")
+	}
+
+	return nil
+}
+
+// checkDisabled returns true if the service is enabled. Otherwise the request
+// is answered with the disabled response of the service.
+func (p *Proxy) checkDisabled(w http.ResponseWriter, r *http.Request,
+	s *Service) bool {
+
+	if !s.Disabled {
+		return true
+	}
+
+	response := s.DisabledResponse
+	if response == nil {
+		response = &DisabledResponseConfig{
+			Status:  http.StatusServiceUnavailable,
+			Message: defaultDisabledMessage,
+		}
+	}
+
+	if response.RetryAfter > 0 {
+		seconds := math.Ceil(response.RetryAfter.Seconds())
+		w.Header().Set(
+			"Retry-After", strconv.FormatInt(int64(seconds), 10),
+		)
+	}
+
+	p.sendDirectResponse(w, r, response.Status, response.Message)
+	return false
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestDisabledService makes sure requests for a disabled service get its
+// disabled response until the service is enabled again.
+func TestDisabledService(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	newServices := func(disabled bool) []*Service {
+		return []*Service{{
+			Name:       "service",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			HostRegexp: ".*",
+			Protocol:   "http",
+			Auth:       "off",
+			Disabled:   disabled,
+			DisabledResponse: &DisabledResponseConfig{
+				RetryAfter: 90 * time.Second,
+			},
+		}}
+	}
+	p, err := New(
+		auth.NewMockAuthenticator(), newServices(true), false, "",
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "90" {
+		t.Fatalf("expected Retry-After 90, got %q", retryAfter)
+	}
+	if !strings.Contains(rec.Body.String(), defaultDisabledMessage) {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+
+	if err := p.UpdateServices(newServices(false)); err != nil {
+		t.Fatalf("unable to update services: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 once enabled, got %d", rec.Code)
+	}
+
+	invalid := &DisabledResponseConfig{Status: 200}
+	if err := invalid.validate(); err == nil {
+		t.Fatalf("expected non-error status to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"sync/atomic"
+)
+
+// inheritServiceState hands the runtime state of the running services over to
+// the new services with the same name, so that reloading the services doesn't
+// reset the freebies, limits, pending challenges and stats of a service that
+// is still configured. State that depends on a setting that changed is not
+// inherited and starts fresh.
+func inheritServiceState(running, services []*Service) {
+	byName := make(map[string]*Service, len(running))
+	for _, service := range running {
+		byName[service.Name] = service
+	}
+
+	for _, service := range services {
+		old, ok := byName[service.Name]
+		if !ok {
+			continue
+		}
+		service.inheritState(old)
+	}
+}
+
+// inheritState takes over the runtime state of the old instance of the
+// service.
+func (s *Service) inheritState(old *Service) {
+	// The token bucket is updated in place, so its tokens carry over to
+	// the new limits just like with a rate limit reload.
+	if old.rateLimiter != nil && s.rateLimiter != nil {
+		old.rateLimiter.update(
+			s.RateLimit, s.RateLimitBurst, s.RateLimitMaxWait,
+		)
+		s.rateLimiter = old.rateLimiter
+	}
+
+	// Requests in flight release their slots to the limiters they were
+	// admitted by, so those must stay the same for the limits to hold.
+	if s.MaxConcurrentRequests == old.MaxConcurrentRequests &&
+		s.ConcurrencyQueueSize == old.ConcurrencyQueueSize &&
+		s.ConcurrencyMaxWait == old.ConcurrencyMaxWait &&
+		s.ConcurrencyFairness == old.ConcurrencyFairness {
+
+		s.concurrency = old.concurrency
+		s.fairness = old.fairness
+	}
+	if s.MaxClientInFlight == old.MaxClientInFlight &&
+		s.InFlightMaxClients == old.InFlightMaxClients {
+
+		s.clientInFlight = old.clientInFlight
+	}
+
+	if s.freebieDb != nil && old.freebieDb != nil &&
+		s.Auth.FreebieCount() == old.Auth.FreebieCount() &&
+		s.FreebieStrategy == old.FreebieStrategy &&
+		s.FreebieMaxKeys == old.FreebieMaxKeys &&
+		s.FreebieKeyTTL == old.FreebieKeyTTL &&
+		s.FreebieCookieKey == old.FreebieCookieKey {
+
+		s.freebieDb = old.freebieDb
+	}
+
+	if s.idempotency != nil && old.idempotency != nil &&
+		s.IdempotencyWindow == old.IdempotencyWindow &&
+		s.IdempotencyMaxEntries == old.IdempotencyMaxEntries {
+
+		s.idempotency = old.idempotency
+	}
+
+	if s.challenges != nil && old.challenges != nil &&
+		s.challenges.window == old.challenges.window {
+
+		s.challenges = old.challenges
+	}
+
+	// The reports and mirrored requests that are still being sent hold
+	// their slots in the old limits.
+	if s.usageReports != nil && old.usageReports != nil {
+		s.usageReports = old.usageReports
+	}
+	if s.shadowRequests != nil && old.shadowRequests != nil {
+		s.shadowRequests = old.shadowRequests
+	}
+
+	// The requests in flight are still counted by the old instance when
+	// they complete, so only the completed ones are taken over.
+	stats, oldStats := &s.stats, &old.stats
+	for _, counter := range []struct {
+		new, old *uint64
+	}{
+		{&stats.total, &oldStats.total},
+		{&stats.paid, &oldStats.paid},
+		{&stats.freebie, &oldStats.freebie},
+		{&stats.rejected, &oldStats.rejected},
+		{&stats.observed, &oldStats.observed},
+		{&stats.latencyNanos, &oldStats.latencyNanos},
+		{&s.requestCounter, &old.requestCounter},
+	} {
+		atomic.StoreUint64(counter.new, atomic.LoadUint64(counter.old))
+	}
+
+	// Discovered addresses stay valid as long as they are discovered the
+	// same way, and so does the health of the backends.
+	old.addressMtx.RLock()
+	defer old.addressMtx.RUnlock()
+
+	if s.DiscoverySRV != "" && s.DiscoverySRV == old.DiscoverySRV {
+		s.setAddresses(old.addresses)
+	}
+	if s.healthChecked() && len(old.unhealthy) > 0 {
+		s.addressMtx.Lock()
+		s.unhealthy = make(map[string]struct{}, len(old.unhealthy))
+		for address := range old.unhealthy {
+			s.unhealthy[address] = struct{}{}
+		}
+		s.addressMtx.Unlock()
+	}
+}
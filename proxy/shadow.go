@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultShadowTimeout is the default maximum duration of a request
+	// that is mirrored to a shadow backend.
+	defaultShadowTimeout = 10 * time.Second
+
+	// defaultShadowMaxBodySize is the default maximum size of a request
+	// body that is buffered to be mirrored to a shadow backend.
+	defaultShadowMaxBodySize = 1024 * 1024
+
+	// maxPendingShadowRequests is the maximum number of requests of a
+	// service that are mirrored to its shadow backend at the same time.
+	// Further requests aren't mirrored until one of them completes, so a
+	// slow shadow backend can't pile up an unlimited number of goroutines.
+	maxPendingShadowRequests = 100
+)
+
+var (
+	// hopHeaders are the hop-by-hop header fields that are only meant for
+	// the connection to aperture. The reverse proxy removes them from the
+	// requests to the backends, so we do the same for the shadow backend.
+	hopHeaders = []string{
+		"Connection", "Proxy-Connection", "Keep-Alive",
+		"Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+		"Transfer-Encoding", "Upgrade",
+	}
+)
+
+// shadowBody buffers the body of a request so it can be mirrored to the shadow
+// backend of the service. The request body is replaced so it can still be read
+// in full when forwarding the request to the actual backend. Only requests with
+// a known body size that doesn't exceed the configured limit are mirrored so we
+// never have to wait for a streaming client. If the request should not be
+// mirrored, false is returned.
+func (s *Service) shadowBody(r *http.Request) ([]byte, bool) {
+	maxSize := s.ShadowMaxBodySize
+	if maxSize == 0 {
+		maxSize = defaultShadowMaxBodySize
+	}
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxSize {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+
+	// Whatever we managed to read, the backend still needs to get the
+	// full body.
+	r.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		Closer: r.Body,
+	}
+	if err != nil {
+		log.Debugf("Unable to buffer request body for shadow backend "+
+			"of service %s: %v", s.Name, err)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// readCloser combines a reader with the closer of another reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// detachedContext is a context that carries the values of its parent but is
+// neither canceled nor has a deadline when the parent does.
+type detachedContext struct {
+	parent context.Context
+}
+
+// Deadline returns no deadline.
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Done returns nil since the context is never canceled.
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+// Err always returns nil since the context is never canceled.
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Value returns the value of the parent context for the key.
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// mirrorRequest sends a copy of the request to the shadow backend of the
+// service in a separate goroutine. The copy is prepared exactly like the
+// request to the actual backend, so the shadow backend never receives any
+// header field the actual backend wouldn't. The response of the shadow backend
+// is discarded and errors are only logged, they never affect the client. If
+// too many requests are being mirrored already, the request isn't mirrored.
+func (p *Proxy) mirrorRequest(s *Service, r *http.Request, body []byte) {
+	select {
+	case s.shadowRequests <- struct{}{}:
+	default:
+		log.Debugf("Too many pending shadow requests of service %s, "+
+			"not mirroring request", s.Name)
+		return
+	}
+
+	timeout := s.ShadowTimeout
+	if timeout == 0 {
+		timeout = defaultShadowTimeout
+	}
+	protocol := s.ShadowProtocol
+	if protocol == "" {
+		protocol = s.Protocol
+	}
+
+	// The shadow request must not be bound to the lifetime of the client
+	// request, but it needs the values of its context to be prepared like
+	// the client request.
+	ctx, cancel := context.WithTimeout(
+		detachedContext{parent: r.Context()}, timeout,
+	)
+	shadowReq := r.Clone(ctx)
+	shadowReq.RequestURI = ""
+	shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	shadowReq.ContentLength = int64(len(body))
+	shadowReq.GetBody = nil
+	removeHopHeaders(shadowReq.Header)
+	p.prepareBackendRequest(s, shadowReq, s.ShadowAddress, protocol)
+
+	transport := p.backendTransport()
+	go func() {
+		defer func() { <-s.shadowRequests }()
+		defer cancel()
+
+		resp, err := transport.RoundTrip(shadowReq)
+		if err != nil {
+			log.Errorf("Error mirroring request to shadow backend "+
+				"%s of service %s: %v", s.ShadowAddress, s.Name,
+				err)
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		log.Debugf("Shadow backend %s of service %s responded with "+
+			"status %d.", s.ShadowAddress, s.Name, resp.StatusCode)
+	}()
+}
+
+// removeHopHeaders removes the hop-by-hop header fields from the header,
+// including the ones named in its Connection field.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
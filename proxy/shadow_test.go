@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMirrorRequest makes sure a request is mirrored to the shadow backend
+// while its body can still be read in full for the actual backend, and that
+// it's prepared like the request to the actual backend.
+func TestMirrorRequest(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The shadow backend gets the same header fields
+			// as the actual backend, so the stripped tokens
+			// must not reach it.
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- r.URL.Path + " " + string(body) +
+				r.Header.Get("Authorization") +
+				r.Header.Get("Proxy-Authorization")
+		},
+	))
+	defer shadow.Close()
+
+	p := &Proxy{transport: http.DefaultTransport}
+	service := &Service{
+		Name:           "test",
+		Protocol:       "http",
+		ShadowAddress:  strings.TrimPrefix(shadow.URL, "http://"),
+		BackendAuth:    backendAuthStrip,
+		shadowRequests: make(chan struct{}, 1),
+	}
+
+	req := httptest.NewRequest("POST", "/foo", strings.NewReader("bar"))
+	req.Header.Set("Authorization", "LSAT secret")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	body, ok := service.shadowBody(req)
+	if !ok {
+		t.Fatalf("expected request to be mirrored")
+	}
+	p.mirrorRequest(service, req, body)
+
+	select {
+	case msg := <-received:
+		if msg != "/foo bar" {
+			t.Fatalf("unexpected shadow request: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("shadow request not received")
+	}
+
+	// The body must still be readable for the actual backend.
+	fullBody, _ := ioutil.ReadAll(req.Body)
+	if string(fullBody) != "bar" {
+		t.Fatalf("unexpected body: %s", fullBody)
+	}
+
+	// Bodies exceeding the limit are not mirrored.
+	service.ShadowMaxBodySize = 2
+	req = httptest.NewRequest("POST", "/foo", strings.NewReader("bar"))
+	if _, ok := service.shadowBody(req); ok {
+		t.Fatalf("expected large request not to be mirrored")
+	}
+}
+
+// TestMirrorRequestLimit makes sure requests aren't mirrored if too many of
+// them are pending already.
+func TestMirrorRequestLimit(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan struct{}, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received <- struct{}{}
+		},
+	))
+	defer shadow.Close()
+
+	p := &Proxy{transport: http.DefaultTransport}
+	service := &Service{
+		Name:           "test",
+		Protocol:       "http",
+		ShadowAddress:  strings.TrimPrefix(shadow.URL, "http://"),
+		shadowRequests: make(chan struct{}, 1),
+	}
+
+	service.shadowRequests <- struct{}{}
+	p.mirrorRequest(service, httptest.NewRequest("GET", "/", nil), nil)
+
+	select {
+	case <-received:
+		t.Fatalf("request mirrored despite the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
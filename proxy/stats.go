@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultStatsPath is the default path the proxy serves the usage
+	// stats of all services on.
+	DefaultStatsPath = "/aperture/stats"
+
+	// bearerPrefix is the prefix of a bearer token in the Authorization
+	// header.
+	bearerPrefix = "Bearer "
+)
+
+// serviceStats are the counters of the activity of a service since it was
+// loaded. All fields must be accessed atomically.
+type serviceStats struct {
+	total        uint64
+	paid         uint64
+	freebie      uint64
+	rejected     uint64
+	observed     uint64
+	latencyNanos uint64
+	inFlight     int64
+
+	// certExpiry is the Unix time the first backend TLS certificate of
+	// the service expires at, zero if it isn't known.
+	certExpiry int64
+}
+
+// begin records the start of a request.
+func (s *serviceStats) begin() {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+// end records a completed request. A request counts as rejected if aperture
+// answered it with an error itself instead of forwarding it to the backend.
+func (s *serviceStats) end(latency time.Duration, status int,
+	forwarded bool) {
+
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddUint64(&s.total, 1)
+	atomic.AddUint64(&s.latencyNanos, uint64(latency))
+	if !forwarded && status >= http.StatusBadRequest {
+		atomic.AddUint64(&s.rejected, 1)
+	}
+}
+
+// ServiceStats is a snapshot of the activity of a service since it was loaded.
+type ServiceStats struct {
+	// Service is the name of the service.
+	Service string `json:"service"`
+
+	// TotalRequests is the number of completed requests.
+	TotalRequests uint64 `json:"total_requests"`
+
+	// PaidRequests is the number of requests with a valid, paid token.
+	PaidRequests uint64 `json:"paid_requests"`
+
+	// FreebieRequests is the number of requests served for free.
+	FreebieRequests uint64 `json:"freebie_requests"`
+
+	// RejectedRequests is the number of requests aperture answered with
+	// an error itself, for example because payment was required or a
+	// limit was reached.
+	RejectedRequests uint64 `json:"rejected_requests"`
+
+	// ObservedRejections is the number of requests that would have been
+	// rejected with status 402 but were served because the auth policy of
+	// the service is in observe-only mode.
+	ObservedRejections uint64 `json:"observed_rejections"`
+
+	// AvgLatencyMs is the average duration of the completed requests in
+	// milliseconds.
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	// InFlightRequests is the number of requests currently in progress.
+	InFlightRequests int64 `json:"in_flight_requests"`
+
+	// CertExpiry is the Unix time the backend TLS certificate of the
+	// service that expires first expires at. It is only set for services
+	// with a TLS certificate if its expiry is monitored.
+	CertExpiry int64 `json:"cert_expiry,omitempty"`
+}
+
+// Stats returns a snapshot of the activity of all services.
+func (p *Proxy) Stats() []ServiceStats {
+	services := p.currentServices()
+	stats := make([]ServiceStats, 0, len(services))
+	for _, service := range services {
+		s := &service.stats
+		snapshot := ServiceStats{
+			Service:            service.Name,
+			TotalRequests:      atomic.LoadUint64(&s.total),
+			PaidRequests:       atomic.LoadUint64(&s.paid),
+			FreebieRequests:    atomic.LoadUint64(&s.freebie),
+			RejectedRequests:   atomic.LoadUint64(&s.rejected),
+			ObservedRejections: atomic.LoadUint64(&s.observed),
+			InFlightRequests:   atomic.LoadInt64(&s.inFlight),
+			CertExpiry:         atomic.LoadInt64(&s.certExpiry),
+		}
+		if snapshot.TotalRequests > 0 {
+			latency := atomic.LoadUint64(&s.latencyNanos)
+			snapshot.AvgLatencyMs = float64(latency) /
+				float64(snapshot.TotalRequests) /
+				float64(time.Millisecond)
+		}
+		stats = append(stats, snapshot)
+	}
+	return stats
+}
+
+// WithStats makes the proxy serve the usage stats of all services as JSON on
+// the given path. Requests must present the given token as bearer token in
+// the Authorization header. If the path is empty, the default path is used.
+func WithStats(path, token string) Option {
+	return func(p *Proxy) error {
+		if token == "" {
+			return fmt.Errorf("stats endpoint needs a token")
+		}
+		if path == "" {
+			path = DefaultStatsPath
+		}
+		p.statsPath = path
+		p.statsToken = token
+		return nil
+	}
+}
+
+// isStatsRequest returns true if the request is for the stats endpoint.
+func (p *Proxy) isStatsRequest(r *http.Request) bool {
+	return p.statsToken != "" && r.URL.Path == p.statsPath
+}
+
+// serveStats answers a request for the stats endpoint if it presents the
+// correct token.
+func (p *Proxy) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !p.checkBearerToken(w, r, p.statsToken, "stats") {
+		return
+	}
+
+	w.Header().Set(hdrContentType, "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(p.Stats()); err != nil {
+		log.Errorf("Unable to send stats: %v", err)
+	}
+}
+
+// checkBearerToken returns true if the request presents the given token as
+// bearer token. Otherwise the request is answered with status 401 and false is
+// returned. The name of the endpoint is used in the error message.
+func (p *Proxy) checkBearerToken(w http.ResponseWriter, r *http.Request,
+	expected, name string) bool {
+
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, bearerPrefix)
+	valid := strings.HasPrefix(auth, bearerPrefix) &&
+		subtle.ConstantTimeCompare([]byte(token),
+			[]byte(expected)) == 1
+	if !valid {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		p.sendDirectResponse(
+			w, r, http.StatusUnauthorized,
+			fmt.Sprintf("invalid %s token", name),
+		)
+	}
+	return valid
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestStats makes sure requests are counted per service and the stats are only
+// served to clients with the token.
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "free",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		PathRegexp: "^/free",
+		Protocol:   "http",
+		Auth:       auth.LevelOff,
+	}, {
+		Name:       "paid",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		PathRegexp: "^/paid",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, false, "",
+		WithStats("", "secret"),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	for _, path := range []string{"/free", "/free", "/paid"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	}
+
+	req := httptest.NewRequest("GET", DefaultStatsPath, nil)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without token, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", DefaultStatsPath, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 with token, got %d", rec.Code)
+	}
+
+	var stats []ServiceStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("unable to decode stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of 2 services, got %d", len(stats))
+	}
+	if stats[0].TotalRequests != 2 || stats[0].RejectedRequests != 0 {
+		t.Fatalf("unexpected stats of free service: %+v", stats[0])
+	}
+	if stats[1].TotalRequests != 1 || stats[1].RejectedRequests != 1 ||
+		stats[1].InFlightRequests != 0 {
+
+		t.Fatalf("unexpected stats of paid service: %+v", stats[1])
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// validateTimeouts makes sure the timeouts of the service aren't negative and
+// brings the method names of the method specific timeouts into upper case.
+func (s *Service) validateTimeouts() error {
+	if s.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+
+	methodTimeouts := make(map[string]time.Duration, len(s.MethodTimeouts))
+	for method, timeout := range s.MethodTimeouts {
+		if method == "" {
+			return fmt.Errorf("method timeout needs a method")
+		}
+		if timeout < 0 {
+			return fmt.Errorf("timeout of method %s cannot be "+
+				"negative", method)
+		}
+		methodTimeouts[strings.ToUpper(method)] = timeout
+	}
+	s.MethodTimeouts = methodTimeouts
+
+	return nil
+}
+
+// requestTimeout returns the maximum duration of a backend request with the
+// given method. Methods without a timeout of their own use the default timeout
+// of the service. Zero means the request isn't limited.
+func (s *Service) requestTimeout(method string) time.Duration {
+	if timeout, ok := s.MethodTimeouts[method]; ok {
+		return timeout
+	}
+
+	return s.Timeout
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestMethodTimeouts makes sure backend requests are limited by the timeout
+// of their method or the default timeout of the service.
+func TestMethodTimeouts(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "slow",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "off",
+		Timeout:    50 * time.Millisecond,
+		MethodTimeouts: map[string]time.Duration{
+			"post": 5 * time.Second,
+		},
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504 for GET, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for POST, got %d", rec.Code)
+	}
+
+	s := &Service{MethodTimeouts: map[string]time.Duration{"GET": -1}}
+	if err := s.validateTimeouts(); err == nil {
+		t.Fatalf("expected negative method timeout to be rejected")
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// tokenCoversPrice returns true if the price caveats of the accepted token in
+// the given header allow requests of the given price. Tokens that were minted
+// without a price caveat are valid for any price, and so are all tokens of
+// services whose price doesn't vary, so a change of their price doesn't
+// invalidate the tokens that are already paid for.
+func (s *Service) tokenCoversPrice(header *http.Header, price int64) bool {
+	if !s.hasVaryingPrice() {
+		return true
+	}
+
+	mac, _, err := lsat.FromHeader(header)
+	if err != nil {
+		// The authenticator accepted the token, so it isn't one we
+		// minted a price caveat into.
+		return true
+	}
+
+	err = lsat.VerifyCaveats(
+		lsat.DecodeCaveats(mac), lsat.NewPriceSatisfier(s.Name, price),
+	)
+	if err != nil {
+		log.Debugf("Deny: Token doesn't cover the price of service "+
+			"%s: %v", s.Name, err)
+		return false
+	}
+	return true
+}
+
+// hasVaryingPrice returns true if the price of the service depends on the
+// method or time of a request, which is when its tokens are bound to the price
+// they were bought for.
+func (s *Service) hasVaryingPrice() bool {
+	return len(s.MethodPrices) > 0 || len(s.PriceSchedule) > 0
+}
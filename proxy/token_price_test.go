@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+	"github.com/lightningnetwork/lnd/lntypes"
+	"gopkg.in/macaroon.v2"
+)
+
+// TestTokenCoversPrice makes sure a token is only valid for requests that don't
+// cost more than the price it was paid for, so a token bought for a cheap
+// method or time window can't be used for an expensive one.
+func TestTokenCoversPrice(t *testing.T) {
+	t.Parallel()
+
+	service := &Service{
+		Name:         "service",
+		Price:        10,
+		MethodPrices: map[string]int64{"POST": 100},
+	}
+	newHeader := func(caveats ...lsat.Caveat) *http.Header {
+		t.Helper()
+
+		mac, err := macaroon.New(
+			[]byte("key"), []byte("id"), "loc",
+			macaroon.LatestVersion,
+		)
+		if err != nil {
+			t.Fatalf("unable to create macaroon: %v", err)
+		}
+		err = lsat.AddFirstPartyCaveats(mac, caveats...)
+		if err != nil {
+			t.Fatalf("unable to add caveats: %v", err)
+		}
+
+		header := &http.Header{}
+		err = lsat.SetHeader(header, mac, lntypes.Preimage{})
+		if err != nil {
+			t.Fatalf("unable to set header: %v", err)
+		}
+		return header
+	}
+
+	cheap := newHeader(lsat.NewPriceCaveat("service", 10))
+	if !service.tokenCoversPrice(cheap, 10) {
+		t.Fatalf("expected token to cover its own price")
+	}
+	if service.tokenCoversPrice(cheap, 100) {
+		t.Fatalf("expected token to not cover a higher price")
+	}
+
+	// Raising the price of a token by adding a caveat doesn't work.
+	raised := newHeader(
+		lsat.NewPriceCaveat("service", 10),
+		lsat.NewPriceCaveat("service", 100),
+	)
+	if service.tokenCoversPrice(raised, 100) {
+		t.Fatalf("expected raised price to be rejected")
+	}
+
+	// A token bought off-peak isn't valid at the peak price.
+	scheduled := &Service{
+		Name:  "service",
+		Price: 1,
+		PriceSchedule: []*PriceRule{{
+			Start: "09:00",
+			End:   "17:00",
+			Price: 5,
+		}},
+	}
+	if err := scheduled.compilePriceSchedule(); err != nil {
+		t.Fatalf("unable to compile price schedule: %v", err)
+	}
+	night := time.Date(2020, 3, 6, 3, 0, 0, 0, time.UTC)
+	noon := time.Date(2020, 3, 6, 12, 0, 0, 0, time.UTC)
+	offPeak := newHeader(lsat.NewPriceCaveat(
+		"service", scheduled.currentPrice("GET", night),
+	))
+	if scheduled.tokenCoversPrice(
+		offPeak, scheduled.currentPrice("GET", noon),
+	) {
+
+		t.Fatalf("expected off-peak token to be rejected at peak")
+	}
+
+	// Tokens minted without a price are valid for any price.
+	if !service.tokenCoversPrice(newHeader(), 100) {
+		t.Fatalf("expected token without price to be accepted")
+	}
+
+	// The tokens of a service with a single price aren't bound to it, so
+	// raising the price doesn't invalidate them.
+	single := &Service{Name: "service", Price: 100}
+	if !single.tokenCoversPrice(cheap, 100) {
+		t.Fatalf("expected token of single price service to be " +
+			"accepted")
+	}
+	if len(single.challengeParams(100).Caveats) != 0 {
+		t.Fatalf("expected no price caveat for single price service")
+	}
+	if len(service.challengeParams(100).Caveats) != 1 {
+		t.Fatalf("expected price caveat for service with method " +
+			"prices")
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestUpdateServicesAtomic makes sure services are only replaced if the whole
+// new configuration is valid, and the running ones are kept otherwise.
+func TestUpdateServicesAtomic(t *testing.T) {
+	t.Parallel()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(name))
+			},
+		))
+	}
+	first, second := newBackend("first"), newBackend("second")
+	defer first.Close()
+	defer second.Close()
+
+	newService := func(backend *httptest.Server) *Service {
+		return &Service{
+			Name:       "service",
+			Address:    strings.TrimPrefix(backend.URL, "http://"),
+			HostRegexp: ".*",
+			Protocol:   "http",
+			Auth:       "off",
+		}
+	}
+	p, err := New(
+		auth.NewMockAuthenticator(), []*Service{newService(first)},
+		false, "",
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	expectBackend := func(name string) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != name {
+			t.Fatalf("expected response of backend %s, got %q",
+				name, rec.Body.String())
+		}
+	}
+	expectBackend("first")
+
+	// The second service is broken, so the valid first one must not be
+	// applied either.
+	broken := newService(second)
+	broken.Name = "broken"
+	broken.PathRegexp = "("
+	err = p.UpdateServices([]*Service{newService(second), broken})
+	if err == nil {
+		t.Fatalf("expected broken services to be rejected")
+	}
+	if len(p.currentServices()) != 1 {
+		t.Fatalf("expected running services to be kept")
+	}
+	expectBackend("first")
+
+	err = p.UpdateServices([]*Service{newService(second)})
+	if err != nil {
+		t.Fatalf("unable to update services: %v", err)
+	}
+	expectBackend("second")
+}
+
+// TestUpdateServicesKeepsState makes sure a service that is still configured
+// after an update keeps its runtime state, unless the setting it depends on
+// changed.
+func TestUpdateServicesKeepsState(t *testing.T) {
+	t.Parallel()
+
+	newService := func() *Service {
+		return &Service{
+			Name:              "service",
+			Address:           "127.0.0.1:1",
+			HostRegexp:        ".*",
+			Protocol:          "http",
+			Auth:              "freebie 1",
+			RateLimit:         1,
+			IdempotencyWindow: time.Minute,
+			DiscoverySRV:      "_test._tcp.example.com",
+		}
+	}
+	running := newService()
+	p, err := New(
+		auth.NewMockAuthenticator(), []*Service{running}, false, "",
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	running.setAddresses([]string{"127.0.0.1:2"})
+	running.stats.end(time.Millisecond, http.StatusOK, true)
+
+	ip := net.ParseIP("127.0.0.1")
+	if _, err := running.freebieDb.TallyFreebie(nil, ip); err != nil {
+		t.Fatalf("unable to tally freebie: %v", err)
+	}
+
+	reloaded := newService()
+	reloaded.RateLimit = 2
+	reloaded.IdempotencyWindow = 2 * time.Minute
+	if err := p.UpdateServices([]*Service{reloaded}); err != nil {
+		t.Fatalf("unable to update services: %v", err)
+	}
+
+	ok, err := reloaded.freebieDb.CanPass(nil, ip)
+	if err != nil {
+		t.Fatalf("unable to check freebie: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected used freebie to be kept")
+	}
+	if reloaded.rateLimiter != running.rateLimiter ||
+		reloaded.rateLimiter.rate != 2 {
+
+		t.Fatalf("expected rate limiter to be updated in place")
+	}
+	if reloaded.idempotency == running.idempotency {
+		t.Fatalf("expected changed idempotency store to start fresh")
+	}
+	if reloaded.backendAddress() != "127.0.0.1:2" {
+		t.Fatalf("expected discovered address to be kept")
+	}
+	if stats := p.Stats(); stats[0].TotalRequests != 1 {
+		t.Fatalf("expected stats to be kept, got %+v", stats[0])
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+const (
+	// usageReportTimeout is the maximum duration of a request that reports
+	// the usage of a service to its billing endpoint.
+	usageReportTimeout = 10 * time.Second
+
+	// maxPendingUsageReports is the maximum number of usage reports of a
+	// service that are sent at the same time. Further reports are dropped
+	// until one of them completes, so a slow endpoint can't pile up an
+	// unlimited number of goroutines.
+	maxPendingUsageReports = 100
+)
+
+// UsageReport is the report about a single request that is sent to the usage
+// report endpoint of a service once the request completed. It allows the
+// endpoint to bill clients based on the data they actually transferred.
+type UsageReport struct {
+	// Service is the name of the service that handled the request.
+	Service string `json:"service"`
+
+	// TokenID is the hex encoded ID of the LSAT the request was made
+	// with. It is empty for requests without an LSAT, for example
+	// freebies.
+	TokenID string `json:"token_id,omitempty"`
+
+	// Account is the billing account the token was issued to, if requests
+	// are tagged with accounts.
+	Account string `json:"account,omitempty"`
+
+	// Method is the HTTP method of the request.
+	Method string `json:"method"`
+
+	// Path is the path of the request.
+	Path string `json:"path"`
+
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+
+	// RequestBytes is the number of bytes of the request body that were
+	// sent to the backend.
+	RequestBytes int64 `json:"request_bytes"`
+
+	// ResponseBytes is the number of bytes of the response body that were
+	// sent to the client.
+	ResponseBytes int64 `json:"response_bytes"`
+}
+
+// countingReader is a request body that counts the bytes read from it.
+type countingReader struct {
+	io.ReadCloser
+
+	// n is the number of bytes read. It must be accessed atomically.
+	n int64
+}
+
+// Read reads from the wrapped body and counts the bytes read.
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns the number of bytes read so far.
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// countRequestBody wraps the body of the request so the bytes sent to the
+// backend can be reported. Nil is returned if the service doesn't report its
+// usage.
+func (s *Service) countRequestBody(r *http.Request) *countingReader {
+	if s.UsageReportURL == "" || r.Body == nil {
+		return nil
+	}
+
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	return body
+}
+
+// reportUsage sends a report about the completed request to the usage report
+// endpoint of the service in a separate goroutine. Errors are only logged,
+// they never affect the client. The token ID is only reported if the token was
+// verified, anyone can put an arbitrary ID into an invalid one.
+func (s *Service) reportUsage(r *http.Request, authenticated bool,
+	body *countingReader, recorder *statusRecorder) {
+
+	if s.UsageReportURL == "" {
+		return
+	}
+
+	report := &UsageReport{
+		Service:       s.Name,
+		Account:       requestAccount(r),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Status:        recorder.Status(),
+		ResponseBytes: recorder.written,
+	}
+	if authenticated {
+		report.TokenID = tokenIDFromHeader(&r.Header)
+	}
+	if body != nil {
+		report.RequestBytes = body.count()
+	}
+
+	select {
+	case s.usageReports <- struct{}{}:
+	default:
+		log.Warnf("Too many pending usage reports of service %s, "+
+			"dropping report", s.Name)
+		return
+	}
+
+	go func() {
+		defer func() { <-s.usageReports }()
+
+		err := postJSON(s.UsageReportURL, report, usageReportTimeout)
+		if err != nil {
+			log.Errorf("Unable to report usage of service %s: %v",
+				s.Name, err)
+		}
+	}()
+}
+
+// postJSON sends the given value as JSON to the given URL and makes sure the
+// endpoint accepted it.
+func postJSON(url string, value interface{}, timeout time.Duration) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(hdrContentType, "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// tokenIDFromHeader returns the hex encoded ID of the LSAT in the given header
+// or an empty string if there is none.
+func tokenIDFromHeader(header *http.Header) string {
+	mac, _, err := lsat.FromHeader(header)
+	if err != nil || mac == nil {
+		return ""
+	}
+	id, err := lsat.DecodeIdentifier(bytes.NewReader(mac.Id()))
+	if err != nil {
+		return ""
+	}
+	return id.TokenID.String()
+}
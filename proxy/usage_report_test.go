@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestUsageReport makes sure the number of bytes transferred by a request is
+// reported to the usage report endpoint of the service.
+func TestUsageReport(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello world"))
+		},
+	))
+	defer backend.Close()
+
+	reports := make(chan *UsageReport, 1)
+	reportServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			report := &UsageReport{}
+			err := json.NewDecoder(r.Body).Decode(report)
+			if err != nil {
+				t.Errorf("unable to decode report: %v", err)
+			}
+			reports <- report
+		},
+	))
+	defer reportServer.Close()
+
+	services := []*Service{{
+		Name:           "test",
+		Address:        strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp:     ".*",
+		Protocol:       "http",
+		Auth:           auth.LevelOff,
+		UsageReportURL: reportServer.URL,
+	}}
+	p, err := New(auth.NewMockAuthenticator(), services, false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("12345"))
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	select {
+	case report := <-reports:
+		if report.Service != "test" || report.Path != "/upload" ||
+			report.Status != http.StatusOK {
+
+			t.Fatalf("unexpected report: %+v", report)
+		}
+		if report.RequestBytes != 5 || report.ResponseBytes != 11 {
+			t.Fatalf("expected 5 request and 11 response bytes, "+
+				"got %d and %d", report.RequestBytes,
+				report.ResponseBytes)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("usage not reported")
+	}
+}
+
+// TestUsageReportLimit makes sure reports are dropped instead of piling up if
+// too many of them are pending already.
+func TestUsageReportLimit(t *testing.T) {
+	t.Parallel()
+
+	reports := make(chan struct{}, 2)
+	reportServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			reports <- struct{}{}
+		},
+	))
+	defer reportServer.Close()
+
+	service := &Service{
+		Name:           "test",
+		UsageReportURL: reportServer.URL,
+		usageReports:   make(chan struct{}, 1),
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	recorder := newStatusRecorder(httptest.NewRecorder())
+
+	// With the only slot taken, the report is dropped.
+	service.usageReports <- struct{}{}
+	service.reportUsage(req, false, nil, recorder)
+
+	// Once the slot is free again, reports are sent.
+	<-service.usageReports
+	service.reportUsage(req, false, nil, recorder)
+
+	select {
+	case <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("usage not reported")
+	}
+	select {
+	case <-reports:
+		t.Fatalf("dropped report was sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
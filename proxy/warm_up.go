@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// MaxWarmUpPeriod is the longest warm-up period that can be
+	// configured, so a misconfiguration can't open the paywall for long.
+	MaxWarmUpPeriod = 10 * time.Minute
+)
+
+// WithWarmUpPeriod makes the proxy serve requests that would need to be paid
+// for without payment for the given period after it was created. This avoids
+// sending challenges to clients with valid tokens while the authentication
+// backends are still starting up after a restart. A period of zero disables
+// the warm-up.
+func WithWarmUpPeriod(period time.Duration) Option {
+	return func(p *Proxy) error {
+		if period < 0 || period > MaxWarmUpPeriod {
+			return fmt.Errorf("warm-up period must be between 0 "+
+				"and %v", MaxWarmUpPeriod)
+		}
+		if period == 0 {
+			return nil
+		}
+
+		p.warmUpEnd = time.Now().Add(period)
+		log.Warnf("Paywall is open for the warm-up period of %v, "+
+			"requests are served without payment until %v",
+			period, p.warmUpEnd)
+		return nil
+	}
+}
+
+// inWarmUp returns true if the proxy is still in its warm-up period.
+func (p *Proxy) inWarmUp() bool {
+	return time.Now().Before(p.warmUpEnd)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestWarmUpPeriod makes sure requests are served without payment during the
+// warm-up period only.
+func TestWarmUpPeriod(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		},
+	))
+	defer backend.Close()
+
+	services := []*Service{{
+		Name:       "paid",
+		Address:    strings.TrimPrefix(backend.URL, "http://"),
+		HostRegexp: ".*",
+		Protocol:   "http",
+		Auth:       "on",
+		Price:      1,
+	}}
+	p, err := New(
+		auth.NewMockAuthenticator(), services, false, "",
+		WithWarmUpPeriod(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 during warm-up, got %d",
+			rec.Code)
+	}
+
+	// Once the warm-up period is over, payment is required again.
+	p.warmUpEnd = time.Now().Add(-time.Second)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected status 402 after warm-up, got %d", rec.Code)
+	}
+
+	err = WithWarmUpPeriod(MaxWarmUpPeriod + time.Second)(&Proxy{})
+	if err == nil {
+		t.Fatalf("expected too long warm-up period to be rejected")
+	}
+}
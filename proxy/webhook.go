@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EventChallengeIssued is sent when a client is asked to pay for a
+	// request.
+	EventChallengeIssued EventType = "challenge_issued"
+
+	// EventPaymentAccepted is sent when a request with a valid, paid token
+	// is accepted.
+	EventPaymentAccepted EventType = "payment_accepted"
+
+	// EventFreebieGranted is sent when a request is served for free.
+	EventFreebieGranted EventType = "freebie_granted"
+
+	// EventRateLimited is sent when a request is rejected because the
+	// rate limit of its service was reached.
+	EventRateLimited EventType = "rate_limited"
+
+	// DefaultWebhookQueueSize is the default number of events that can be
+	// waiting for delivery. Further events are dropped.
+	DefaultWebhookQueueSize = 1000
+
+	// DefaultWebhookRetries is the default number of times the delivery of
+	// an event is retried.
+	DefaultWebhookRetries = 5
+
+	// DefaultWebhookTimeout is the default maximum duration of a single
+	// delivery attempt.
+	DefaultWebhookTimeout = 10 * time.Second
+
+	// DefaultWebhookWorkers is the default number of events that are
+	// delivered at the same time.
+	DefaultWebhookWorkers = 4
+
+	// webhookInitialBackoff is the time we wait before retrying a failed
+	// delivery for the first time. It doubles with every retry.
+	webhookInitialBackoff = time.Second
+)
+
+// EventType is the type of an event that is sent to the webhook.
+type EventType string
+
+// Event is the JSON payload that is sent to the webhook for an event in the
+// authentication lifecycle of a request.
+type Event struct {
+	// Type is the type of the event.
+	Type EventType `json:"type"`
+
+	// Time is the time the event occurred at.
+	Time time.Time `json:"time"`
+
+	// Service is the name of the service the request was made to.
+	Service string `json:"service"`
+
+	// ClientIP is the IP address of the client. It is empty if client IPs
+	// are redacted.
+	ClientIP string `json:"client_ip,omitempty"`
+
+	// TokenID is the hex encoded ID of the LSAT the request was made with,
+	// if it was verified.
+	TokenID string `json:"token_id,omitempty"`
+
+	// Price is the price of the service in satoshis.
+	Price int64 `json:"price"`
+}
+
+// WebhookConfig is the configuration of the webhook that events are sent to.
+type WebhookConfig struct {
+	// URL is the endpoint the events are sent to as JSON encoded Event in
+	// a POST request.
+	URL string `long:"url" description:"URL the events are posted to"`
+
+	// Events is the list of event types that are sent. If empty, all
+	// events are sent.
+	Events []string `long:"events" description:"Event types that are sent, all if empty"`
+
+	// RedactClientIP omits the IP address of the client from the events.
+	RedactClientIP bool `long:"redactclientip" description:"Omit the IP address of clients from the events"`
+
+	// QueueSize is the maximum number of events waiting for delivery.
+	// Events that don't fit into the queue anymore are dropped.
+	QueueSize int `long:"queuesize" description:"Maximum number of events waiting for delivery"`
+
+	// MaxRetries is the number of times the delivery of an event is
+	// retried with exponential backoff before it is dropped.
+	MaxRetries int `long:"maxretries" description:"Number of times the delivery of an event is retried"`
+
+	// Timeout is the maximum duration of a single delivery attempt.
+	Timeout time.Duration `long:"timeout" description:"Maximum duration of a single delivery attempt"`
+
+	// Workers is the number of events that are delivered at the same
+	// time, so a single slow delivery or one that is being retried
+	// doesn't hold up all other events.
+	Workers int `long:"workers" description:"Number of events delivered at the same time"`
+}
+
+// Webhook delivers events to an external endpoint in the background. Events
+// are queued so that sending them never blocks the request they occurred in.
+type Webhook struct {
+	cfg    WebhookConfig
+	events map[EventType]bool
+	queue  chan *Event
+
+	// dropped is the number of events that were dropped because the
+	// queue was full. It must be accessed atomically.
+	dropped uint64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWebhook creates a new webhook from the given configuration.
+func NewWebhook(cfg *WebhookConfig) (*Webhook, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook URL cannot be empty")
+	}
+	if cfg.QueueSize < 0 || cfg.MaxRetries < 0 || cfg.Timeout < 0 ||
+		cfg.Workers < 0 {
+
+		return nil, fmt.Errorf("webhook settings cannot be negative")
+	}
+
+	w := &Webhook{
+		cfg:  *cfg,
+		quit: make(chan struct{}),
+	}
+	if w.cfg.QueueSize == 0 {
+		w.cfg.QueueSize = DefaultWebhookQueueSize
+	}
+	if w.cfg.MaxRetries == 0 {
+		w.cfg.MaxRetries = DefaultWebhookRetries
+	}
+	if w.cfg.Timeout == 0 {
+		w.cfg.Timeout = DefaultWebhookTimeout
+	}
+	if w.cfg.Workers == 0 {
+		w.cfg.Workers = DefaultWebhookWorkers
+	}
+	w.queue = make(chan *Event, w.cfg.QueueSize)
+
+	if len(cfg.Events) > 0 {
+		w.events = make(map[EventType]bool, len(cfg.Events))
+		for _, name := range cfg.Events {
+			eventType := EventType(name)
+			switch eventType {
+			case EventChallengeIssued, EventPaymentAccepted,
+				EventFreebieGranted, EventRateLimited:
+
+			default:
+				return nil, fmt.Errorf("unknown webhook event "+
+					"%s", name)
+			}
+			w.events[eventType] = true
+		}
+	}
+
+	return w, nil
+}
+
+// Start starts delivering the queued events in the background.
+func (w *Webhook) Start() {
+	for i := 0; i < w.cfg.Workers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+
+			for {
+				select {
+				case event := <-w.queue:
+					w.deliver(event)
+
+				case <-w.quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops delivering events. Events that are still queued are dropped.
+func (w *Webhook) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// deliver sends the event to the endpoint and retries failed attempts with
+// exponential backoff until the maximum number of retries is reached or the
+// webhook is stopped.
+func (w *Webhook) deliver(event *Event) {
+	backoff := webhookInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := postJSON(w.cfg.URL, event, w.cfg.Timeout)
+		if err == nil {
+			return
+		}
+		if attempt >= w.cfg.MaxRetries {
+			log.Errorf("Unable to deliver %s event of service %s "+
+				"to webhook, giving up: %v", event.Type,
+				event.Service, err)
+			return
+		}
+
+		log.Debugf("Unable to deliver %s event to webhook, retrying "+
+			"in %v: %v", event.Type, backoff, err)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Dropped returns the number of events that were dropped because the queue was
+// full.
+func (w *Webhook) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// notify queues an event of the given type for the request to the service. If
+// the event type isn't sent or the queue is full, the event is dropped. The
+// token ID is only sent if the token of the request was verified, anyone can
+// put an arbitrary ID into an invalid one.
+func (w *Webhook) notify(eventType EventType, r *http.Request, s *Service,
+	price int64, authenticated bool) {
+
+	if w.events != nil && !w.events[eventType] {
+		return
+	}
+
+	event := &Event{
+		Type:    eventType,
+		Time:    time.Now(),
+		Service: s.Name,
+		Price:   price,
+	}
+	if authenticated {
+		event.TokenID = tokenIDFromHeader(&r.Header)
+	}
+	if !w.cfg.RedactClientIP {
+		event.ClientIP = r.RemoteAddr
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			event.ClientIP = host
+		}
+	}
+
+	select {
+	case w.queue <- event:
+	default:
+		dropped := atomic.AddUint64(&w.dropped, 1)
+		log.Warnf("Webhook queue full, dropping %s event of service "+
+			"%s (%d dropped in total)", eventType, s.Name, dropped)
+	}
+}
+
+// WithWebhook sets the webhook that events in the authentication lifecycle of
+// requests are sent to. The webhook must be started by the caller.
+func WithWebhook(webhook *Webhook) Option {
+	return func(p *Proxy) error {
+		p.webhook = webhook
+		return nil
+	}
+}
+
+// notifyEvent sends an event of the given type for the request to the service
+// to the webhook, if one is configured. Authenticated is set if the token of
+// the request was verified.
+func (p *Proxy) notifyEvent(eventType EventType, r *http.Request, s *Service,
+	price int64, authenticated bool) {
+
+	if p.webhook == nil {
+		return
+	}
+	p.webhook.notify(eventType, r, s, price, authenticated)
+}
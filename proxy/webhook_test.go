@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWebhook makes sure only the configured events are delivered and failed
+// deliveries are retried.
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	events := make(chan *Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The first delivery fails so it must be retried.
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			event := &Event{}
+			err := json.NewDecoder(r.Body).Decode(event)
+			if err != nil {
+				t.Errorf("unable to decode event: %v", err)
+			}
+			events <- event
+		},
+	))
+	defer server.Close()
+
+	webhook, err := NewWebhook(&WebhookConfig{
+		URL:            server.URL,
+		Events:         []string{string(EventChallengeIssued)},
+		RedactClientIP: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to create webhook: %v", err)
+	}
+	webhook.Start()
+	defer webhook.Stop()
+
+	p := &Proxy{}
+	if err := WithWebhook(webhook)(p); err != nil {
+		t.Fatalf("unable to apply option: %v", err)
+	}
+
+	s := &Service{Name: "test"}
+	req := httptest.NewRequest("GET", "/", nil)
+	p.notifyEvent(EventFreebieGranted, req, s, 0, false)
+	p.notifyEvent(EventChallengeIssued, req, s, 42, false)
+
+	select {
+	case event := <-events:
+		if event.Type != EventChallengeIssued ||
+			event.Service != "test" || event.Price != 42 {
+
+			t.Fatalf("unexpected event: %+v", event)
+		}
+		if event.ClientIP != "" {
+			t.Fatalf("expected redacted client IP, got %s",
+				event.ClientIP)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event not delivered")
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %+v", event)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = NewWebhook(&WebhookConfig{
+		URL:    server.URL,
+		Events: []string{"unknown"},
+	})
+	if err == nil {
+		t.Fatalf("expected unknown event to be rejected")
+	}
+}
+
+// TestWebhookWorkers makes sure a slow delivery doesn't hold up other events
+// and that events that don't fit into the queue are counted.
+func TestWebhookWorkers(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	delivered := make(chan EventType, 2)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			event := &Event{}
+			err := json.NewDecoder(r.Body).Decode(event)
+			if err != nil {
+				t.Errorf("unable to decode event: %v", err)
+			}
+			if event.Type == EventChallengeIssued {
+				<-release
+			}
+			delivered <- event.Type
+		},
+	))
+	defer server.Close()
+
+	webhook, err := NewWebhook(&WebhookConfig{
+		URL:     server.URL,
+		Workers: 2,
+	})
+	if err != nil {
+		t.Fatalf("unable to create webhook: %v", err)
+	}
+	webhook.Start()
+	defer webhook.Stop()
+	defer close(release)
+
+	s := &Service{Name: "test"}
+	req := httptest.NewRequest("GET", "/", nil)
+	webhook.notify(EventChallengeIssued, req, s, 42, false)
+	webhook.notify(EventFreebieGranted, req, s, 0, false)
+
+	select {
+	case eventType := <-delivered:
+		if eventType != EventFreebieGranted {
+			t.Fatalf("unexpected event %s", eventType)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event held up by slow delivery")
+	}
+
+	// Without workers, the second event doesn't fit into the queue.
+	stopped, err := NewWebhook(&WebhookConfig{
+		URL:       server.URL,
+		QueueSize: 1,
+	})
+	if err != nil {
+		t.Fatalf("unable to create webhook: %v", err)
+	}
+	stopped.notify(EventFreebieGranted, req, s, 0, false)
+	stopped.notify(EventFreebieGranted, req, s, 0, false)
+	if dropped := stopped.Dropped(); dropped != 1 {
+		t.Fatalf("expected one dropped event, got %d", dropped)
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultWellKnownPath is the default path the proxy serves the
+	// discovery document of its services on.
+	DefaultWellKnownPath = "/.well-known/lsat"
+
+	// wellKnownScheme is the authentication scheme advertised in the
+	// discovery document.
+	wellKnownScheme = "LSAT"
+)
+
+// WellKnownDocument is the machine readable description of the services of the
+// proxy that clients can use to discover what's available and at what cost.
+type WellKnownDocument struct {
+	// Scheme is the authentication scheme clients have to use.
+	Scheme string `json:"scheme"`
+
+	// Services are the services that can be accessed through the proxy.
+	Services []WellKnownService `json:"services"`
+}
+
+// WellKnownService describes a service in the discovery document.
+type WellKnownService struct {
+	// Name is the name of the service.
+	Name string `json:"name"`
+
+	// HostRegexp is the expression the host of requests to the service
+	// must match.
+	HostRegexp string `json:"host_regexp"`
+
+	// PathRegexp is the expression the path of requests to the service
+	// must match.
+	PathRegexp string `json:"path_regexp"`
+
+	// Auth is the authentication level of the service, "on", "off" or
+	// "freebie".
+	Auth string `json:"auth"`
+
+	// Freebies is the number of free requests a client has if the auth
+	// level is "freebie".
+	Freebies uint64 `json:"freebies,omitempty"`
+
+	// PriceSat is the current price of a token for the service in
+	// satoshis.
+	PriceSat int64 `json:"price_sat"`
+
+	// MethodPricesSat are the prices of requests with certain HTTP
+	// methods that differ from PriceSat.
+	MethodPricesSat map[string]int64 `json:"method_prices_sat,omitempty"`
+
+	// FiatCurrency is the currency the price is also shown in when a
+	// challenge is issued.
+	FiatCurrency string `json:"fiat_currency,omitempty"`
+}
+
+// WithWellKnown makes the proxy serve a discovery document of its services,
+// their prices and the authentication scheme as JSON on the given path,
+// without requiring any authentication. If the path is empty, the default
+// path is used.
+func WithWellKnown(path string) Option {
+	return func(p *Proxy) error {
+		if path == "" {
+			path = DefaultWellKnownPath
+		}
+		p.wellKnownPath = path
+		return nil
+	}
+}
+
+// isWellKnownRequest returns true if the request is for the discovery
+// document.
+func (p *Proxy) isWellKnownRequest(r *http.Request) bool {
+	return p.wellKnownPath != "" && r.URL.Path == p.wellKnownPath &&
+		(r.Method == "GET" || r.Method == "HEAD")
+}
+
+// wellKnownDocument creates the discovery document from the current services.
+// Services that use TLS passthrough can't be paid for and are left out.
+func (p *Proxy) wellKnownDocument(now time.Time) *WellKnownDocument {
+	doc := &WellKnownDocument{
+		Scheme:   wellKnownScheme,
+		Services: []WellKnownService{},
+	}
+	for _, service := range p.currentServices() {
+		if service.TLSPassthrough {
+			continue
+		}
+
+		desc := WellKnownService{
+			Name:            service.Name,
+			HostRegexp:      service.HostRegexp,
+			PathRegexp:      service.PathRegexp,
+			Auth:            "on",
+			PriceSat:        service.currentPrice("", now),
+			MethodPricesSat: service.MethodPrices,
+			FiatCurrency:    service.FiatCurrency,
+		}
+		switch {
+		case service.Auth.IsOff():
+			desc.Auth = "off"
+
+		case service.Auth.IsFreebie():
+			desc.Auth = "freebie"
+			desc.Freebies = uint64(service.Auth.FreebieCount())
+		}
+		doc.Services = append(doc.Services, desc)
+	}
+
+	return doc
+}
+
+// serveWellKnown answers a request for the discovery document.
+func (p *Proxy) serveWellKnown(w http.ResponseWriter, r *http.Request) {
+	if p.corsEnabled(nil) {
+		addCorsHeaders(w.Header())
+	}
+	w.Header().Set(hdrContentType, "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	err := json.NewEncoder(w).Encode(p.wellKnownDocument(time.Now()))
+	if err != nil {
+		log.Errorf("Unable to send discovery document: %v", err)
+	}
+}
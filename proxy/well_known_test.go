@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lightninglabs/aperture/auth"
+)
+
+// TestServeWellKnown makes sure the discovery document describes the services
+// and is only served if enabled.
+func TestServeWellKnown(t *testing.T) {
+	t.Parallel()
+
+	newServices := func() []*Service {
+		return []*Service{{
+			Name:         "paid",
+			Address:      "127.0.0.1:10009",
+			HostRegexp:   "^api.example.com$",
+			PathRegexp:   "^/v1/.*$",
+			Protocol:     "http",
+			Auth:         "on",
+			Price:        5,
+			MethodPrices: map[string]int64{"post": 50},
+		}, {
+			Name:       "free",
+			Address:    "127.0.0.1:10010",
+			HostRegexp: ".*",
+			Protocol:   "http",
+			Auth:       "freebie 3",
+		}, {
+			Name:           "passthrough",
+			Address:        "127.0.0.1:10011",
+			HostRegexp:     "^tls.example.com$",
+			TLSPassthrough: true,
+		}}
+	}
+
+	p, err := New(auth.NewMockAuthenticator(), newServices(), false, "")
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+	if p.isWellKnownRequest(httptest.NewRequest(
+		"GET", DefaultWellKnownPath, nil,
+	)) {
+		t.Fatalf("expected discovery document to be disabled")
+	}
+
+	p, err = New(
+		auth.NewMockAuthenticator(), newServices(), false, "",
+		WithWellKnown(""),
+	)
+	if err != nil {
+		t.Fatalf("unable to create proxy: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", DefaultWellKnownPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var doc WellKnownDocument
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("unable to decode document: %v", err)
+	}
+	if doc.Scheme != wellKnownScheme || len(doc.Services) != 2 {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+
+	paid, free := doc.Services[0], doc.Services[1]
+	if paid.Name != "paid" || paid.Auth != "on" || paid.PriceSat != 5 ||
+		paid.MethodPricesSat["POST"] != 50 ||
+		paid.PathRegexp != "^/v1/.*$" {
+
+		t.Fatalf("unexpected paid service: %+v", paid)
+	}
+	if free.Name != "free" || free.Auth != "freebie" ||
+		free.Freebies != 3 {
+
+		t.Fatalf("unexpected free service: %+v", free)
+	}
+}
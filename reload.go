@@ -0,0 +1,110 @@
+package aperture
+
+import (
+	"context"
+	"net/http"
+	"os"
+	ossignal "os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lightninglabs/aperture/proxy"
+)
+
+const (
+	// reloadRateLimits is the reload mode that only applies the rate
+	// limits of the services on SIGHUP.
+	reloadRateLimits = "ratelimits"
+
+	// reloadServices is the reload mode that replaces all services on
+	// SIGHUP.
+	reloadServices = "services"
+
+	// defaultShutdownTimeout is the default maximum duration the requests
+	// in flight are given to complete on shutdown.
+	defaultShutdownTimeout = 15 * time.Second
+)
+
+// reloadOnSignal re-reads the configuration file each time the process
+// receives SIGHUP and applies it to the running proxy according to the reload
+// mode. By default only the rate limits of the services are applied, which
+// lets operators tighten limits during an incident without a restart. In the
+// services mode, the services are replaced as a whole if the new ones are
+// valid, otherwise the running ones are kept. Connections are never dropped by
+// a reload. After the services were replaced, onServicesReload is called with
+// the new configuration so the components that depend on the services can
+// catch up. The function blocks until the quit channel is closed.
+func reloadOnSignal(configFile, mode string, p *proxy.Proxy,
+	onServicesReload func(*config), quit <-chan struct{}) {
+
+	if mode == "" {
+		mode = reloadRateLimits
+	}
+
+	hup := make(chan os.Signal, 1)
+	ossignal.Notify(hup, syscall.SIGHUP)
+	defer ossignal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			log.Infof("Received SIGHUP, reloading %s from %s", mode,
+				configFile)
+
+			cfg, err := getConfig(configFile)
+			if err != nil {
+				log.Errorf("Unable to reload config: %v", err)
+				continue
+			}
+
+			switch mode {
+			case reloadServices:
+				err = p.UpdateServices(cfg.Services)
+				if err == nil {
+					onServicesReload(cfg)
+				}
+
+			default:
+				err = p.UpdateRateLimits(cfg.Services)
+			}
+			if err != nil {
+				log.Errorf("Unable to reload %s, keeping the "+
+					"running configuration: %v", mode, err)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
+
+// drainServers stops the servers from accepting new connections and waits for
+// the requests in flight to complete, at most for the given timeout. The
+// connections that are still open afterwards are left to be closed by the
+// caller. Hijacked connections, like those of passed through TLS connections,
+// aren't waited for.
+func drainServers(servers []*http.Server, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	log.Infof("Draining requests in flight for up to %v", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				log.Warnf("Requests still in flight after "+
+					"%v, closing connections: %v", timeout,
+					err)
+			}
+		}(server)
+	}
+	wg.Wait()
+}
@@ -2,7 +2,9 @@ package aperture
 
 import (
 	"context"
+	"sync"
 
+	"github.com/lightninglabs/aperture/auth"
 	"github.com/lightninglabs/aperture/lsat"
 	"github.com/lightninglabs/aperture/mint"
 	"github.com/lightninglabs/aperture/proxy"
@@ -20,6 +22,14 @@ type staticServiceLimiter struct {
 // mint.ServiceLimiter.
 var _ mint.ServiceLimiter = (*staticServiceLimiter)(nil)
 
+// limiterKey returns the key the restrictions of the given service are stored
+// under. The price isn't part of it since it can vary between challenges, for
+// example because of a price schedule or a discount.
+func limiterKey(service lsat.Service) lsat.Service {
+	service.Price = 0
+	return service
+}
+
 // newStaticServiceLimiter instantiates a new static service limiter backed by
 // the given restrictions.
 func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimiter {
@@ -28,9 +38,8 @@ func newStaticServiceLimiter(proxyServices []*proxy.Service) *staticServiceLimit
 
 	for _, proxyService := range proxyServices {
 		s := lsat.Service{
-			Name:  proxyService.Name,
-			Tier:  lsat.BaseTier,
-			Price: proxyService.Price,
+			Name: proxyService.Name,
+			Tier: lsat.BaseTier,
 		}
 		capabilities[s] = lsat.NewCapabilitiesCaveat(
 			proxyService.Name, proxyService.Capabilities,
@@ -54,7 +63,7 @@ func (l *staticServiceLimiter) ServiceCapabilities(ctx context.Context,
 
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		capabilities, ok := l.capabilities[service]
+		capabilities, ok := l.capabilities[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -71,7 +80,7 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 
 	res := make([]lsat.Caveat, 0, len(services))
 	for _, service := range services {
-		constraints, ok := l.constraints[service]
+		constraints, ok := l.constraints[limiterKey(service)]
 		if !ok {
 			continue
 		}
@@ -80,3 +89,44 @@ func (l *staticServiceLimiter) ServiceConstraints(ctx context.Context,
 
 	return res, nil
 }
+
+// serviceQuotas are the usage quotas of the configured services. They are
+// updated when the services are reloaded.
+type serviceQuotas struct {
+	quotas map[string]uint64
+	mtx    sync.RWMutex
+}
+
+// A compile-time constraint to ensure serviceQuotas implements
+// auth.QuotaSource.
+var _ auth.QuotaSource = (*serviceQuotas)(nil)
+
+// newServiceQuotas creates the usage quotas of the given services.
+func newServiceQuotas(proxyServices []*proxy.Service) *serviceQuotas {
+	q := &serviceQuotas{}
+	q.update(proxyServices)
+	return q
+}
+
+// update replaces the quotas with the ones of the given services. The usage
+// counted so far is kept, so lowering a quota can exhaust tokens right away.
+func (q *serviceQuotas) update(proxyServices []*proxy.Service) {
+	quotas := make(map[string]uint64, len(proxyServices))
+	for _, proxyService := range proxyServices {
+		quotas[proxyService.Name] = proxyService.Quota
+	}
+
+	q.mtx.Lock()
+	q.quotas = quotas
+	q.mtx.Unlock()
+}
+
+// UsageQuota returns the quota of the service.
+//
+// NOTE: This is part of the auth.QuotaSource interface.
+func (q *serviceQuotas) UsageQuota(serviceName string) uint64 {
+	q.mtx.RLock()
+	defer q.mtx.RUnlock()
+
+	return q.quotas[serviceName]
+}
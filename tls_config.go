@@ -0,0 +1,117 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+const (
+	// defaultTLSMinVersion is the minimum TLS version clients must use if
+	// none is configured.
+	defaultTLSMinVersion = tls.VersionTLS12
+)
+
+var (
+	// tlsVersions maps the configurable names of the TLS versions to their
+	// value.
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// tlsCipherSuites maps the standard names of the cipher suites that
+	// can be configured to their value. Only suites with forward secrecy
+	// and authenticated encryption are offered. The cipher suites of TLS
+	// 1.3 can't be configured.
+	tlsCipherSuites = map[string]uint16{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+
+	// http2CipherSuites are the cipher suites of which HTTP/2 requires at
+	// least one to be enabled.
+	http2CipherSuites = []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	}
+
+	// tlsCurves maps the configurable names of the elliptic curves to
+	// their ID.
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+// applyTLSSettings restricts the TLS versions, cipher suites and curves the
+// given server TLS configuration accepts according to the settings. Without
+// settings, TLS 1.2 is the minimum version and the default cipher suites and
+// curves are used.
+func applyTLSSettings(tlsConfig *tls.Config, settings *tlsSettings) error {
+	tlsConfig.MinVersion = defaultTLSMinVersion
+	if settings == nil {
+		return nil
+	}
+
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %s",
+				settings.MinVersion)
+		}
+		if version < tls.VersionTLS12 {
+			log.Warnf("Accepting deprecated TLS version %s",
+				settings.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(settings.CipherSuites) > 0 {
+		suites := make([]uint16, 0, len(settings.CipherSuites))
+		http2Suite := false
+		for _, name := range settings.CipherSuites {
+			suite, ok := tlsCipherSuites[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher "+
+					"suite %s", name)
+			}
+			for _, required := range http2CipherSuites {
+				http2Suite = http2Suite || suite == required
+			}
+			suites = append(suites, suite)
+		}
+
+		// The HTTP/2 server refuses to start without one of its
+		// required suites, so we fail with a clearer error.
+		if !http2Suite {
+			return fmt.Errorf("cipher suites must include " +
+				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or " +
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 " +
+				"for HTTP/2")
+		}
+		tlsConfig.CipherSuites = suites
+	}
+
+	if len(settings.CurvePreferences) > 0 {
+		curves := make([]tls.CurveID, 0, len(settings.CurvePreferences))
+		for _, name := range settings.CurvePreferences {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("unknown curve %s", name)
+			}
+			curves = append(curves, curve)
+		}
+		tlsConfig.CurvePreferences = curves
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package aperture
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// TestApplyTLSSettings makes sure the TLS settings are applied to the server
+// TLS configuration and that unknown values are rejected.
+func TestApplyTLSSettings(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS10}
+	if err := applyTLSSettings(tlsConfig, nil); err != nil {
+		t.Fatalf("unable to apply default settings: %v", err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 as default minimum version, got %x",
+			tlsConfig.MinVersion)
+	}
+
+	err := applyTLSSettings(tlsConfig, &tlsSettings{
+		MinVersion: "1.3",
+		CipherSuites: []string{
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		},
+		CurvePreferences: []string{"X25519", "P256"},
+	})
+	if err != nil {
+		t.Fatalf("unable to apply settings: %v", err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 as minimum version, got %x",
+			tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 2 || tlsConfig.CipherSuites[0] !=
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+
+		t.Fatalf("unexpected cipher suites %v", tlsConfig.CipherSuites)
+	}
+	if len(tlsConfig.CurvePreferences) != 2 ||
+		tlsConfig.CurvePreferences[0] != tls.X25519 {
+
+		t.Fatalf("unexpected curves %v", tlsConfig.CurvePreferences)
+	}
+
+	invalid := []*tlsSettings{
+		{MinVersion: "1.4"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		}},
+		{CurvePreferences: []string{"P224"}},
+	}
+	for _, settings := range invalid {
+		err := applyTLSSettings(&tls.Config{}, settings)
+		if err == nil {
+			t.Fatalf("expected error for settings %v", settings)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package aperture
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/lightninglabs/aperture/auth"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+var (
+	// usagePrefix is the key we'll use to prefix all LSAT usage counters
+	// with when storing them in an etcd cluster.
+	usagePrefix = "usage"
+
+	// defaultUsageTTL is the default duration after which the usage
+	// counters of a token are removed.
+	defaultUsageTTL = 365 * 24 * time.Hour
+
+	// usageLeaseRotation is the interval in which a new shared lease is
+	// granted for the counters created afterwards. Counters therefore
+	// live for up to this long past their TTL.
+	usageLeaseRotation = 24 * time.Hour
+)
+
+// usageKey returns the full key to store the usage counter of a token for a
+// service in the database.
+//
+// The resulting path of the token ID bff4ee83 for service1 within etcd would
+// look like:
+//
+//	lsat/proxy/usage/bff4ee83/service1
+func usageKey(id lsat.TokenID, serviceName string) string {
+	return strings.Join(
+		[]string{topLevelKey, usagePrefix, id.String(), serviceName},
+		etcdKeyDelimeter,
+	)
+}
+
+// usageStore is a store of LSAT usage counters backed by an etcd cluster. This
+// allows multiple instances of the proxy to share the same counters. Counters
+// are attached to a lease when they're created, so the counters of tokens that
+// aren't used anymore don't pile up in etcd forever. All counters created
+// within usageLeaseRotation share a lease. Counters that reach the quota are
+// detached from their lease, since tokens don't expire and an exhausted token
+// must never get its quota back.
+type usageStore struct {
+	*clientv3.Client
+
+	// ttl is the minimum duration after which a counter is removed,
+	// counted from the first request of the token.
+	ttl time.Duration
+
+	// lease is the shared lease new counters are attached to. It's
+	// replaced once it was granted usageLeaseRotation ago.
+	lease        clientv3.LeaseID
+	leaseGranted time.Time
+	leaseMtx     sync.Mutex
+}
+
+// A compile-time constraint to ensure usageStore implements auth.UsageStore.
+var _ auth.UsageStore = (*usageStore)(nil)
+
+// newUsageStore instantiates a new LSAT usage store backed by an etcd cluster.
+// The counters of tokens with requests left are removed after the given TTL,
+// or after defaultUsageTTL if it is zero.
+func newUsageStore(client *clientv3.Client, ttl time.Duration) *usageStore {
+	if ttl == 0 {
+		ttl = defaultUsageTTL
+	}
+	return &usageStore{Client: client, ttl: ttl}
+}
+
+// Usage returns the number of requests made with the token to the given
+// service so far.
+func (s *usageStore) Usage(ctx context.Context, id lsat.TokenID,
+	serviceName string) (uint64, error) {
+
+	resp, err := s.Get(ctx, usageKey(id, serviceName))
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return parseUsage(resp.Kvs[0].Value)
+}
+
+// IncrementUsage increments the number of requests made with the token to the
+// given service and returns the new number of requests. The counter is updated
+// in a transaction that is retried if another instance updated it in between.
+// Once the counter reaches the given quota, it's kept until it's deleted
+// manually.
+func (s *usageStore) IncrementUsage(ctx context.Context, id lsat.TokenID,
+	serviceName string, quota uint64) (uint64, error) {
+
+	key := usageKey(id, serviceName)
+	for {
+		resp, err := s.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		// A key that doesn't exist yet has a mod revision of zero, so
+		// the comparison below also works for the first request.
+		var (
+			usage       uint64
+			modRevision int64
+			lease       clientv3.LeaseID
+		)
+		if len(resp.Kvs) > 0 {
+			usage, err = parseUsage(resp.Kvs[0].Value)
+			if err != nil {
+				return 0, err
+			}
+			modRevision = resp.Kvs[0].ModRevision
+			lease = clientv3.LeaseID(resp.Kvs[0].Lease)
+		}
+		usage++
+
+		// A new counter gets the shared lease. An existing one must
+		// be put with the lease it already has, otherwise it would be
+		// detached from it, which is exactly what we want once the
+		// quota is reached.
+		switch {
+		case quota > 0 && usage >= quota:
+			lease = clientv3.NoLease
+
+		case lease == clientv3.NoLease:
+			lease, err = s.sharedLease(ctx)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		txnResp, err := s.Txn(ctx).
+			If(clientv3.Compare(
+				clientv3.ModRevision(key), "=", modRevision,
+			)).
+			Then(clientv3.OpPut(
+				key, strconv.FormatUint(usage, 10),
+				clientv3.WithLease(lease),
+			)).
+			Commit()
+		if err != nil {
+			// The lease might have been lost, for example if the
+			// cluster was restored from a backup, so a new one
+			// is granted for the next request.
+			s.dropSharedLease(lease)
+			return 0, err
+		}
+		if txnResp.Succeeded {
+			return usage, nil
+		}
+	}
+}
+
+// sharedLease returns the lease new counters are attached to, granting a new
+// one if there is none yet or the current one is due for rotation. The lease
+// outlives the rotation by the TTL, so each counter is kept for at least the
+// TTL.
+func (s *usageStore) sharedLease(ctx context.Context) (clientv3.LeaseID,
+	error) {
+
+	s.leaseMtx.Lock()
+	defer s.leaseMtx.Unlock()
+
+	if s.lease != clientv3.NoLease &&
+		time.Since(s.leaseGranted) < usageLeaseRotation {
+
+		return s.lease, nil
+	}
+
+	ttl := int64((s.ttl + usageLeaseRotation) / time.Second)
+	grant, err := s.Grant(ctx, ttl)
+	if err != nil {
+		return 0, fmt.Errorf("unable to grant usage lease: %v", err)
+	}
+	s.lease = grant.ID
+	s.leaseGranted = time.Now()
+
+	return s.lease, nil
+}
+
+// dropSharedLease forgets the given lease if it's the shared one, so a new one
+// is granted for the next counter.
+func (s *usageStore) dropSharedLease(lease clientv3.LeaseID) {
+	s.leaseMtx.Lock()
+	defer s.leaseMtx.Unlock()
+
+	if lease != clientv3.NoLease && s.lease == lease {
+		s.lease = clientv3.NoLease
+	}
+}
+
+// parseUsage decodes the value of a usage counter.
+func parseUsage(value []byte) (uint64, error) {
+	usage, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid usage counter: %v", err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,68 @@
+package aperture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/lightninglabs/aperture/lsat"
+)
+
+// TestUsageStore makes sure counters share a lease until they reach the quota
+// and are kept for good afterwards.
+func TestUsageStore(t *testing.T) {
+	etcdClient, serverCleanup := etcdSetup(t)
+	defer etcdClient.Close()
+	defer serverCleanup()
+
+	ctx := context.Background()
+	store := newUsageStore(etcdClient, time.Hour)
+
+	// leaseOf returns the lease the counter of the token is attached to.
+	leaseOf := func(id lsat.TokenID) clientv3.LeaseID {
+		t.Helper()
+
+		resp, err := etcdClient.Get(ctx, usageKey(id, "service"))
+		if err != nil {
+			t.Fatalf("unable to get counter: %v", err)
+		}
+		if len(resp.Kvs) != 1 {
+			t.Fatalf("expected one counter, got %d", len(resp.Kvs))
+		}
+		return clientv3.LeaseID(resp.Kvs[0].Lease)
+	}
+
+	var first, second lsat.TokenID
+	second[0] = 1
+	for _, id := range []lsat.TokenID{first, second} {
+		usage, err := store.IncrementUsage(ctx, id, "service", 2)
+		if err != nil {
+			t.Fatalf("unable to increment usage: %v", err)
+		}
+		if usage != 1 {
+			t.Fatalf("expected usage 1, got %d", usage)
+		}
+	}
+
+	lease := leaseOf(first)
+	if lease == clientv3.NoLease || leaseOf(second) != lease {
+		t.Fatalf("expected counters to share a lease")
+	}
+
+	// Once the quota is reached, the counter must not expire anymore.
+	usage, err := store.IncrementUsage(ctx, first, "service", 2)
+	if err != nil {
+		t.Fatalf("unable to increment usage: %v", err)
+	}
+	if usage != 2 {
+		t.Fatalf("expected usage 2, got %d", usage)
+	}
+	if leaseOf(first) != clientv3.NoLease {
+		t.Fatalf("expected exhausted counter without lease")
+	}
+	usage, err = store.Usage(ctx, first, "service")
+	if err != nil || usage != 2 {
+		t.Fatalf("expected usage 2, got %d: %v", usage, err)
+	}
+}